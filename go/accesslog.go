@@ -0,0 +1,236 @@
+package isuports
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// アクセスログの出力先と形式
+// ベンチ中にログの出力自体が負荷にならないよう、echoのLoggerを通さずに1行ずつ直接書き込む
+
+// サイズと経過時間でローテーションするファイル
+// ローテーション時は今のファイルを path.20060102T150405 にリネームして新しいファイルを開く
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64         // 0以下ならサイズではローテーションしない
+	interval time.Duration // 0以下なら時間ではローテーションしない
+	f        *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, interval time.Duration) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, interval: interval}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error os.OpenFile: path=%s, %w", r.path, err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("error Stat: path=%s, %w", r.path, err)
+	}
+	r.f = f
+	r.size = st.Size()
+	r.openedAt = time.Now()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	rotated := r.path + "." + time.Now().Format("20060102T150405")
+	if err := os.Rename(r.path, rotated); err != nil {
+		return fmt.Errorf("error os.Rename: path=%s, %w", r.path, err)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if (r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize && r.size > 0) ||
+		(r.interval > 0 && time.Since(r.openedAt) >= r.interval) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// 標準出力に書く場合は閉じない
+type nopCloseWriter struct{ io.Writer }
+
+func (nopCloseWriter) Close() error { return nil }
+
+// アクセスログの1行分
+// フィールドの順序を固定するため、mapではなくキーと値のスライスで持つ
+type accessLogRecord []accessLogField
+
+type accessLogField struct {
+	key   string
+	value any
+}
+
+// 1行のJSONにする
+func formatAccessLogJSON(rec accessLogRecord) []byte {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, f := range rec {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(f.key)
+		v, err := json.Marshal(f.value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(f.value))
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
+
+// LTSV (http://ltsv.org/) の1行にする
+// 値に含まれるタブと改行はスペースに置き換える
+var ltsvReplacer = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+func formatAccessLogLTSV(rec accessLogRecord) []byte {
+	var b strings.Builder
+	for i, f := range rec {
+		if i > 0 {
+			b.WriteByte('\t')
+		}
+		b.WriteString(f.key)
+		b.WriteByte(':')
+		b.WriteString(ltsvReplacer.Replace(fmt.Sprint(f.value)))
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// アクセスログの出力先
+type accessLogger struct {
+	w           io.WriteCloser
+	format      func(accessLogRecord) []byte
+	defaultRate float64
+	routeRates  map[string]float64 // ルートごとのサンプリング率
+}
+
+// 設定からアクセスログの出力先を作る
+//
+//	ISUCON_ACCESS_LOG_FORMAT          json か ltsv (デフォルトは json)
+//	ISUCON_ACCESS_LOG_FILE            出力先のファイル (未設定なら標準出力)
+//	ISUCON_ACCESS_LOG_MAX_SIZE        このバイト数を超えたらローテーションする (0なら無効)
+//	ISUCON_ACCESS_LOG_ROTATE_INTERVAL この時間が経過したらローテーションする (0なら無効)
+//	ISUCON_ACCESS_LOG_SAMPLE_RATE     記録する割合 (0から1)
+//	ISUCON_ACCESS_LOG_ROUTE_SAMPLE_RATES ルートごとの記録する割合 "/api/player/competition/:competition_id/ranking=0.01,..."
+func newAccessLoggerFromConfig() (*accessLogger, error) {
+	l := &accessLogger{}
+	switch format := getEnv("ISUCON_ACCESS_LOG_FORMAT", "json"); format {
+	case "json":
+		l.format = formatAccessLogJSON
+	case "ltsv":
+		l.format = formatAccessLogLTSV
+	default:
+		return nil, fmt.Errorf("unknown access log format: %s", format)
+	}
+
+	var err error
+	if l.defaultRate, err = parseSampleRate(getEnv("ISUCON_ACCESS_LOG_SAMPLE_RATE", "1")); err != nil {
+		return nil, fmt.Errorf("invalid ISUCON_ACCESS_LOG_SAMPLE_RATE: %w", err)
+	}
+	l.routeRates = map[string]float64{}
+	for _, kv := range strings.Split(getEnv("ISUCON_ACCESS_LOG_ROUTE_SAMPLE_RATES", ""), ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		// ルートに=は含まれないので最後の=で区切る
+		i := strings.LastIndex(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid ISUCON_ACCESS_LOG_ROUTE_SAMPLE_RATES: %s", kv)
+		}
+		rate, err := parseSampleRate(kv[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ISUCON_ACCESS_LOG_ROUTE_SAMPLE_RATES: %s, %w", kv, err)
+		}
+		l.routeRates[strings.TrimSpace(kv[:i])] = rate
+	}
+
+	if path := getEnv("ISUCON_ACCESS_LOG_FILE", ""); path != "" {
+		l.w, err = openRotatingFile(
+			path,
+			int64(getEnvInt("ISUCON_ACCESS_LOG_MAX_SIZE", 100*1024*1024)),
+			getEnvDuration("ISUCON_ACCESS_LOG_ROTATE_INTERVAL", 24*time.Hour),
+		)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		l.w = nopCloseWriter{os.Stdout}
+	}
+	return l, nil
+}
+
+func parseSampleRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("sample rate must be between 0 and 1: %s", s)
+	}
+	return rate, nil
+}
+
+// このリクエストを記録するかどうか
+// サーバーエラーはサンプリングせずに必ず記録する
+func (l *accessLogger) sampled(route string, status int) bool {
+	if status >= 500 {
+		return true
+	}
+	rate, ok := l.routeRates[route]
+	if !ok {
+		rate = l.defaultRate
+	}
+	if rate >= 1 {
+		return true
+	}
+	return rand.Float64() < rate
+}
+
+func (l *accessLogger) write(rec accessLogRecord) {
+	// 書き込みに失敗してもリクエストの処理は止めない
+	l.w.Write(l.format(rec))
+}
+
+func (l *accessLogger) Close() error {
+	return l.w.Close()
+}
@@ -2,19 +2,28 @@ package isuports
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 
-	"github.com/go-sql-driver/mysql"
 	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
 )
 
 type TenantsAddHandlerResult struct {
 	Tenant TenantWithBilling `json:"tenant"`
 }
 
+type TenantsAddRequest struct {
+	Name        string `form:"name" validate:"required,pattern=tenant_name"`
+	DisplayName string `form:"display_name"`
+}
+
 // SasS管理者用API
 // テナントを追加する
 // POST /api/admin/tenants/add
@@ -34,38 +43,18 @@ func tenantsAddHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
 	}
 
-	displayName := c.FormValue("display_name")
-	name := c.FormValue("name")
-	if err := validateTenantName(name); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	var req TenantsAddRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
+	name, displayName := req.Name, req.DisplayName
 
-	ctx := context.Background()
-	now := time.Now().Unix()
-	insertRes, err := adminDB.ExecContext(
-		ctx,
-		"INSERT INTO tenant (name, display_name, created_at, updated_at) VALUES (?, ?, ?, ?)",
-		name, displayName, now, now,
-	)
+	id, err := addTenant(c.Request().Context(), name, displayName)
 	if err != nil {
-		if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1062 { // duplicate entry
-			return echo.NewHTTPError(http.StatusBadRequest, "duplicate tenant")
+		if errors.Is(err, errDuplicateTenant) {
+			return &conflictError{code: errorCodeDuplicateTenant, message: "duplicate tenant", err: err}
 		}
-		return fmt.Errorf(
-			"error Insert tenant: name=%s, displayName=%s, createdAt=%d, updatedAt=%d, %w",
-			name, displayName, now, now, err,
-		)
-	}
-
-	id, err := insertRes.LastInsertId()
-	if err != nil {
-		return fmt.Errorf("error get LastInsertId: %w", err)
-	}
-	// NOTE: 先にadminDBに書き込まれることでこのAPIの処理中に
-	//       /api/admin/tenants/billingにアクセスされるとエラーになりそう
-	//       ロックなどで対処したほうが良さそう
-	if err := createTenantDB(id); err != nil {
-		return fmt.Errorf("error createTenantDB: id=%d name=%s %w", id, name, err)
+		return err
 	}
 
 	res := TenantsAddHandlerResult{
@@ -79,6 +68,71 @@ func tenantsAddHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
 }
 
+var errDuplicateTenant = errors.New("duplicate tenant")
+
+// テナントを登録してテナントDBを作成する
+// HTTP APIとCLIのcreate-tenantから呼ばれる
+// テナントの行は作成中 (provisioning) として追加し、テナントDBを作成できてから有効にする
+// テナントDBの作成に失敗した場合は行を消すので、テナントDBのないテナントは残らない
+func addTenant(ctx context.Context, name, displayName string) (int64, error) {
+	now := srv(ctx).clock.Now().Unix()
+	var insertRes sql.Result
+	err := withRetry(ctx, func() (err error) {
+		insertRes, err = srv(ctx).adminDB.ExecContext(
+			ctx,
+			"INSERT INTO tenant (name, display_name, provisioning, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+			name, displayName, true, now, now,
+		)
+		return err
+	})
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, errDuplicateTenant
+		}
+		return 0, fmt.Errorf(
+			"error Insert tenant: name=%s, displayName=%s, createdAt=%d, updatedAt=%d, %w",
+			name, displayName, now, now, err,
+		)
+	}
+
+	// 同名のテナントが以前に引かれていた場合に備えて消しておく
+	srv(ctx).tenantRowCache.Delete(name)
+
+	id, err := insertRes.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error get LastInsertId: %w", err)
+	}
+	// シャーディングしている場合、担当でないテナントのDBは担当のサーバーで migrate サブコマンドを実行して作るので、すぐに有効にする
+	if srv(ctx).shards.owns(id) {
+		if err := srv(ctx).createTenantDB(id); err != nil {
+			discardTenant(srv(ctx), id)
+			return 0, fmt.Errorf("error createTenantDB: id=%d name=%s %w", id, name, err)
+		}
+	}
+	if err := withRetry(ctx, func() error {
+		_, err := srv(ctx).adminDB.ExecContext(ctx, "UPDATE tenant SET provisioning = ?, updated_at = ? WHERE id = ?", false, now, id)
+		return err
+	}); err != nil {
+		discardTenant(srv(ctx), id)
+		return 0, fmt.Errorf("error Update tenant provisioning: id=%d, %w", id, err)
+	}
+	return id, nil
+}
+
+// 作成に失敗したテナントの行を消す
+// リクエストが中断されていても消せるよう、リクエストのcontextは使わない
+// 消せなかった場合も作成中のまま残るので、どのAPIからも見えない
+func discardTenant(s *Server, id int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := withRetry(ctx, func() error {
+		_, err := s.adminDB.ExecContext(ctx, "DELETE FROM tenant WHERE id = ? AND provisioning = ?", id, true)
+		return err
+	}); err != nil {
+		logger.Error("failed to discard provisioning tenant", zap.Int64("tenant_id", id), zap.Error(err))
+	}
+}
+
 // テナント名が規則に沿っているかチェックする
 func validateTenantName(name string) error {
 	if tenantNameRegexp.MatchString(name) {
@@ -96,160 +150,22 @@ type TenantWithBilling struct {
 }
 
 type TenantsBillingHandlerResult struct {
-	Tenants []TenantWithBilling `json:"tenants"`
+	Pagination Pagination          `json:"pagination"`
+	Tenants    []TenantWithBilling `json:"tenants"`
 }
 
-type ScoredPlayer struct {
-	ID            string `db:"pid"`
-	CompetitionID string `db:"competition_id"`
+// SaaS管理者向けの課金レポートで同時に集計するテナント数
+var billingWorkers = getEnvInt("ISUCON_BILLING_WORKERS", 10)
+
+type TenantsBillingRequest struct {
+	Before int64 `query:"before" validate:"min=0"`
 }
 
 // SaaS管理者用API
 // テナントごとの課金レポートを最大10件、テナントのid降順で取得する
 // GET /api/admin/tenants/billing
 // URL引数beforeを指定した場合、指定した値よりもidが小さいテナントの課金レポートを取得する
-// func tenantsBillingHandler(c echo.Context) error {
-// 	if host := c.Request().Host; host != getEnv("ISUCON_ADMIN_HOSTNAME", "admin.t.isucon.dev") {
-// 		return echo.NewHTTPError(
-// 			http.StatusNotFound,
-// 			fmt.Sprintf("invalid hostname %s", host),
-// 		)
-// 	}
-
-// 	ctx := context.Background()
-// 	if v, err := parseViewer(c); err != nil {
-// 		return err
-// 	} else if v.role != RoleAdmin {
-// 		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
-// 	}
-
-// 	before := c.QueryParam("before")
-// 	var beforeID int64
-// 	if before != "" {
-// 		var err error
-// 		beforeID, err = strconv.ParseInt(before, 10, 64)
-// 		if err != nil {
-// 			return echo.NewHTTPError(
-// 				http.StatusBadRequest,
-// 				fmt.Sprintf("failed to parse query parameter 'before': %s", err.Error()),
-// 			)
-// 		}
-// 	}
-// 	// テナントごとに
-// 	//   大会ごとに
-// 	//     scoreが登録されているplayer * 100
-// 	//     scoreが登録されていないplayerでアクセスした人 * 10
-// 	//   を合計したものを
-// 	// テナントの課金とする
-// 	// ts := []TenantRow{}
-// 	// if err := adminDB.SelectContext(ctx, &ts, "SELECT * FROM tenant ORDER BY id DESC"); err != nil {
-// 	// 	return fmt.Errorf("error Select tenant: %w", err)
-
-// 	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
-// 	billingMap := map[string]string{}
-
-// 	tenants := make([]TenantRow, 0, 200)
-// 	err := adminDB.SelectContext(c.Request().Context(), &tenants, "SELECT * FROM tenant ORDER BY id DESC") // }
-// 	if err != nil {
-// 		return fmt.Errorf("error Select tenant: %w", err)
-// 	}
-
-// 	tenantBillings := make([]TenantWithBilling, 0, len(tenants))
-
-// 	for i := range tenants {
-// 		if beforeID != 0 && beforeID <= tenants[i].ID {
-// 			continue
-// 		}
-
-// 		tenantBillings = append(tenantBillings, TenantWithBilling{
-// 			ID:          strconv.FormatInt(tenants[i].ID, 10),
-// 			Name:        tenants[i].Name,
-// 			DisplayName: tenants[i].DisplayName,
-// 			BillingYen:  0,
-// 			tenantID:    tenants[i].ID,
-// 		})
-
-// 		if len(tenantBillings) >= 10 {
-// 			break
-// 		}
-// 	}
-
-// 	currentCompID := ""
-
-// 	for i := range tenantBillings {
-// 		tenantDB, _ := connectToTenantDB(tenantBillings[i].tenantID)
-
-// 		fl, err := flockByTenantID(tenantBillings[i].tenantID)
-// 		if err != nil {
-// 			return fmt.Errorf("error flockByTenantID: %w", err)
-// 		}
-
-// 		// スコアを登録した参加者のIDを取得する
-// 		scoredPlayers := []scoredPlayer{}
-// 		if err := tenantDB.SelectContext(
-// 			ctx,
-// 			&scoredPlayers,
-// 			"SELECT DISTINCT(player_id) as pid, competition_id FROM player_score WHERE tenant_id = ? ORDER BY competition_id",
-// 			tenantBillings[i].tenantID,
-// 		); err != nil && err != sql.ErrNoRows {
-// 			return fmt.Errorf("error Select count player_score: %w", err)
-// 		}
-
-// 		var comp *CompetitionRow
-// 		for j := range scoredPlayers {
-// 			if currentCompID != scoredPlayers[j].CompetitionID {
-// 				currentCompID = scoredPlayers[j].CompetitionID
-// 				comp, _ = retrieveCompetition(ctx, tenantDB, currentCompID)
-// 			}
-
-// 			if comp == nil || !comp.FinishedAt.Valid {
-// 				continue
-// 			}
-
-// 			// スコアが登録されている参加者
-// 			billingMap[scoredPlayers[j].ID] = "player"
-// 			tenantBillings[i].BillingYen += 100
-// 		}
-
-// 		vhs := []VisitHistorySummaryRow{}
-// 		if err := adminDB.SelectContext(ctx, &vhs,
-// 			"SELECT player_id, MIN(created_at) AS min_created_at, competition_id FROM visit_history "+
-// 				"WHERE tenant_id = ? GROUP BY player_id, competition_id ORDER BY competition_id",
-// 			tenantBillings[i].tenantID,
-// 		); err != nil && err != sql.ErrNoRows {
-// 			return fmt.Errorf("error Select visit_history. %w", err)
-// 		}
-// 		for j := range vhs {
-// 			var comp *CompetitionRow
-// 			if currentCompID != vhs[j].CompetitionID {
-// 				currentCompID = vhs[j].CompetitionID
-// 				comp, _ = retrieveCompetition(ctx, tenantDB, currentCompID)
-// 			}
-
-// 			if comp == nil || !comp.FinishedAt.Valid {
-// 				continue
-// 			}
-
-// 			// competition.finished_atよりもあとの場合は、終了後に訪問したとみなして大会開催内アクセス済みとみなさない
-// 			if comp.FinishedAt.Int64 < vhs[j].MinCreatedAt {
-// 				continue
-// 			}
-
-// 			if billingMap[vhs[j].PlayerID] != "player" {
-// 				tenantBillings[i].BillingYen += 10
-// 			}
-// 		}
-
-// 		fl.Close()
-// 	}
-// 	return c.JSON(http.StatusOK, SuccessResult{
-// 		Status: true,
-// 		Data: TenantsBillingHandlerResult{
-// 			Tenants: tenantBillings,
-// 		},
-// 	})
-// }
-
+// cursorとlimitでもページングできる (pagination.go を参照)
 func tenantsBillingHandler(c echo.Context) error {
 	if host := c.Request().Host; host != getEnv("ISUCON_ADMIN_HOSTNAME", "admin.t.isucon.dev") {
 		return echo.NewHTTPError(
@@ -258,83 +174,326 @@ func tenantsBillingHandler(c echo.Context) error {
 		)
 	}
 
-	ctx := context.Background()
+	ctx := c.Request().Context()
 	if v, err := parseViewer(c); err != nil {
 		return err
 	} else if v.role != RoleAdmin {
 		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
 	}
 
-	before := c.QueryParam("before")
-	var beforeID int64
-	if before != "" {
-		var err error
-		beforeID, err = strconv.ParseInt(before, 10, 64)
-		if err != nil {
-			return echo.NewHTTPError(
-				http.StatusBadRequest,
-				fmt.Sprintf("failed to parse query parameter 'before': %s", err.Error()),
-			)
+	var req TenantsBillingRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+	beforeID := req.Before
+	// テナントの課金の計算は billing.go を参照
+	// カーソルはbeforeと同じく、このIDより小さいテナントから返すことを表す
+	page, err := parsePageParams(c, 10, 100)
+	if err != nil {
+		return err
+	}
+	if page.cursor != "" {
+		if beforeID, err = strconv.ParseInt(page.cursor, 10, 64); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
 		}
 	}
-	// テナントごとに
-	//   大会ごとに
-	//     scoreが登録されているplayer * 100
-	//     scoreが登録されていないplayerでアクセスした人 * 10
-	//   を合計したものを
-	// テナントの課金とする
+	// 対象のテナントはSQLでlimit件に絞ってから、テナントごとに並列で集計する
+	// 次のページがあるか確かめるため1件多く取得する
 	ts := []TenantRow{}
-	if err := adminDB.SelectContext(ctx, &ts, "SELECT * FROM tenant ORDER BY id DESC"); err != nil {
-		return fmt.Errorf("error Select tenant: %w", err)
+	if beforeID != 0 {
+		err = srv(ctx).adminReadDB.SelectContext(ctx, &ts, "SELECT * FROM tenant WHERE id < ? AND provisioning = 0 ORDER BY id DESC LIMIT ?", beforeID, page.limit+1)
+	} else {
+		err = srv(ctx).adminReadDB.SelectContext(ctx, &ts, "SELECT * FROM tenant WHERE provisioning = 0 ORDER BY id DESC LIMIT ?", page.limit+1)
 	}
-	tenantBillings := make([]TenantWithBilling, 0, len(ts))
-	for _, t := range ts {
-		if beforeID != 0 && beforeID <= t.ID {
-			continue
+	if err != nil {
+		return fmt.Errorf("error Select tenant: before=%d, %w", beforeID, err)
+	}
+	var total int64
+	if err := srv(ctx).adminReadDB.GetContext(ctx, &total, "SELECT COUNT(*) FROM tenant WHERE provisioning = 0"); err != nil {
+		return fmt.Errorf("error Select count tenant: %w", err)
+	}
+	pg := Pagination{Total: &total}
+	targets := ts
+	if len(ts) > page.limit {
+		targets = ts[:page.limit]
+		pg.NextCursor = encodeCursor(strconv.FormatInt(targets[len(targets)-1].ID, 10))
+	}
+	if beforeID != 0 {
+		// 前のページは、beforeID以上のテナントのうちIDの小さい方からlimit件
+		// その先頭 (最もIDの大きいテナント) より1つ大きいIDを指す
+		var prevIDs []int64
+		if err := srv(ctx).adminReadDB.SelectContext(ctx, &prevIDs, "SELECT id FROM tenant WHERE id >= ? AND provisioning = 0 ORDER BY id ASC LIMIT ?", beforeID, page.limit); err != nil {
+			return fmt.Errorf("error Select tenant id: before=%d, %w", beforeID, err)
+		}
+		if len(prevIDs) > 0 {
+			pg.PrevCursor = encodeCursor(strconv.FormatInt(prevIDs[len(prevIDs)-1]+1, 10))
 		}
-		err := func(t TenantRow) error {
-			tb := TenantWithBilling{
-				ID:          strconv.FormatInt(t.ID, 10),
-				Name:        t.Name,
-				DisplayName: t.DisplayName,
-			}
-			tenantDB, err := connectToTenantDB(t.ID)
-			if err != nil {
-				return fmt.Errorf("failed to connectToTenantDB: %w", err)
-			}
-			cs := []CompetitionRow{}
-			if err := tenantDB.SelectContext(
-				ctx,
-				&cs,
-				"SELECT * FROM competition WHERE tenant_id=?",
-				t.ID,
-			); err != nil {
-				return fmt.Errorf("failed to Select competition: %w", err)
-			}
-			for _, comp := range cs {
-				report, err := billingReportByCompetition(ctx, tenantDB, t.ID, comp.ID)
-				if err != nil {
-					return fmt.Errorf("failed to billingReportByCompetition: %w", err)
-				}
-				tb.BillingYen += report.BillingYen
-			}
-			tenantBillings = append(tenantBillings, tb)
-			return nil
-		}(t)
+	}
+	pg.setLinks(c, "before")
+	indexes := make([]int, len(targets))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	tenantBillings := make([]TenantWithBilling, len(targets))
+	if err := forEachParallel(ctx, billingWorkers, indexes, func(ctx context.Context, i int) error {
+		tb, err := tenantBilling(ctx, targets[i])
 		if err != nil {
 			return err
 		}
-		if len(tenantBillings) >= 10 {
-			break
-		}
+		tenantBillings[i] = tb
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	vhsCache.Reset()
-
 	return c.JSON(http.StatusOK, SuccessResult{
 		Status: true,
 		Data: TenantsBillingHandlerResult{
-			Tenants: tenantBillings,
+			Pagination: pg,
+			Tenants:    tenantBillings,
 		},
 	})
 }
+
+type TenantsMaintenanceHandlerResult struct {
+	Results []TenantMaintenanceResult `json:"results"`
+}
+
+// SaaS管理者用API
+// テナントDBのメンテナンス(VACUUM, ANALYZE, integrity_check)を実行する
+// POST /api/admin/tenants/maintenance
+// tenant_idを指定した場合はそのテナントだけ、指定しない場合は使用中でない全テナントが対象
+func tenantsMaintenanceHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.tenantName != "admin" {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("%s has not this API", v.tenantName),
+		)
+	}
+	if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+
+	var ids []int64
+	force := false
+	if tenantID := c.FormValue("tenant_id"); tenantID != "" {
+		id, err := strconv.ParseInt(tenantID, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(
+				http.StatusBadRequest,
+				fmt.Sprintf("failed to parse tenant_id: %s", err.Error()),
+			)
+		}
+		ids = []int64{id}
+		force = true
+	} else {
+		ids, err = listTenantDBIDs()
+		if err != nil {
+			return fmt.Errorf("error listTenantDBIDs: %w", err)
+		}
+	}
+
+	results := maintainTenantDBs(c.Request().Context(), ids, force)
+	return c.JSON(http.StatusOK, SuccessResult{
+		Status: true,
+		Data:   TenantsMaintenanceHandlerResult{Results: results},
+	})
+}
+
+type TenantsBackupHandlerResult struct {
+	Backup TenantBackupResult `json:"backup"`
+}
+
+// SaaS管理者用API
+// テナントDBのバックアップを取る
+// POST /api/admin/tenants/backup
+// tenant_idを指定する、compress=1ならgzipで圧縮する
+func tenantsBackupHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.tenantName != "admin" {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("%s has not this API", v.tenantName),
+		)
+	}
+	if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+
+	tenantID, err := strconv.ParseInt(c.FormValue("tenant_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(
+			http.StatusBadRequest,
+			fmt.Sprintf("failed to parse tenant_id: %s", err.Error()),
+		)
+	}
+	if _, err := os.Stat(tenantDBPath(tenantID)); errors.Is(err, os.ErrNotExist) {
+		return echo.NewHTTPError(http.StatusNotFound, "tenant not found")
+	}
+
+	res, err := backupTenantDB(c.Request().Context(), tenantID, c.FormValue("compress") == "1")
+	if err != nil {
+		return fmt.Errorf("error backupTenantDB: %w", err)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{
+		Status: true,
+		Data:   TenantsBackupHandlerResult{Backup: *res},
+	})
+}
+
+// SaaS管理者用API
+// バックアップからテナントDBを復元する
+// POST /api/admin/tenants/restore
+// tenant_idと、バックアップディレクトリ内のファイル名fileか、オブジェクトストレージのキーobject_keyを指定する
+func tenantsRestoreHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.tenantName != "admin" {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("%s has not this API", v.tenantName),
+		)
+	}
+	if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+
+	tenantID, err := strconv.ParseInt(c.FormValue("tenant_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(
+			http.StatusBadRequest,
+			fmt.Sprintf("failed to parse tenant_id: %s", err.Error()),
+		)
+	}
+	if key := c.FormValue("object_key"); key != "" {
+		if objectStorage == nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "object storage is not configured")
+		}
+		if err := restoreTenantDBFromObject(c.Request().Context(), tenantID, key); err != nil {
+			return fmt.Errorf("error restoreTenantDBFromObject: %w", err)
+		}
+		return c.JSON(http.StatusOK, SuccessResult{Status: true})
+	}
+
+	// バックアップディレクトリの外のファイルを指定させない
+	file := c.FormValue("file")
+	if file == "" || file != filepath.Base(file) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid file")
+	}
+	p := filepath.Join(backupDir(), file)
+	if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+		return echo.NewHTTPError(http.StatusNotFound, "backup not found")
+	}
+
+	if err := restoreTenantDB(c.Request().Context(), tenantID, p); err != nil {
+		return fmt.Errorf("error restoreTenantDB: %w", err)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
+
+type CachesHandlerResult struct {
+	Caches []CacheDetail `json:"caches"`
+}
+
+// SaaS管理者用API
+// キャッシュの件数とヒット率を返す
+// GET /api/admin/caches
+func cachesHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.tenantName != "admin" {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("%s has not this API", v.tenantName),
+		)
+	}
+	if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+	s := srv(c.Request().Context())
+	caches := s.managedCaches()
+	details := make([]CacheDetail, 0, len(caches))
+	for _, m := range caches {
+		details = append(details, m.detail(s))
+	}
+	return c.JSON(http.StatusOK, SuccessResult{
+		Status: true,
+		Data:   CachesHandlerResult{Caches: details},
+	})
+}
+
+// SaaS管理者用API
+// 指定したキャッシュを破棄する
+// 本番でキャッシュとDBの内容がずれたときに使う
+// POST /api/admin/caches
+func cachesFlushHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.tenantName != "admin" {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("%s has not this API", v.tenantName),
+		)
+	}
+	if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+	name := c.FormValue("name")
+	s := srv(c.Request().Context())
+	for _, m := range s.managedCaches() {
+		if m.name != name {
+			continue
+		}
+		m.flush()
+		loggerFromContext(c.Request().Context()).Info("flushed cache", zap.String("cache", name))
+		return c.JSON(http.StatusOK, SuccessResult{
+			Status: true,
+			Data:   CachesHandlerResult{Caches: []CacheDetail{m.detail(s)}},
+		})
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown cache: %s", name))
+}
+
+type StatsHandlerResult struct {
+	Routes []RouteLatencyDetail `json:"routes"`
+}
+
+// SaaS管理者用API
+// ルートごとのレイテンシのヒストグラムを返す
+// ランキングとスコアのアップロードはテナントごとの内訳も返す
+// reset=1 を指定すると返したあとに集計をやり直す
+// GET /api/admin/stats
+func statsHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.tenantName != "admin" {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("%s has not this API", v.tenantName),
+		)
+	}
+	if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+
+	res := StatsHandlerResult{Routes: requestLatencies.details()}
+	if c.QueryParam("reset") == "1" {
+		requestLatencies.reset()
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
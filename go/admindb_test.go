@@ -0,0 +1,455 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+// テストで使う管理用DBの偽物
+// database/sql/driver のConnをSQLiteのものに差し替え、アプリケーションが管理用DBに送るMySQLの構文だけをSQLiteの構文に読み替える
+// ハンドラやServerは本番と同じ *sqlx.DB を通して使うので、MySQLを起動しなくても管理用DBを使う処理をそのまま動かせる
+//
+// スキーマは schema/admin のマイグレーションを全て適用した後と同じ列と一意キーを、SQLiteの構文で fakeAdminSchema に書く
+// 管理用DBのマイグレーションを追加して合わせ忘れたら TestFakeAdminSchemaMatchesMigrations が失敗する
+const fakeAdminDriverName = "isuports-fake-admin"
+
+func init() {
+	sql.Register(fakeAdminDriverName, fakeAdminDriver{})
+}
+
+// MySQLの構文からSQLiteの構文への読み替え
+var fakeAdminRewrites = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`ON DUPLICATE KEY UPDATE`), "ON CONFLICT DO UPDATE SET"},
+	// ON DUPLICATE KEY UPDATE の中で挿入しようとした値を参照する
+	{regexp.MustCompile(`VALUES\((\w+)\)`), "excluded.$1"},
+	{regexp.MustCompile(`\bLEAST\(`), "MIN("},
+	{regexp.MustCompile(`\bGREATEST\(`), "MAX("},
+	{regexp.MustCompile(`INSERT IGNORE`), "INSERT OR IGNORE"},
+	// SQLiteは書き込みでデータベース全体をロックするので行ロックは要らない
+	{regexp.MustCompile(`\s+FOR UPDATE`), ""},
+}
+
+func rewriteFakeAdminQuery(query string) string {
+	for _, r := range fakeAdminRewrites {
+		query = r.re.ReplaceAllString(query, r.repl)
+	}
+	return query
+}
+
+type fakeAdminDriver struct{}
+
+func (fakeAdminDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := (&sqlite3.SQLiteDriver{}).Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeAdminConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+// クエリを受け取るメソッドだけ読み替えてSQLiteに渡す
+type fakeAdminConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func (c *fakeAdminConn) Prepare(query string) (driver.Stmt, error) {
+	return c.SQLiteConn.Prepare(rewriteFakeAdminQuery(query))
+}
+
+func (c *fakeAdminConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.SQLiteConn.PrepareContext(ctx, rewriteFakeAdminQuery(query))
+}
+
+func (c *fakeAdminConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.SQLiteConn.ExecContext(ctx, rewriteFakeAdminQuery(query), args)
+}
+
+func (c *fakeAdminConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.SQLiteConn.QueryContext(ctx, rewriteFakeAdminQuery(query), args)
+}
+
+var fakeAdminSchema = []string{
+	`CREATE TABLE tenant (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name VARCHAR(255) NOT NULL UNIQUE,
+		display_name VARCHAR(255) NOT NULL,
+		provisioning TINYINT(1) NOT NULL DEFAULT 0,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE id_generator (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		stub CHAR(1) NOT NULL DEFAULT '' UNIQUE
+	)`,
+	`INSERT INTO id_generator (id, stub) VALUES (2678400000, 'a')`,
+	`CREATE TABLE visit_history (
+		player_id VARCHAR(255) NOT NULL,
+		tenant_id BIGINT NOT NULL,
+		competition_id VARCHAR(255) NOT NULL,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		UNIQUE (tenant_id, competition_id, player_id)
+	)`,
+	`CREATE TABLE webhook_endpoint (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tenant_id BIGINT NOT NULL,
+		url VARCHAR(1024) NOT NULL,
+		secret VARCHAR(255) NOT NULL,
+		events VARCHAR(255) NOT NULL,
+		format VARCHAR(16) NOT NULL DEFAULT 'full',
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE webhook_delivery (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tenant_id BIGINT NOT NULL,
+		endpoint_id BIGINT NOT NULL,
+		event VARCHAR(64) NOT NULL,
+		payload MEDIUMTEXT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at BIGINT NOT NULL,
+		last_status_code INT NOT NULL DEFAULT 0,
+		last_error VARCHAR(1024) NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE tenant_setting (
+		tenant_id BIGINT NOT NULL,
+		name VARCHAR(64) NOT NULL,
+		value TEXT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		PRIMARY KEY (tenant_id, name)
+	)`,
+	`CREATE TABLE player_email (
+		tenant_id BIGINT NOT NULL,
+		player_id VARCHAR(255) NOT NULL,
+		email VARCHAR(255) NOT NULL,
+		updated_at BIGINT NOT NULL,
+		PRIMARY KEY (tenant_id, player_id)
+	)`,
+	`CREATE TABLE mail_outbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tenant_id BIGINT NOT NULL,
+		kind VARCHAR(64) NOT NULL,
+		to_address VARCHAR(255) NOT NULL,
+		subject VARCHAR(1024) NOT NULL,
+		body TEXT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at BIGINT NOT NULL,
+		last_error VARCHAR(1024) NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE api_token (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tenant_id BIGINT NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		token_hash CHAR(64) NOT NULL UNIQUE,
+		token_prefix VARCHAR(16) NOT NULL,
+		revoked_at BIGINT NULL,
+		created_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE sso_identity (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tenant_id BIGINT NOT NULL,
+		subject VARCHAR(255) NOT NULL DEFAULT '',
+		email VARCHAR(255) NOT NULL DEFAULT '',
+		organizer_id VARCHAR(255) NOT NULL,
+		created_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE sso_state (
+		state VARCHAR(64) NOT NULL PRIMARY KEY,
+		tenant_id BIGINT NOT NULL,
+		nonce VARCHAR(64) NOT NULL,
+		code_verifier VARCHAR(128) NOT NULL,
+		redirect_to VARCHAR(1024) NOT NULL,
+		expires_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE scim_user (
+		tenant_id BIGINT NOT NULL,
+		player_id VARCHAR(255) NOT NULL,
+		user_name VARCHAR(255) NOT NULL,
+		external_id VARCHAR(255) NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		PRIMARY KEY (tenant_id, player_id),
+		UNIQUE (tenant_id, user_name)
+	)`,
+	`CREATE TABLE billing_invoice (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tenant_id BIGINT NOT NULL,
+		period CHAR(7) NOT NULL,
+		amount_yen BIGINT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		stripe_invoice_id VARCHAR(255) NOT NULL DEFAULT '',
+		last_error VARCHAR(1024) NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		UNIQUE (tenant_id, period)
+	)`,
+	`CREATE TABLE billing_invoice_line (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		invoice_id BIGINT NOT NULL,
+		tenant_id BIGINT NOT NULL,
+		competition_id VARCHAR(255) NOT NULL,
+		description VARCHAR(1024) NOT NULL,
+		amount_yen BIGINT NOT NULL
+	)`,
+}
+
+// 一時ディレクトリに偽物の管理用DBを作る
+func openFakeAdminDB(t *testing.T, dir string) *sqlx.DB {
+	t.Helper()
+	adminDB, err := sqlx.Open(fakeAdminDriverName, fmt.Sprintf("file:%s?mode=rwc", filepath.Join(dir, "admin.db")))
+	if err != nil {
+		t.Fatalf("failed to open admin DB: %s", err)
+	}
+	for _, q := range fakeAdminSchema {
+		if _, err := adminDB.Exec(q); err != nil {
+			t.Fatalf("failed to create admin table: %s", err)
+		}
+	}
+	return adminDB
+}
+
+func TestRewriteFakeAdminQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{
+			query: "INSERT INTO tenant_setting (tenant_id, name, value, updated_at) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value), updated_at = VALUES(updated_at)",
+			want:  "INSERT INTO tenant_setting (tenant_id, name, value, updated_at) VALUES (?, ?, ?, ?) ON CONFLICT DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at",
+		},
+		{
+			query: "ON DUPLICATE KEY UPDATE created_at = LEAST(created_at, VALUES(created_at)), updated_at = GREATEST(updated_at, VALUES(updated_at))",
+			want:  "ON CONFLICT DO UPDATE SET created_at = MIN(created_at, excluded.created_at), updated_at = MAX(updated_at, excluded.updated_at)",
+		},
+		{
+			query: "SELECT * FROM billing_invoice WHERE tenant_id = ? AND period = ? FOR UPDATE",
+			want:  "SELECT * FROM billing_invoice WHERE tenant_id = ? AND period = ?",
+		},
+		{
+			query: "SELECT MAX(created_at) FROM visit_history",
+			want:  "SELECT MAX(created_at) FROM visit_history",
+		},
+	}
+	for _, tt := range tests {
+		if got := rewriteFakeAdminQuery(tt.query); got != tt.want {
+			t.Errorf("rewriteFakeAdminQuery(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+// マイグレーションを順に読んで作った、テーブルごとの列と一意キー (主キーを含む)
+// 一意キーは列名をカンマでつないだもの
+type schemaTable struct {
+	columns []string
+	uniques []string
+}
+
+var (
+	migrationCreateTableLikeRe = regexp.MustCompile("^CREATE TABLE (IF NOT EXISTS )?`(\\w+)` LIKE `(\\w+)`")
+	migrationCreateTableRe     = regexp.MustCompile("^CREATE TABLE (IF NOT EXISTS )?`(\\w+)` \\(")
+	migrationAddColumnRe       = regexp.MustCompile("^ALTER TABLE `(\\w+)` ADD COLUMN `(\\w+)`")
+	migrationAddUniqueRe       = regexp.MustCompile("^ALTER TABLE `(\\w+)` ADD UNIQUE KEY `\\w+` \\(([^)]*)\\)")
+	migrationCreateUniqueRe    = regexp.MustCompile("^CREATE UNIQUE INDEX `?\\w+`? ON `?(\\w+)`? \\(([^)]*)\\)")
+	migrationRenameRe          = regexp.MustCompile("`(\\w+)` TO `(\\w+)`")
+	migrationDropTableRe       = regexp.MustCompile("^DROP TABLE (IF EXISTS )?`(\\w+)`")
+	migrationKeyRe             = regexp.MustCompile("^(PRIMARY KEY|UNIQUE KEY `\\w+`) \\(([^)]*)\\)")
+)
+
+// "`a`, `b`" を "a,b" にする
+func migrationColumnList(s string) string {
+	var cs []string
+	for _, c := range strings.Split(s, ",") {
+		cs = append(cs, strings.Trim(strings.TrimSpace(c), "`"))
+	}
+	return strings.Join(cs, ",")
+}
+
+// schema/admin のマイグレーションを全て適用した後のテーブルを、DDLを読んで求める
+// 読めない形のDDLを使ったマイグレーションを追加したら、ここを直すこと
+func migratedAdminSchema(t *testing.T) map[string]*schemaTable {
+	t.Helper()
+	ms, err := loadMigrations("schema/admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := map[string]*schemaTable{}
+	for _, m := range ms {
+		for _, stmt := range splitStatements(m.sql) {
+			oneLine := strings.Join(strings.Fields(stmt), " ")
+			switch {
+			case migrationCreateTableLikeRe.MatchString(oneLine):
+				g := migrationCreateTableLikeRe.FindStringSubmatch(oneLine)
+				if _, ok := tables[g[2]]; ok && g[1] != "" {
+					continue
+				}
+				src := tables[g[3]]
+				tables[g[2]] = &schemaTable{
+					columns: append([]string{}, src.columns...),
+					uniques: append([]string{}, src.uniques...),
+				}
+			case migrationCreateTableRe.MatchString(oneLine):
+				g := migrationCreateTableRe.FindStringSubmatch(oneLine)
+				if _, ok := tables[g[2]]; ok && g[1] != "" {
+					continue
+				}
+				st := &schemaTable{}
+				for _, line := range strings.Split(stmt, "\n")[1:] {
+					line = strings.TrimSuffix(strings.TrimSpace(line), ",")
+					if strings.HasPrefix(line, "`") {
+						st.columns = append(st.columns, strings.Trim(strings.Fields(line)[0], "`"))
+					} else if k := migrationKeyRe.FindStringSubmatch(line); k != nil {
+						st.uniques = append(st.uniques, migrationColumnList(k[2]))
+					}
+				}
+				tables[g[2]] = st
+			case migrationAddColumnRe.MatchString(oneLine):
+				g := migrationAddColumnRe.FindStringSubmatch(oneLine)
+				tables[g[1]].columns = append(tables[g[1]].columns, g[2])
+			case migrationAddUniqueRe.MatchString(oneLine):
+				g := migrationAddUniqueRe.FindStringSubmatch(oneLine)
+				tables[g[1]].uniques = append(tables[g[1]].uniques, migrationColumnList(g[2]))
+			case migrationCreateUniqueRe.MatchString(oneLine):
+				g := migrationCreateUniqueRe.FindStringSubmatch(oneLine)
+				tables[g[1]].uniques = append(tables[g[1]].uniques, migrationColumnList(g[2]))
+			case strings.HasPrefix(oneLine, "RENAME TABLE "):
+				// 左から順に名前を変える (入れ替えもこの順で正しくなる)
+				for _, g := range migrationRenameRe.FindAllStringSubmatch(oneLine, -1) {
+					tables[g[2]] = tables[g[1]]
+					delete(tables, g[1])
+				}
+			case migrationDropTableRe.MatchString(oneLine):
+				delete(tables, migrationDropTableRe.FindStringSubmatch(oneLine)[2])
+			case strings.HasPrefix(oneLine, "CREATE INDEX "), strings.HasPrefix(oneLine, "INSERT "), strings.HasPrefix(oneLine, "UPDATE "):
+				// 列と一意キーは変わらない
+			default:
+				t.Fatalf("migration %d_%s: cannot read statement: %s", m.version, m.name, oneLine)
+			}
+		}
+	}
+	for _, st := range tables {
+		sort.Strings(st.columns)
+		sort.Strings(st.uniques)
+	}
+	return tables
+}
+
+// SQLiteのテーブルの列と一意キーを読む
+func sqliteSchema(t *testing.T, db *sqlx.DB) map[string]*schemaTable {
+	t.Helper()
+	var names []string
+	if err := db.Select(&names, "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'"); err != nil {
+		t.Fatal(err)
+	}
+	tables := map[string]*schemaTable{}
+	for _, name := range names {
+		var cols []struct {
+			CID     int            `db:"cid"`
+			Name    string         `db:"name"`
+			Type    string         `db:"type"`
+			NotNull bool           `db:"notnull"`
+			Default sql.NullString `db:"dflt_value"`
+			PK      int            `db:"pk"`
+		}
+		if err := db.Select(&cols, fmt.Sprintf("PRAGMA table_info(%s)", name)); err != nil {
+			t.Fatal(err)
+		}
+		st := &schemaTable{}
+		pk := map[int]string{}
+		for _, c := range cols {
+			st.columns = append(st.columns, c.Name)
+			if c.PK > 0 {
+				pk[c.PK] = c.Name
+			}
+		}
+		uniques := map[string]bool{}
+		if len(pk) > 0 {
+			var pkCols []string
+			for i := 1; i <= len(pk); i++ {
+				pkCols = append(pkCols, pk[i])
+			}
+			uniques[strings.Join(pkCols, ",")] = true
+		}
+		var indexes []struct {
+			Seq     int    `db:"seq"`
+			Name    string `db:"name"`
+			Unique  bool   `db:"unique"`
+			Origin  string `db:"origin"`
+			Partial bool   `db:"partial"`
+		}
+		if err := db.Select(&indexes, fmt.Sprintf("PRAGMA index_list(%s)", name)); err != nil {
+			t.Fatal(err)
+		}
+		for _, idx := range indexes {
+			if !idx.Unique {
+				continue
+			}
+			var idxCols []struct {
+				SeqNo int            `db:"seqno"`
+				CID   int            `db:"cid"`
+				Name  sql.NullString `db:"name"`
+			}
+			if err := db.Select(&idxCols, fmt.Sprintf("PRAGMA index_info(%s)", idx.Name)); err != nil {
+				t.Fatal(err)
+			}
+			sort.Slice(idxCols, func(i, j int) bool { return idxCols[i].SeqNo < idxCols[j].SeqNo })
+			var cs []string
+			for _, c := range idxCols {
+				cs = append(cs, c.Name.String)
+			}
+			uniques[strings.Join(cs, ",")] = true
+		}
+		for u := range uniques {
+			st.uniques = append(st.uniques, u)
+		}
+		sort.Strings(st.columns)
+		sort.Strings(st.uniques)
+		tables[name] = st
+	}
+	return tables
+}
+
+// fakeAdminSchema がマイグレーションを全て適用した管理用DBと同じテーブル、列、一意キーを持つことを確かめる
+func TestFakeAdminSchemaMatchesMigrations(t *testing.T) {
+	want := migratedAdminSchema(t)
+	db := openFakeAdminDB(t, t.TempDir())
+	defer db.Close()
+	got := sqliteSchema(t, db)
+
+	for name, w := range want {
+		g, ok := got[name]
+		if !ok {
+			t.Errorf("table %s is missing in fakeAdminSchema", name)
+			continue
+		}
+		if !reflect.DeepEqual(g.columns, w.columns) {
+			t.Errorf("table %s: columns = %v, want %v", name, g.columns, w.columns)
+		}
+		if !reflect.DeepEqual(g.uniques, w.uniques) {
+			t.Errorf("table %s: unique keys = %v, want %v", name, g.uniques, w.uniques)
+		}
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			t.Errorf("table %s is not in the migrations", name)
+		}
+	}
+}
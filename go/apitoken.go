@@ -0,0 +1,236 @@
+package isuports
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 読み取り専用のAPIトークン
+// 会場のスコアボードや報道向けに、参加者のJWTなしでランキングと大会の一覧を取得できるようにする
+// トークンは Authorization: Bearer isp_... で送り、テナントのHostヘッダと組み合わせて使う
+// 管理用DBにはトークンのSHA-256だけを保存し、トークンそのものは発行したときのレスポンスでだけ返す
+
+const apiTokenPrefix = "isp_"
+
+type APITokenRow struct {
+	ID          int64         `db:"id"`
+	TenantID    int64         `db:"tenant_id"`
+	Name        string        `db:"name"`
+	TokenHash   string        `db:"token_hash"`
+	TokenPrefix string        `db:"token_prefix"` // 一覧で見分けるための先頭部分
+	RevokedAt   sql.NullInt64 `db:"revoked_at"`
+	CreatedAt   int64         `db:"created_at"`
+}
+
+func hashAPIToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// Authorizationヘッダから読み取り専用のAPIトークンを取り出す
+func apiTokenFromHeader(c echo.Context) (string, bool) {
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || !strings.HasPrefix(token, apiTokenPrefix) {
+		return "", false
+	}
+	return token, true
+}
+
+// APIトークンを検証してViewerを返す
+// トークンを発行したテナントとHostヘッダのテナントが一致しなければ401にする
+func parseAPITokenViewer(c echo.Context, token string) (*Viewer, error) {
+	ctx := c.Request().Context()
+	hash := hashAPIToken(token)
+	t, ok := srv(ctx).apiTokenCache.Get(hash)
+	if !ok {
+		if err := srv(ctx).adminReadDB.GetContext(ctx, &t, "SELECT * FROM api_token WHERE token_hash = ?", hash); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, echo.NewHTTPError(http.StatusUnauthorized, "invalid api token")
+			}
+			return nil, fmt.Errorf("error Select api_token: %w", err)
+		}
+		srv(ctx).apiTokenCache.Set(hash, t)
+	}
+	if t.RevokedAt.Valid {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "api token is revoked")
+	}
+
+	tenant, err := retrieveTenantRowFromHeader(c)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, echo.NewHTTPError(http.StatusUnauthorized, "tenant not found")
+		}
+		return nil, fmt.Errorf("error retrieveTenantRowFromHeader: %w", err)
+	}
+	if tenant.ID != t.TenantID {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "invalid api token: tenant is not match")
+	}
+
+	return &Viewer{
+		role:       RoleReader,
+		tenantName: tenant.Name,
+		tenantID:   tenant.ID,
+	}, nil
+}
+
+// Cookieもヘッダも送れないクライアント (カレンダーアプリ、フィードリーダー) 向けに
+// クエリのtokenでもAPIトークンを受け付ける
+func parseViewerWithTokenParam(c echo.Context) (*Viewer, error) {
+	if token := c.QueryParam("token"); strings.HasPrefix(token, apiTokenPrefix) {
+		return parseAPITokenViewer(c, token)
+	}
+	return parseViewer(c)
+}
+
+type APITokenDetail struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Prefix    string `json:"prefix"`
+	Token     string `json:"token,omitempty"` // 発行したときだけ返す
+	IsRevoked bool   `json:"is_revoked"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func apiTokenDetail(t APITokenRow) APITokenDetail {
+	return APITokenDetail{
+		ID:        strconv.FormatInt(t.ID, 10),
+		Name:      t.Name,
+		Prefix:    t.TokenPrefix,
+		IsRevoked: t.RevokedAt.Valid,
+		CreatedAt: t.CreatedAt,
+	}
+}
+
+type APITokensHandlerResult struct {
+	APITokens []APITokenDetail `json:"api_tokens"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/api_tokens
+// 読み取り専用のAPIトークンの一覧を取得する
+func apiTokensHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	ts := []APITokenRow{}
+	if err := srv(ctx).adminDB.SelectContext(ctx, &ts, "SELECT * FROM api_token WHERE tenant_id = ? ORDER BY id", v.tenantID); err != nil {
+		return fmt.Errorf("error Select api_token: tenantID=%d, %w", v.tenantID, err)
+	}
+	ds := make([]APITokenDetail, 0, len(ts))
+	for _, t := range ts {
+		ds = append(ds, apiTokenDetail(t))
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: APITokensHandlerResult{APITokens: ds}})
+}
+
+type APITokenAddHandlerResult struct {
+	APIToken APITokenDetail `json:"api_token"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/api_tokens/add
+// 読み取り専用のAPIトークンを発行する
+// トークンはこのレスポンスでだけ返す
+func apiTokenAddHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	name := c.FormValue("name")
+	if name == "" || len(name) > 255 {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid name")
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("error rand.Read: %w", err)
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	t := APITokenRow{
+		TenantID:    v.tenantID,
+		Name:        name,
+		TokenHash:   hashAPIToken(token),
+		TokenPrefix: token[:len(apiTokenPrefix)+8],
+		CreatedAt:   srv(ctx).clock.Now().Unix(),
+	}
+	res, err := srv(ctx).adminDB.ExecContext(
+		ctx,
+		"INSERT INTO api_token (tenant_id, name, token_hash, token_prefix, created_at) VALUES (?, ?, ?, ?, ?)",
+		t.TenantID, t.Name, t.TokenHash, t.TokenPrefix, t.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("error Insert api_token: tenantID=%d, %w", v.tenantID, err)
+	}
+	if t.ID, err = res.LastInsertId(); err != nil {
+		return fmt.Errorf("error get LastInsertId: %w", err)
+	}
+
+	d := apiTokenDetail(t)
+	d.Token = token
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: APITokenAddHandlerResult{APIToken: d}})
+}
+
+// テナントのAPIトークンを取得する
+func retrieveAPIToken(ctx context.Context, tenantID int64, id string) (*APITokenRow, error) {
+	var t APITokenRow
+	if err := srv(ctx).adminDB.GetContext(ctx, &t, "SELECT * FROM api_token WHERE tenant_id = ? AND id = ?", tenantID, id); err != nil {
+		return nil, fmt.Errorf("error Select api_token: tenantID=%d, id=%s, %w", tenantID, id, err)
+	}
+	return &t, nil
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/api_token/:token_id/revoke
+// APIトークンを失効させる
+func apiTokenRevokeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	t, err := retrieveAPIToken(ctx, v.tenantID, c.Param("token_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "api token not found")
+		}
+		return err
+	}
+	if !t.RevokedAt.Valid {
+		if _, err := srv(ctx).adminDB.ExecContext(
+			ctx,
+			"UPDATE api_token SET revoked_at = ? WHERE id = ?",
+			srv(ctx).clock.Now().Unix(), t.ID,
+		); err != nil {
+			return fmt.Errorf("error Update api_token: id=%d, %w", t.ID, err)
+		}
+	}
+	srv(ctx).apiTokenCache.Delete(t.TokenHash)
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
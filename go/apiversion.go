@@ -0,0 +1,178 @@
+package isuports
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// APIのバージョン
+// /api/v2/... は /api/... と同じハンドラで処理し、レスポンスのJSONをv2の形式に変換して返す
+// ベンチマーカーや既存のクライアントは /api/... のまま今の形式を使い続けられる
+// 形式を変えるときはハンドラではなく apiV2Transforms に変換を追加すること
+
+const (
+	apiVersionContextKey = "api_version"
+	apiVersionHeader     = "X-Isuports-Api-Version"
+	apiV2Prefix          = "/api/v2/"
+)
+
+// v2のレスポンスの変換、順番に適用する
+// bodyはjson.Number を使ってデコードしたSuccessResultかFailureResult
+var apiV2Transforms = []func(body map[string]any){
+	apiV2MovePagination,
+	apiV2FormatTimestamps,
+}
+
+// リクエストのAPIのバージョン
+func apiVersion(c echo.Context) int {
+	if v, ok := c.Get(apiVersionContextKey).(int); ok {
+		return v
+	}
+	return 1
+}
+
+// バージョンに合わせたAPIのパスを返す
+// ページングのリンクなど、クライアントに返すURLに使う
+func versionedAPIPath(c echo.Context, path string) string {
+	if apiVersion(c) == 2 && strings.HasPrefix(path, "/api/") {
+		return apiV2Prefix + strings.TrimPrefix(path, "/api/")
+	}
+	return path
+}
+
+// /api/v2/... を /api/... にルーティングしてレスポンスを変換する
+// ルーティングより前に動かすため e.Pre で使う
+func apiVersionMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if !strings.HasPrefix(req.URL.Path, apiV2Prefix) {
+				if strings.HasPrefix(req.URL.Path, "/api/") {
+					c.Response().Header().Set(apiVersionHeader, "1")
+				}
+				return next(c)
+			}
+			req.URL.Path = "/api/" + strings.TrimPrefix(req.URL.Path, apiV2Prefix)
+			req.URL.RawPath = ""
+			c.Set(apiVersionContextKey, 2)
+			c.Response().Header().Set(apiVersionHeader, "2")
+
+			res := c.Response()
+			w := &apiV2Writer{ResponseWriter: res.Writer}
+			res.Writer = w
+			err := next(c)
+			// エラーのレスポンスはこの後にechoが書くので、元に戻してから返す
+			res.Writer = w.ResponseWriter
+			w.finish()
+			return err
+		}
+	}
+}
+
+// v2のレスポンスを書き込むWriter
+// JSONのレスポンスだけをバッファして変換し、CSVやSSEなどはそのまま書く
+type apiV2Writer struct {
+	http.ResponseWriter
+	buf     bytes.Buffer
+	status  int
+	capture bool
+	written bool
+}
+
+func (w *apiV2Writer) WriteHeader(code int) {
+	if w.written {
+		return
+	}
+	w.written = true
+	w.status = code
+	ct := w.Header().Get(echo.HeaderContentType)
+	w.capture = strings.HasPrefix(ct, echo.MIMEApplicationJSON) && code != http.StatusNoContent && code != http.StatusNotModified
+	if !w.capture {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *apiV2Writer) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.capture {
+		return w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *apiV2Writer) Flush() {
+	if w.capture {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// バッファしたJSONを変換して書き込む
+func (w *apiV2Writer) finish() {
+	if !w.capture {
+		return
+	}
+	b := w.buf.Bytes()
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var body map[string]any
+	if err := dec.Decode(&body); err == nil {
+		for _, t := range apiV2Transforms {
+			t(body)
+		}
+		if converted, err := json.Marshal(body); err == nil {
+			b = append(converted, '\n')
+		}
+	}
+	// 変換できないJSONはそのまま返す
+	w.Header().Del("ETag")
+	w.Header().Set(echo.HeaderContentLength, strconv.Itoa(len(b)))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(b)
+}
+
+// data.pagination をトップレベルの pagination に移す
+func apiV2MovePagination(body map[string]any) {
+	data, ok := body["data"].(map[string]any)
+	if !ok {
+		return
+	}
+	if pg, ok := data["pagination"]; ok {
+		body["pagination"] = pg
+		delete(data, "pagination")
+	}
+}
+
+// unix秒の *_at をRFC3339の文字列にする
+func apiV2FormatTimestamps(body map[string]any) {
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, e := range v {
+				if n, ok := e.(json.Number); ok && strings.HasSuffix(k, "_at") {
+					if sec, err := n.Int64(); err == nil && sec > 0 {
+						v[k] = time.Unix(sec, 0).UTC().Format(time.RFC3339)
+					}
+					continue
+				}
+				walk(e)
+			}
+		case []any:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(body)
+}
@@ -0,0 +1,139 @@
+package isuports
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// テナント管理者の操作の監査ログ
+// 終了した大会のスコアの訂正のように、通常は拒否する操作を許可したときに誰が何のために行ったかを残す
+// テナントDBの audit_log に書き、GET /api/organizer/audit で読める
+
+// AuditLogRow.Action
+const (
+	auditActionScoreCorrection = "score.correction" // 終了した大会のスコアの置き換え (scorecorrection.go を参照)
+)
+
+type AuditLogRow struct {
+	ID        int64  `db:"id"`
+	TenantID  int64  `db:"tenant_id"`
+	Actor     string `db:"actor"` // 操作したテナント管理者 (JWTのsub)
+	Action    string `db:"action"`
+	TargetID  string `db:"target_id"`
+	Detail    string `db:"detail"` // JSON
+	CreatedAt int64  `db:"created_at"`
+}
+
+// 操作と同じトランザクションで書く監査ログ
+type auditEntry struct {
+	actor    string
+	action   string
+	targetID string
+	detail   map[string]any
+}
+
+// 監査ログを書く
+func recordAudit(ctx context.Context, tenantDB dbOrTx, tenantID int64, actor, action, targetID string, detail map[string]any) error {
+	return withRetry(ctx, func() error {
+		return insertAudit(ctx, tenantDB, tenantID, actor, action, targetID, detail)
+	})
+}
+
+// 監査ログを1行書く
+// 操作と同じトランザクションで書く場合はtxを渡し、リトライはトランザクションごと行う
+func insertAudit(ctx context.Context, tenantDB dbOrTx, tenantID int64, actor, action, targetID string, detail map[string]any) error {
+	b, err := json.Marshal(detail)
+	if err != nil {
+		return fmt.Errorf("error json.Marshal: %w", err)
+	}
+	now := srv(ctx).clock.Now().Unix()
+	if _, err := tenantDB.ExecContext(
+		ctx,
+		"INSERT INTO audit_log (tenant_id, actor, action, target_id, detail, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		tenantID, actor, action, targetID, string(b), now,
+	); err != nil {
+		return fmt.Errorf("error Insert audit_log: tenantID=%d, action=%s, targetID=%s, %w", tenantID, action, targetID, err)
+	}
+	return nil
+}
+
+type AuditLogDetail struct {
+	ID        string          `json:"id"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	TargetID  string          `json:"target_id"`
+	Detail    json.RawMessage `json:"detail"`
+	CreatedAt int64           `json:"created_at"`
+}
+
+type AuditLogHandlerResult struct {
+	Pagination Pagination       `json:"pagination"`
+	Logs       []AuditLogDetail `json:"logs"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/audit
+// 監査ログを新しい順に返す
+// カーソルはこのIDより古いログから返すことを表す
+func auditLogHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	page, err := parsePageParams(c, 100, 1000)
+	if err != nil {
+		return err
+	}
+	var beforeID int64
+	if page.cursor != "" {
+		if beforeID, err = strconv.ParseInt(page.cursor, 10, 64); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+		}
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	// 次のページがあるか確かめるため1件多く取得する
+	rows := []AuditLogRow{}
+	if beforeID != 0 {
+		err = tenantDB.SelectContext(ctx, &rows, "SELECT * FROM audit_log WHERE tenant_id = ? AND id < ? ORDER BY id DESC LIMIT ?", v.tenantID, beforeID, page.limit+1)
+	} else {
+		err = tenantDB.SelectContext(ctx, &rows, "SELECT * FROM audit_log WHERE tenant_id = ? ORDER BY id DESC LIMIT ?", v.tenantID, page.limit+1)
+	}
+	if err != nil {
+		return fmt.Errorf("error Select audit_log: tenantID=%d, %w", v.tenantID, err)
+	}
+	var pg Pagination
+	if len(rows) > page.limit {
+		rows = rows[:page.limit]
+		pg.NextCursor = encodeCursor(strconv.FormatInt(rows[len(rows)-1].ID, 10))
+	}
+	pg.setLinks(c)
+
+	logs := make([]AuditLogDetail, 0, len(rows))
+	for _, r := range rows {
+		logs = append(logs, AuditLogDetail{
+			ID:        strconv.FormatInt(r.ID, 10),
+			Actor:     r.Actor,
+			Action:    r.Action,
+			TargetID:  r.TargetID,
+			Detail:    json.RawMessage(r.Detail),
+			CreatedAt: r.CreatedAt,
+		})
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: AuditLogHandlerResult{Pagination: pg, Logs: logs}})
+}
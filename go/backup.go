@@ -0,0 +1,254 @@
+package isuports
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// テナントDBのバックアップ
+// 稼働中でも一貫したコピーが取れるよう、ファイルをコピーするのではなくSQLiteのオンラインバックアップAPIを使う
+
+// バックアップの結果
+type TenantBackupResult struct {
+	TenantID   string `json:"tenant_id"`
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	Compressed bool   `json:"compressed"`
+	ObjectKey  string `json:"object_key,omitempty"` // オブジェクトストレージにも保存した場合のキー
+}
+
+// 1回のステップでコピーするページ数
+// 小さく区切ることで、バックアップ中もスコアの更新を長く止めないようにする
+const backupStepPages = 256
+
+func backupDir() string {
+	return getEnv("ISUCON_BACKUP_DIR", "../backup")
+}
+
+// バックアップAPIを使うため、トレース用のproxyを通さずにSQLiteのコネクションを直接開く
+func openRawSQLiteConn(dsn string) (*sqlite3.SQLiteConn, error) {
+	conn, err := (&sqlite3.SQLiteDriver{}).Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	sc, ok := conn.(*sqlite3.SQLiteConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected sqlite conn type: %T", conn)
+	}
+	return sc, nil
+}
+
+// srcPathのDBをdstPathにバックアップAPIでコピーする
+func sqliteBackup(ctx context.Context, srcPath, dstPath string) error {
+	src, err := openRawSQLiteConn(fmt.Sprintf("file:%s?mode=ro", srcPath))
+	if err != nil {
+		return fmt.Errorf("error open source: path=%s, %w", srcPath, err)
+	}
+	defer src.Close()
+	dst, err := openRawSQLiteConn(fmt.Sprintf("file:%s?mode=rwc", dstPath))
+	if err != nil {
+		return fmt.Errorf("error open destination: path=%s, %w", dstPath, err)
+	}
+	defer dst.Close()
+
+	b, err := dst.Backup("main", src, "main")
+	if err != nil {
+		return fmt.Errorf("error Backup: %w", err)
+	}
+	for {
+		done, err := b.Step(backupStepPages)
+		if err != nil {
+			b.Close()
+			return fmt.Errorf("error Backup.Step: %w", err)
+		}
+		if done {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			b.Close()
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if err := b.Finish(); err != nil {
+		return fmt.Errorf("error Backup.Finish: %w", err)
+	}
+	return nil
+}
+
+// テナントDBのバックアップを取る
+// compressがtrueならgzipで圧縮する
+func backupTenantDB(ctx context.Context, tenantID int64, compress bool) (*TenantBackupResult, error) {
+	dir := backupDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error os.MkdirAll: dir=%s, %w", dir, err)
+	}
+	name := fmt.Sprintf("tenant-%d-%s.db", tenantID, time.Now().UTC().Format("20060102T150405Z"))
+	tmp := filepath.Join(dir, name+".tmp")
+	defer os.Remove(tmp)
+
+	if err := sqliteBackup(ctx, tenantDBPath(tenantID), tmp); err != nil {
+		return nil, fmt.Errorf("error backup tenantID=%d: %w", tenantID, err)
+	}
+
+	dst := filepath.Join(dir, name)
+	if compress {
+		dst += ".gz"
+		if err := gzipFile(tmp, dst); err != nil {
+			return nil, err
+		}
+	} else if err := os.Rename(tmp, dst); err != nil {
+		return nil, fmt.Errorf("error os.Rename: %w", err)
+	}
+
+	st, err := os.Stat(dst)
+	if err != nil {
+		return nil, fmt.Errorf("error os.Stat: path=%s, %w", dst, err)
+	}
+	res := &TenantBackupResult{
+		TenantID:   fmt.Sprint(tenantID),
+		Path:       dst,
+		Size:       st.Size(),
+		Compressed: compress,
+	}
+	// アプリケーションサーバーのディスクだけに置かないよう、設定されていればオブジェクトストレージにも保存する
+	if objectStorage != nil {
+		key, err := uploadTenantBackup(ctx, tenantID, dst)
+		if err != nil {
+			return nil, fmt.Errorf("error uploadTenantBackup: %w", err)
+		}
+		res.ObjectKey = key
+	}
+	return res, nil
+}
+
+// バックアップからテナントDBを復元する
+// .gzで終わるファイルは展開してから使う
+// 復元前にバックアップの整合性を確認し、スコアの更新と重ならないようロックを取ってから書き戻す
+func restoreTenantDB(ctx context.Context, tenantID int64, backupPath string) error {
+	src := backupPath
+	if strings.HasSuffix(backupPath, ".gz") {
+		tmp := filepath.Join(os.TempDir(), fmt.Sprintf("isuports-restore-%d-%d.db", tenantID, time.Now().UnixNano()))
+		if err := gunzipFile(backupPath, tmp); err != nil {
+			return err
+		}
+		defer os.Remove(tmp)
+		src = tmp
+	}
+
+	if err := checkSQLiteIntegrity(ctx, src); err != nil {
+		return fmt.Errorf("invalid backup: path=%s, %w", backupPath, err)
+	}
+
+	// 接続済みのハンドルが古い内容をキャッシュしないよう、ロックを取る前に閉じておく
+	srv(ctx).tenantDBs.remove(tenantID)
+
+	fl, err := lockTenant(ctx, tenantID, lockWrite)
+	if err != nil {
+		return fmt.Errorf("error lockTenant: %w", err)
+	}
+	if err := sqliteBackup(ctx, src, tenantDBPath(tenantID)); err != nil {
+		fl.Close()
+		return fmt.Errorf("error restore tenantID=%d: %w", tenantID, err)
+	}
+	fl.Close()
+
+	// 古いスキーマのバックアップの場合に備えて、次に使うときにマイグレーションさせる
+	srv(ctx).migratedTenants.remove(tenantID)
+	resetTenantCaches(ctx)
+	return nil
+}
+
+// テナントのデータを差し替えたときに、DBから読んだ内容のキャッシュを捨てる
+func resetTenantCaches(ctx context.Context) {
+	srv(ctx).playerCache.Reset()
+	srv(ctx).competitionCache.Reset()
+	srv(ctx).billingReportCache.Reset()
+}
+
+// SQLiteのファイルが壊れていないか確認する
+func checkSQLiteIntegrity(ctx context.Context, path string) error {
+	conn, err := openRawSQLiteConn(fmt.Sprintf("file:%s?mode=ro", path))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rows, err := conn.Query("PRAGMA integrity_check", nil)
+	if err != nil {
+		return fmt.Errorf("error integrity_check: %w", err)
+	}
+	defer rows.Close()
+	dest := make([]driver.Value, 1)
+	if err := rows.Next(dest); err != nil {
+		return fmt.Errorf("error integrity_check: %w", err)
+	}
+	var result string
+	switch v := dest[0].(type) {
+	case string:
+		result = v
+	case []byte:
+		result = string(v)
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity_check failed: %s", result)
+	}
+	return nil
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error os.Open: path=%s, %w", src, err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error os.Create: path=%s, %w", dst, err)
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("error gzip: path=%s, %w", dst, err)
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("error gzip: path=%s, %w", dst, err)
+	}
+	return out.Close()
+}
+
+func gunzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error os.Open: path=%s, %w", src, err)
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("error gzip.NewReader: path=%s, %w", src, err)
+	}
+	defer zr.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error os.Create: path=%s, %w", dst, err)
+	}
+	if _, err := io.Copy(out, zr); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("error gunzip: path=%s, %w", src, err)
+	}
+	return out.Close()
+}
@@ -4,9 +4,21 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"strconv"
 
-	"github.com/logica0419/helpisu"
+	"github.com/jmoiron/sqlx"
+)
+
+// 課金の計算
+// テナントの請求金額は、大会ごとに
+//   スコアを登録した参加者 * 100円
+//   スコアを登録せず、大会の終了までにランキングにアクセスした参加者 * 10円
+// を合計したもの
+
+const (
+	billingPlayerUnitYen  = 100 // スコアを登録した参加者は100円
+	billingVisitorUnitYen = 10  // ランキングを閲覧だけした(スコアを登録していない)参加者は10円
 )
 
 type BillingReport struct {
@@ -17,6 +29,8 @@ type BillingReport struct {
 	BillingPlayerYen  int64  `json:"billing_player_yen"`  // 請求金額 スコアを登録した参加者分
 	BillingVisitorYen int64  `json:"billing_visitor_yen"` // 請求金額 ランキングを閲覧だけした(スコアを登録していない)参加者分
 	BillingYen        int64  `json:"billing_yen"`         // 合計請求金額
+	FinishedAt        int64  `json:"finished_at,omitempty"`
+	FinishedAtRFC3339 string `json:"finished_at_rfc3339,omitempty"` // テナントのタイムゾーン、キャッシュには入れずにレスポンスを返すときに埋める
 }
 
 type VisitHistoryRow struct {
@@ -27,6 +41,11 @@ type VisitHistoryRow struct {
 	UpdatedAt     int64  `db:"updated_at"`
 }
 
+type ScoredPlayer struct {
+	ID            string `db:"pid"`
+	CompetitionID string `db:"competition_id"`
+}
+
 type VisitHistorySummaryRow struct {
 	PlayerID      string `db:"player_id"`
 	MinCreatedAt  int64  `db:"min_created_at"`
@@ -34,101 +53,210 @@ type VisitHistorySummaryRow struct {
 	TenantID      int64  `db:"tenant_id"`
 }
 
-var vhsCache = helpisu.NewCache[int64, []VisitHistorySummaryRow]()
-var scoredPlayerCache = helpisu.NewCache[int64, []ScoredPlayer]()
+// 課金レポートを計算するための読み取り専用のスナップショット
+// 作成してからCloseするまでテナントの共有ロック (lockTenant の lockRead) を持ち続けるので、
+// スコアの置き換えや大会の終了 (排他ロックを取る) は課金レポートの計算と重ならない
+// 課金レポートのキャッシュもロックを持っている間に書くので、大会の終了で消したものが古い値で書き戻されることはない
+type billingSnapshot struct {
+	*sqlx.Tx
+	fl io.Closer
+}
 
-var billingReportCache = helpisu.NewCache[string, BillingReport]()
+// 使い終わったら必ず呼ぶこと
+func (s *billingSnapshot) Close() error {
+	err := s.Tx.Rollback()
+	s.fl.Close()
+	return err
+}
 
-// 大会ごとの課金レポートを計算する
-func billingReportByCompetition(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string) (*BillingReport, error) {
-	billingReport, ok := billingReportCache.Get(strconv.Itoa(int(tenantID)) + competitionID)
-	if ok {
-		return &billingReport, nil
+// 課金レポートを計算するためのスナップショットを開始する
+// ロックを取る必要があるので、connectToTenantDBの後に、ロックを持っていない状態で呼ぶこと
+func beginBillingSnapshot(ctx context.Context, tenantDB *tenantDBConn, tenantID int64) (*billingSnapshot, error) {
+	// 参加者数はplayer_scoreから数えるので、ライブモードの大会のスコアを先に書き出しておく
+	if err := srv(ctx).liveScores.flushTenant(ctx, tenantDB, tenantID); err != nil {
+		return nil, fmt.Errorf("error liveScores.flushTenant: %w", err)
 	}
-
-	comp, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	fl, err := lockTenant(ctx, tenantID, lockRead)
 	if err != nil {
-		return nil, fmt.Errorf("error retrieveCompetition: %w", err)
+		return nil, fmt.Errorf("error lockTenant: %w", err)
 	}
 
-	// ランキングにアクセスした参加者のIDを取得する
-	vhs, ok := vhsCache.Get(tenantID)
-	if !ok {
-		if err := adminDB.SelectContext(
-			ctx,
-			&vhs,
-			"SELECT player_id, MIN(created_at) AS min_created_at, competition_id FROM visit_history WHERE tenant_id = ? GROUP BY player_id, competition_id",
-			tenantID,
-		); err != nil && err != sql.ErrNoRows {
-			return nil, fmt.Errorf("error Select visit_history: tenantID=%d, competitionID=%s, %w", tenantID, comp.ID, err)
-		}
+	tx, err := tenantDB.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		fl.Close()
+		return nil, fmt.Errorf("error BeginTxx: tenantID=%d, %w", tenantID, err)
 	}
-	billingMap := map[string]string{}
-	for i := range vhs {
-		if vhs[i].CompetitionID != comp.ID {
+	return &billingSnapshot{Tx: tx, fl: fl}, nil
+}
+
+// テナントの大会ごとの課金レポートをまとめて計算する
+// 訪問履歴とスコアを登録した参加者はテナント単位で1回ずつ取得し、集計は aggregateBillingReports で行う
+// tenantDBにはbeginBillingSnapshotで開始したトランザクションを渡す
+// 返り値はcompsと同じ順序
+func billingReportsByTenant(ctx context.Context, tenantDB dbOrTx, tenantID int64, comps []CompetitionRow) ([]BillingReport, error) {
+	reports := make([]BillingReport, len(comps))
+	// キャッシュにない大会
+	pending := make([]CompetitionRow, 0, len(comps))
+	pendingIndexes := make([]int, 0, len(comps))
+	for i, comp := range comps {
+		report, ok := srv(ctx).billingReportCache.Get(strconv.Itoa(int(tenantID)) + comp.ID)
+		billingReportCacheStats.record(ok)
+		if ok {
+			reports[i] = report
 			continue
 		}
+		pending = append(pending, comp)
+		pendingIndexes = append(pendingIndexes, i)
+	}
+	if len(pending) == 0 {
+		return reports, nil
+	}
 
-		// competition.finished_atよりもあとの場合は、終了後に訪問したとみなして大会開催内アクセス済みとみなさない
-		if comp.FinishedAt.Valid && comp.FinishedAt.Int64 < vhs[i].MinCreatedAt {
+	// 終了した時に確定した課金レポートがあればそれを使う (competitionfinish.go を参照)
+	results, err := competitionResultsByTenant(ctx, tenantDB, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	unfrozen := pending[:0]
+	unfrozenIndexes := pendingIndexes[:0]
+	for j, comp := range pending {
+		i := pendingIndexes[j]
+		if r, ok := results[comp.ID]; ok && comp.FinishedAt.Valid && r.FinishedAt == comp.FinishedAt.Int64 {
+			reports[i] = r.billingReport(comp)
+			srv(ctx).billingReportCache.Set(strconv.Itoa(int(tenantID))+comp.ID, reports[i])
 			continue
 		}
-		billingMap[vhs[i].PlayerID] = "visitor"
+		unfrozen = append(unfrozen, comp)
+		unfrozenIndexes = append(unfrozenIndexes, i)
+	}
+	pending, pendingIndexes = unfrozen, unfrozenIndexes
+	if len(pending) == 0 {
+		return reports, nil
 	}
-	vhsCache.Set(tenantID, vhs)
 
-	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
-	fl, err := flockByTenantID(tenantID)
-	if err != nil {
-		return nil, fmt.Errorf("error flockByTenantID: %w", err)
+	// ランキングにアクセスした参加者のIDを取得する
+	vhs := []VisitHistorySummaryRow{}
+	if err := srv(ctx).adminReadDB.SelectContext(
+		ctx,
+		&vhs,
+		"SELECT player_id, MIN(created_at) AS min_created_at, competition_id FROM visit_history WHERE tenant_id = ? GROUP BY player_id, competition_id",
+		tenantID,
+	); err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("error Select visit_history: tenantID=%d, %w", tenantID, err)
 	}
-	defer fl.Close()
 
 	// スコアを登録した参加者のIDを取得する
-	scoredPlayers, ok := scoredPlayerCache.Get(tenantID)
-	if !ok {
-		if err := tenantDB.SelectContext(
-			ctx,
-			&scoredPlayers,
-			"SELECT DISTINCT(player_id) AS pid, competition_id FROM player_score WHERE tenant_id = ?",
-			tenantID, comp.ID,
-		); err != nil && err != sql.ErrNoRows {
-			return nil, fmt.Errorf("error Select count player_score: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
-		}
+	scoredPlayers := []ScoredPlayer{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&scoredPlayers,
+		"SELECT DISTINCT player_id AS pid, competition_id FROM player_score WHERE tenant_id = ?",
+		tenantID,
+	); err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("error Select player_score: tenantID=%d, %w", tenantID, err)
 	}
-	for i := range scoredPlayers {
-		if scoredPlayers[i].CompetitionID != comp.ID {
-			continue
-		}
 
-		// スコアが登録されている参加者
-		billingMap[scoredPlayers[i].ID] = "player"
+	for j, report := range aggregateBillingReports(pending, vhs, scoredPlayers) {
+		i := pendingIndexes[j]
+		reports[i] = report
+		srv(ctx).billingReportCache.Set(strconv.Itoa(int(tenantID))+comps[i].ID, report)
 	}
+	return reports, nil
+}
 
-	// 大会が終了している場合のみ請求金額が確定するので計算する
-	var playerCount, visitorCount int64
-	if comp.FinishedAt.Valid {
-		for _, category := range billingMap {
-			switch category {
-			case "player":
-				playerCount++
-			case "visitor":
-				visitorCount++
-			}
+// 大会ごとの課金レポートを集計する
+// DBやキャッシュを参照しないので、同じ入力には常に同じレポートを返す
+//   - 大会が終了していなければ請求金額は確定していないので0円
+//   - スコアを登録した参加者は1人100円
+//   - スコアを登録せず、大会の終了までにランキングにアクセスした参加者は1人10円
+//
+// visitsとscoredには他の大会の行が含まれていてもよい、返り値はcompsと同じ順序
+func aggregateBillingReports(comps []CompetitionRow, visits []VisitHistorySummaryRow, scored []ScoredPlayer) []BillingReport {
+	// 大会ごとのスコアを登録した参加者と、アクセスした参加者
+	players := make(map[string]map[string]struct{}, len(comps))
+	visitors := make(map[string]map[string]struct{}, len(comps))
+	finishedAt := make(map[string]int64, len(comps))
+	for _, comp := range comps {
+		if !comp.FinishedAt.Valid {
+			continue
 		}
+		players[comp.ID] = map[string]struct{}{}
+		visitors[comp.ID] = map[string]struct{}{}
+		finishedAt[comp.ID] = comp.FinishedAt.Int64
 	}
 
-	billingReport = BillingReport{
-		CompetitionID:     comp.ID,
-		CompetitionTitle:  comp.Title,
-		PlayerCount:       playerCount,
-		VisitorCount:      visitorCount,
-		BillingPlayerYen:  100 * playerCount, // スコアを登録した参加者は100円
-		BillingVisitorYen: 10 * visitorCount, // ランキングを閲覧だけした(スコアを登録していない)参加者は10円
-		BillingYen:        100*playerCount + 10*visitorCount,
+	for _, sp := range scored {
+		if m, ok := players[sp.CompetitionID]; ok {
+			m[sp.ID] = struct{}{}
+		}
+	}
+	for _, vh := range visits {
+		m, ok := visitors[vh.CompetitionID]
+		if !ok {
+			continue
+		}
+		// competition.finished_atよりもあとの場合は、終了後に訪問したとみなして大会開催内アクセス済みとみなさない
+		if finishedAt[vh.CompetitionID] < vh.MinCreatedAt {
+			continue
+		}
+		if _, ok := players[vh.CompetitionID][vh.PlayerID]; ok {
+			continue
+		}
+		m[vh.PlayerID] = struct{}{}
 	}
 
-	billingReportCache.Set(strconv.Itoa(int(tenantID))+competitionID, billingReport)
+	reports := make([]BillingReport, len(comps))
+	for i, comp := range comps {
+		playerCount := int64(len(players[comp.ID]))
+		visitorCount := int64(len(visitors[comp.ID]))
+		reports[i] = BillingReport{
+			CompetitionID:     comp.ID,
+			CompetitionTitle:  comp.Title,
+			PlayerCount:       playerCount,
+			VisitorCount:      visitorCount,
+			BillingPlayerYen:  billingPlayerUnitYen * playerCount,
+			BillingVisitorYen: billingVisitorUnitYen * visitorCount,
+			BillingYen:        billingPlayerUnitYen*playerCount + billingVisitorUnitYen*visitorCount,
+			FinishedAt:        finishedAt[comp.ID],
+		}
+	}
+	return reports
+}
 
-	return &billingReport, nil
+// テナントの全ての大会の請求金額を合計する
+// SaaS管理者向けの課金レポート (tenantsBillingHandler) で使う
+func tenantBilling(ctx context.Context, t TenantRow) (TenantWithBilling, error) {
+	tb := TenantWithBilling{
+		ID:          strconv.FormatInt(t.ID, 10),
+		Name:        t.Name,
+		DisplayName: t.DisplayName,
+		tenantID:    t.ID,
+	}
+	tenantDB, err := connectToTenantDB(ctx, t.ID)
+	if err != nil {
+		return tb, fmt.Errorf("failed to connectToTenantDB: %w", err)
+	}
+	defer tenantDB.Close()
+	tx, err := beginBillingSnapshot(ctx, tenantDB, t.ID)
+	if err != nil {
+		return tb, fmt.Errorf("failed to beginBillingSnapshot: %w", err)
+	}
+	defer tx.Close()
+	cs := []CompetitionRow{}
+	if err := tx.SelectContext(
+		ctx,
+		&cs,
+		"SELECT * FROM competition WHERE tenant_id=?",
+		t.ID,
+	); err != nil {
+		return tb, fmt.Errorf("failed to Select competition: %w", err)
+	}
+	reports, err := billingReportsByTenant(ctx, tx, t.ID, cs)
+	if err != nil {
+		return tb, fmt.Errorf("failed to billingReportsByTenant: %w", err)
+	}
+	for _, report := range reports {
+		tb.BillingYen += report.BillingYen
+	}
+	return tb, nil
 }
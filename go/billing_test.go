@@ -0,0 +1,285 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAggregateBillingReports(t *testing.T) {
+	finished := func(id string, at int64) CompetitionRow {
+		return CompetitionRow{ID: id, Title: "title-" + id, FinishedAt: sql.NullInt64{Int64: at, Valid: true}}
+	}
+	running := func(id string) CompetitionRow {
+		return CompetitionRow{ID: id, Title: "title-" + id}
+	}
+	visit := func(playerID, compID string, at int64) VisitHistorySummaryRow {
+		return VisitHistorySummaryRow{PlayerID: playerID, CompetitionID: compID, MinCreatedAt: at, TenantID: 1}
+	}
+	scored := func(playerID, compID string) ScoredPlayer {
+		return ScoredPlayer{ID: playerID, CompetitionID: compID}
+	}
+	report := func(comp CompetitionRow, players, visitors int64) BillingReport {
+		return BillingReport{
+			CompetitionID:     comp.ID,
+			CompetitionTitle:  comp.Title,
+			PlayerCount:       players,
+			VisitorCount:      visitors,
+			BillingPlayerYen:  100 * players,
+			BillingVisitorYen: 10 * visitors,
+			BillingYen:        100*players + 10*visitors,
+			FinishedAt:        comp.FinishedAt.Int64,
+		}
+	}
+
+	c1 := finished("c1", 1000)
+	c2 := finished("c2", 2000)
+	c3 := running("c3")
+
+	tests := []struct {
+		name   string
+		comps  []CompetitionRow
+		visits []VisitHistorySummaryRow
+		scored []ScoredPlayer
+		want   []BillingReport
+	}{
+		{
+			name:  "no visits and no scores",
+			comps: []CompetitionRow{c1},
+			want:  []BillingReport{report(c1, 0, 0)},
+		},
+		{
+			name:   "visit before finish is billed",
+			comps:  []CompetitionRow{c1},
+			visits: []VisitHistorySummaryRow{visit("p1", "c1", 999)},
+			want:   []BillingReport{report(c1, 0, 1)},
+		},
+		{
+			name:   "visit at finish is billed",
+			comps:  []CompetitionRow{c1},
+			visits: []VisitHistorySummaryRow{visit("p1", "c1", 1000)},
+			want:   []BillingReport{report(c1, 0, 1)},
+		},
+		{
+			name:   "visit after finish is not billed",
+			comps:  []CompetitionRow{c1},
+			visits: []VisitHistorySummaryRow{visit("p1", "c1", 1001)},
+			want:   []BillingReport{report(c1, 0, 0)},
+		},
+		{
+			name:   "player who only scored",
+			comps:  []CompetitionRow{c1},
+			scored: []ScoredPlayer{scored("p1", "c1"), scored("p2", "c1")},
+			want:   []BillingReport{report(c1, 2, 0)},
+		},
+		{
+			name:   "player who scored and visited is billed once as a player",
+			comps:  []CompetitionRow{c1},
+			visits: []VisitHistorySummaryRow{visit("p1", "c1", 500), visit("p2", "c1", 500)},
+			scored: []ScoredPlayer{scored("p1", "c1")},
+			want:   []BillingReport{report(c1, 1, 1)},
+		},
+		{
+			name:   "player who scored and visited after finish",
+			comps:  []CompetitionRow{c1},
+			visits: []VisitHistorySummaryRow{visit("p1", "c1", 1500)},
+			scored: []ScoredPlayer{scored("p1", "c1")},
+			want:   []BillingReport{report(c1, 1, 0)},
+		},
+		{
+			name:   "duplicate rows are counted once",
+			comps:  []CompetitionRow{c1},
+			visits: []VisitHistorySummaryRow{visit("p1", "c1", 100), visit("p1", "c1", 200)},
+			scored: []ScoredPlayer{scored("p2", "c1"), scored("p2", "c1")},
+			want:   []BillingReport{report(c1, 1, 1)},
+		},
+		{
+			name:   "unfinished competition is not billed",
+			comps:  []CompetitionRow{c3},
+			visits: []VisitHistorySummaryRow{visit("p1", "c3", 100)},
+			scored: []ScoredPlayer{scored("p2", "c3")},
+			want:   []BillingReport{report(c3, 0, 0)},
+		},
+		{
+			name:  "rows of other competitions are ignored",
+			comps: []CompetitionRow{c1},
+			visits: []VisitHistorySummaryRow{
+				visit("p1", "c2", 100),
+				visit("p2", "unknown", 100),
+			},
+			scored: []ScoredPlayer{scored("p3", "c2"), scored("p4", "unknown")},
+			want:   []BillingReport{report(c1, 0, 0)},
+		},
+		{
+			name:  "reports are in the order of comps and split by competition",
+			comps: []CompetitionRow{c3, c2, c1},
+			visits: []VisitHistorySummaryRow{
+				visit("p1", "c1", 900),
+				visit("p1", "c2", 1900),
+				visit("p2", "c2", 2100),
+				visit("p3", "c3", 100),
+			},
+			scored: []ScoredPlayer{scored("p2", "c1"), scored("p3", "c3")},
+			want: []BillingReport{
+				report(c3, 0, 0),
+				report(c2, 0, 1),
+				report(c1, 1, 1),
+			},
+		},
+		{
+			name:  "no competitions",
+			comps: []CompetitionRow{},
+			want:  []BillingReport{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := aggregateBillingReports(tt.comps, tt.visits, tt.scored)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("aggregateBillingReports() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// スコアのCSVを作る、全員のスコアをscoreにする
+func testScoreCSV(playerIDs []string, score int64) string {
+	var b strings.Builder
+	b.WriteString("player_id,score\n")
+	for _, id := range playerIDs {
+		fmt.Fprintf(&b, "%s,%d\n", id, score)
+	}
+	return b.String()
+}
+
+// スコアのアップロードと課金レポートの計算を同時に行っても、課金レポートの計算は置き換えの途中のスコアを読まない
+//   - 開催中の大会: 同じスナップショットで読んだplayer_scoreが、いずれかのアップロードの全行と一致する
+//   - 終了した大会の訂正: 課金レポートの参加者数が、訂正前か訂正後のどちらかの人数になる
+func TestBillingDoesNotSeeHalfAppliedUpload(t *testing.T) {
+	ctx, _ := newTestServer(t)
+
+	players := make([]string, 50)
+	for i := range players {
+		players[i] = fmt.Sprintf("p%03d", i)
+	}
+	insertTestPlayers(t, ctx, players...)
+	insertTestCompetition(t, ctx, "running", 0)
+	insertTestCompetition(t, ctx, "finished", testNow.Unix())
+	// 訂正は30人と50人を交互に登録する
+	corrections := [][]string{players[:30], players}
+
+	const uploads = 20
+	const readers = 4
+	errs := make(chan error, uploads*2+readers)
+	done := make(chan struct{})
+
+	var writers sync.WaitGroup
+	writers.Add(2)
+	go func() {
+		defer writers.Done()
+		for gen := 1; gen <= uploads; gen++ {
+			ctx := withRequestID(ctx, fmt.Sprintf("upload-running-%d", gen))
+			tenantDB, err := connectToTenantDB(ctx, testTenantID)
+			if err != nil {
+				errs <- err
+				return
+			}
+			_, _, err = importScores(ctx, tenantDB, testTenantID, "running", scoreImportOptions{}, strings.NewReader(testScoreCSV(players, int64(gen))), ingestFormatCSV)
+			tenantDB.Close()
+			if err != nil {
+				errs <- fmt.Errorf("upload running gen=%d: %w", gen, err)
+			}
+		}
+	}()
+	go func() {
+		defer writers.Done()
+		for gen := 1; gen <= uploads; gen++ {
+			ctx := withRequestID(ctx, fmt.Sprintf("upload-finished-%d", gen))
+			tenantDB, err := connectToTenantDB(ctx, testTenantID)
+			if err != nil {
+				errs <- err
+				return
+			}
+			csv := testScoreCSV(corrections[gen%2], int64(gen))
+			_, _, err = importScores(ctx, tenantDB, testTenantID, "finished", scoreImportOptions{allowFinished: true}, strings.NewReader(csv), ingestFormatCSV)
+			tenantDB.Close()
+			if err != nil {
+				errs <- fmt.Errorf("upload finished gen=%d: %w", gen, err)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				ctx := withRequestID(ctx, fmt.Sprintf("billing-%d-%d", r, i))
+				if err := checkBillingSnapshot(ctx, len(players), len(corrections[0])); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(r)
+	}
+
+	writers.Wait()
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// 課金レポートの計算と同じスナップショットで、アップロードが全て反映されているか、全く反映されていないかを確かめる
+func checkBillingSnapshot(ctx context.Context, runningPlayers, fewerPlayers int) error {
+	tenantDB, err := connectToTenantDB(ctx, testTenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	tbrs, err := tenantBillingReports(ctx, tenantDB, testTenantID)
+	if err != nil {
+		return fmt.Errorf("error tenantBillingReports: %w", err)
+	}
+	for _, r := range tbrs {
+		if r.CompetitionID == "finished" && r.PlayerCount != 0 && r.PlayerCount != int64(fewerPlayers) && r.PlayerCount != int64(runningPlayers) {
+			return fmt.Errorf("billing saw a half-applied correction: player_count=%d", r.PlayerCount)
+		}
+	}
+
+	tx, err := beginBillingSnapshot(ctx, tenantDB, testTenantID)
+	if err != nil {
+		return fmt.Errorf("error beginBillingSnapshot: %w", err)
+	}
+	defer tx.Close()
+	var counts []struct {
+		Score int64 `db:"score"`
+		Count int64 `db:"count"`
+	}
+	if err := tx.SelectContext(
+		ctx,
+		&counts,
+		"SELECT score, COUNT(*) AS count FROM player_score WHERE tenant_id = ? AND competition_id = ? GROUP BY score",
+		testTenantID, "running",
+	); err != nil {
+		return fmt.Errorf("error Select player_score: %w", err)
+	}
+	// まだ1度もアップロードしていないか、1回分のアップロードの全行
+	if len(counts) > 1 || (len(counts) == 1 && counts[0].Count != int64(runningPlayers)) {
+		return fmt.Errorf("billing snapshot saw a half-applied upload: %+v", counts)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package isuports
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// リクエストの読み取りと検証
+// ハンドラはフォームやクエリを c.FormValue などで個別に読む代わりに、タグをつけた構造体に bindRequest で読み込む
+//   param, query, form: echoのBindと同じ、queryはPOSTでも読む
+//   validate: カンマ区切りの規則
+//     required   空を許さない
+//     min=N      数値は値の下限、文字列は文字数の下限
+//     max=N      数値は値の上限、文字列は文字数の上限
+//     pattern=名前  requestPatterns の正規表現に一致すること
+// 問題のあるフィールドは環境によらず一覧 (FieldError) で400を返す
+
+// 検証に失敗したときの FailureResult.Code
+const errorCodeInvalidRequest = "invalid_request"
+
+// FieldError.Code
+const (
+	fieldErrRequired = "required"
+	fieldErrInvalid  = "invalid" // 型が合わない、パターンに一致しない
+	fieldErrMin      = "min"
+	fieldErrMax      = "max"
+)
+
+// validate の pattern で使える正規表現
+var requestPatterns = map[string]*regexp.Regexp{
+	"tenant_name":        tenantNameRegexp,
+	"season_aggregation": regexp.MustCompile(`^(sum|best)$`),
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// 検証に失敗したリクエスト
+// errorResponseHandler がフィールドの一覧をつけて400を返す
+type requestError struct {
+	fields []FieldError
+}
+
+func (e *requestError) Error() string {
+	msgs := make([]string, 0, len(e.fields))
+	for _, f := range e.fields {
+		msgs = append(msgs, f.Message)
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// 失敗した取り込みの通知などで、他のバリデーションと同じく400として扱えるようにする
+func (e *requestError) Unwrap() error {
+	return echo.NewHTTPError(http.StatusBadRequest, e.Error())
+}
+
+type InvalidRequestResult struct {
+	FailureResult
+	Errors []FieldError `json:"errors"`
+}
+
+func invalidRequest(c echo.Context, re *requestError) error {
+	return c.JSON(http.StatusBadRequest, InvalidRequestResult{
+		FailureResult: FailureResult{
+			Status:  false,
+			Message: re.Error(),
+			Code:    errorCodeInvalidRequest,
+		},
+		Errors: re.fields,
+	})
+}
+
+// リクエストのパラメータをreqに読み込んで検証する
+// reqは構造体へのポインタ
+func bindRequest(c echo.Context, req any) error {
+	// echoのBindは型の合わない値をフィールド名なしのエラーにするので、先に確かめる
+	if fields := checkRequestTypes(c, req); len(fields) > 0 {
+		return &requestError{fields: fields}
+	}
+	b := &echo.DefaultBinder{}
+	if err := b.BindPathParams(c, req); err != nil {
+		return fmt.Errorf("error BindPathParams: %w", err)
+	}
+	if err := b.BindQueryParams(c, req); err != nil {
+		return fmt.Errorf("error BindQueryParams: %w", err)
+	}
+	if c.Request().Method != http.MethodGet {
+		if err := b.BindBody(c, req); err != nil {
+			return fmt.Errorf("error BindBody: %w", err)
+		}
+	}
+	return c.Validate(req)
+}
+
+// リクエストのパラメータの名前と値
+func requestParam(c echo.Context, f reflect.StructField) (string, string, bool) {
+	if name := f.Tag.Get("param"); name != "" {
+		return name, c.Param(name), true
+	}
+	if name := f.Tag.Get("form"); name != "" {
+		return name, c.FormValue(name), true
+	}
+	if name := f.Tag.Get("query"); name != "" {
+		return name, c.QueryParam(name), true
+	}
+	return "", "", false
+}
+
+// 数値と真偽値のフィールドに読めない値が渡されていないか確かめる
+func checkRequestTypes(c echo.Context, req any) []FieldError {
+	var fields []FieldError
+	t := reflect.TypeOf(req).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, value, ok := requestParam(c, f)
+		if !ok || value == "" {
+			continue
+		}
+		var err error
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			_, err = strconv.ParseInt(value, 10, 64)
+		case reflect.Bool:
+			_, err = strconv.ParseBool(value)
+		default:
+			continue
+		}
+		if err != nil {
+			fields = append(fields, FieldError{Field: name, Code: fieldErrInvalid, Message: fmt.Sprintf("%s: invalid value %q", name, value)})
+		}
+	}
+	return fields
+}
+
+// validate のタグで検証する
+// e.Validator に登録して c.Validate から呼ばれる
+type requestValidator struct{}
+
+func (requestValidator) Validate(i any) error {
+	v := reflect.ValueOf(i).Elem()
+	t := v.Type()
+	var fields []FieldError
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		rules := f.Tag.Get("validate")
+		if rules == "" {
+			continue
+		}
+		name := f.Tag.Get("param") + f.Tag.Get("form") + f.Tag.Get("query")
+		if name == "" {
+			name = f.Name
+		}
+		if fe := validateField(name, v.Field(i), rules); fe != nil {
+			fields = append(fields, *fe)
+		}
+	}
+	if len(fields) > 0 {
+		return &requestError{fields: fields}
+	}
+	return nil
+}
+
+// 1つのフィールドを検証し、最初に満たさなかった規則を返す
+func validateField(name string, v reflect.Value, rules string) *FieldError {
+	for _, rule := range strings.Split(rules, ",") {
+		key, arg, _ := strings.Cut(rule, "=")
+		switch key {
+		case "required":
+			if v.IsZero() {
+				return &FieldError{Field: name, Code: fieldErrRequired, Message: fmt.Sprintf("%s is required", name)}
+			}
+		case "min", "max":
+			limit, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				panic(fmt.Sprintf("invalid validate rule: %s", rule))
+			}
+			var n int64
+			switch v.Kind() {
+			case reflect.String:
+				n = int64(utf8.RuneCountInString(v.String()))
+			case reflect.Int, reflect.Int32, reflect.Int64:
+				n = v.Int()
+			default:
+				panic(fmt.Sprintf("invalid validate rule for %s: %s", v.Kind(), rule))
+			}
+			if key == "min" && n < limit {
+				return &FieldError{Field: name, Code: fieldErrMin, Message: fmt.Sprintf("%s must be at least %d", name, limit)}
+			}
+			if key == "max" && n > limit {
+				return &FieldError{Field: name, Code: fieldErrMax, Message: fmt.Sprintf("%s must be at most %d", name, limit)}
+			}
+		case "pattern":
+			re, ok := requestPatterns[arg]
+			if !ok {
+				panic(fmt.Sprintf("unknown validate pattern: %s", arg))
+			}
+			// 空の値はrequiredで検証する
+			if s := v.String(); s != "" && !re.MatchString(s) {
+				return &FieldError{Field: name, Code: fieldErrInvalid, Message: fmt.Sprintf("invalid %s: %s", name, s)}
+			}
+		default:
+			panic(fmt.Sprintf("unknown validate rule: %s", rule))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package isuports
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// リクエストボディのサイズの上限
+// CSVのアップロードで大きすぎるボディを送られてもメモリを使い切らないようにする
+// 上限はバイト数で指定し、0以下なら制限しない
+func bodyLimit(key string, defaultLimit int) echo.MiddlewareFunc {
+	limit := int64(getEnvInt(key, defaultLimit))
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if limit <= 0 {
+			return next
+		}
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.ContentLength > limit {
+				return bodyTooLargeError(limit)
+			}
+			// Content-Lengthがない場合や偽っている場合に備えて、読み込みながら数える
+			lr := &limitedBody{ReadCloser: req.Body, remaining: limit}
+			req.Body = lr
+			err := next(c)
+			if lr.exceeded {
+				// multipartのパースなどでラップされたエラーは500になってしまうので413に変換する
+				return bodyTooLargeError(limit)
+			}
+			return err
+		}
+	}
+}
+
+func bodyTooLargeError(limit int64) error {
+	return echo.NewHTTPError(
+		http.StatusRequestEntityTooLarge,
+		fmt.Sprintf("request body too large: limit=%d bytes", limit),
+	)
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		b.exceeded = true
+		return 0, fmt.Errorf("request body too large")
+	}
+	// 上限ちょうどのボディを許すため、1バイト余分に読んで超えたかどうかを判定する
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		b.exceeded = true
+		return n, fmt.Errorf("request body too large")
+	}
+	return n, err
+}
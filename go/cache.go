@@ -0,0 +1,133 @@
+package isuports
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// テナントごとのキャッシュのキー
+// IDはテナントをまたいで一意とは限らないのでテナントIDと組にする
+type tenantKey struct {
+	tenantID int64
+	id       string
+}
+
+// 有効期限つきのキャッシュ
+// helpisu.Cacheと同じ使い方で、Setしてからttl経過したものはGetで返さない
+type ttlCache[K comparable, V any] struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	entries map[K]ttlCacheEntry[V]
+	stats   cacheStats
+}
+
+type ttlCacheEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+// ttlが0以下ならキャッシュしない
+func newTTLCache[K comparable, V any](ttl time.Duration) *ttlCache[K, V] {
+	return &ttlCache[K, V]{
+		ttl:     ttl,
+		entries: map[K]ttlCacheEntry[V]{},
+	}
+}
+
+func (c *ttlCache[K, V]) Get(key K) (V, bool) {
+	c.mu.RLock()
+	e, ok := c.entries[key]
+	c.mu.RUnlock()
+	if ok && time.Now().After(e.expiresAt) {
+		ok = false
+	}
+	c.stats.record(ok)
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return e.value, true
+}
+
+func (c *ttlCache[K, V]) Set(key K, value V) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = ttlCacheEntry[V]{value: value, expiresAt: time.Now().Add(c.ttl)}
+}
+
+func (c *ttlCache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+func (c *ttlCache[K, V]) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[K]ttlCacheEntry[V]{}
+}
+
+func (c *ttlCache[K, V]) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
+
+// 管理APIから状態の確認と破棄ができるキャッシュ
+// キャッシュを追加したらここにも登録すること
+type managedCache struct {
+	name  string
+	size  func() int // 件数を数えられないキャッシュはnil
+	stats *cacheStats
+	flush func()
+}
+
+func (s *Server) managedCaches() []managedCache {
+	return []managedCache{
+		{name: "jwt_token", stats: jwtTokenCacheStats, flush: s.jwtVerifier.tokens.Reset},
+		{name: "jwt_key", flush: s.jwtVerifier.keys.Reset},
+		{name: "jwt_signing_key", flush: jwtSigningKeyCache.Reset},
+		{name: "oidc_provider", size: oidcProviderCache.Len, stats: &oidcProviderCache.stats, flush: oidcProviderCache.Reset},
+		{name: "tenant_row", size: s.tenantRowCache.Len, stats: &s.tenantRowCache.stats, flush: s.tenantRowCache.Reset},
+		{name: "api_token", size: s.apiTokenCache.Len, stats: &s.apiTokenCache.stats, flush: s.apiTokenCache.Reset},
+		{name: "allowed_origins", size: s.allowedOriginsCache.Len, stats: &s.allowedOriginsCache.stats, flush: s.allowedOriginsCache.Reset},
+		{name: "player", stats: playerCacheStats, flush: s.playerCache.Reset},
+		{name: "competition", stats: competitionCacheStats, flush: s.competitionCache.Reset},
+		{name: "billing_report", stats: billingReportCacheStats, flush: s.billingReportCache.Reset},
+		{name: "tenant_location", flush: s.tenantLocationCache.Reset},
+		// 使用中のハンドルは返却されたときに閉じられる
+		{name: "tenant_dbs", size: func() int { return s.tenantDBs.stats().Open }, flush: s.tenantDBs.closeAll},
+	}
+}
+
+// キャッシュの状態
+type CacheDetail struct {
+	Name    string  `json:"name"`
+	Size    *int    `json:"size"` // 数えられない場合はnull
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+func (m managedCache) detail(s *Server) CacheDetail {
+	d := CacheDetail{Name: m.name}
+	if m.size != nil {
+		size := m.size()
+		d.Size = &size
+	}
+	if m.name == "tenant_dbs" {
+		ps := s.tenantDBs.stats()
+		d.Hits, d.Misses = ps.Hits, ps.Misses
+	} else if m.stats != nil {
+		d.Hits = atomic.LoadInt64(&m.stats.hits)
+		d.Misses = atomic.LoadInt64(&m.stats.misses)
+	}
+	if total := d.Hits + d.Misses; total > 0 {
+		d.HitRate = float64(d.Hits) / float64(total)
+	}
+	return d
+}
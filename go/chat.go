@@ -0,0 +1,181 @@
+package isuports
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// SlackやDiscordへの通知
+// テナントごとにIncoming WebhookのURLを tenant_setting の chat_webhook_url に設定すると、
+// 大会の終了とスコアのアップロードの失敗を投稿する
+// 投稿の形式はURLのホストで切り替える
+
+const chatWebhookSettingName = "chat_webhook_url"
+
+// テナントが設定したURLに送るので、プライベートなアドレスへの接続を拒否する (outbound.go を参照)
+var chatClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: outboundDialGuard.control,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// DiscordのWebhookのURLか
+func isDiscordWebhook(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	return host == "discord.com" || host == "discordapp.com" || strings.HasSuffix(host, ".discord.com")
+}
+
+// Incoming WebhookのURLとして使えるか
+// IPアドレスで指定されたURLは設定する時点で接続先を検査する (名前で指定されたURLは接続するときに検査する)
+func validChatWebhookURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil || len(s) > 1024 {
+		return false
+	}
+	host := u.Hostname()
+	if strings.EqualFold(host, "localhost") {
+		return false
+	}
+	if net.ParseIP(host) != nil {
+		return outboundDialGuard.control("tcp", net.JoinHostPort(host, "443"), nil) == nil
+	}
+	return true
+}
+
+// メッセージを投稿する
+func postChatMessage(ctx context.Context, webhookURL, text string) error {
+	if !validChatWebhookURL(webhookURL) {
+		// URLにはトークンが入っているのでエラーには含めない
+		return errors.New("invalid chat webhook url")
+	}
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return fmt.Errorf("invalid chat webhook url: %w", err)
+	}
+	var payload map[string]string
+	if isDiscordWebhook(u) {
+		// Discordのcontentは2000文字まで
+		if r := []rune(text); len(r) > 2000 {
+			text = string(r[:2000])
+		}
+		payload = map[string]string{"content": text}
+	} else {
+		payload = map[string]string{"text": text}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error json.Marshal: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := chatClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error post chat message: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("error post chat message: status=%d, %s", res.StatusCode, msg)
+	}
+	return nil
+}
+
+// テナントに設定されていればメッセージを投稿する
+func postTenantChatMessage(ctx context.Context, tenantID int64, text string) error {
+	webhookURL, err := getTenantSetting(ctx, tenantID, chatWebhookSettingName)
+	if err != nil || webhookURL == "" {
+		return err
+	}
+	return postChatMessage(ctx, webhookURL, text)
+}
+
+// スコアのアップロードがバリデーションで失敗したことを投稿する
+func notifyScoreRejectedByChat(ctx context.Context, tenant *TenantRow, comp *CompetitionRow, reason string) error {
+	return postTenantChatMessage(ctx, tenant.ID, fmt.Sprintf(
+		":warning: [%s] 大会「%s」(ID: %s) のスコアのアップロードに失敗しました\n理由: %s",
+		tenant.DisplayName, comp.Title, comp.ID, reason,
+	))
+}
+
+// 大会が終了したことを投稿する
+func notifyCompetitionFinishedByChat(ctx context.Context, tenant *TenantRow, comp *CompetitionRow) error {
+	return postTenantChatMessage(ctx, tenant.ID, fmt.Sprintf(
+		":checkered_flag: [%s] 大会「%s」(ID: %s) が終了しました",
+		tenant.DisplayName, comp.Title, comp.ID,
+	))
+}
+
+type ChatSettingsHandlerResult struct {
+	WebhookURL string `json:"webhook_url"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/chat
+// SlackやDiscordのIncoming WebhookのURLを取得する
+func chatSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	webhookURL, err := getTenantSetting(ctx, v.tenantID, chatWebhookSettingName)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: ChatSettingsHandlerResult{WebhookURL: webhookURL}})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/chat
+// SlackやDiscordのIncoming WebhookのURLを設定する、空にすると投稿しない
+// test=1を指定すると設定後にテストのメッセージを投稿し、失敗した場合は設定しない
+func chatSettingsUpdateHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	webhookURL := c.FormValue("webhook_url")
+	if webhookURL != "" && !validChatWebhookURL(webhookURL) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid webhook_url")
+	}
+	if webhookURL != "" && c.FormValue("test") == "1" {
+		if err := postChatMessage(ctx, webhookURL, fmt.Sprintf(":white_check_mark: [%s] 通知の設定を確認しました", v.tenantName)); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("failed to post test message: %s", err))
+		}
+	}
+	if err := setTenantSetting(ctx, v.tenantID, chatWebhookSettingName, webhookURL); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
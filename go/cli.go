@@ -0,0 +1,381 @@
+package isuports
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// サブコマンド
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{"serve", "HTTPサーバーを起動する (サブコマンド省略時のデフォルト)", nil},
+	{"create-tenant", "テナントを追加する -name NAME -display-name DISPLAY_NAME", runCreateTenant},
+	{"migrate", "管理用DBと全テナントDBのスキーマを最新にし、テナントDBがないテナントは作成する", runMigrate},
+	{"billing-report", "テナントの課金レポートを出力する [-tenant ID]", runBillingReport},
+	{"vacuum-tenants", "テナントDBの整合性チェックとVACUUMを行う [-tenant ID,ID,...]", runVacuumTenants},
+	{"backup", "テナントDBのバックアップを取る -tenant ID [-gzip]", runBackup},
+	{"restore", "バックアップからテナントDBを復元する -tenant ID (-from FILE | -object KEY)", runRestore},
+	{"verify-initial-data", "テナントDBが初期データと同じ内容かSHA-256で確かめる", runVerifyInitialData},
+}
+
+// Main は cmd/isuports/main.go から呼ばれるエントリーポイントです
+// argsはプログラム名を除いた起動引数で、終了コードを返す
+func Main(args []string) int {
+	// コマンド名より前の-configは読み込み済みなので読み飛ばす
+	for len(args) > 0 {
+		if args[0] == "-config" || args[0] == "--config" {
+			args = args[1:]
+			if len(args) > 0 {
+				args = args[1:]
+			}
+		} else if strings.HasPrefix(args[0], "-config=") || strings.HasPrefix(args[0], "--config=") {
+			args = args[1:]
+		} else {
+			break
+		}
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") || args[0] == "serve" {
+		Run()
+		return 0
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != args[0] || cmd.run == nil {
+			continue
+		}
+		if configFileErr != nil {
+			fmt.Fprintf(os.Stderr, "failed to load config file: %s\n", configFileErr)
+			return 1
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+		defer stop()
+		if err := cmd.run(ctx, args[1:]); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return 2
+			}
+			fmt.Fprintf(os.Stderr, "%s: %s\n", cmd.name, err)
+			return 1
+		}
+		return 0
+	}
+
+	printUsage(os.Stderr)
+	return 2
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: isuports [-config FILE] <command> [flags]")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-16s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+// サブコマンドのフラグを作る
+// -configは起動時に読み込み済みなので受け付けるだけにする (config.go を参照)
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.String("config", "", "設定ファイルのパス")
+	return fs
+}
+
+// サブコマンドから管理用DBとテナントDBを使えるようにする
+// 返り値のcontextにServerを入れて返すので、以降はそれを使うこと
+// 返り値の関数で後片付けをすること
+func setupCLI(ctx context.Context) (context.Context, func(), error) {
+	sqliteDriverName, sqlLogger, err := initializeSQLLogger()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error initializeSQLLogger: %w", err)
+	}
+	adminDB, err := connectAdminDB()
+	if err != nil {
+		sqlLogger.Close()
+		return nil, nil, fmt.Errorf("failed to connect db: %w", err)
+	}
+	// 直前の書き込みを読めるようにCLIではレプリカを使わない (NewServerのデフォルト)
+	s := NewServer(adminDB, WithSQLiteDriver(sqliteDriverName))
+	defaultServer = s
+	return withServer(ctx, s), func() {
+		s.tenantDBs.closeAll()
+		adminDB.Close()
+		sqlLogger.Close()
+	}, nil
+}
+
+// 結果をJSONで標準出力に書く
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func runCreateTenant(ctx context.Context, args []string) error {
+	fs := newFlagSet("create-tenant")
+	name := fs.String("name", "", "テナント名")
+	displayName := fs.String("display-name", "", "テナントの表示名")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := validateTenantName(*name); err != nil {
+		return err
+	}
+
+	ctx, cleanup, err := setupCLI(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	id, err := addTenant(ctx, *name, *displayName)
+	if err != nil {
+		return err
+	}
+	return printJSON(TenantWithBilling{
+		ID:          strconv.FormatInt(id, 10),
+		Name:        *name,
+		DisplayName: *displayName,
+	})
+}
+
+func runMigrate(ctx context.Context, args []string) error {
+	fs := newFlagSet("migrate")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cleanup, err := setupCLI(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	applied, err := migrateAdminDB(ctx, srv(ctx).adminDB)
+	if err != nil {
+		return err
+	}
+
+	var ids []int64
+	if err := srv(ctx).adminDB.SelectContext(ctx, &ids, "SELECT id FROM tenant ORDER BY id"); err != nil {
+		return fmt.Errorf("error Select tenant: %w", err)
+	}
+	created := []int64{}
+	tenantVersions := map[int64]int{}
+	for _, id := range ids {
+		// シャーディングしている場合は担当のテナントのDBだけを作る
+		if !srv(ctx).shards.owns(id) {
+			continue
+		}
+		if _, err := os.Stat(tenantDBPath(id)); errors.Is(err, os.ErrNotExist) {
+			if err := srv(ctx).createTenantDB(id); err != nil {
+				return err
+			}
+			created = append(created, id)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error os.Stat: tenantID=%d, %w", id, err)
+		}
+	}
+	// 初期データのテナントDBは複数のテナントをまとめて持っていることがあるので、ファイル単位で適用する
+	fileIDs, err := listTenantDBIDs()
+	if err != nil {
+		return fmt.Errorf("error listTenantDBIDs: %w", err)
+	}
+	for _, id := range fileIDs {
+		db, err := srv(ctx).openTenantDB(id)
+		if err != nil {
+			return err
+		}
+		version, err := migrateTenantDB(ctx, id, db)
+		db.Close()
+		if err != nil {
+			return err
+		}
+		tenantVersions[id] = version
+	}
+	return printJSON(map[string]any{
+		"admin_applied":   applied,
+		"tenants_created": created,
+		"tenant_versions": tenantVersions,
+	})
+}
+
+// billing-reportの出力
+type billingReportOutput struct {
+	TenantID   int64           `json:"tenant_id"`
+	Name       string          `json:"name"`
+	BillingYen int64           `json:"billing_yen"`
+	Reports    []BillingReport `json:"reports"`
+}
+
+func runBillingReport(ctx context.Context, args []string) error {
+	fs := newFlagSet("billing-report")
+	tenantID := fs.Int64("tenant", 0, "対象のテナントID (省略時は全テナント)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cleanup, err := setupCLI(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	ts := []TenantRow{}
+	if *tenantID != 0 {
+		err = srv(ctx).adminDB.SelectContext(ctx, &ts, "SELECT * FROM tenant WHERE id = ?", *tenantID)
+	} else {
+		err = srv(ctx).adminDB.SelectContext(ctx, &ts, "SELECT * FROM tenant ORDER BY id")
+	}
+	if err != nil {
+		return fmt.Errorf("error Select tenant: %w", err)
+	}
+	if *tenantID != 0 && len(ts) == 0 {
+		return fmt.Errorf("tenant not found: id=%d", *tenantID)
+	}
+
+	outputs := make([]billingReportOutput, 0, len(ts))
+	for _, t := range ts {
+		out, err := func() (*billingReportOutput, error) {
+			tenantDB, err := connectToTenantDB(ctx, t.ID)
+			if err != nil {
+				return nil, err
+			}
+			defer tenantDB.Close()
+			reports, err := tenantBillingReports(ctx, tenantDB, t.ID)
+			if err != nil {
+				return nil, err
+			}
+			out := &billingReportOutput{TenantID: t.ID, Name: t.Name, Reports: reports}
+			for _, r := range reports {
+				out.BillingYen += r.BillingYen
+			}
+			return out, nil
+		}()
+		if err != nil {
+			return fmt.Errorf("tenantID=%d: %w", t.ID, err)
+		}
+		outputs = append(outputs, *out)
+	}
+	return printJSON(outputs)
+}
+
+func runVacuumTenants(ctx context.Context, args []string) error {
+	fs := newFlagSet("vacuum-tenants")
+	tenantIDs := fs.String("tenant", "", "対象のテナントIDをカンマ区切りで指定 (省略時は全テナント)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cleanup, err := setupCLI(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	var ids []int64
+	if *tenantIDs != "" {
+		for _, s := range strings.Split(*tenantIDs, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				return fmt.Errorf("failed to parse tenant id: %s: %w", s, err)
+			}
+			ids = append(ids, id)
+		}
+	} else if ids, err = listTenantDBIDs(); err != nil {
+		return fmt.Errorf("error listTenantDBIDs: %w", err)
+	}
+
+	results := maintainTenantDBs(ctx, ids, true)
+	if err := printJSON(results); err != nil {
+		return err
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			return fmt.Errorf("failed to maintain some tenant DBs")
+		}
+	}
+	return nil
+}
+
+func runVerifyInitialData(ctx context.Context, args []string) error {
+	fs := newFlagSet("verify-initial-data")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// ファイルを比べるだけなのでDBには接続しない
+	problems, err := verifyTenantDBChecksums(ctx)
+	if err != nil {
+		return err
+	}
+	if err := printJSON(problems); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("tenant DBs differ from initial data")
+	}
+	return nil
+}
+
+func runBackup(ctx context.Context, args []string) error {
+	fs := newFlagSet("backup")
+	tenantID := fs.Int64("tenant", 0, "対象のテナントID")
+	compress := fs.Bool("gzip", false, "gzipで圧縮する")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *tenantID == 0 {
+		return fmt.Errorf("-tenant is required")
+	}
+	if _, err := os.Stat(tenantDBPath(*tenantID)); err != nil {
+		return fmt.Errorf("tenant DB not found: id=%d, %w", *tenantID, err)
+	}
+
+	// バックアップはテナントDBのファイルだけを読むので管理用DBには接続しない
+	res, err := backupTenantDB(ctx, *tenantID, *compress)
+	if err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+// 稼働中のサーバーが持っているキャッシュは更新されないので、稼働中に復元する場合は
+// POST /api/admin/tenants/restore を使うこと
+func runRestore(ctx context.Context, args []string) error {
+	fs := newFlagSet("restore")
+	tenantID := fs.Int64("tenant", 0, "対象のテナントID")
+	from := fs.String("from", "", "バックアップファイルのパス")
+	object := fs.String("object", "", "オブジェクトストレージ上のバックアップのキー")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *tenantID == 0 || (*from == "") == (*object == "") {
+		return fmt.Errorf("-tenant and either -from or -object are required")
+	}
+
+	if *object != "" {
+		if err := restoreTenantDBFromObject(ctx, *tenantID, *object); err != nil {
+			return err
+		}
+		return printJSON(map[string]any{"tenant_id": *tenantID, "restored_from": *object})
+	}
+	if err := restoreTenantDB(ctx, *tenantID, *from); err != nil {
+		return err
+	}
+	return printJSON(map[string]any{"tenant_id": *tenantID, "restored_from": *from})
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"os"
+
 	isuports "github.com/isucon/isucon12-qualify/webapp/go"
 )
 
 func main() {
-	isuports.Run()
+	os.Exit(isuports.Main(os.Args[1:]))
 }
@@ -0,0 +1,301 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// 大会の終了
+// finished_atの更新、課金レポートの確定、最終ランキングの保存を1つのトランザクションで行い、
+// 途中で落ちても「終了しているのに課金レポートが確定していない」大会が残らないようにする
+// 確定した結果はテナントDBのcompetition_resultに書き、課金レポートはそこから読む
+//
+// 終了のWebhookは管理用DBに積むので同じトランザクションには入れられない
+// competition_result.event_published_at がNULLのものは送っていないので、もう一度終了を呼ぶと送り直す
+// 結果を確定してWebhookも送った大会をもう一度終了しようとした場合は409 (competition_already_finished) を返す
+
+type CompetitionResultRow struct {
+	CompetitionID     string        `db:"competition_id"`
+	TenantID          int64         `db:"tenant_id"`
+	FinishedAt        int64         `db:"finished_at"`
+	PlayerCount       int64         `db:"player_count"`
+	VisitorCount      int64         `db:"visitor_count"`
+	BillingPlayerYen  int64         `db:"billing_player_yen"`
+	BillingVisitorYen int64         `db:"billing_visitor_yen"`
+	BillingYen        int64         `db:"billing_yen"`
+	Ranking           string        `db:"ranking"` // []CompetitionRank のJSON
+	EventPublishedAt  sql.NullInt64 `db:"event_published_at"`
+	CreatedAt         int64         `db:"created_at"`
+	UpdatedAt         int64         `db:"updated_at"`
+}
+
+func (r *CompetitionResultRow) billingReport(comp CompetitionRow) BillingReport {
+	return BillingReport{
+		CompetitionID:     comp.ID,
+		CompetitionTitle:  comp.Title,
+		PlayerCount:       r.PlayerCount,
+		VisitorCount:      r.VisitorCount,
+		BillingPlayerYen:  r.BillingPlayerYen,
+		BillingVisitorYen: r.BillingVisitorYen,
+		BillingYen:        r.BillingYen,
+		FinishedAt:        r.FinishedAt,
+	}
+}
+
+// 大会を終了する
+// 既に終了していれば何も変えず、終了のWebhookを送っていなければ送り直す、送っていれば *conflictError を返す
+func finishCompetition(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, competitionID string) (int64, error) {
+	// ライブモードのスコアは終了前に全て書き出して、以降はplayer_scoreから読むようにする
+	// 書き出しは自分でロックを取るので、ここでロックを取る前に行う
+	if err := srv(ctx).liveScores.finish(ctx, tenantDB, tenantID, competitionID); err != nil {
+		return 0, fmt.Errorf("error liveScores.finish: %w", err)
+	}
+
+	// 計算中の課金レポートやスコアの置き換えと重ならないようロックを取る (beginBillingSnapshot を参照)
+	fl, err := lockTenant(ctx, tenantID, lockWrite)
+	if err != nil {
+		return 0, fmt.Errorf("error lockTenant: %w", err)
+	}
+	var comp *CompetitionRow
+	var result *CompetitionResultRow
+	var saved bool
+	err = withRetry(ctx, func() (err error) {
+		comp, result, saved, err = finishCompetitionTx(ctx, tenantDB, tenantID, competitionID)
+		return err
+	})
+	if err == nil {
+		// 課金レポートのキャッシュはロックを持っている間に書く
+		srv(ctx).billingReportCache.Set(strconv.Itoa(int(tenantID))+competitionID, result.billingReport(*comp))
+		// 新しく確定した最終ランキングをレーティングに反映する (rating.go を参照)
+		if saved {
+			applyCompetitionRating(ctx, tenantDB, tenantID, result)
+		}
+	}
+	fl.Close()
+	if err != nil {
+		return 0, err
+	}
+	srv(ctx).competitionCache.Delete(tenantKey{tenantID, competitionID})
+
+	if !result.EventPublishedAt.Valid {
+		publishCompetitionFinished(ctx, tenantDB, tenantID, result)
+	}
+	return result.FinishedAt, nil
+}
+
+// competition_resultをこの呼び出しで書いたかどうかも返す
+// 呼び出し側でlockTenantの排他ロックを取っておくこと
+func finishCompetitionTx(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, competitionID string) (*CompetitionRow, *CompetitionResultRow, bool, error) {
+	tx, err := tenantDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("error BeginTxx: tenantID=%d, %w", tenantID, err)
+	}
+	defer tx.Rollback()
+
+	var comp CompetitionRow
+	if err := tx.GetContext(ctx, &comp, "SELECT * FROM competition WHERE tenant_id = ? AND id = ?", tenantID, competitionID); err != nil {
+		return nil, nil, false, fmt.Errorf("error Select competition: tenantID=%d, id=%s, %w", tenantID, competitionID, err)
+	}
+	if comp.FinishedAt.Valid {
+		var result CompetitionResultRow
+		err := tx.GetContext(ctx, &result, "SELECT * FROM competition_result WHERE tenant_id = ? AND competition_id = ?", tenantID, competitionID)
+		if err == nil {
+			if result.EventPublishedAt.Valid {
+				return nil, nil, false, &conflictError{code: errorCodeCompetitionAlreadyFinished, message: "competition is already finished"}
+			}
+			return &comp, &result, false, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, false, fmt.Errorf("error Select competition_result: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+		}
+		// competition_resultを作る前に終了した大会は、終了した時刻のまま結果を確定する
+	} else {
+		now := srv(ctx).clock.Now().Unix()
+		if _, err := tx.ExecContext(
+			ctx,
+			"UPDATE competition SET finished_at = ?, updated_at = ? WHERE tenant_id = ? AND id = ?",
+			now, now, tenantID, competitionID,
+		); err != nil {
+			return nil, nil, false, fmt.Errorf("error Update competition: finishedAt=%d, id=%s, %w", now, competitionID, err)
+		}
+		comp.FinishedAt = sql.NullInt64{Int64: now, Valid: true}
+		comp.UpdatedAt = now
+	}
+
+	result, err := saveCompetitionResult(ctx, tx, comp)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, false, fmt.Errorf("error Commit: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	return &comp, result, true, nil
+}
+
+// 終了した大会の課金レポートと最終ランキングを計算してcompetition_resultに書く
+// 終了した大会のスコアを訂正した場合にも呼んで確定し直す、Webhookを送ったかどうかは引き継ぐ
+func saveCompetitionResult(ctx context.Context, tx *sqlx.Tx, comp CompetitionRow) (*CompetitionResultRow, error) {
+	// 確定した金額が後から変わらないよう、レプリカの遅れで訪問を取りこぼさないように管理用DBから読む
+	vhs := []VisitHistorySummaryRow{}
+	if err := srv(ctx).adminDB.SelectContext(
+		ctx,
+		&vhs,
+		"SELECT player_id, MIN(created_at) AS min_created_at, competition_id FROM visit_history WHERE tenant_id = ? AND competition_id = ? GROUP BY player_id, competition_id",
+		comp.TenantID, comp.ID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select visit_history: tenantID=%d, competitionID=%s, %w", comp.TenantID, comp.ID, err)
+	}
+	// まだvisit_historyに書き出していない訪問も数える (delayedInsertVisitHistory を参照)
+	vhs = append(vhs, bufferedVisits(ctx, comp.TenantID, comp.ID)...)
+	scoredPlayers := []ScoredPlayer{}
+	if err := tx.SelectContext(
+		ctx,
+		&scoredPlayers,
+		"SELECT DISTINCT player_id AS pid, competition_id FROM player_score WHERE tenant_id = ? AND competition_id = ?",
+		comp.TenantID, comp.ID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", comp.TenantID, comp.ID, err)
+	}
+	report := aggregateBillingReports([]CompetitionRow{comp}, vhs, scoredPlayers)[0]
+
+	pss := []PlayerScoreRow{}
+	if err := tx.SelectContext(
+		ctx,
+		&pss,
+		"SELECT * FROM player_score WHERE tenant_id = ? AND competition_id = ? ORDER BY row_num DESC",
+		comp.TenantID, comp.ID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", comp.TenantID, comp.ID, err)
+	}
+	ranks, err := buildCompetitionRanks(ctx, tx, pss)
+	if err != nil {
+		return nil, err
+	}
+	// 表示名は参加者の消去 (playerdata.go) で変わるので残さない、読むときにplayerから引く
+	for i := range ranks {
+		ranks[i].Rank = int64(i + 1)
+		ranks[i].PlayerDisplayName = ""
+	}
+	ranking, err := json.Marshal(ranks)
+	if err != nil {
+		return nil, fmt.Errorf("error json.Marshal: %w", err)
+	}
+
+	now := srv(ctx).clock.Now().Unix()
+	result := &CompetitionResultRow{
+		CompetitionID:     comp.ID,
+		TenantID:          comp.TenantID,
+		FinishedAt:        comp.FinishedAt.Int64,
+		PlayerCount:       report.PlayerCount,
+		VisitorCount:      report.VisitorCount,
+		BillingPlayerYen:  report.BillingPlayerYen,
+		BillingVisitorYen: report.BillingVisitorYen,
+		BillingYen:        report.BillingYen,
+		Ranking:           string(ranking),
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+	if _, err := tx.NamedExecContext(
+		ctx,
+		`INSERT INTO competition_result (competition_id, tenant_id, finished_at, player_count, visitor_count, billing_player_yen, billing_visitor_yen, billing_yen, ranking, event_published_at, created_at, updated_at)
+		VALUES (:competition_id, :tenant_id, :finished_at, :player_count, :visitor_count, :billing_player_yen, :billing_visitor_yen, :billing_yen, :ranking, :event_published_at, :created_at, :updated_at)
+		ON CONFLICT (competition_id) DO UPDATE SET finished_at = excluded.finished_at, player_count = excluded.player_count, visitor_count = excluded.visitor_count,
+		billing_player_yen = excluded.billing_player_yen, billing_visitor_yen = excluded.billing_visitor_yen, billing_yen = excluded.billing_yen,
+		ranking = excluded.ranking, updated_at = excluded.updated_at`,
+		result,
+	); err != nil {
+		return nil, fmt.Errorf("error Insert competition_result: tenantID=%d, competitionID=%s, %w", comp.TenantID, comp.ID, err)
+	}
+	if err := tx.GetContext(ctx, result, "SELECT * FROM competition_result WHERE competition_id = ?", comp.ID); err != nil {
+		return nil, fmt.Errorf("error Select competition_result: tenantID=%d, competitionID=%s, %w", comp.TenantID, comp.ID, err)
+	}
+	return result, nil
+}
+
+// このプロセスでvisit_historyへの書き出しを待っている訪問
+func bufferedVisits(ctx context.Context, tenantID int64, competitionID string) []VisitHistorySummaryRow {
+	vhs := []VisitHistorySummaryRow{}
+	for _, vh := range srv(ctx).visits.competition(tenantID, competitionID) {
+		vhs = append(vhs, VisitHistorySummaryRow{
+			PlayerID:      vh.PlayerID,
+			MinCreatedAt:  vh.CreatedAt,
+			CompetitionID: vh.CompetitionID,
+			TenantID:      vh.TenantID,
+		})
+	}
+	return vhs
+}
+
+// 終了した大会のスコアを訂正したあとに結果を確定し直す
+// 呼び出し側でlockTenantの排他ロックを取っておくこと
+func resaveCompetitionResult(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, competitionID string) (*CompetitionResultRow, error) {
+	var result *CompetitionResultRow
+	err := withRetry(ctx, func() error {
+		tx, err := tenantDB.BeginTxx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("error BeginTxx: tenantID=%d, %w", tenantID, err)
+		}
+		defer tx.Rollback()
+		var comp CompetitionRow
+		if err := tx.GetContext(ctx, &comp, "SELECT * FROM competition WHERE tenant_id = ? AND id = ?", tenantID, competitionID); err != nil {
+			return fmt.Errorf("error Select competition: tenantID=%d, id=%s, %w", tenantID, competitionID, err)
+		}
+		if result, err = saveCompetitionResult(ctx, tx, comp); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error Commit: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// 確定した課金レポートを返す
+// tenantDBにはbeginBillingSnapshotで開始したトランザクションを渡す
+func competitionResultsByTenant(ctx context.Context, tenantDB dbOrTx, tenantID int64) (map[string]CompetitionResultRow, error) {
+	rs := []CompetitionResultRow{}
+	if err := tenantDB.SelectContext(ctx, &rs, "SELECT * FROM competition_result WHERE tenant_id = ?", tenantID); err != nil {
+		return nil, fmt.Errorf("error Select competition_result: tenantID=%d, %w", tenantID, err)
+	}
+	m := make(map[string]CompetitionResultRow, len(rs))
+	for _, r := range rs {
+		m[r.CompetitionID] = r
+	}
+	return m, nil
+}
+
+// 終了のWebhookを積んで、積めたら送ったことを記録する
+// 積めなかった場合はログに残し、次に終了を呼んだときに送り直す
+func publishCompetitionFinished(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, result *CompetitionResultRow) {
+	if err := enqueueWebhookEvent(ctx, tenantID, webhookEventCompetitionFinished, map[string]any{
+		"competition_id": result.CompetitionID,
+		"finished_at":    result.FinishedAt,
+	}); err != nil {
+		logger.Error("failed to publish webhook event",
+			zap.Int64("tenant_id", tenantID),
+			zap.String("event", webhookEventCompetitionFinished),
+			zap.Error(err),
+		)
+		return
+	}
+	now := srv(ctx).clock.Now().Unix()
+	if _, err := tenantDB.ExecContext(
+		ctx,
+		"UPDATE competition_result SET event_published_at = ? WHERE tenant_id = ? AND competition_id = ?",
+		now, tenantID, result.CompetitionID,
+	); err != nil {
+		logger.Error("failed to mark competition_finished published",
+			zap.Int64("tenant_id", tenantID),
+			zap.String("competition_id", result.CompetitionID),
+			zap.Error(err),
+		)
+	}
+}
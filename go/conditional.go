@@ -0,0 +1,85 @@
+package isuports
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 条件付きGET (RFC 9110 13章)
+// 大会の一覧や埋め込みのスコアボードのように、頻繁に取得されるがめったに変わらないレスポンスで使う
+//
+//	ETag          レスポンスの内容から作る (contentETag)
+//	Last-Modified 返す行の更新日時の最大値
+//
+// If-None-MatchがあればIf-Modified-Sinceは見ない
+
+// レスポンスの内容から強いETagを作る
+func contentETag(v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("error json.Marshal: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// ETagとLast-Modifiedを設定し、リクエストの条件からクライアントのキャッシュが新しければtrueを返す
+// etagが空、lastModifiedが0ならそれぞれ設定しない
+// Last-Modifiedは秒単位なので、同じ秒のうちに変更されうる間は返さない
+func notModified(c echo.Context, etag string, lastModified int64) bool {
+	h := c.Response().Header()
+	if etag != "" {
+		h.Set("ETag", etag)
+	}
+	if lastModified <= 0 || lastModified >= srv(c.Request().Context()).clock.Now().Unix() {
+		lastModified = 0
+	} else {
+		h.Set(echo.HeaderLastModified, time.Unix(lastModified, 0).UTC().Format(http.TimeFormat))
+	}
+
+	req := c.Request().Header
+	if inm := req.Get("If-None-Match"); inm != "" {
+		return etag != "" && etagMatches(inm, etag)
+	}
+	if lastModified == 0 {
+		return false
+	}
+	ims, err := http.ParseTime(req.Get(echo.HeaderIfModifiedSince))
+	return err == nil && lastModified <= ims.Unix()
+}
+
+// If-None-Matchの値 ("*" またはカンマ区切りのETagの並び) がetagに一致するかを弱い比較で返す
+// ETagの中にはカンマを書けるので、引用符の中は区切らない
+// 形式が正しくないところから後は読まない
+func etagMatches(header, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	s := header
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return false
+		}
+		tag := strings.TrimPrefix(s, "W/")
+		if !strings.HasPrefix(tag, `"`) {
+			return false
+		}
+		end := strings.IndexByte(tag[1:], '"')
+		if end < 0 {
+			return false
+		}
+		if tag[:end+2] == etag {
+			return true
+		}
+		s = tag[end+2:]
+	}
+}
@@ -0,0 +1,96 @@
+package isuports
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: `"abc"`, want: true},
+		{header: `W/"abc"`, want: true},
+		{header: `"x", "abc"`, want: true},
+		{header: `"x",W/"abc"`, want: true},
+		{header: `*`, want: true},
+		{header: `"a,b", "abc"`, want: true},
+		{header: `"abcd"`, want: false},
+		{header: `"x"`, want: false},
+		{header: `abc`, want: false},
+		{header: `"x", abc`, want: false},
+		{header: `"abc`, want: false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, `"abc"`); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompetitionsConditionalGet(t *testing.T) {
+	clock := newFrozenClock(testNow)
+	app := newTestApp(t, WithClock(clock))
+	decodeSuccess(t, app.postForm(t, app.admin(t), "/api/admin/tenants/add", url.Values{
+		"name":         {"conditional"},
+		"display_name": {"Conditional"},
+	}), nil)
+	org := app.organizer(t, "conditional")
+	decodeSuccess(t, app.postForm(t, org, "/api/organizer/competitions/add", url.Values{"title": {"conditional competition"}}), nil)
+
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/organizer/competitions", nil)
+		req.Host = org.host
+		req.AddCookie(&http.Cookie{Name: cookieName, Value: org.token})
+		for k, vs := range header {
+			req.Header[k] = vs
+		}
+		rec := httptest.NewRecorder()
+		app.e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// 同じ秒のうちはまだ変更されうるのでLast-Modifiedを返さない
+	if lm := get(nil).Header().Get(echo.HeaderLastModified); lm != "" {
+		t.Errorf("Last-Modified = %s in the same second", lm)
+	}
+
+	clock.Advance(time.Minute)
+	rec := get(nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	etag := rec.Header().Get("ETag")
+	lastModified := rec.Header().Get(echo.HeaderLastModified)
+	if want := testNow.UTC().Format(http.TimeFormat); lastModified != want {
+		t.Errorf("Last-Modified = %q, want %q", lastModified, want)
+	}
+	if etag == "" {
+		t.Fatal("ETag is not set")
+	}
+
+	before := testNow.Add(-time.Second).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		name   string
+		header http.Header
+		code   int
+	}{
+		{"If-Modified-Since at Last-Modified", http.Header{"If-Modified-Since": {lastModified}}, http.StatusNotModified},
+		{"If-Modified-Since before Last-Modified", http.Header{"If-Modified-Since": {before}}, http.StatusOK},
+		{"If-None-Match list", http.Header{"If-None-Match": {`"other", W/` + etag}}, http.StatusNotModified},
+		{"If-None-Match *", http.Header{"If-None-Match": {"*"}}, http.StatusNotModified},
+		{"If-None-Match takes precedence over If-Modified-Since", http.Header{"If-None-Match": {`"other"`}, "If-Modified-Since": {lastModified}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := get(tt.header); rec.Code != tt.code {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.code)
+		}
+	}
+}
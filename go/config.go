@@ -0,0 +1,161 @@
+package isuports
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 設定ファイル
+// 環境変数 ISUCON_CONFIG_FILE か、起動引数の -config で指定する
+// 書式はTOMLのうちトップレベルの key = value だけを使ったもので、キーは環境変数名と同じ
+//
+//	# 管理用DB
+//	ISUCON_DB_HOST = "10.0.0.2"
+//	ISUCON_DB_MAX_OPEN_CONNS = 50
+//
+// 同じキーの環境変数が設定されている場合は環境変数を優先する
+// 設定できるキーの一覧は isuports.toml.example を参照
+//
+// パッケージ変数の初期化でも設定値を使うので、main より前に読み込まれる必要がある
+var (
+	configFileMu                    sync.RWMutex
+	configFileValues, configFileErr = loadConfigFile(configFilePath(os.Args[1:]))
+)
+
+// 設定ファイルのパスを返す、指定がなければ空文字列
+func configFilePath(args []string) string {
+	for i, arg := range args {
+		switch {
+		case arg == "-config" || arg == "--config":
+			if i+1 < len(args) {
+				return args[i+1]
+			}
+		case strings.HasPrefix(arg, "-config="):
+			return strings.TrimPrefix(arg, "-config=")
+		case strings.HasPrefix(arg, "--config="):
+			return strings.TrimPrefix(arg, "--config=")
+		}
+	}
+	return os.Getenv("ISUCON_CONFIG_FILE")
+}
+
+// 設定ファイルを読み込む
+func loadConfigFile(path string) (map[string]string, error) {
+	values := map[string]string{}
+	if path == "" {
+		return values, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return values, fmt.Errorf("error os.Open: path=%s, %w", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		key, value, ok, err := parseConfigLine(scanner.Text())
+		if err != nil {
+			return values, fmt.Errorf("invalid config: path=%s, line=%d: %w", path, lineNo, err)
+		}
+		if ok {
+			values[key] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return values, fmt.Errorf("error read config: path=%s, %w", path, err)
+	}
+	return values, nil
+}
+
+// 1行を key = value として解釈する
+// 空行とコメント行はokがfalseになる
+func parseConfigLine(line string) (string, string, bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false, nil
+	}
+	i := strings.Index(line, "=")
+	if i < 0 {
+		return "", "", false, fmt.Errorf("missing '=': %q", line)
+	}
+	key := strings.TrimSpace(line[:i])
+	if key == "" {
+		return "", "", false, fmt.Errorf("empty key: %q", line)
+	}
+	raw := strings.TrimSpace(line[i+1:])
+	if strings.HasPrefix(raw, `"`) {
+		// 文字列の後ろにコメントがある場合に備えて、閉じる"までを取り出す
+		end := -1
+		for j := 1; j < len(raw); j++ {
+			if raw[j] == '\\' {
+				j++
+				continue
+			}
+			if raw[j] == '"' {
+				end = j
+				break
+			}
+		}
+		if end < 0 {
+			return "", "", false, fmt.Errorf("unterminated string: %q", line)
+		}
+		value, err := strconv.Unquote(raw[:end+1])
+		if err != nil {
+			return "", "", false, fmt.Errorf("invalid string: %q: %w", line, err)
+		}
+		return key, value, true, nil
+	}
+	// 数値や真偽値はそのまま使う
+	if j := strings.Index(raw, "#"); j >= 0 {
+		raw = strings.TrimSpace(raw[:j])
+	}
+	switch raw {
+	case "true":
+		raw = "1"
+	case "false":
+		raw = "0"
+	}
+	return key, raw, true, nil
+}
+
+// 設定値を環境変数、設定ファイルの順に探す
+func lookupConfig(key string) (string, bool) {
+	if val, ok := os.LookupEnv(key); ok {
+		return val, true
+	}
+	configFileMu.RLock()
+	defer configFileMu.RUnlock()
+	val, ok := configFileValues[key]
+	return val, ok
+}
+
+// 設定ファイルを読み直し、値が変わったキーを返す
+// 読み込みに失敗した場合は今の設定のまま変えない
+// パッケージ変数の初期化で読んだ値 (プールの上限など) は reloadRuntimeState で個別に反映する
+func reloadConfigFile() ([]string, error) {
+	values, err := loadConfigFile(configFilePath(os.Args[1:]))
+	if err != nil {
+		return nil, err
+	}
+	configFileMu.Lock()
+	defer configFileMu.Unlock()
+	changed := []string{}
+	for k, v := range values {
+		if old, ok := configFileValues[k]; !ok || old != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range configFileValues {
+		if _, ok := values[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	configFileValues = values
+	return changed, nil
+}
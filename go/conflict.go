@@ -0,0 +1,80 @@
+package isuports
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo/v4"
+	"github.com/mattn/go-sqlite3"
+)
+
+// 重複や二重の操作による衝突
+// 一意制約の違反はMySQL (管理用DB) とSQLite (テナントDB) のどちらで起きても409とコードで返す
+// ハンドラは何が重複したかわかる場合は asConflict でコードをつけ、つけなかった違反も errorResponseHandler が errorCodeConflict で返す
+
+// FailureResult.Code
+const (
+	errorCodeConflict                   = "conflict"
+	errorCodeDuplicateTenant            = "duplicate_tenant"
+	errorCodeDuplicatePlayer            = "duplicate_player"
+	errorCodeCompetitionAlreadyFinished = "competition_already_finished"
+)
+
+// MySQLの一意制約の違反
+const (
+	mysqlErrDupEntry            = 1062
+	mysqlErrDupEntryWithKeyName = 1586
+)
+
+// 一意制約 (主キーを含む) の違反か
+func isUniqueViolation(err error) bool {
+	var merr *mysql.MySQLError
+	if errors.As(err, &merr) {
+		return merr.Number == mysqlErrDupEntry || merr.Number == mysqlErrDupEntryWithKeyName
+	}
+	var serr sqlite3.Error
+	if errors.As(err, &serr) {
+		return serr.ExtendedCode == sqlite3.ErrConstraintUnique || serr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
+
+type conflictError struct {
+	code    string
+	message string
+	err     error
+}
+
+func (e *conflictError) Error() string {
+	return e.message
+}
+
+func (e *conflictError) Unwrap() error {
+	return e.err
+}
+
+// errが一意制約の違反ならコードをつけた *conflictError にする、それ以外はそのまま返す
+func asConflict(err error, code, message string) error {
+	if err == nil || !isUniqueViolation(err) {
+		return err
+	}
+	return &conflictError{code: code, message: message, err: err}
+}
+
+// errが衝突ならそのレスポンスを返す
+func conflictResponse(c echo.Context, err error) bool {
+	var ce *conflictError
+	if !errors.As(err, &ce) {
+		if !isUniqueViolation(err) {
+			return false
+		}
+		ce = &conflictError{code: errorCodeConflict, message: "conflict"}
+	}
+	c.JSON(http.StatusConflict, FailureResult{
+		Status:  false,
+		Message: ce.message,
+		Code:    ce.code,
+	})
+	return true
+}
@@ -0,0 +1,236 @@
+package isuports
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// 公開APIのレスポンスの形の契約
+// testdata/contract にベンチマーカーが読むレスポンスの形を、APIの仕様から手で書いて置いておく
+// 実際のレスポンスをそれと比べ、ベンチマーカーが使うフィールドの名前や型が変わったら失敗させる
+//
+// 契約のJSONは、値の代わりに型の名前 (string, number, boolean, null) を書く
+// オブジェクトは書いたキーだけを比べ、仕様にないキー (後から追加したフィールド) がレスポンスにあってもよい
+// 配列は要素の形を1つだけ書き、レスポンスの全ての要素と比べる
+// 要素を比べられないので、空の配列は契約違反にする (テストのシナリオで要素があるようにしておく)
+//
+// 契約はレスポンスから生成しないこと、APIの仕様を変えたときだけ手で書き直す
+
+// JSONの値の型の名前
+func jsonKind(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// gotが契約specを満たさない箇所を返す
+func diffContract(path string, spec, got any) []string {
+	switch s := spec.(type) {
+	case string:
+		if jsonKind(got) != s {
+			return []string{fmt.Sprintf("%s: type is %s, want %s", path, jsonKind(got), s)}
+		}
+		return nil
+	case map[string]any:
+		g, ok := got.(map[string]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s: type is %s, want object", path, jsonKind(got))}
+		}
+		keys := make([]string, 0, len(s))
+		for k := range s {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var diffs []string
+		for _, k := range keys {
+			gv, ok := g[k]
+			if !ok {
+				diffs = append(diffs, fmt.Sprintf("%s.%s: missing", path, k))
+				continue
+			}
+			diffs = append(diffs, diffContract(path+"."+k, s[k], gv)...)
+		}
+		return diffs
+	case []any:
+		g, ok := got.([]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s: type is %s, want array", path, jsonKind(got))}
+		}
+		if len(s) != 1 {
+			return []string{fmt.Sprintf("%s: contract must have exactly one element, has %d", path, len(s))}
+		}
+		if len(g) == 0 {
+			return []string{fmt.Sprintf("%s: empty array, elements cannot be checked", path)}
+		}
+		var diffs []string
+		for i, gv := range g {
+			diffs = append(diffs, diffContract(fmt.Sprintf("%s[%d]", path, i), s[0], gv)...)
+		}
+		return diffs
+	}
+	return []string{fmt.Sprintf("%s: invalid contract %v", path, spec)}
+}
+
+func decodeJSONValue(b []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// レスポンスのステータスコードと、bodyが testdata/contract/<name>.json の契約を満たすことを確かめる
+func checkContract(t *testing.T, name string, rec *httptest.ResponseRecorder, code int) {
+	t.Helper()
+	if rec.Code != code {
+		t.Errorf("%s: status = %d, want %d, body = %s", name, rec.Code, code, rec.Body.String())
+	}
+	p := filepath.Join("testdata", "contract", name+".json")
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	spec, err := decodeJSONValue(b)
+	if err != nil {
+		t.Fatalf("%s: invalid contract: %s", p, err)
+	}
+	got, err := decodeJSONValue(rec.Body.Bytes())
+	if err != nil {
+		t.Fatalf("%s: invalid response: %s, %s", name, err, rec.Body.String())
+	}
+	if diffs := diffContract("$", spec, got); len(diffs) > 0 {
+		t.Errorf("%s: response does not satisfy %s\n%s\nresponse: %s", name, p, strings.Join(diffs, "\n"), rec.Body.String())
+	}
+}
+
+func TestDiffContract(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		got  string
+		diff []string
+	}{
+		{
+			name: "same shape with other values",
+			spec: `{"status":"boolean","data":{"id":"string","rows":"number","ranks":[{"rank":"number"}],"me":"null"}}`,
+			got:  `{"data":{"ranks":[{"rank":2},{"rank":3}],"me":null,"rows":10,"id":"a"},"status":false}`,
+		},
+		{
+			name: "keys not in the contract are allowed",
+			spec: `{"a":"number"}`,
+			got:  `{"a":1,"pagination":{"total":1}}`,
+		},
+		{
+			name: "missing keys",
+			spec: `{"a":"number","b":"number","c":{"d":"string"}}`,
+			got:  `{"a":1}`,
+			diff: []string{"$.b: missing", "$.c: missing"},
+		},
+		{
+			name: "type changed",
+			spec: `{"id":"string","finished_at":"number","me":"null","player":{"id":"string"},"ranks":[{"rank":"number"}]}`,
+			got:  `{"id":1,"finished_at":null,"me":{"id":"1"},"player":"1","ranks":{}}`,
+			diff: []string{
+				"$.finished_at: type is null, want number",
+				"$.id: type is number, want string",
+				"$.me: type is object, want null",
+				"$.player: type is string, want object",
+				"$.ranks: type is object, want array",
+			},
+		},
+		{
+			name: "every array element is checked",
+			spec: `[{"a":"number"}]`,
+			got:  `[{"a":1},{"a":"x"},{}]`,
+			diff: []string{"$[1].a: type is string, want number", "$[2].a: missing"},
+		},
+		{
+			name: "empty arrays",
+			spec: `{"a":[{"x":"number"}]}`,
+			got:  `{"a":[]}`,
+			diff: []string{"$.a: empty array, elements cannot be checked"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := decodeJSONValue([]byte(tt.spec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeJSONValue([]byte(tt.got))
+			if err != nil {
+				t.Fatal(err)
+			}
+			diff := diffContract("$", spec, got)
+			if strings.Join(diff, "\n") != strings.Join(tt.diff, "\n") {
+				t.Errorf("diffContract() =\n%s\nwant\n%s", strings.Join(diff, "\n"), strings.Join(tt.diff, "\n"))
+			}
+		})
+	}
+}
+
+// ベンチマーカーが呼ぶ公開APIのレスポンスを、testdata/contract の契約と比べる
+// POST /initialize は初期データのファイルとMySQLのスクリプトを使うので対象にしない
+func TestAPIContract(t *testing.T) {
+	app := newTestApp(t)
+	admin := app.admin(t)
+
+	rec := app.postForm(t, admin, "/api/admin/tenants/add", url.Values{"name": {"contract"}, "display_name": {"Contract"}})
+	checkContract(t, "admin_tenants_add", rec, http.StatusOK)
+	org := app.organizer(t, "contract")
+
+	rec = app.postForm(t, org, "/api/organizer/players/add", url.Values{"display_name[]": {"alice", "bob"}})
+	checkContract(t, "organizer_players_add", rec, http.StatusOK)
+	var playersRes PlayersAddHandlerResult
+	decodeSuccess(t, rec, &playersRes)
+	alice, bob := playersRes.Players[0], playersRes.Players[1]
+	player := app.player(t, "contract", alice.ID)
+
+	rec = app.postForm(t, org, "/api/organizer/competitions/add", url.Values{"title": {"contract competition"}})
+	checkContract(t, "organizer_competitions_add", rec, http.StatusOK)
+	var compRes CompetitionsAddHandlerResult
+	decodeSuccess(t, rec, &compRes)
+	compID := compRes.Competition.ID
+
+	csv := fmt.Sprintf("player_id,score\n%s,100\n%s,200\n", alice.ID, bob.ID)
+	checkContract(t, "organizer_competition_score", app.postFile(t, org, "/api/organizer/competition/"+compID+"/score", "scores", "scores.csv", csv), http.StatusOK)
+	checkContract(t, "player_competition_ranking", app.get(t, player, "/api/player/competition/"+compID+"/ranking"), http.StatusOK)
+	checkContract(t, "player_competitions", app.get(t, player, "/api/player/competitions"), http.StatusOK)
+	checkContract(t, "organizer_competitions", app.get(t, org, "/api/organizer/competitions"), http.StatusOK)
+	checkContract(t, "organizer_competition_finish", app.postForm(t, org, "/api/organizer/competition/"+compID+"/finish", nil), http.StatusOK)
+
+	checkContract(t, "organizer_player_disqualified", app.postForm(t, org, "/api/organizer/player/"+bob.ID+"/disqualified", nil), http.StatusOK)
+	checkContract(t, "organizer_players", app.get(t, org, "/api/organizer/players"), http.StatusOK)
+	checkContract(t, "player_player", app.get(t, player, "/api/player/player/"+alice.ID), http.StatusOK)
+	checkContract(t, "me_player", app.get(t, player, "/api/me"), http.StatusOK)
+	checkContract(t, "me_anonymous", app.get(t, testViewer{host: testHost("contract")}, "/api/me"), http.StatusOK)
+	checkContract(t, "organizer_billing", app.get(t, org, "/api/organizer/billing"), http.StatusOK)
+	checkContract(t, "admin_tenants_billing", app.get(t, admin, "/api/admin/tenants/billing"), http.StatusOK)
+
+	// エラーはどのAPIでも同じ形で返す
+	checkContract(t, "failure", app.get(t, player, "/api/organizer/billing"), http.StatusForbidden)
+	checkContract(t, "failure", app.get(t, app.player(t, "contract", bob.ID), "/api/player/competitions"), http.StatusForbidden)
+}
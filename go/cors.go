@@ -0,0 +1,172 @@
+package isuports
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// CORS
+// テナントが自分のドメインに置いたSPAから、プロキシなしで参加者向けAPIを呼べるようにする
+// 許可するOriginはテナントの設定 (cors_allowed_origins) にカンマ区切りで保存する
+// 認証はCookieなので、許可したOriginにはAccess-Control-Allow-Credentialsも返す
+// 埋め込み用のスコアボード (scoreboard.go を参照) は別の設定を使うので、このミドルウェアでは扱わない
+
+const corsAllowedOriginsSettingName = "cors_allowed_origins"
+
+// プリフライトの結果をブラウザがキャッシュする時間
+var corsMaxAge = getEnvDuration("ISUCON_CORS_MAX_AGE", 10*time.Minute)
+
+// 設定に保存した許可したOriginの一覧を取得する
+func allowedOrigins(c echo.Context, tenantID int64, settingName string) ([]string, error) {
+	ctx := c.Request().Context()
+	key := tenantKey{tenantID, settingName}
+	if origins, ok := srv(ctx).allowedOriginsCache.Get(key); ok {
+		return origins, nil
+	}
+	s, err := getTenantSetting(ctx, tenantID, settingName)
+	if err != nil {
+		return nil, err
+	}
+	origins := splitOrigins(s)
+	srv(ctx).allowedOriginsCache.Set(key, origins)
+	return origins, nil
+}
+
+func splitOrigins(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// フォームで受け取ったカンマ区切りのOriginを検証して保存する
+func setAllowedOrigins(c echo.Context, tenantID int64, settingName string, allowAny bool) error {
+	ctx := c.Request().Context()
+	var origins []string
+	for _, o := range strings.Split(c.FormValue("allowed_origins"), ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		if !(allowAny && o == "*") && !validOrigin(o) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid origin: %s", o))
+		}
+		origins = append(origins, o)
+	}
+	if err := setTenantSetting(ctx, tenantID, settingName, strings.Join(origins, ",")); err != nil {
+		return err
+	}
+	srv(ctx).allowedOriginsCache.Delete(tenantKey{tenantID, settingName})
+	return nil
+}
+
+// Originの形式 (scheme://host[:port]) になっているか
+func validOrigin(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	return u.Path == "" && u.RawQuery == "" && u.Fragment == "" && u.User == nil
+}
+
+// リクエストのOriginが許可されていればAccess-Control-Allow-Originを設定する
+func setAllowOrigin(c echo.Context, origins []string) bool {
+	h := c.Response().Header()
+	h.Add(echo.HeaderVary, echo.HeaderOrigin)
+	origin := c.Request().Header.Get(echo.HeaderOrigin)
+	if origin == "" {
+		return false
+	}
+	for _, o := range origins {
+		if o == "*" || o == origin {
+			h.Set(echo.HeaderAccessControlAllowOrigin, origin)
+			return true
+		}
+	}
+	return false
+}
+
+func corsMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			path := c.Path()
+			if req.Header.Get(echo.HeaderOrigin) == "" ||
+				path == "/initialize" || strings.HasPrefix(path, "/api/admin/") || strings.HasPrefix(path, "/embed/") {
+				return next(c)
+			}
+			tenant, err := retrieveTenantRowFromHeader(c)
+			if err != nil || tenant.Name == "admin" {
+				// テナントが見つからない場合のエラーはハンドラに任せる
+				return next(c)
+			}
+			origins, err := allowedOrigins(c, tenant.ID, corsAllowedOriginsSettingName)
+			if err != nil {
+				return err
+			}
+			allowed := setAllowOrigin(c, origins)
+			if allowed {
+				c.Response().Header().Set(echo.HeaderAccessControlAllowCredentials, "true")
+			}
+
+			// プリフライトはハンドラを呼ばずに返す
+			if req.Method == http.MethodOptions && req.Header.Get(echo.HeaderAccessControlRequestMethod) != "" {
+				if allowed {
+					h := c.Response().Header()
+					h.Set(echo.HeaderAccessControlAllowMethods, strings.Join([]string{http.MethodGet, http.MethodPost}, ","))
+					h.Set(echo.HeaderAccessControlAllowHeaders, strings.Join([]string{echo.HeaderContentType, echo.HeaderAuthorization}, ","))
+					h.Set(echo.HeaderAccessControlMaxAge, fmt.Sprintf("%d", int(corsMaxAge.Seconds())))
+				}
+				return c.NoContent(http.StatusNoContent)
+			}
+			return next(c)
+		}
+	}
+}
+
+type CORSSettingsHandlerResult struct {
+	AllowedOrigins []string `json:"allowed_origins"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/cors
+// APIを呼べるOriginを取得する
+func corsSettingsHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	s, err := getTenantSetting(c.Request().Context(), v.tenantID, corsAllowedOriginsSettingName)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: CORSSettingsHandlerResult{AllowedOrigins: splitOrigins(s)}})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/cors
+// APIを呼べるOriginを設定する
+// allowed_originsはカンマ区切りで、Cookieを送るので*は指定できない、空ならCORSのヘッダを返さない
+func corsSettingsUpdateHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	if err := setAllowedOrigins(c, v.tenantID, corsAllowedOriginsSettingName, false); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
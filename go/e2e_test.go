@@ -0,0 +1,387 @@
+package isuports
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// APIを通して動かすテストの環境
+// 管理用DBは偽物 (admindb_test.go を参照)、テナントDBは一時ディレクトリに埋め込んだマイグレーションから作る
+//
+// ISUCON_TEST_DB_NAME を設定すると、管理用DBに偽物の代わりにそのMySQLのデータベースを使う
+// 中のテーブルは全て消して作り直すので、テスト専用のデータベースを指定すること
+// 接続先とユーザーは ISUCON_DB_HOST などアプリケーションと同じ設定を使う
+//
+//	docker run -d -p 3306:3306 -e MYSQL_ROOT_PASSWORD=root -e MYSQL_DATABASE=isuports_test \
+//	  -e MYSQL_USER=isucon -e MYSQL_PASSWORD=isucon mysql:8
+//	ISUCON_TEST_DB_NAME=isuports_test go test -run TestE2E .
+type testApp struct {
+	e       *echo.Echo
+	s       *Server
+	adminDB *sqlx.DB
+	key     *rsa.PrivateKey
+}
+
+func newTestApp(t *testing.T, opts ...ServerOption) *testApp {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("ISUCON_TENANT_DB_DIR", dir)
+
+	var adminDB *sqlx.DB
+	if dbName := os.Getenv("ISUCON_TEST_DB_NAME"); dbName != "" {
+		t.Setenv("ISUCON_DB_NAME", dbName)
+		var err error
+		adminDB, err = connectAdminDB()
+		if err != nil {
+			t.Fatalf("failed to connect admin DB: %s", err)
+		}
+		resetTestAdminDB(t, adminDB)
+	} else {
+		adminDB = openFakeAdminDB(t, dir)
+	}
+	t.Cleanup(func() { adminDB.Close() })
+
+	// JWTは公開鍵のファイルを置かずに、テストで作った鍵で検証する
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	opts = append([]ServerOption{
+		WithClock(newFrozenClock(testNow)),
+		WithSequentialIDs(0),
+		WithJWTKeyLoader(func() (any, error) { return &key.PublicKey, nil }),
+	}, opts...)
+	s := NewServer(adminDB, opts...)
+	t.Cleanup(func() {
+		s.ratingRecomputes.wait()
+		s.notifications.Wait()
+		s.tenantDBs.closeAll()
+	})
+
+	e := echo.New()
+	e.Pre(s.middleware())
+	e.Use(requestIDMiddleware())
+	registerRoutes(e)
+	e.HTTPErrorHandler = errorResponseHandler
+	e.Validator = requestValidator{}
+	return &testApp{e: e, s: s, adminDB: adminDB, key: key}
+}
+
+// 管理用DBのテーブルを全て消し、埋め込んだマイグレーションから作り直す
+func resetTestAdminDB(t *testing.T, adminDB *sqlx.DB) {
+	t.Helper()
+	ctx := context.Background()
+	var tables []string
+	if err := adminDB.SelectContext(ctx, &tables, "SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE()"); err != nil {
+		t.Fatalf("failed to list admin tables: %s", err)
+	}
+	for _, table := range tables {
+		if _, err := adminDB.ExecContext(ctx, "DROP TABLE `"+table+"`"); err != nil {
+			t.Fatalf("failed to drop %s: %s", table, err)
+		}
+	}
+	if _, err := migrateAdminDB(ctx, adminDB); err != nil {
+		t.Fatalf("failed to migrate admin DB: %s", err)
+	}
+}
+
+// APIを呼ぶ人
+// hostでテナントを、tokenでロールを決める
+type testViewer struct {
+	host  string
+	token string
+}
+
+// JWTに署名する
+// 中身はベンチマーカーが送るものと同じで、audにテナント名を入れる
+func (a *testApp) sign(t *testing.T, tenantName, role, subject string) string {
+	t.Helper()
+	tok := jwt.New()
+	for k, v := range map[string]any{
+		"iss":  "isuports",
+		"sub":  subject,
+		"aud":  []string{tenantName},
+		"role": role,
+		"iat":  testNow,
+		"exp":  testNow.Add(time.Hour),
+	} {
+		if err := tok.Set(k, v); err != nil {
+			t.Fatalf("failed to set %s: %s", k, err)
+		}
+	}
+	signed, err := jwt.Sign(tok, jwt.WithKey(jwa.RS256, a.key))
+	if err != nil {
+		t.Fatalf("failed to sign token: %s", err)
+	}
+	return string(signed)
+}
+
+func testHost(tenantName string) string {
+	return tenantName + getEnv("ISUCON_BASE_HOSTNAME", ".t.isucon.dev")
+}
+
+func (a *testApp) admin(t *testing.T) testViewer {
+	return testViewer{host: testHost("admin"), token: a.sign(t, "admin", RoleAdmin, "admin")}
+}
+
+func (a *testApp) organizer(t *testing.T, tenantName string) testViewer {
+	return testViewer{host: testHost(tenantName), token: a.sign(t, tenantName, RoleOrganizer, "organizer")}
+}
+
+func (a *testApp) player(t *testing.T, tenantName, playerID string) testViewer {
+	return testViewer{host: testHost(tenantName), token: a.sign(t, tenantName, RolePlayer, playerID)}
+}
+
+// リクエストを送ってレスポンスを返す
+func (a *testApp) do(t *testing.T, v testViewer, method, path, contentType string, body io.Reader) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, body)
+	req.Host = v.host
+	if contentType != "" {
+		req.Header.Set(echo.HeaderContentType, contentType)
+	}
+	if v.token != "" {
+		req.AddCookie(&http.Cookie{Name: cookieName, Value: v.token})
+	}
+	rec := httptest.NewRecorder()
+	a.e.ServeHTTP(rec, req)
+	return rec
+}
+
+func (a *testApp) get(t *testing.T, v testViewer, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	return a.do(t, v, http.MethodGet, path, "", nil)
+}
+
+func (a *testApp) postForm(t *testing.T, v testViewer, path string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	return a.do(t, v, http.MethodPost, path, echo.MIMEApplicationForm, strings.NewReader(form.Encode()))
+}
+
+// multipartでファイルを1つ送る
+func (a *testApp) postFile(t *testing.T, v testViewer, path, field, filename, content string) *httptest.ResponseRecorder {
+	t.Helper()
+	return a.postFileWithForm(t, v, path, nil, field, filename, content)
+}
+
+// multipartでフォームの値とファイルを1つ送る
+func (a *testApp) postFileWithForm(t *testing.T, v testViewer, path string, form url.Values, field, filename, content string) *httptest.ResponseRecorder {
+	t.Helper()
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for k, vs := range form {
+		for _, v := range vs {
+			mw.WriteField(k, v)
+		}
+	}
+	fw, err := mw.CreateFormFile(field, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fw, content)
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return a.do(t, v, http.MethodPost, path, mw.FormDataContentType(), &b)
+}
+
+// 200のSuccessResultであることを確かめ、dataをvに読む
+func decodeSuccess(t *testing.T, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	res := struct {
+		Status bool            `json:"status"`
+		Data   json.RawMessage `json:"data"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("invalid response: %s, %s", err, rec.Body.String())
+	}
+	if !res.Status {
+		t.Fatalf("status is false: %s", rec.Body.String())
+	}
+	if v == nil {
+		return
+	}
+	if err := json.Unmarshal(res.Data, v); err != nil {
+		t.Fatalf("invalid data: %s, %s", err, res.Data)
+	}
+}
+
+// テナントを作り、参加者と大会を追加してスコアを登録し、ランキングと課金レポートまでをAPIで通して確かめる
+func TestE2EScoreToBilling(t *testing.T) {
+	app := newTestApp(t)
+	admin := app.admin(t)
+
+	var tenantRes TenantsAddHandlerResult
+	decodeSuccess(t, app.postForm(t, admin, "/api/admin/tenants/add", url.Values{
+		"name":         {"e2e"},
+		"display_name": {"E2E"},
+	}), &tenantRes)
+	if tenantRes.Tenant.Name != "e2e" {
+		t.Fatalf("tenant = %+v", tenantRes.Tenant)
+	}
+	org := app.organizer(t, "e2e")
+
+	var playersRes PlayersAddHandlerResult
+	decodeSuccess(t, app.postForm(t, org, "/api/organizer/players/add", url.Values{
+		"display_name[]": {"alice", "bob", "carol", "dave"},
+	}), &playersRes)
+	if len(playersRes.Players) != 4 {
+		t.Fatalf("players = %+v", playersRes.Players)
+	}
+	alice, bob, carol, dave := playersRes.Players[0], playersRes.Players[1], playersRes.Players[2], playersRes.Players[3]
+
+	var compRes CompetitionsAddHandlerResult
+	decodeSuccess(t, app.postForm(t, org, "/api/organizer/competitions/add", url.Values{
+		"title": {"e2e competition"},
+	}), &compRes)
+	comp := compRes.Competition
+	if comp.Title != "e2e competition" || comp.IsFinished {
+		t.Fatalf("competition = %+v", comp)
+	}
+
+	// daveはスコアを登録せずにランキングを見るだけ
+	csv := fmt.Sprintf("player_id,score\n%s,100\n%s,300\n%s,200\n", alice.ID, bob.ID, carol.ID)
+	var scoreRes ScoreHandlerResult
+	decodeSuccess(t, app.postFile(t, org, "/api/organizer/competition/"+comp.ID+"/score", "scores", "scores.csv", csv), &scoreRes)
+	if scoreRes.Rows != 3 {
+		t.Fatalf("rows = %d, want 3", scoreRes.Rows)
+	}
+
+	for _, p := range []PlayerDetail{alice, dave} {
+		var rankingRes CompetitionRankingHandlerResult
+		decodeSuccess(t, app.get(t, app.player(t, "e2e", p.ID), "/api/player/competition/"+comp.ID+"/ranking"), &rankingRes)
+		got := []string{}
+		for _, r := range rankingRes.Ranks {
+			got = append(got, fmt.Sprintf("%d:%s:%d", r.Rank, r.PlayerDisplayName, r.Score))
+		}
+		want := []string{"1:bob:300", "2:carol:200", "3:alice:100"}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("ranking seen by %s = %v, want %v", p.DisplayName, got, want)
+		}
+	}
+
+	// 課金は終了した大会だけ
+	decodeSuccess(t, app.postForm(t, org, "/api/organizer/competition/"+comp.ID+"/finish", nil), nil)
+
+	var billingRes BillingHandlerResult
+	decodeSuccess(t, app.get(t, org, "/api/organizer/billing"), &billingRes)
+	if len(billingRes.Reports) != 1 {
+		t.Fatalf("reports = %+v", billingRes.Reports)
+	}
+	r := billingRes.Reports[0]
+	// スコアを登録した3人が100円、閲覧だけのdaveが10円
+	if r.CompetitionID != comp.ID || r.PlayerCount != 3 || r.VisitorCount != 1 || r.BillingYen != 310 {
+		t.Errorf("report = %+v", r)
+	}
+
+	var adminRes TenantsBillingHandlerResult
+	decodeSuccess(t, app.get(t, admin, "/api/admin/tenants/billing"), &adminRes)
+	if len(adminRes.Tenants) != 1 || adminRes.Tenants[0].Name != "e2e" || adminRes.Tenants[0].BillingYen != 310 {
+		t.Errorf("tenants = %+v", adminRes.Tenants)
+	}
+
+	// 他のテナントの管理者は課金レポートを見られない
+	if rec := app.get(t, app.organizer(t, "other"), "/api/organizer/billing"); rec.Code == http.StatusOK {
+		t.Errorf("billing of another tenant: status = %d", rec.Code)
+	}
+}
+
+func (a *testApp) ratings(t *testing.T, org testViewer) []string {
+	t.Helper()
+	var res RatingsHandlerResult
+	decodeSuccess(t, a.get(t, org, "/api/organizer/ratings"), &res)
+	got := []string{}
+	for _, r := range res.Ratings {
+		got = append(got, fmt.Sprintf("%s:%d:%d", r.PlayerDisplayName, r.Rating, r.Games))
+	}
+	return got
+}
+
+// 大会の終了と対戦の登録で少しずつ更新したレーティングと、訂正のあとにバックグラウンドで計算し直したレーティングが
+// 全ての結果から計算し直したものと同じになることを確かめる
+func TestE2ERatingsIncremental(t *testing.T) {
+	app := newTestApp(t)
+	decodeSuccess(t, app.postForm(t, app.admin(t), "/api/admin/tenants/add", url.Values{
+		"name":         {"rating"},
+		"display_name": {"Rating"},
+	}), nil)
+	org := app.organizer(t, "rating")
+
+	var playersRes PlayersAddHandlerResult
+	decodeSuccess(t, app.postForm(t, org, "/api/organizer/players/add", url.Values{
+		"display_name[]": {"alice", "bob", "carol"},
+	}), &playersRes)
+	alice, bob, carol := playersRes.Players[0], playersRes.Players[1], playersRes.Players[2]
+
+	addCompetition := func(title string) string {
+		var res CompetitionsAddHandlerResult
+		decodeSuccess(t, app.postForm(t, org, "/api/organizer/competitions/add", url.Values{"title": {title}}), &res)
+		return res.Competition.ID
+	}
+	uploadScores := func(compID, csv string) {
+		decodeSuccess(t, app.postFile(t, org, "/api/organizer/competition/"+compID+"/score", "scores", "scores.csv", csv), nil)
+	}
+	recomputed := func() []string {
+		decodeSuccess(t, app.postForm(t, org, "/api/organizer/ratings/recompute", nil), nil)
+		return app.ratings(t, org)
+	}
+
+	first := addCompetition("first")
+	uploadScores(first, fmt.Sprintf("player_id,score\n%s,100\n%s,300\n%s,200\n", alice.ID, bob.ID, carol.ID))
+	decodeSuccess(t, app.postForm(t, org, "/api/organizer/competition/"+first+"/finish", nil), nil)
+
+	// 対戦の結果で順位を決める大会は、対戦ごとに更新する
+	second := addCompetition("second")
+	for _, m := range [][2]string{{alice.ID, bob.ID}, {carol.ID, alice.ID}} {
+		decodeSuccess(t, app.postForm(t, org, "/api/organizer/competition/"+second+"/matches/add", url.Values{
+			"player_a_id": {m[0]},
+			"player_b_id": {m[1]},
+			"score_a":     {"3"},
+			"score_b":     {"1"},
+		}), nil)
+	}
+	decodeSuccess(t, app.postForm(t, org, "/api/organizer/competition/"+second+"/finish", nil), nil)
+
+	incremental := app.ratings(t, org)
+	if len(incremental) != 3 {
+		t.Fatalf("ratings = %v", incremental)
+	}
+	if want := recomputed(); strings.Join(incremental, ",") != strings.Join(want, ",") {
+		t.Errorf("incremental ratings = %v, want %v", incremental, want)
+	}
+
+	// 終了した大会の訂正はバックグラウンドで計算し直す
+	decodeSuccess(t, app.postFileWithForm(t, org, "/api/organizer/competition/"+first+"/score",
+		url.Values{"override": {"true"}, "reason": {"入力ミスの訂正"}},
+		"scores", "scores.csv", fmt.Sprintf("player_id,score\n%s,300\n%s,100\n%s,200\n", alice.ID, bob.ID, carol.ID),
+	), nil)
+	app.s.ratingRecomputes.wait()
+	corrected := app.ratings(t, org)
+	if strings.Join(corrected, ",") == strings.Join(incremental, ",") {
+		t.Errorf("ratings did not change after correction: %v", corrected)
+	}
+	if want := recomputed(); strings.Join(corrected, ",") != strings.Join(want, ",") {
+		t.Errorf("ratings after correction = %v, want %v", corrected, want)
+	}
+}
@@ -0,0 +1,264 @@
+package isuports
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// 500エラーとpanicの通知
+// ISUCON_SENTRY_DSN を設定するとSentryに送る
+// ISUCON_PANIC_WEBHOOK_URL を設定するとpanicだけをWebhookに送る
+// 他のサービスに送る場合は errorReporter を実装して errorReporters に追加する
+
+// 通知する内容
+type errorReport struct {
+	Message   string
+	Stack     string // panicの場合のみ
+	RequestID string
+	Method    string
+	URI       string
+	Route     string
+	Tenant    string
+	Time      time.Time
+}
+
+type errorReporter interface {
+	report(r errorReport)
+}
+
+var errorReporters = newErrorReportersFromConfig()
+
+func newErrorReportersFromConfig() []errorReporter {
+	var rs []errorReporter
+	if dsn := getEnv("ISUCON_SENTRY_DSN", ""); dsn != "" {
+		r, err := newSentryReporter(dsn)
+		if err != nil {
+			logger.Error("invalid ISUCON_SENTRY_DSN", zap.Error(err))
+		} else {
+			rs = append(rs, r)
+		}
+	}
+	if u := getEnv("ISUCON_PANIC_WEBHOOK_URL", ""); u != "" {
+		rs = append(rs, newPanicWebhookReporter(u))
+	}
+	return rs
+}
+
+// panicを起こしたリクエストのエラー
+// Recover middlewareで作り、errorResponseHandlerでスタックトレースつきで通知する
+type panicError struct {
+	err   error
+	stack []byte
+}
+
+func (e *panicError) Error() string { return "panic: " + e.err.Error() }
+func (e *panicError) Unwrap() error { return e.err }
+
+// リクエストの処理中に起きたエラーを通知する
+func reportRequestError(c echo.Context, err error) {
+	if len(errorReporters) == 0 {
+		return
+	}
+	req := c.Request()
+	r := errorReport{
+		Message:   err.Error(),
+		RequestID: requestIDFromContext(req.Context()),
+		Method:    req.Method,
+		URI:       req.RequestURI,
+		Route:     c.Path(),
+		Tenant:    strings.TrimSuffix(req.Host, getEnv("ISUCON_BASE_HOSTNAME", ".t.isucon.dev")),
+		Time:      time.Now(),
+	}
+	var pe *panicError
+	if errors.As(err, &pe) {
+		r.Stack = string(pe.stack)
+	}
+	for _, rep := range errorReporters {
+		rep.report(r)
+	}
+}
+
+// Sentryに送る
+// SDKは使わずに、store APIにイベントをJSONでPOSTする
+// https://develop.sentry.dev/sdk/store/
+type sentryReporter struct {
+	storeURL    string
+	publicKey   string
+	environment string
+	serverName  string
+	client      *http.Client
+	// リクエストの応答を遅らせないよう、送信は別のgoroutineで行う
+	// 送信が詰まった場合は捨てる
+	queue chan errorReport
+}
+
+// DSNは https://<public_key>@<host>/<project_id> の形式
+func newSentryReporter(dsn string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("public key is missing in DSN")
+	}
+	projectID := strings.Trim(u.Path, "/")
+	if projectID == "" {
+		return nil, fmt.Errorf("project id is missing in DSN")
+	}
+	hostname, _ := os.Hostname()
+	r := &sentryReporter{
+		storeURL:    fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, projectID),
+		publicKey:   u.User.Username(),
+		environment: getEnv("ISUCON_SENTRY_ENVIRONMENT", "production"),
+		serverName:  hostname,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		queue:       make(chan errorReport, 100),
+	}
+	go r.run()
+	return r, nil
+}
+
+func (s *sentryReporter) report(r errorReport) {
+	select {
+	case s.queue <- r:
+	default:
+	}
+}
+
+func (s *sentryReporter) run() {
+	for r := range s.queue {
+		if err := s.send(r); err != nil {
+			logger.Warn("failed to send error to sentry", zap.Error(err))
+		}
+	}
+}
+
+func (s *sentryReporter) send(r errorReport) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+	event := map[string]any{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   r.Time.UTC().Format(time.RFC3339),
+		"level":       "error",
+		"platform":    "go",
+		"logger":      "isuports",
+		"server_name": s.serverName,
+		"environment": s.environment,
+		"message":     r.Message,
+		"transaction": r.Route,
+		"tags": map[string]string{
+			"route":      r.Route,
+			"tenant":     r.Tenant,
+			"request_id": r.RequestID,
+		},
+		"request": map[string]string{
+			"method": r.Method,
+			"url":    r.URI,
+		},
+	}
+	if r.Stack != "" {
+		event["extra"] = map[string]string{"stack": r.Stack}
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.storeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf(
+		"Sentry sentry_version=7, sentry_client=isuports/1.0, sentry_timestamp=%d, sentry_key=%s",
+		time.Now().Unix(), s.publicKey,
+	))
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("status=%d, %s", res.StatusCode, msg)
+	}
+	return nil
+}
+
+// panicをWebhookに送る
+// SlackのIncoming Webhookでそのまま表示できるよう、textに概要を入れる
+type panicWebhookReporter struct {
+	url    string
+	client *http.Client
+	queue  chan errorReport
+}
+
+func newPanicWebhookReporter(u string) *panicWebhookReporter {
+	r := &panicWebhookReporter{
+		url:    u,
+		client: &http.Client{Timeout: 5 * time.Second},
+		queue:  make(chan errorReport, 100),
+	}
+	go r.run()
+	return r
+}
+
+func (w *panicWebhookReporter) report(r errorReport) {
+	if r.Stack == "" {
+		return
+	}
+	select {
+	case w.queue <- r:
+	default:
+	}
+}
+
+func (w *panicWebhookReporter) run() {
+	for r := range w.queue {
+		if err := w.send(r); err != nil {
+			logger.Warn("failed to send panic webhook", zap.Error(err))
+		}
+	}
+}
+
+func (w *panicWebhookReporter) send(r errorReport) error {
+	// スタックトレースは長くなるので先頭だけ送る
+	stack := r.Stack
+	if len(stack) > 4000 {
+		stack = stack[:4000]
+	}
+	body, err := json.Marshal(map[string]any{
+		"text":       fmt.Sprintf("panic in %s %s (tenant=%s, request_id=%s): %s", r.Method, r.Route, r.Tenant, r.RequestID, r.Message),
+		"code":       errorCodePanic,
+		"route":      r.Route,
+		"tenant":     r.Tenant,
+		"request_id": r.RequestID,
+		"uri":        r.URI,
+		"stack":      stack,
+		"time":       r.Time.Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	res, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("status=%d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package isuports
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 終了した大会のAtomフィード (RFC 4287)
+// テナントのクラブのサイトなどに大会の結果を転載するために、最近終了した大会とランキングへのリンクを返す
+// フィードリーダーはCookieを送れないので、読み取り専用のAPIトークン (apitoken.go を参照) をクエリのtokenでも受け付ける
+
+// フィードに載せる大会の数
+const feedEntryLimit = 50
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID      string   `xml:"id"`
+	Title   string   `xml:"title"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Summary string   `xml:"summary"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// フィード向けAPI
+// GET /feeds/competitions.atom
+// 最近終了した大会をAtom形式で取得する
+func competitionsAtomHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewerWithTokenParam(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RolePlayer && v.role != RoleReader {
+		return echo.NewHTTPError(http.StatusForbidden, "role player required")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	if v.role == RolePlayer {
+		if err := authorizePlayer(ctx, tenantDB, v.tenantID, v.playerID); err != nil {
+			return err
+		}
+	}
+
+	tenant, err := retrieveTenantRowFromHeader(c)
+	if err != nil {
+		return fmt.Errorf("error retrieveTenantRowFromHeader: %w", err)
+	}
+	cs := []CompetitionRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&cs,
+		"SELECT * FROM competition WHERE tenant_id=? AND finished_at IS NOT NULL ORDER BY finished_at DESC LIMIT ?",
+		v.tenantID, feedEntryLimit,
+	); err != nil {
+		return fmt.Errorf("error Select competition: %w", err)
+	}
+
+	base := fmt.Sprintf("%s://%s", c.Scheme(), c.Request().Host)
+	self := base + c.Request().URL.Path
+	// 取得したトークンをフィードのURLに残さない
+	if q := c.Request().URL.Query(); len(q) > 0 {
+		q.Del("token")
+		if len(q) > 0 {
+			self += "?" + q.Encode()
+		}
+	}
+	feed := atomFeed{
+		ID:      fmt.Sprintf("urn:isuports:%s:competitions", tenant.Name),
+		Title:   tenant.DisplayName + " 終了した大会",
+		Updated: time.Unix(0, 0).UTC().Format(time.RFC3339),
+		Author:  tenant.DisplayName,
+		Links:   []atomLink{{Href: self, Rel: "self", Type: "application/atom+xml"}},
+		Entries: make([]atomEntry, 0, len(cs)),
+	}
+	if len(cs) > 0 {
+		// 最後に終了した大会の日時をフィードの更新日時にする
+		feed.Updated = time.Unix(cs[0].FinishedAt.Int64, 0).UTC().Format(time.RFC3339)
+	}
+	for _, comp := range cs {
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      fmt.Sprintf("urn:isuports:%s:competition:%s", tenant.Name, comp.ID),
+			Title:   comp.Title,
+			Updated: time.Unix(comp.FinishedAt.Int64, 0).UTC().Format(time.RFC3339),
+			Link: atomLink{
+				Href: fmt.Sprintf("%s/api/player/competition/%s/ranking", base, url.PathEscape(comp.ID)),
+				Rel:  "alternate",
+				Type: "application/json",
+			},
+			Summary: fmt.Sprintf("%s が終了しました", comp.Title),
+		})
+	}
+
+	b, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error xml.MarshalIndent: %w", err)
+	}
+	return c.Blob(http.StatusOK, "application/atom+xml; charset=utf-8", append([]byte(xml.Header), b...))
+}
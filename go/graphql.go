@@ -0,0 +1,487 @@
+package isuports
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/graph-gophers/graphql-go"
+	"github.com/labstack/echo/v4"
+)
+
+// テナントのフロントエンド向けのGraphQL API (graphql/schema.graphql)
+// GET /api/graphql?query=...&variables=... または POST /api/graphql {"query": ..., "operationName": ..., "variables": ...}
+//
+// クエリの解析、検証、実行は graph-gophers/graphql-go で行い、ここではリゾルバを実装している
+// 認証はREST APIと同じparseViewerで1回だけ行い、各フィールドのリゾルバがREST APIと同じロールの判定をする
+// 権限のないフィールドや見つからない参加者・大会はnullにしてerrorsに理由を入れ、他のフィールドは返す
+// (ロールによって返せないフィールドは、スキーマでnullableにしてある)
+// mutationには対応していない
+
+// クエリのネストの上限
+const graphqlMaxDepth = 10
+
+// Competition.ranking で1回に返す件数 (GET /api/player/competition/:competition_id/ranking と同じ)
+const graphqlRankingLimit = 100
+
+//go:embed graphql/schema.graphql
+var graphqlSchemaString string
+
+var graphqlSchema = graphql.MustParseSchema(graphqlSchemaString, &graphqlResolver{}, graphql.MaxDepth(graphqlMaxDepth))
+
+type graphqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// 検証に失敗したクエリや引数
+func graphqlInvalid(field, message string) error {
+	return &requestError{fields: []FieldError{{Field: field, Code: fieldErrInvalid, Message: message}}}
+}
+
+// GET/POST /api/graphql
+func graphqlHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return err
+	}
+	if v.role == RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "role admin is not allowed")
+	}
+
+	req, err := bindGraphqlRequest(c)
+	if err != nil {
+		return err
+	}
+	// 解析や検証に失敗するクエリでは、テナントDBを開かずにerrorsだけを返す
+	if errs := graphqlSchema.ValidateWithVariables(req.Query, req.Variables); len(errs) > 0 {
+		return c.JSON(http.StatusBadRequest, &graphql.Response{Errors: errs})
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	if v.role == RolePlayer {
+		if err := authorizePlayer(ctx, tenantDB, v.tenantID, v.playerID); err != nil {
+			return err
+		}
+	}
+
+	q := &graphqlQuery{
+		c:        c,
+		v:        v,
+		tenantDB: tenantDB,
+		ranks:    map[string][]CompetitionRank{},
+		visited:  map[string]bool{},
+	}
+	res := graphqlSchema.Exec(context.WithValue(ctx, graphqlQueryKey{}, q), req.Query, req.OperationName, req.Variables)
+	if res.Data == nil {
+		// operationNameが見つからないなど、実行前に失敗した
+		return c.JSON(http.StatusBadRequest, res)
+	}
+	for _, e := range res.Errors {
+		if e.ResolverError != nil {
+			e.Message = q.errorMessage(e.ResolverError)
+		}
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func bindGraphqlRequest(c echo.Context) (*graphqlRequest, error) {
+	req := &graphqlRequest{}
+	if c.Request().Method == http.MethodGet {
+		req.Query = c.QueryParam("query")
+		req.OperationName = c.QueryParam("operationName")
+		if vs := c.QueryParam("variables"); vs != "" {
+			if err := json.Unmarshal([]byte(vs), &req.Variables); err != nil {
+				return nil, graphqlInvalid("variables", "variables must be a JSON object")
+			}
+		}
+	} else {
+		if err := json.NewDecoder(c.Request().Body).Decode(req); err != nil {
+			return nil, graphqlInvalid("body", "body must be a JSON object")
+		}
+	}
+	if req.Query == "" {
+		return nil, &requestError{fields: []FieldError{{Field: "query", Code: fieldErrRequired, Message: "query is required"}}}
+	}
+	return req, nil
+}
+
+// 1回のクエリの実行中の状態
+// リゾルバはcontextから取り出して使う
+type graphqlQuery struct {
+	c        echo.Context
+	v        *Viewer
+	tenantDB *tenantDBConn
+
+	// 1回のクエリの中で同じものを何度も読まないようにする
+	// リゾルバは並行に呼ばれるのでmuで守る
+	mu      sync.Mutex
+	ranks   map[string][]CompetitionRank
+	billing []BillingReport
+	visited map[string]bool
+}
+
+type graphqlQueryKey struct{}
+
+func graphqlQueryFrom(ctx context.Context) *graphqlQuery {
+	return ctx.Value(graphqlQueryKey{}).(*graphqlQuery)
+}
+
+// リゾルバのエラーをレスポンスのerrorsに入れるメッセージにする
+// REST APIでクライアントに理由を返しているエラーは同じ理由を、それ以外はログに残して内部エラーとだけ返す
+func (q *graphqlQuery) errorMessage(err error) string {
+	var nfe *notFoundError
+	var re *requestError
+	var he *echo.HTTPError
+	switch {
+	case errors.As(err, &nfe):
+		return nfe.Error()
+	case errors.As(err, &re):
+		return re.Error()
+	case errors.As(err, &he) && he.Code < http.StatusInternalServerError:
+		return fmt.Sprint(he.Message)
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return err.Error()
+	}
+	logRequestError(q.c, err)
+	if isDevelopment() {
+		return err.Error()
+	}
+	return "internal server error"
+}
+
+// GET /api/player/competition/:competition_id/ranking と同じ順位
+func (q *graphqlQuery) competitionRanks(ctx context.Context, competitionID string) ([]CompetitionRank, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if ranks, ok := q.ranks[competitionID]; ok {
+		return ranks, nil
+	}
+	ranks, err := competitionRanks(ctx, q.tenantDB, q.v.tenantID, competitionID)
+	if err != nil {
+		return nil, err
+	}
+	q.ranks[competitionID] = ranks
+	return ranks, nil
+}
+
+// APIトークンでの閲覧は参加者の訪問ではないので課金の対象にしない
+// 同じクエリで同じ大会のランキングを何度参照しても訪問は1回にする
+func (q *graphqlQuery) visit(ctx context.Context, competitionID string) {
+	if q.v.role != RolePlayer {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.visited[competitionID] {
+		return
+	}
+	q.visited[competitionID] = true
+	now := srv(ctx).clock.Now().Unix()
+	srv(ctx).visits.record(VisitHistoryRow{q.v.playerID, q.v.tenantID, competitionID, now, now})
+}
+
+// 課金レポートはREST APIと同じく、同じテナントへの同時アクセスの集計を1回にまとめる
+func (q *graphqlQuery) billingReports(ctx context.Context) ([]BillingReport, error) {
+	if err := graphqlRequireRole(q.v, RoleOrganizer); err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.billing != nil {
+		return q.billing, nil
+	}
+	tbrs, err := srv(ctx).billingFlight.Do(ctx, strconv.FormatInt(q.v.tenantID, 10), func(ctx context.Context) ([]BillingReport, error) {
+		return tenantBillingReports(ctx, q.tenantDB, q.v.tenantID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	q.billing = tbrs
+	return tbrs, nil
+}
+
+func graphqlRequireRole(v *Viewer, roles ...string) error {
+	for _, r := range roles {
+		if v.role == r {
+			return nil
+		}
+	}
+	return echo.NewHTTPError(http.StatusForbidden, "role "+roles[0]+" required")
+}
+
+// GraphQLのIntは32bitなので、超える値はエラーにする
+func graphqlInt(n int64) (int32, error) {
+	if n < math.MinInt32 || n > math.MaxInt32 {
+		return 0, fmt.Errorf("value %d overflows GraphQL Int", n)
+	}
+	return int32(n), nil
+}
+
+// リゾルバ
+// ロールの判定は対応するREST APIのハンドラと同じにする
+
+// Query
+type graphqlResolver struct{}
+
+// GET /api/me
+func (*graphqlResolver) Me(ctx context.Context) (*graphqlPlayer, error) {
+	q := graphqlQueryFrom(ctx)
+	if err := graphqlRequireRole(q.v, RolePlayer); err != nil {
+		return nil, err
+	}
+	return graphqlRetrievePlayer(ctx, q.v.playerID)
+}
+
+// GET /api/player/player/:player_id
+func (*graphqlResolver) Player(ctx context.Context, args struct{ ID graphql.ID }) (*graphqlPlayer, error) {
+	q := graphqlQueryFrom(ctx)
+	if err := graphqlRequireRole(q.v, RolePlayer, RoleOrganizer); err != nil {
+		return nil, err
+	}
+	return graphqlRetrievePlayer(ctx, string(args.ID))
+}
+
+// GET /api/organizer/players
+func (*graphqlResolver) Players(ctx context.Context) (*[]*graphqlPlayer, error) {
+	q := graphqlQueryFrom(ctx)
+	if err := graphqlRequireRole(q.v, RoleOrganizer); err != nil {
+		return nil, err
+	}
+	var pls []PlayerRow
+	if err := q.tenantDB.SelectContext(
+		ctx,
+		&pls,
+		"SELECT * FROM player WHERE tenant_id=? ORDER BY created_at DESC",
+		q.v.tenantID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select player: %w", err)
+	}
+	res := make([]*graphqlPlayer, 0, len(pls))
+	for i := range pls {
+		res = append(res, &graphqlPlayer{&pls[i]})
+	}
+	return &res, nil
+}
+
+// GET /api/player/competitions と GET /api/organizer/competitions の大会
+func (*graphqlResolver) Competition(ctx context.Context, args struct{ ID graphql.ID }) (*graphqlCompetition, error) {
+	q := graphqlQueryFrom(ctx)
+	if err := graphqlRequireRole(q.v, RolePlayer, RoleReader, RoleOrganizer); err != nil {
+		return nil, err
+	}
+	return graphqlRetrieveCompetition(ctx, string(args.ID))
+}
+
+// GET /api/player/competitions と GET /api/organizer/competitions
+func (*graphqlResolver) Competitions(ctx context.Context) ([]*graphqlCompetition, error) {
+	q := graphqlQueryFrom(ctx)
+	if err := graphqlRequireRole(q.v, RolePlayer, RoleReader, RoleOrganizer); err != nil {
+		return nil, err
+	}
+	cs := []CompetitionRow{}
+	if err := q.tenantDB.SelectContext(
+		ctx,
+		&cs,
+		"SELECT * FROM competition WHERE tenant_id=? ORDER BY created_at DESC",
+		q.v.tenantID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select competition: %w", err)
+	}
+	res := make([]*graphqlCompetition, 0, len(cs))
+	for i := range cs {
+		res = append(res, &graphqlCompetition{&cs[i]})
+	}
+	return res, nil
+}
+
+// GET /api/organizer/billing
+func (*graphqlResolver) Billing(ctx context.Context) (*[]*graphqlBillingReport, error) {
+	reports, err := graphqlQueryFrom(ctx).billingReports(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*graphqlBillingReport, 0, len(reports))
+	for _, r := range reports {
+		res = append(res, &graphqlBillingReport{r})
+	}
+	return &res, nil
+}
+
+func graphqlRetrievePlayer(ctx context.Context, id string) (*graphqlPlayer, error) {
+	q := graphqlQueryFrom(ctx)
+	p, err := retrievePlayer(ctx, q.tenantDB, q.v.tenantID, id)
+	if err != nil {
+		return nil, err
+	}
+	return &graphqlPlayer{p}, nil
+}
+
+func graphqlRetrieveCompetition(ctx context.Context, id string) (*graphqlCompetition, error) {
+	q := graphqlQueryFrom(ctx)
+	comp, err := retrieveCompetition(ctx, q.tenantDB, q.v.tenantID, id)
+	if err != nil {
+		return nil, err
+	}
+	return &graphqlCompetition{comp}, nil
+}
+
+// Player
+type graphqlPlayer struct {
+	row *PlayerRow
+}
+
+func (p *graphqlPlayer) ID() graphql.ID {
+	return graphql.ID(p.row.ID)
+}
+
+func (p *graphqlPlayer) DisplayName() string {
+	return p.row.DisplayName
+}
+
+func (p *graphqlPlayer) IsDisqualified() bool {
+	return p.row.IsDisqualified
+}
+
+// GET /api/player/player/:player_id の scores
+func (p *graphqlPlayer) Scores(ctx context.Context) (*[]*graphqlPlayerScore, error) {
+	q := graphqlQueryFrom(ctx)
+	if err := graphqlRequireRole(q.v, RolePlayer, RoleOrganizer); err != nil {
+		return nil, err
+	}
+	scores, err := loadPlayerScores(ctx, q.tenantDB, q.v.tenantID, p.row.ID)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*graphqlPlayerScore, 0, len(scores))
+	for _, s := range scores {
+		res = append(res, &graphqlPlayerScore{s})
+	}
+	return &res, nil
+}
+
+// PlayerScore
+type graphqlPlayerScore struct {
+	s playerCompetitionScore
+}
+
+func (s *graphqlPlayerScore) Competition(ctx context.Context) (*graphqlCompetition, error) {
+	return graphqlRetrieveCompetition(ctx, s.s.CompID)
+}
+
+func (s *graphqlPlayerScore) Score() (int32, error) {
+	return graphqlInt(s.s.Score)
+}
+
+// Competition
+type graphqlCompetition struct {
+	row *CompetitionRow
+}
+
+func (c *graphqlCompetition) ID() graphql.ID {
+	return graphql.ID(c.row.ID)
+}
+
+func (c *graphqlCompetition) Title() string {
+	return c.row.Title
+}
+
+func (c *graphqlCompetition) IsFinished() bool {
+	return c.row.FinishedAt.Valid
+}
+
+// GET /api/player/competition/:competition_id/ranking
+func (c *graphqlCompetition) Ranking(ctx context.Context, args struct{ RankAfter int32 }) (*[]*graphqlRank, error) {
+	q := graphqlQueryFrom(ctx)
+	if err := graphqlRequireRole(q.v, RolePlayer, RoleReader); err != nil {
+		return nil, err
+	}
+	if args.RankAfter < 0 {
+		return nil, &requestError{fields: []FieldError{{Field: "rankAfter", Code: fieldErrMin, Message: "rankAfter must be 0 or greater"}}}
+	}
+	q.visit(ctx, c.row.ID)
+
+	ranks, err := q.competitionRanks(ctx, c.row.ID)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*graphqlRank, 0, graphqlRankingLimit)
+	for i := int(args.RankAfter); i < len(ranks) && len(res) < graphqlRankingLimit; i++ {
+		r := ranks[i]
+		r.Rank = int64(i + 1)
+		res = append(res, &graphqlRank{r})
+	}
+	return &res, nil
+}
+
+func (c *graphqlCompetition) Billing(ctx context.Context) (*graphqlBillingReport, error) {
+	reports, err := graphqlQueryFrom(ctx).billingReports(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range reports {
+		if r.CompetitionID == c.row.ID {
+			return &graphqlBillingReport{r}, nil
+		}
+	}
+	return nil, nil
+}
+
+// Rank
+type graphqlRank struct {
+	r CompetitionRank
+}
+
+func (r *graphqlRank) Rank() (int32, error) {
+	return graphqlInt(r.r.Rank)
+}
+
+func (r *graphqlRank) Score() (int32, error) {
+	return graphqlInt(r.r.Score)
+}
+
+func (r *graphqlRank) Player(ctx context.Context) (*graphqlPlayer, error) {
+	return graphqlRetrievePlayer(ctx, r.r.PlayerID)
+}
+
+// BillingReport
+type graphqlBillingReport struct {
+	r BillingReport
+}
+
+func (b *graphqlBillingReport) Competition(ctx context.Context) (*graphqlCompetition, error) {
+	return graphqlRetrieveCompetition(ctx, b.r.CompetitionID)
+}
+
+func (b *graphqlBillingReport) PlayerCount() (int32, error) {
+	return graphqlInt(b.r.PlayerCount)
+}
+
+func (b *graphqlBillingReport) VisitorCount() (int32, error) {
+	return graphqlInt(b.r.VisitorCount)
+}
+
+func (b *graphqlBillingReport) BillingPlayerYen() (int32, error) {
+	return graphqlInt(b.r.BillingPlayerYen)
+}
+
+func (b *graphqlBillingReport) BillingVisitorYen() (int32, error) {
+	return graphqlInt(b.r.BillingVisitorYen)
+}
+
+func (b *graphqlBillingReport) BillingYen() (int32, error) {
+	return graphqlInt(b.r.BillingYen)
+}
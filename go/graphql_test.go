@@ -0,0 +1,160 @@
+package isuports
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type testGraphqlResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+		Path    []any  `json:"path"`
+	} `json:"errors"`
+}
+
+func (a *testApp) graphql(t *testing.T, v testViewer, query string, variables map[string]any) *httptest.ResponseRecorder {
+	t.Helper()
+	b, err := json.Marshal(graphqlRequest{Query: query, Variables: variables})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.do(t, v, http.MethodPost, "/api/graphql", "application/json", strings.NewReader(string(b)))
+}
+
+func decodeGraphql(t *testing.T, rec *httptest.ResponseRecorder, code int) testGraphqlResponse {
+	t.Helper()
+	if rec.Code != code {
+		t.Fatalf("status = %d, want %d, body = %s", rec.Code, code, rec.Body.String())
+	}
+	var res testGraphqlResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("invalid response: %s, %s", err, rec.Body.String())
+	}
+	return res
+}
+
+// エラーを "path: message" の形にしてソートする (リゾルバは並行に呼ばれるので順番は決まらない)
+func (r testGraphqlResponse) errorStrings() []string {
+	var es []string
+	for _, e := range r.Errors {
+		var p []string
+		for _, s := range e.Path {
+			p = append(p, fmt.Sprint(s))
+		}
+		es = append(es, strings.Join(p, ".")+": "+e.Message)
+	}
+	sort.Strings(es)
+	return es
+}
+
+func TestGraphql(t *testing.T) {
+	app := newTestApp(t)
+	decodeSuccess(t, app.postForm(t, app.admin(t), "/api/admin/tenants/add", url.Values{
+		"name":         {"graphql"},
+		"display_name": {"GraphQL"},
+	}), nil)
+	org := app.organizer(t, "graphql")
+
+	var playersRes PlayersAddHandlerResult
+	decodeSuccess(t, app.postForm(t, org, "/api/organizer/players/add", url.Values{
+		"display_name[]": {"alice", "bob"},
+	}), &playersRes)
+	alice, bob := playersRes.Players[0], playersRes.Players[1]
+	var compRes CompetitionsAddHandlerResult
+	decodeSuccess(t, app.postForm(t, org, "/api/organizer/competitions/add", url.Values{"title": {"graphql competition"}}), &compRes)
+	compID := compRes.Competition.ID
+	csv := fmt.Sprintf("player_id,score\n%s,100\n%s,200\n", alice.ID, bob.ID)
+	decodeSuccess(t, app.postFile(t, org, "/api/organizer/competition/"+compID+"/score", "scores", "scores.csv", csv), nil)
+	player := app.player(t, "graphql", alice.ID)
+
+	tests := []struct {
+		name      string
+		v         testViewer
+		query     string
+		variables map[string]any
+		data      string
+		errors    []string
+	}{
+		{
+			name: "player reads ranking with variables",
+			v:    player,
+			query: `query Ranking($id: ID!, $after: Int) {
+				me { displayName }
+				competition(id: $id) { title ranking(rankAfter: $after) { rank score player { displayName } } }
+			}`,
+			variables: map[string]any{"id": compID, "after": 1},
+			data:      `{"me":{"displayName":"alice"},"competition":{"title":"graphql competition","ranking":[{"rank":2,"score":100,"player":{"displayName":"alice"}}]}}`,
+		},
+		{
+			name:   "fields the role cannot read are null with errors",
+			v:      player,
+			query:  `{ me { id } players { id } billing { billingYen } }`,
+			data:   fmt.Sprintf(`{"me":{"id":%q},"players":null,"billing":null}`, alice.ID),
+			errors: []string{"billing: role organizer required", "players: role organizer required"},
+		},
+		{
+			name:   "organizer cannot read ranking",
+			v:      org,
+			query:  `{ competitions { title ranking { rank } report: billing { playerCount } } }`,
+			data:   `{"competitions":[{"title":"graphql competition","ranking":null,"report":{"playerCount":0}}]}`,
+			errors: []string{"competitions.0.ranking: role player required"},
+		},
+		{
+			name:   "not found",
+			v:      org,
+			query:  `{ player(id: "unknown") { id } }`,
+			data:   `{"player":null}`,
+			errors: []string{"player: player not found"},
+		},
+		{
+			name:   "negative rankAfter",
+			v:      player,
+			query:  fmt.Sprintf(`{ competition(id: %q) { ranking(rankAfter: -1) { rank } } }`, compID),
+			data:   `{"competition":{"ranking":null}}`,
+			errors: []string{"competition.ranking: rankAfter must be 0 or greater"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := decodeGraphql(t, app.graphql(t, tt.v, tt.query, tt.variables), http.StatusOK)
+			if string(res.Data) != tt.data {
+				t.Errorf("data = %s, want %s", res.Data, tt.data)
+			}
+			if got := res.errorStrings(); strings.Join(got, "\n") != strings.Join(tt.errors, "\n") {
+				t.Errorf("errors = %q, want %q", got, tt.errors)
+			}
+		})
+	}
+
+	// 解析や検証に失敗したクエリは実行せずに400を返す
+	invalid := []string{
+		`{ me { id `,
+		`{ me { unknown } }`,
+		`{ competitions }`,
+		`mutation { me { id } }`,
+		`{ me { scores { competition { ranking { player { scores { competition { ranking { player { scores { score } } } } } } } } } } }`,
+	}
+	for _, q := range invalid {
+		res := decodeGraphql(t, app.graphql(t, player, q, nil), http.StatusBadRequest)
+		if res.Data != nil || len(res.Errors) == 0 {
+			t.Errorf("%s: response = %+v, want errors only", q, res)
+		}
+	}
+
+	// GETでも同じクエリを実行できる
+	rec := app.get(t, player, "/api/graphql?"+url.Values{"query": {"{ me { displayName } }"}}.Encode())
+	if res := decodeGraphql(t, rec, http.StatusOK); string(res.Data) != `{"me":{"displayName":"alice"}}` {
+		t.Errorf("GET data = %s", res.Data)
+	}
+
+	if rec := app.graphql(t, app.admin(t), `{ competitions { id } }`, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("admin: status = %d, want 403", rec.Code)
+	}
+}
@@ -0,0 +1,387 @@
+package isuports
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	isuportsv1 "github.com/isucon/isucon12-qualify/webapp/go/proto/isuports/v1"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// 計測機器のベンダー向けのgRPC API (proto/isuports/v1/isuports.proto)
+// マルチパートのCSVの代わりに、型のついたストリーミングでスコアを送れるようにする
+// ISUCON_GRPC_ADDR を設定すると、HTTPのAPIとは別のポートで待ち受ける
+// TLSの設定 (tls.go を参照) があればTLS、なければ平文のHTTP/2で待ち受ける
+//
+// サーバーは google.golang.org/grpc で、メッセージとサービスの型は protoc で生成したもの (proto/isuports/v1) を使う
+//
+// 認証はHTTPのAPIと同じJWTかAPIトークンを authorization メタデータで "Bearer <token>" として渡し、テナントは :authority で判別する
+// 各メソッドはHTTPのAPIと同じ権限で、同じテナントDBの処理を使う
+//
+//	UploadScores      organizer        POST /api/organizer/competition/:competition_id/score
+//	GetRanking        player, reader   GET /api/player/competition/:competition_id/ranking
+//	ListCompetitions  organizer        GET /api/organizer/competitions
+
+// GetRankingで1回に返す順位の数 (HTTPのAPIのデフォルトと同じ)
+const grpcRankingPageSize = 100
+
+// gRPCのリスナーを起動する
+// ISUCON_GRPC_ADDR が未設定なら起動しない
+func startGRPCServer(s *Server) (*grpc.Server, error) {
+	addr := getEnv("ISUCON_GRPC_ADDR", "")
+	if addr == "" {
+		return nil, nil
+	}
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	var opts []grpc.ServerOption
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	gs := newGRPCServer(s, opts...)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error net.Listen: addr=%s, %w", addr, err)
+	}
+	go gs.Serve(ln)
+	return gs, nil
+}
+
+// ScoreServiceを登録したgRPCのサーバーを作る
+func newGRPCServer(s *Server, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			res, err := handler(withServer(ctx, s), req)
+			return res, grpcError(info.FullMethod, err)
+		}),
+		grpc.ChainStreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			err := handler(srv, &grpcServerStream{ServerStream: ss, ctx: withServer(ss.Context(), s)})
+			return grpcError(info.FullMethod, err)
+		}),
+	)
+	gs := grpc.NewServer(opts...)
+	isuportsv1.RegisterScoreServiceServer(gs, &scoreService{echo: echo.New()})
+	return gs
+}
+
+// Serverを入れたcontextを返すServerStream
+type grpcServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss *grpcServerStream) Context() context.Context {
+	return ss.ctx
+}
+
+// ハンドラのエラーをgRPCのステータスにする
+// 内部のエラーはログに残す
+func grpcError(method string, err error) error {
+	if err == nil {
+		return nil
+	}
+	st := grpcStatusOf(err)
+	if st.Code() == codes.Internal {
+		logger.Error("grpc request failed", zap.String("method", method), zap.Error(err))
+	}
+	return st.Err()
+}
+
+// errorResponseHandler と同じ分類でgRPCのステータスにする
+func grpcStatusOf(err error) *status.Status {
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		return se.GRPCStatus()
+	}
+	if errors.Is(err, context.Canceled) {
+		return status.New(codes.Canceled, "canceled")
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return status.New(codes.DeadlineExceeded, "deadline exceeded")
+	}
+	var ie *ingestError
+	if errors.As(err, &ie) {
+		return status.New(codes.InvalidArgument, ie.Error())
+	}
+	var cfe *competitionFinishedError
+	if errors.As(err, &cfe) {
+		return status.New(codes.FailedPrecondition, cfe.Error())
+	}
+	var tme *tenantDBMissingError
+	if errors.As(err, &tme) {
+		return status.New(codes.Unavailable, errorCodeTenantDBUnavailable)
+	}
+	var ce *conflictError
+	if errors.As(err, &ce) {
+		return status.New(codes.AlreadyExists, ce.Error())
+	}
+	var re *requestError
+	if errors.As(err, &re) {
+		return status.New(codes.InvalidArgument, re.Error())
+	}
+	var nfe *notFoundError
+	if errors.As(err, &nfe) {
+		return status.New(codes.NotFound, nfe.Error())
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		msg := fmt.Sprint(he.Message)
+		switch he.Code {
+		case http.StatusBadRequest:
+			return status.New(codes.InvalidArgument, msg)
+		case http.StatusUnauthorized:
+			return status.New(codes.Unauthenticated, msg)
+		case http.StatusForbidden:
+			return status.New(codes.PermissionDenied, msg)
+		case http.StatusNotFound:
+			return status.New(codes.NotFound, msg)
+		case http.StatusConflict:
+			return status.New(codes.AlreadyExists, msg)
+		case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+			return status.New(codes.ResourceExhausted, msg)
+		case http.StatusServiceUnavailable:
+			return status.New(codes.Unavailable, msg)
+		}
+	}
+	// 内部のエラーはHTTPのAPIと同じく開発環境でだけ返す
+	if isDevelopment() {
+		return status.New(codes.Internal, err.Error())
+	}
+	return status.New(codes.Internal, "internal error")
+}
+
+type scoreService struct {
+	isuportsv1.UnimplementedScoreServiceServer
+	// parseViewerなどechoのContextを受け取る関数を使うためのもの
+	echo *echo.Echo
+}
+
+// メタデータをHTTPのリクエストに見立てたechoのContextを返す
+// :authority をHostに、authorizationとcookieをヘッダにする
+func (ss *scoreService) echoContext(ctx context.Context) echo.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	r := (&http.Request{Method: http.MethodPost, Header: http.Header{}}).WithContext(ctx)
+	if v := md.Get(":authority"); len(v) > 0 {
+		r.Host = v[0]
+	}
+	for _, k := range []string{echo.HeaderAuthorization, "Cookie"} {
+		for _, v := range md.Get(k) {
+			r.Header.Add(k, v)
+		}
+	}
+	return ss.echo.NewContext(r, nil)
+}
+
+// authorizationメタデータのJWTかAPIトークンからViewerを返す
+// クッキーで送ってきた場合もHTTPのAPIと同じように受け付ける
+func (ss *scoreService) viewer(ctx context.Context) (*Viewer, error) {
+	c := ss.echoContext(ctx)
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	if token := strings.TrimPrefix(auth, "Bearer "); token != auth && !strings.HasPrefix(token, apiTokenPrefix) {
+		return parseJWTViewer(c, token)
+	}
+	return parseViewer(c)
+}
+
+// UploadScores
+// 最初のメッセージの大会IDに、以降のメッセージのスコアを順にCSVの行として importScores に渡す
+func (ss *scoreService) UploadScores(stream isuportsv1.ScoreService_UploadScoresServer) error {
+	ctx := stream.Context()
+	v, err := ss.viewer(ctx)
+	if err != nil {
+		return err
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	first, err := stream.Recv()
+	if errors.Is(err, io.EOF) {
+		return status.Error(codes.InvalidArgument, "request message required")
+	}
+	if err != nil {
+		return err
+	}
+	competitionID := first.GetCompetitionId()
+	if first.GetRow() != nil || competitionID == "" {
+		return status.Error(codes.InvalidArgument, "first message must be competition_id")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	comp, err := retrieveCompetition(ctx, tenantDB, v.tenantID, competitionID)
+	if err != nil {
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	if comp.FinishedAt.Valid {
+		return &competitionFinishedError{competitionID: comp.ID}
+	}
+
+	sr := newGRPCScoreReader(stream)
+	res, q, err := importScores(ctx, tenantDB, v.tenantID, competitionID, scoreImportOptions{}, sr, ingestFormatCSV)
+	// ストリームが壊れていた場合は、途中までの行の検証の結果よりも先に返す
+	if sr.err != nil {
+		return sr.err
+	}
+	if err != nil {
+		return err
+	}
+	if q != nil {
+		return status.Errorf(codes.ResourceExhausted, "tenant quota exceeded: %s, limit=%v", q.Quota, q.Limit)
+	}
+	return stream.SendAndClose(&isuportsv1.UploadScoresResponse{Rows: res.Rows})
+}
+
+// ScoreRowのストリームをヘッダ付きのCSVとして読めるようにする
+// 読まれた分だけメッセージを受け取るので、大きなアップロードでもメモリに溜めない
+type grpcScoreReader struct {
+	stream isuportsv1.ScoreService_UploadScoresServer
+	buf    bytes.Buffer
+	csv    *csv.Writer
+	eof    bool
+	// ストリームの受信に失敗した理由
+	err error
+}
+
+func newGRPCScoreReader(stream isuportsv1.ScoreService_UploadScoresServer) *grpcScoreReader {
+	r := &grpcScoreReader{stream: stream}
+	r.csv = csv.NewWriter(&r.buf)
+	r.csv.Write([]string{"player_id", "score"})
+	r.csv.Flush()
+	return r
+}
+
+func (r *grpcScoreReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.eof {
+			return 0, io.EOF
+		}
+		m, err := r.stream.Recv()
+		if errors.Is(err, io.EOF) {
+			r.eof = true
+			continue
+		}
+		if err != nil {
+			r.err = err
+			continue
+		}
+		row := m.GetRow()
+		if row == nil {
+			r.err = status.Error(codes.InvalidArgument, "competition_id must be sent only in the first message")
+			continue
+		}
+		r.csv.Write([]string{row.PlayerId, strconv.FormatInt(row.Score, 10)})
+		r.csv.Flush()
+	}
+	return r.buf.Read(p)
+}
+
+// GetRanking
+func (ss *scoreService) GetRanking(ctx context.Context, req *isuportsv1.GetRankingRequest) (*isuportsv1.GetRankingResponse, error) {
+	v, err := ss.viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if v.role != RolePlayer && v.role != RoleReader {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "role player required")
+	}
+	if req.CompetitionId == "" {
+		return nil, status.Error(codes.InvalidArgument, "competition_id required")
+	}
+	if req.RankAfter < 0 {
+		return nil, status.Error(codes.InvalidArgument, "rank_after must be at least 0")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer tenantDB.Close()
+
+	if v.role == RolePlayer {
+		if err := authorizePlayer(ctx, tenantDB, v.tenantID, v.playerID); err != nil {
+			return nil, err
+		}
+	}
+	comp, err := retrieveCompetition(ctx, tenantDB, v.tenantID, req.CompetitionId)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	// HTTPのAPIと同じく、参加者の閲覧は課金の対象にする
+	if v.role == RolePlayer {
+		now := srv(ctx).clock.Now().Unix()
+		srv(ctx).visits.record(VisitHistoryRow{v.playerID, v.tenantID, comp.ID, now, now})
+	}
+
+	ranks, err := competitionRanks(ctx, tenantDB, v.tenantID, comp.ID)
+	if err != nil {
+		return nil, err
+	}
+	res := &isuportsv1.GetRankingResponse{
+		Competition: &isuportsv1.Competition{Id: comp.ID, Title: comp.Title, IsFinished: comp.FinishedAt.Valid},
+		Ranks:       []*isuportsv1.Rank{},
+	}
+	for i := req.RankAfter; i < int64(len(ranks)) && i < req.RankAfter+grpcRankingPageSize; i++ {
+		res.Ranks = append(res.Ranks, &isuportsv1.Rank{
+			Rank:              i + 1,
+			Score:             ranks[i].Score,
+			PlayerId:          ranks[i].PlayerID,
+			PlayerDisplayName: ranks[i].PlayerDisplayName,
+		})
+	}
+	return res, nil
+}
+
+// ListCompetitions
+func (ss *scoreService) ListCompetitions(ctx context.Context, req *isuportsv1.ListCompetitionsRequest) (*isuportsv1.ListCompetitionsResponse, error) {
+	v, err := ss.viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if v.role != RoleOrganizer {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer tenantDB.Close()
+
+	cs := []CompetitionRow{}
+	if err := tenantDB.SelectContext(ctx, &cs, "SELECT * FROM competition WHERE tenant_id=? ORDER BY created_at DESC", v.tenantID); err != nil {
+		return nil, fmt.Errorf("error Select competition: %w", err)
+	}
+	res := &isuportsv1.ListCompetitionsResponse{Competitions: make([]*isuportsv1.Competition, 0, len(cs))}
+	for _, comp := range cs {
+		res.Competitions = append(res.Competitions, &isuportsv1.Competition{
+			Id:         comp.ID,
+			Title:      comp.Title,
+			IsFinished: comp.FinishedAt.Valid,
+		})
+	}
+	return res, nil
+}
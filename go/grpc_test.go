@@ -0,0 +1,167 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	isuportsv1 "github.com/isucon/isucon12-qualify/webapp/go/proto/isuports/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testAppのServerにつないだgRPCのクライアントを返す
+// テナントは :authority で、ロールは authorization メタデータのJWTで決まる
+func (a *testApp) grpcClient(t *testing.T, v testViewer) (isuportsv1.ScoreServiceClient, context.Context) {
+	t.Helper()
+	ln := bufconn.Listen(1 << 20)
+	gs := newGRPCServer(a.s)
+	go gs.Serve(ln)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.Dial(v.host,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+v.token)
+	return isuportsv1.NewScoreServiceClient(conn), ctx
+}
+
+func uploadScoresByGRPC(ctx context.Context, client isuportsv1.ScoreServiceClient, reqs ...*isuportsv1.UploadScoresRequest) (*isuportsv1.UploadScoresResponse, error) {
+	stream, err := client.UploadScores(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, req := range reqs {
+		if err := stream.Send(req); err != nil {
+			return nil, err
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+func TestGRPCScoreService(t *testing.T) {
+	app := newTestApp(t)
+	decodeSuccess(t, app.postForm(t, app.admin(t), "/api/admin/tenants/add", url.Values{
+		"name":         {"grpc"},
+		"display_name": {"gRPC"},
+	}), nil)
+	org := app.organizer(t, "grpc")
+
+	var playersRes PlayersAddHandlerResult
+	decodeSuccess(t, app.postForm(t, org, "/api/organizer/players/add", url.Values{
+		"display_name[]": {"alice", "bob"},
+	}), &playersRes)
+	alice, bob := playersRes.Players[0], playersRes.Players[1]
+	var compRes CompetitionsAddHandlerResult
+	decodeSuccess(t, app.postForm(t, org, "/api/organizer/competitions/add", url.Values{"title": {"grpc competition"}}), &compRes)
+	compID := compRes.Competition.ID
+
+	orgClient, orgCtx := app.grpcClient(t, org)
+	res, err := uploadScoresByGRPC(orgCtx, orgClient,
+		&isuportsv1.UploadScoresRequest{Payload: &isuportsv1.UploadScoresRequest_CompetitionId{CompetitionId: compID}},
+		&isuportsv1.UploadScoresRequest{Payload: &isuportsv1.UploadScoresRequest_Row{Row: &isuportsv1.ScoreRow{PlayerId: alice.ID, Score: 100}}},
+		&isuportsv1.UploadScoresRequest{Payload: &isuportsv1.UploadScoresRequest_Row{Row: &isuportsv1.ScoreRow{PlayerId: bob.ID, Score: 200}}},
+	)
+	if err != nil {
+		t.Fatalf("UploadScores: %s", err)
+	}
+	if res.Rows != 2 {
+		t.Errorf("rows = %d, want 2", res.Rows)
+	}
+
+	playerClient, playerCtx := app.grpcClient(t, app.player(t, "grpc", alice.ID))
+	ranking, err := playerClient.GetRanking(playerCtx, &isuportsv1.GetRankingRequest{CompetitionId: compID})
+	if err != nil {
+		t.Fatalf("GetRanking: %s", err)
+	}
+	got := []string{}
+	for _, r := range ranking.Ranks {
+		got = append(got, fmt.Sprintf("%d:%s:%d", r.Rank, r.PlayerDisplayName, r.Score))
+	}
+	if want := "1:bob:200,2:alice:100"; strings.Join(got, ",") != want {
+		t.Errorf("ranks = %v, want %s", got, want)
+	}
+	if ranking.Competition.GetId() != compID || ranking.Competition.GetIsFinished() {
+		t.Errorf("competition = %v", ranking.Competition)
+	}
+
+	comps, err := orgClient.ListCompetitions(orgCtx, &isuportsv1.ListCompetitionsRequest{})
+	if err != nil {
+		t.Fatalf("ListCompetitions: %s", err)
+	}
+	if len(comps.Competitions) != 1 || comps.Competitions[0].Title != "grpc competition" {
+		t.Errorf("competitions = %v", comps.Competitions)
+	}
+
+	// エラーはHTTPのAPIと同じ分類のステータスで返す
+	tests := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{
+			name: "player cannot upload",
+			err: func() error {
+				_, err := uploadScoresByGRPC(playerCtx, playerClient,
+					&isuportsv1.UploadScoresRequest{Payload: &isuportsv1.UploadScoresRequest_CompetitionId{CompetitionId: compID}},
+				)
+				return err
+			}(),
+			code: codes.PermissionDenied,
+		},
+		{
+			name: "first message must be competition_id",
+			err: func() error {
+				_, err := uploadScoresByGRPC(orgCtx, orgClient,
+					&isuportsv1.UploadScoresRequest{Payload: &isuportsv1.UploadScoresRequest_Row{Row: &isuportsv1.ScoreRow{PlayerId: alice.ID, Score: 1}}},
+				)
+				return err
+			}(),
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "unknown player",
+			err: func() error {
+				_, err := uploadScoresByGRPC(orgCtx, orgClient,
+					&isuportsv1.UploadScoresRequest{Payload: &isuportsv1.UploadScoresRequest_CompetitionId{CompetitionId: compID}},
+					&isuportsv1.UploadScoresRequest{Payload: &isuportsv1.UploadScoresRequest_Row{Row: &isuportsv1.ScoreRow{PlayerId: "unknown", Score: 1}}},
+				)
+				return err
+			}(),
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "unknown competition",
+			err: func() error {
+				_, err := playerClient.GetRanking(playerCtx, &isuportsv1.GetRankingRequest{CompetitionId: "unknown"})
+				return err
+			}(),
+			code: codes.NotFound,
+		},
+		{
+			name: "no token",
+			err: func() error {
+				_, err := orgClient.ListCompetitions(context.Background(), &isuportsv1.ListCompetitionsRequest{})
+				return err
+			}(),
+			code: codes.Unauthenticated,
+		},
+	}
+	for _, tt := range tests {
+		if code := status.Code(tt.err); code != tt.code {
+			t.Errorf("%s: code = %s, want %s (%v)", tt.name, code, tt.code, tt.err)
+		}
+	}
+}
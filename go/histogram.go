@@ -0,0 +1,197 @@
+package isuports
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ルートごとのレイテンシのヒストグラム
+// ランキングとスコアのアップロードはテナントごとにも集計し、どのテナントのデータで遅くなっているかを見られるようにする
+
+// バケットの上限 (ミリ秒)、最後のバケットはそれ以上すべて
+var latencyBucketsMs = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+type latencyHistogram struct {
+	counts []int64 // len(latencyBucketsMs)+1
+	count  int64
+	sumUs  int64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]int64, len(latencyBucketsMs)+1)}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	ms := float64(d.Microseconds()) / 1000
+	i := sort.SearchFloat64s(latencyBucketsMs, ms)
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sumUs, d.Microseconds())
+}
+
+type LatencyBucket struct {
+	LeMs  float64 `json:"le_ms"` // 最後のバケットは-1 (上限なし)
+	Count int64   `json:"count"`
+}
+
+type LatencyHistogramDetail struct {
+	Count  int64           `json:"count"`
+	MeanMs float64         `json:"mean_ms"`
+	P50Ms  float64         `json:"p50_ms"`
+	P90Ms  float64         `json:"p90_ms"`
+	P99Ms  float64         `json:"p99_ms"`
+	Bucket []LatencyBucket `json:"buckets"`
+}
+
+func (h *latencyHistogram) detail() LatencyHistogramDetail {
+	d := LatencyHistogramDetail{
+		Count:  atomic.LoadInt64(&h.count),
+		Bucket: make([]LatencyBucket, len(h.counts)),
+	}
+	for i := range h.counts {
+		le := -1.0
+		if i < len(latencyBucketsMs) {
+			le = latencyBucketsMs[i]
+		}
+		d.Bucket[i] = LatencyBucket{LeMs: le, Count: atomic.LoadInt64(&h.counts[i])}
+	}
+	if d.Count > 0 {
+		d.MeanMs = float64(atomic.LoadInt64(&h.sumUs)) / 1000 / float64(d.Count)
+	}
+	d.P50Ms = d.quantile(0.5)
+	d.P90Ms = d.quantile(0.9)
+	d.P99Ms = d.quantile(0.99)
+	return d
+}
+
+// バケットの上限で近似したパーセンタイル
+func (d LatencyHistogramDetail) quantile(q float64) float64 {
+	if d.Count == 0 {
+		return 0
+	}
+	target := int64(float64(d.Count) * q)
+	var acc int64
+	for _, b := range d.Bucket {
+		acc += b.Count
+		if acc > target {
+			if b.LeMs < 0 {
+				return latencyBucketsMs[len(latencyBucketsMs)-1]
+			}
+			return b.LeMs
+		}
+	}
+	return latencyBucketsMs[len(latencyBucketsMs)-1]
+}
+
+// テナントごとにも集計するルート
+var tenantBreakdownRoutes = map[string]bool{
+	"/api/player/competition/:competition_id/ranking":  true,
+	"/api/organizer/competition/:competition_id/score": true,
+}
+
+type routeStats struct {
+	mu      sync.RWMutex
+	routes  map[string]*latencyHistogram
+	tenants map[string]map[string]*latencyHistogram // ルート -> テナント名 -> ヒストグラム
+}
+
+var requestLatencies = &routeStats{
+	routes:  map[string]*latencyHistogram{},
+	tenants: map[string]map[string]*latencyHistogram{},
+}
+
+func (s *routeStats) histogram(route, tenant string) (*latencyHistogram, *latencyHistogram) {
+	s.mu.RLock()
+	rh := s.routes[route]
+	var th *latencyHistogram
+	if tenant != "" {
+		th = s.tenants[route][tenant]
+	}
+	s.mu.RUnlock()
+	if rh != nil && (tenant == "" || th != nil) {
+		return rh, th
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rh = s.routes[route]; rh == nil {
+		rh = newLatencyHistogram()
+		s.routes[route] = rh
+	}
+	if tenant != "" {
+		if s.tenants[route] == nil {
+			s.tenants[route] = map[string]*latencyHistogram{}
+		}
+		if th = s.tenants[route][tenant]; th == nil {
+			th = newLatencyHistogram()
+			s.tenants[route][tenant] = th
+		}
+	}
+	return rh, th
+}
+
+func (s *routeStats) observe(route, tenant string, d time.Duration) {
+	rh, th := s.histogram(route, tenant)
+	rh.observe(d)
+	if th != nil {
+		th.observe(d)
+	}
+}
+
+func (s *routeStats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.routes = map[string]*latencyHistogram{}
+	s.tenants = map[string]map[string]*latencyHistogram{}
+}
+
+type RouteLatencyDetail struct {
+	Route   string                            `json:"route"`
+	Latency LatencyHistogramDetail            `json:"latency"`
+	Tenants map[string]LatencyHistogramDetail `json:"tenants,omitempty"`
+}
+
+func (s *routeStats) details() []RouteLatencyDetail {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ds := make([]RouteLatencyDetail, 0, len(s.routes))
+	for route, h := range s.routes {
+		d := RouteLatencyDetail{Route: route, Latency: h.detail()}
+		if ts := s.tenants[route]; len(ts) > 0 {
+			d.Tenants = make(map[string]LatencyHistogramDetail, len(ts))
+			for tenant, th := range ts {
+				d.Tenants[tenant] = th.detail()
+			}
+		}
+		ds = append(ds, d)
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].Route < ds[j].Route })
+	return ds
+}
+
+// ルートごとのレイテンシを記録するmiddleware
+// ルーティング後のパスを使うので e.Use で登録すること
+func latencyStatsMiddleware() echo.MiddlewareFunc {
+	baseHost := getEnv("ISUCON_BASE_HOSTNAME", ".t.isucon.dev")
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			route := c.Path()
+			if route == "" {
+				return err
+			}
+			tenant := ""
+			if tenantBreakdownRoutes[route] {
+				tenant = strings.TrimSuffix(c.Request().Host, baseHost)
+			}
+			requestLatencies.observe(route, tenant, time.Since(start))
+			return err
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package isuports
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 大会のカレンダー (iCalendar, RFC 5545)
+// 参加者がスマートフォンのカレンダーアプリで購読できるようにする
+// 大会には開催予定の日時がないので、作成日時から終了日時 (終了していなければ作成日時のみ) を予定にする
+// カレンダーアプリはCookieを送れないので、読み取り専用のAPIトークン (apitoken.go を参照) をクエリのtokenでも受け付ける
+
+// iCalendarのテキストのエスケープ
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func icalTime(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format("20060102T150405Z")
+}
+
+// 1行75オクテットを超える行は折り返す
+// UTF-8の文字の途中では折り返さない
+func writeICalLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		i := limit
+		for i > 0 && !isUTF8Start(line[i]) {
+			i--
+		}
+		b.WriteString(line[:i])
+		b.WriteString("\r\n ")
+		line = line[i:]
+		// 折り返した行は先頭の空白の分だけ短くする
+		limit = 74
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+func isUTF8Start(c byte) bool {
+	return c&0xC0 != 0x80
+}
+
+// 参加者向けAPI
+// GET /api/player/competitions.ics
+// 大会の一覧をiCalendar形式で取得する
+func competitionsICalHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewerWithTokenParam(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RolePlayer && v.role != RoleReader {
+		return echo.NewHTTPError(http.StatusForbidden, "role player required")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	if v.role == RolePlayer {
+		if err := authorizePlayer(ctx, tenantDB, v.tenantID, v.playerID); err != nil {
+			return err
+		}
+	}
+
+	tenant, err := retrieveTenantRowFromHeader(c)
+	if err != nil {
+		return fmt.Errorf("error retrieveTenantRowFromHeader: %w", err)
+	}
+	cs := []CompetitionRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&cs,
+		"SELECT * FROM competition WHERE tenant_id=? ORDER BY created_at DESC",
+		v.tenantID,
+	); err != nil {
+		return fmt.Errorf("error Select competition: %w", err)
+	}
+
+	var b strings.Builder
+	writeICalLine(&b, "BEGIN:VCALENDAR")
+	writeICalLine(&b, "VERSION:2.0")
+	writeICalLine(&b, "PRODID:-//ISUPORTS//competitions//JA")
+	writeICalLine(&b, "CALSCALE:GREGORIAN")
+	writeICalLine(&b, "METHOD:PUBLISH")
+	writeICalLine(&b, "X-WR-CALNAME:"+icalEscaper.Replace(tenant.DisplayName))
+	for _, comp := range cs {
+		writeICalLine(&b, "BEGIN:VEVENT")
+		writeICalLine(&b, fmt.Sprintf("UID:%s@%s.isuports", comp.ID, tenant.Name))
+		writeICalLine(&b, "DTSTAMP:"+icalTime(comp.UpdatedAt))
+		writeICalLine(&b, "DTSTART:"+icalTime(comp.CreatedAt))
+		if comp.FinishedAt.Valid {
+			writeICalLine(&b, "DTEND:"+icalTime(comp.FinishedAt.Int64))
+		}
+		writeICalLine(&b, "SUMMARY:"+icalEscaper.Replace(comp.Title))
+		status := "開催中"
+		if comp.FinishedAt.Valid {
+			status = "終了"
+		}
+		writeICalLine(&b, "DESCRIPTION:"+icalEscaper.Replace(status))
+		writeICalLine(&b, "LAST-MODIFIED:"+icalTime(comp.UpdatedAt))
+		writeICalLine(&b, "END:VEVENT")
+	}
+	writeICalLine(&b, "END:VCALENDAR")
+
+	return c.Blob(http.StatusOK, "text/calendar; charset=utf-8", []byte(b.String()))
+}
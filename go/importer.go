@@ -0,0 +1,464 @@
+package isuports
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 外部の形式の結果の取り込み
+// 計測会社のタイム表や採点アプリのエクスポートなど、他のツールが出力した結果のCSVを
+// 参加者とスコアに変換して、スコアのアップロードと同じ処理 (importScores) で大会のスコアを置き換える
+// 参加者は表示名で照合し、見つからない参加者は追加する
+// 形式を増やすときは resultMapper を実装して resultMappers に登録すること
+
+// 外部の形式の1行を変換した結果
+type importedResult struct {
+	row         int64 // ファイルのデータの行番号、ヘッダを除いて1から
+	displayName string
+	score       int64
+}
+
+// 外部の形式を参加者とスコアに変換する
+type resultMapper interface {
+	// 読む列と、ヘッダの列名の候補 (大文字小文字と前後の空白は無視する)
+	// 必ず "name" と "score" を含むこと
+	columns() map[string][]string
+	// 1行を変換する、recordのキーはcolumnsのキー
+	// 記録のない行 (棄権など) はokをfalseにして読み飛ばす
+	mapRecord(record map[string]string) (score int64, ok bool, err error)
+}
+
+// 全ての行を読んだ後に、ファイル全体を見てスコアを直す形式が実装する
+type resultNormalizer interface {
+	normalize(results []importedResult)
+}
+
+var resultMappers = map[string]resultMapper{
+	"race_timing":  raceTimingMapper{},
+	"google_forms": googleFormsMapper{},
+	"kaggle":       kaggleMapper{},
+}
+
+// IngestIssue.Code
+const (
+	ingestErrInvalidScore    = "invalid_score"
+	ingestErrAmbiguousPlayer = "ambiguous_player"
+)
+
+// 計測会社やエントリーサイトのタイム表
+// 列名は各社で違うので候補から探す、タイムは H:MM:SS, MM:SS, 秒 のいずれかで小数を含んでもよい
+// スコアは大きいほど上位なので、タイムをミリ秒にして符号を反転する
+type raceTimingMapper struct{}
+
+func (raceTimingMapper) columns() map[string][]string {
+	return map[string][]string{
+		"name":  {"name", "full name", "athlete", "runner", "participant", "氏名", "名前", "選手名"},
+		"score": {"chip time", "net time", "finish time", "gun time", "time", "タイム", "記録", "ネットタイム"},
+	}
+}
+
+func (raceTimingMapper) mapRecord(record map[string]string) (int64, bool, error) {
+	v := record["score"]
+	switch strings.ToUpper(v) {
+	case "", "DNF", "DNS", "DQ", "DSQ", "-":
+		return 0, false, nil
+	}
+	ms, err := parseRaceTime(v)
+	if err != nil {
+		return 0, false, err
+	}
+	return -ms, true, nil
+}
+
+// H:MM:SS(.fff), MM:SS(.fff), SS(.fff) をミリ秒にする
+func parseRaceTime(v string) (int64, error) {
+	parts := strings.Split(v, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time: %s", v)
+	}
+	var ms int64
+	for i, p := range parts {
+		if i < len(parts)-1 {
+			n, err := strconv.ParseUint(p, 10, 32)
+			if err != nil {
+				return 0, fmt.Errorf("invalid time: %s", v)
+			}
+			ms = (ms + int64(n)) * 60
+			continue
+		}
+		sec, err := strconv.ParseFloat(p, 64)
+		if err != nil || sec < 0 || (i > 0 && sec >= 60) {
+			return 0, fmt.Errorf("invalid time: %s", v)
+		}
+		ms = ms*1000 + int64(math.Round(sec*1000))
+	}
+	return ms, nil
+}
+
+// Googleフォームのテスト (クイズ) の回答のエクスポート
+// スコアの列は "7 / 10" の形式なので得点だけを使う
+// 名前の列はフォームの質問によるので、候補にない場合は name_column で指定する
+type googleFormsMapper struct{}
+
+func (googleFormsMapper) columns() map[string][]string {
+	return map[string][]string{
+		"name":  {"name", "your name", "full name", "名前", "お名前", "氏名"},
+		"score": {"score", "スコア", "点数"},
+	}
+}
+
+func (googleFormsMapper) mapRecord(record map[string]string) (int64, bool, error) {
+	v := record["score"]
+	if v == "" {
+		return 0, false, nil
+	}
+	points, _, _ := strings.Cut(v, "/")
+	f, err := strconv.ParseFloat(strings.TrimSpace(points), 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid score: %s", v)
+	}
+	return int64(math.Round(f)), true, nil
+}
+
+// Kaggleのリーダーボードのダウンロード
+// 小数のスコアを小数点以下5桁 (リーダーボードの表示と同じ) の固定小数点にする
+// 評価指標によっては小さいほど上位なので、Rankの順に並べたときにスコアが増えていれば符号を反転する
+type kaggleMapper struct{}
+
+const kaggleScoreScale = 100000
+
+func (kaggleMapper) columns() map[string][]string {
+	return map[string][]string{
+		"name":  {"teamname", "team name"},
+		"score": {"score"},
+	}
+}
+
+func (kaggleMapper) mapRecord(record map[string]string) (int64, bool, error) {
+	v := record["score"]
+	if v == "" {
+		return 0, false, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || math.Abs(f) > math.MaxInt64/kaggleScoreScale {
+		return 0, false, fmt.Errorf("invalid score: %s", v)
+	}
+	return int64(math.Round(f * kaggleScoreScale)), true, nil
+}
+
+func (kaggleMapper) normalize(results []importedResult) {
+	// ダウンロードしたファイルはRank順に並んでいる
+	if len(results) < 2 || results[0].score >= results[len(results)-1].score {
+		return
+	}
+	for i := range results {
+		results[i].score = -results[i].score
+	}
+}
+
+// ヘッダの区切り文字を推測する
+// 計測会社のファイルにはセミコロンやタブで区切ったものがある
+func detectDelimiter(header []byte) rune {
+	best, count := ',', bytes.Count(header, []byte{','})
+	for _, d := range []rune{';', '\t'} {
+		if n := bytes.Count(header, []byte(string(d))); n > count {
+			best, count = d, n
+		}
+	}
+	return best
+}
+
+// 外部の形式のCSVを読む
+// 問題のある行はまとめて *ingestError で返す
+// nameColumnを指定した場合は、名前の列の候補の代わりに使う
+// 読み飛ばした行も含めて読んだ行数を返す
+func readImportedResults(r io.Reader, m resultMapper, nameColumn string) ([]importedResult, int64, error) {
+	var report IngestReport
+	fail := func() error {
+		return &ingestError{report: report}
+	}
+
+	br := bufio.NewReader(r)
+	if b, err := br.Peek(3); err == nil && bytes.Equal(b, []byte("\ufeff")) {
+		br.Discard(3)
+	}
+	head, _ := br.Peek(4096)
+	if i := bytes.IndexByte(head, '\n'); i >= 0 {
+		head = head[:i]
+	}
+	cr := csv.NewReader(br)
+	cr.Comma = detectDelimiter(head)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		report.add(IngestIssue{Code: ingestErrMalformed, Message: fmt.Sprintf("error reading header: %s", err)})
+		return nil, 0, fail()
+	}
+	columns := m.columns()
+	if nameColumn != "" {
+		columns["name"] = []string{nameColumn}
+	}
+	// 列名から列の位置へ、候補の先頭にあるものを優先する
+	index := make(map[string]int, len(columns))
+	for key, names := range columns {
+		for _, name := range names {
+			for i, h := range header {
+				if _, ok := index[key]; !ok && strings.EqualFold(strings.TrimSpace(h), name) {
+					index[key] = i
+				}
+			}
+		}
+		if _, ok := index[key]; !ok {
+			report.add(IngestIssue{Code: ingestErrInvalidHeader, Column: key, Message: fmt.Sprintf("column not found: one of %s", strings.Join(names, ", "))})
+		}
+	}
+	if len(report.Errors) > 0 {
+		return nil, 0, fail()
+	}
+
+	results := []importedResult{}
+	for num := int64(1); ; num++ {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		report.Rows = num
+		if err != nil {
+			report.add(IngestIssue{Row: num, Code: ingestErrMalformed, Message: err.Error()})
+			if len(report.Errors) >= ingestMaxIssues {
+				break
+			}
+			continue
+		}
+		record := make(map[string]string, len(index))
+		for key, i := range index {
+			if i < len(rec) {
+				record[key] = strings.TrimSpace(rec[i])
+			}
+		}
+		score, ok, err := m.mapRecord(record)
+		if err != nil {
+			report.add(IngestIssue{Row: num, Column: "score", Code: ingestErrInvalidScore, Message: err.Error()})
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if record["name"] == "" {
+			report.add(IngestIssue{Row: num, Column: "name", Code: ingestErrRequired, Message: "name is required"})
+			continue
+		}
+		results = append(results, importedResult{row: num, displayName: record["name"], score: score})
+	}
+	if len(report.Errors) > 0 {
+		return nil, 0, fail()
+	}
+	if n, ok := m.(resultNormalizer); ok {
+		n.normalize(results)
+	}
+	return results, report.Rows, nil
+}
+
+// 表示名から参加者IDを引く
+// 表示名が重複している参加者は特定できないのでエラーにする、個人データを消去した参加者は対象にしない
+// 見つからない表示名は返り値のmissingに入れる
+func matchImportedPlayers(ctx context.Context, tenantDB dbOrTx, tenantID int64, results []importedResult) (ids map[string]string, missing []string, err error) {
+	pls := []PlayerRow{}
+	if err := tenantDB.SelectContext(ctx, &pls, "SELECT * FROM player WHERE tenant_id = ? AND erased_at IS NULL", tenantID); err != nil {
+		return nil, nil, fmt.Errorf("error Select player: tenantID=%d, %w", tenantID, err)
+	}
+	ids = make(map[string]string, len(pls))
+	ambiguous := map[string]bool{}
+	for _, p := range pls {
+		if _, ok := ids[p.DisplayName]; ok {
+			ambiguous[p.DisplayName] = true
+		}
+		ids[p.DisplayName] = p.ID
+	}
+
+	var report IngestReport
+	seen := map[string]bool{}
+	for _, r := range results {
+		if ambiguous[r.displayName] {
+			report.add(IngestIssue{Row: r.row, Column: "name", Code: ingestErrAmbiguousPlayer, Message: fmt.Sprintf("multiple players named %s", r.displayName)})
+			continue
+		}
+		if _, ok := ids[r.displayName]; !ok && !seen[r.displayName] {
+			seen[r.displayName] = true
+			missing = append(missing, r.displayName)
+		}
+	}
+	if len(report.Errors) > 0 {
+		report.Rows = int64(len(results))
+		return nil, nil, &ingestError{report: report}
+	}
+	return ids, missing, nil
+}
+
+type ImportHandlerResult struct {
+	Format         string         `json:"format"`
+	Rows           int64          `json:"rows"`
+	Skipped        int64          `json:"skipped"` // 記録がなく読み飛ばした行数
+	CreatedPlayers []PlayerDetail `json:"created_players"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/import
+// 外部の形式の結果のCSVで大会のスコアを置き換える
+func importHandler(c echo.Context) (err error) {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	format := c.FormValue("format")
+	m, ok := resultMappers[format]
+	if !ok {
+		formats := make([]string, 0, len(resultMappers))
+		for f := range resultMappers {
+			formats = append(formats, f)
+		}
+		sort.Strings(formats)
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("format must be one of %s", strings.Join(formats, ", ")))
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	competitionID := c.FormValue("competition_id")
+	if competitionID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "competition_id required")
+	}
+	comp, err := retrieveCompetition(ctx, tenantDB, v.tenantID, competitionID)
+	if err != nil {
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	defer func() {
+		var he *echo.HTTPError
+		if errors.As(err, &he) && he.Code == http.StatusBadRequest {
+			notifyScoreRejected(c, comp, fmt.Sprint(he.Message))
+		}
+	}()
+	if comp.FinishedAt.Valid {
+		return &competitionFinishedError{competitionID: comp.ID}
+	}
+
+	fh, err := c.FormFile("results")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "results file required")
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return fmt.Errorf("error fh.Open FormFile(results): %w", err)
+	}
+	defer f.Close()
+
+	results, read, err := readImportedResults(f, m, c.FormValue("name_column"))
+	if err != nil {
+		return err
+	}
+	ids, missing, err := matchImportedPlayers(ctx, tenantDB, v.tenantID, results)
+	if err != nil {
+		return err
+	}
+
+	// 見つからない参加者を追加する
+	// スコアの検証で失敗しても追加した参加者はそのまま残る
+	created := make([]PlayerDetail, 0, len(missing))
+	if len(missing) > 0 {
+		if q, err := checkPlayersQuota(ctx, tenantDB, v.tenantID, len(missing)); err != nil {
+			return err
+		} else if q != nil {
+			return quotaExceeded(c, http.StatusForbidden, *q)
+		}
+		loc, err := tenantLocation(ctx, v.tenantID)
+		if err != nil {
+			return err
+		}
+		players := make([]PlayerRow, 0, len(missing))
+		for _, displayName := range missing {
+			id, err := dispenseID(ctx)
+			if err != nil {
+				return fmt.Errorf("error dispenseID: %w", err)
+			}
+			now := srv(ctx).clock.Now().Unix()
+			players = append(players, PlayerRow{v.tenantID, id, displayName, false, now, now, sql.NullInt64{}})
+		}
+		if err := withRetry(ctx, func() error {
+			_, err := tenantDB.NamedExecContext(ctx, "INSERT INTO player (id, tenant_id, display_name, is_disqualified, created_at, updated_at) values (:id, :tenant_id, :display_name, :is_disqualified, :created_at, :updated_at)", players)
+			return err
+		}); err != nil {
+			return asConflict(fmt.Errorf("error Insert player at tenantDB: %w", err), errorCodeDuplicatePlayer, "duplicate player")
+		}
+		for _, p := range players {
+			srv(ctx).playerCache.Set(tenantKey{v.tenantID, p.ID}, p)
+			ids[p.DisplayName] = p.ID
+			created = append(created, newPlayerDetail(&p, loc))
+		}
+	}
+
+	// スコアのCSVにしてアップロードと同じ検証と置き換えを行う
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"player_id", "score"})
+	for _, r := range results {
+		w.Write([]string{ids[r.displayName], strconv.FormatInt(r.score, 10)})
+	}
+	w.Flush()
+	res, q, err := importScores(ctx, tenantDB, v.tenantID, competitionID, scoreImportOptions{}, &buf, ingestFormatCSV)
+	if err != nil {
+		// 変換後の行番号を元のファイルの行番号に戻す
+		var ie *ingestError
+		if errors.As(err, &ie) {
+			for i, issue := range ie.report.Errors {
+				if issue.Row > 0 && int(issue.Row) <= len(results) {
+					ie.report.Errors[i].Row = results[issue.Row-1].row
+				}
+			}
+			for _, up := range ie.report.UnknownPlayers {
+				for i, row := range up.Rows {
+					if row > 0 && int(row) <= len(results) {
+						up.Rows[i] = results[row-1].row
+					}
+				}
+			}
+		}
+		return err
+	}
+	if q != nil {
+		return quotaExceeded(c, http.StatusForbidden, *q)
+	}
+
+	return c.JSON(http.StatusOK, SuccessResult{
+		Status: true,
+		Data: ImportHandlerResult{
+			Format:         format,
+			Rows:           res.Rows,
+			Skipped:        read - int64(len(results)),
+			CreatedPlayers: created,
+		},
+	})
+}
@@ -0,0 +1,524 @@
+package isuports
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ファイルの取り込みの検証
+// スコアや参加者のCSV・JSONを、ヘッダ、型、ルール (参照している参加者やテナントごとの制約) の順に検証する
+// 最初のエラーで止めずに、行番号・列・エラーコードの一覧 (IngestReport) を400で返す
+// 1行でもエラーがあれば何も取り込まない
+
+const (
+	ingestFormatCSV  = "csv"
+	ingestFormatJSON = "json" // オブジェクトの配列、キーはCSVのヘッダと同じ
+)
+
+// IngestIssue.Code
+const (
+	ingestErrInvalidHeader  = "invalid_header"
+	ingestErrMalformed      = "malformed" // CSVやJSONとして読めない
+	ingestErrColumnCount    = "column_count"
+	ingestErrInvalidType    = "invalid_type"
+	ingestErrRequired       = "required"
+	ingestErrInvalidInteger = "invalid_integer"
+	ingestErrPlayerNotFound = "player_not_found"
+	ingestErrOutOfRange     = "out_of_range"
+)
+
+// 1つのレポートに載せるエラーの上限
+const ingestMaxIssues = 100
+
+// 検証に失敗したときの FailureResult.Code
+const errorCodeValidationFailed = "validation_failed"
+
+type ingestColumn struct {
+	name     string
+	integer  bool // 整数として読めること
+	required bool // 空を許さない
+}
+
+// 取り込むファイルの形式
+type ingestSchema struct {
+	columns []ingestColumn
+	// 型の検証を通った行に対して順に適用する
+	// 問題があればIngestIssueを返し、それ以外のエラーは取り込み自体を失敗させる
+	rules []ingestRule
+}
+
+type ingestRule func(ctx context.Context, row ingestRow) (*IngestIssue, error)
+
+// 型の検証を通った1行
+type ingestRow struct {
+	num    int64 // データの行番号、ヘッダを除いて1から
+	values map[string]string
+}
+
+func (r ingestRow) str(name string) string {
+	return r.values[name]
+}
+
+// 型の検証を通っているので失敗しない
+func (r ingestRow) integer(name string) int64 {
+	n, _ := strconv.ParseInt(r.values[name], 10, 64)
+	return n
+}
+
+func (r ingestRow) issue(column, code, format string, args ...any) *IngestIssue {
+	return &IngestIssue{Row: r.num, Column: column, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+type IngestIssue struct {
+	Row     int64  `json:"row"` // データの行番号、ファイル全体の問題は0
+	Column  string `json:"column,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type IngestReport struct {
+	Rows      int64         `json:"rows"` // 読んだデータの行数
+	Skipped   int64         `json:"skipped,omitempty"`
+	Errors    []IngestIssue `json:"errors"`
+	Truncated bool          `json:"truncated"` // エラーが多すぎて途中で打ち切った
+	// スコアのファイルに含まれていた存在しない参加者、Errorsと違って打ち切らずに全て返す
+	UnknownPlayers []UnknownPlayer `json:"unknown_players,omitempty"`
+}
+
+func (r *IngestReport) add(issue IngestIssue) {
+	if len(r.Errors) >= ingestMaxIssues {
+		r.Truncated = true
+		return
+	}
+	r.Errors = append(r.Errors, issue)
+}
+
+// 検証に失敗した取り込み
+// errorResponseHandler がレポートをつけて400を返す
+type ingestError struct {
+	report IngestReport
+}
+
+func (e *ingestError) Error() string {
+	first := e.report.Errors[0]
+	if first.Row == 0 {
+		return fmt.Sprintf("%s: %s", first.Code, first.Message)
+	}
+	return fmt.Sprintf("row %d: %s: %s (%d error(s))", first.Row, first.Code, first.Message, len(e.report.Errors))
+}
+
+// 失敗した取り込みの通知などで、他のバリデーションと同じく400として扱えるようにする
+func (e *ingestError) Unwrap() error {
+	return echo.NewHTTPError(http.StatusBadRequest, e.Error())
+}
+
+type IngestFailedResult struct {
+	FailureResult
+	Report IngestReport `json:"report"`
+}
+
+func ingestFailed(c echo.Context, ie *ingestError) error {
+	return c.JSON(http.StatusBadRequest, IngestFailedResult{
+		FailureResult: FailureResult{
+			Status:  false,
+			Message: ie.Error(),
+			Code:    errorCodeValidationFailed,
+		},
+		Report: ie.report,
+	})
+}
+
+// Content-Typeかファイル名の拡張子からファイルの形式を決める、わからなければCSV
+func ingestFormatOf(contentType, filename string) string {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil && mt == echo.MIMEApplicationJSON {
+		return ingestFormatJSON
+	}
+	if strings.EqualFold(path.Ext(filename), ".json") {
+		return ingestFormatJSON
+	}
+	return ingestFormatCSV
+}
+
+// ルールが返すと、その行をエラーにせずに取り込まない
+var errIngestSkipRow = errors.New("ingest skip row")
+
+// 取り込みを途中でやめるときにfnが返す
+// 上限を超えたときなど、レポートではなく呼び出し元で別の応答を返す場合に使う
+var errIngestStop = errors.New("ingest stopped")
+
+// この行数ごとにctxのキャンセルを確かめる
+const ingestCancelCheckRows = 1000
+
+// rを検証し、問題のない行を順にfnに渡して読んだ行数を返す
+// 1行でも問題があれば *ingestError を返すので、fnで受け取った行はその時点まで確定させないこと
+func (s ingestSchema) run(ctx context.Context, r io.Reader, format string, fn func(row ingestRow) error) (int64, error) {
+	var report IngestReport
+	check := func(num int64, record map[string]string) error {
+		// クライアントが切断したら、大きなファイルでも最後まで読まずにやめる
+		if num%ingestCancelCheckRows == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		report.Rows = num
+		row := ingestRow{num: num, values: record}
+		ok := true
+		for _, col := range s.columns {
+			v := record[col.name]
+			switch {
+			case v == "" && col.required:
+				report.add(*row.issue(col.name, ingestErrRequired, "%s is required", col.name))
+				ok = false
+			case v != "" && col.integer:
+				if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+					report.add(*row.issue(col.name, ingestErrInvalidInteger, "%s must be an integer: %q", col.name, v))
+					ok = false
+				}
+			}
+		}
+		if !ok {
+			return nil
+		}
+		for _, rule := range s.rules {
+			issue, err := rule(ctx, row)
+			if errors.Is(err, errIngestSkipRow) {
+				report.Skipped++
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if issue != nil {
+				report.add(*issue)
+				return nil
+			}
+		}
+		if len(report.Errors) > 0 {
+			// エラーのあるファイルは取り込まないので、残りは検証だけする
+			return nil
+		}
+		return fn(row)
+	}
+
+	var err error
+	if format == ingestFormatJSON {
+		err = s.readJSON(r, &report, check)
+	} else {
+		err = s.readCSV(r, &report, check)
+	}
+	if err != nil {
+		return report.Rows, err
+	}
+	if len(report.Errors) > 0 {
+		return report.Rows, &ingestError{report: report}
+	}
+	return report.Rows, nil
+}
+
+func (s ingestSchema) readCSV(r io.Reader, report *IngestReport, check func(num int64, record map[string]string) error) error {
+	cr := csv.NewReader(r)
+	// 列数の違いはレポートに載せる
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	headers, err := cr.Read()
+	if err != nil {
+		if err == io.EOF {
+			report.add(IngestIssue{Code: ingestErrInvalidHeader, Message: "empty file"})
+			return nil
+		}
+		report.add(IngestIssue{Code: ingestErrMalformed, Message: err.Error()})
+		return nil
+	}
+	if len(headers) > 0 {
+		// Excelなどが付けるBOM
+		headers[0] = strings.TrimPrefix(headers[0], "\ufeff")
+	}
+	want := make([]string, 0, len(s.columns))
+	for _, col := range s.columns {
+		want = append(want, col.name)
+	}
+	if strings.Join(headers, ",") != strings.Join(want, ",") {
+		report.add(IngestIssue{
+			Code:    ingestErrInvalidHeader,
+			Message: fmt.Sprintf("headers must be %s", strings.Join(want, ",")),
+		})
+		return nil
+	}
+
+	for num := int64(1); ; num++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// 壊れたCSVはどこまで続くかわからないので、以降は読まない
+			report.Rows = num
+			report.add(IngestIssue{Row: num, Code: ingestErrMalformed, Message: err.Error()})
+			return nil
+		}
+		if len(record) != len(s.columns) {
+			report.Rows = num
+			report.add(IngestIssue{
+				Row:     num,
+				Code:    ingestErrColumnCount,
+				Message: fmt.Sprintf("row must have %d columns, got %d", len(s.columns), len(record)),
+			})
+			continue
+		}
+		values := make(map[string]string, len(record))
+		for i, col := range s.columns {
+			values[col.name] = record[i]
+		}
+		if err := check(num, values); err != nil {
+			return err
+		}
+	}
+}
+
+func (s ingestSchema) readJSON(r io.Reader, report *IngestReport, check func(num int64, record map[string]string) error) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+		report.add(IngestIssue{Code: ingestErrMalformed, Message: "must be an array of objects"})
+		return nil
+	}
+	for num := int64(1); dec.More(); num++ {
+		var obj map[string]any
+		if err := dec.Decode(&obj); err != nil {
+			report.Rows = num
+			report.add(IngestIssue{Row: num, Code: ingestErrMalformed, Message: err.Error()})
+			return nil
+		}
+		values := make(map[string]string, len(s.columns))
+		ok := true
+		for _, col := range s.columns {
+			switch v := obj[col.name].(type) {
+			case nil:
+			case string:
+				values[col.name] = v
+			case json.Number:
+				values[col.name] = v.String()
+			default:
+				report.Rows = num
+				report.add(IngestIssue{
+					Row:     num,
+					Column:  col.name,
+					Code:    ingestErrInvalidType,
+					Message: fmt.Sprintf("%s must be a string or a number", col.name),
+				})
+				ok = false
+			}
+		}
+		if !ok {
+			continue
+		}
+		if err := check(num, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// スコアのファイル
+// player_id,score の2列で、参加者が存在すること、テナントに設定があればスコアがその範囲にあることを確かめる
+
+// スコアの範囲のテナントごとの設定、空なら制限しない
+const (
+	scoreMinSettingName = "score.min"
+	scoreMaxSettingName = "score.max"
+)
+
+// 存在しない参加者の行の扱い (player_check)
+const (
+	playerCheckStrict  = "strict"  // 1行でもあればファイル全体を拒否する
+	playerCheckLenient = "lenient" // その行だけ飛ばして残りを取り込む
+)
+
+// リクエストのplayer_checkを読む、省略した場合はstrict
+func parsePlayerCheck(c echo.Context) (string, error) {
+	switch v := c.FormValue("player_check"); v {
+	case "", playerCheckStrict:
+		return playerCheckStrict, nil
+	case playerCheckLenient:
+		return playerCheckLenient, nil
+	default:
+		return "", &requestError{fields: []FieldError{{Field: "player_check", Code: fieldErrInvalid, Message: fmt.Sprintf("invalid player_check: %s", v)}}}
+	}
+}
+
+// スコアのファイルに含まれていた存在しない参加者と、その行番号
+type UnknownPlayer struct {
+	PlayerID string  `json:"player_id"`
+	Rows     []int64 `json:"rows"`
+}
+
+// スコアのファイルのplayer_idを確かめる
+// 行ごとに問い合わせず、テナントの参加者のIDを1回のクエリでまとめて読んでおく
+type playerIDCheck struct {
+	mode    string
+	known   map[string]struct{}
+	unknown []UnknownPlayer
+	index   map[string]int // player_id -> unknownの位置
+}
+
+func newPlayerIDCheck(ctx context.Context, tenantDB dbOrTx, tenantID int64, mode string) (*playerIDCheck, error) {
+	var ids []string
+	if err := tenantDB.SelectContext(ctx, &ids, "SELECT id FROM player WHERE tenant_id = ?", tenantID); err != nil {
+		return nil, fmt.Errorf("error Select player id: tenantID=%d, %w", tenantID, err)
+	}
+	known := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		known[id] = struct{}{}
+	}
+	return &playerIDCheck{mode: mode, known: known, index: map[string]int{}}, nil
+}
+
+func (pc *playerIDCheck) rule(ctx context.Context, row ingestRow) (*IngestIssue, error) {
+	playerID := row.str("player_id")
+	if _, ok := pc.known[playerID]; ok {
+		return nil, nil
+	}
+	i, ok := pc.index[playerID]
+	if !ok {
+		i = len(pc.unknown)
+		pc.index[playerID] = i
+		pc.unknown = append(pc.unknown, UnknownPlayer{PlayerID: playerID})
+	}
+	pc.unknown[i].Rows = append(pc.unknown[i].Rows, row.num)
+	if pc.mode == playerCheckLenient {
+		return nil, errIngestSkipRow
+	}
+	return row.issue("player_id", ingestErrPlayerNotFound, "player not found: %s", playerID), nil
+}
+
+// スコアのファイルの形式
+// 存在しない参加者はpcに記録する
+func scoreIngestSchema(ctx context.Context, tenantID int64, pc *playerIDCheck) (ingestSchema, error) {
+	settings, err := getTenantSettings(ctx, tenantID)
+	if err != nil {
+		return ingestSchema{}, err
+	}
+	s := ingestSchema{
+		columns: []ingestColumn{
+			{name: "player_id", required: true},
+			{name: "score", integer: true, required: true},
+		},
+		rules: []ingestRule{pc.rule},
+	}
+	if v := settings[scoreMinSettingName]; v != "" {
+		min, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return ingestSchema{}, fmt.Errorf("invalid tenant setting %s: %q, %w", scoreMinSettingName, v, err)
+		}
+		s.rules = append(s.rules, func(ctx context.Context, row ingestRow) (*IngestIssue, error) {
+			if score := row.integer("score"); score < min {
+				return row.issue("score", ingestErrOutOfRange, "score must be at least %d: %d", min, score), nil
+			}
+			return nil, nil
+		})
+	}
+	if v := settings[scoreMaxSettingName]; v != "" {
+		max, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return ingestSchema{}, fmt.Errorf("invalid tenant setting %s: %q, %w", scoreMaxSettingName, v, err)
+		}
+		s.rules = append(s.rules, func(ctx context.Context, row ingestRow) (*IngestIssue, error) {
+			if score := row.integer("score"); score > max {
+				return row.issue("score", ingestErrOutOfRange, "score must be at most %d: %d", max, score), nil
+			}
+			return nil, nil
+		})
+	}
+	return s, nil
+}
+
+// 参加者のファイル
+// display_name の1列
+var playerIngestSchema = ingestSchema{
+	columns: []ingestColumn{
+		{name: "display_name", required: true},
+	},
+}
+
+type ScoreRulesHandlerResult struct {
+	MinScore *int64 `json:"min_score"` // nullなら制限しない
+	MaxScore *int64 `json:"max_score"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/score_rules
+// スコアのファイルを取り込むときのスコアの範囲を取得する
+func scoreRulesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	settings, err := getTenantSettings(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	var res ScoreRulesHandlerResult
+	if n, err := strconv.ParseInt(settings[scoreMinSettingName], 10, 64); err == nil {
+		res.MinScore = &n
+	}
+	if n, err := strconv.ParseInt(settings[scoreMaxSettingName], 10, 64); err == nil {
+		res.MaxScore = &n
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/score_rules
+// スコアのファイルを取り込むときのスコアの範囲を設定する
+// min_score, max_scoreは空なら制限しない
+func scoreRulesUpdateHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	values := map[string]string{
+		scoreMinSettingName: c.FormValue("min_score"),
+		scoreMaxSettingName: c.FormValue("max_score"),
+	}
+	var bounds [2]*int64
+	for i, name := range []string{scoreMinSettingName, scoreMaxSettingName} {
+		if values[name] == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(values[name], 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid score: %s", values[name]))
+		}
+		bounds[i] = &n
+	}
+	if bounds[0] != nil && bounds[1] != nil && *bounds[0] > *bounds[1] {
+		return echo.NewHTTPError(http.StatusBadRequest, "min_score must not be greater than max_score")
+	}
+	for name, value := range values {
+		if err := setTenantSetting(ctx, v.tenantID, name, value); err != nil {
+			return err
+		}
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: ScoreRulesHandlerResult{MinScore: bounds[0], MaxScore: bounds[1]}})
+}
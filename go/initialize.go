@@ -0,0 +1,265 @@
+package isuports
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+)
+
+// 初期化で消す管理用DBの行
+// ../sql/init.sql と同じ内容にすること、初期化後の検証 (verifyInitialized) でも使う
+var initializeAdminCleanups = []struct {
+	table string
+	where string
+}{
+	{"tenant", "id > 100"},
+	{"visit_history", "created_at >= '1654041600'"},
+	{"webhook_endpoint", "tenant_id > 100"},
+	{"webhook_delivery", "tenant_id > 100"},
+	{"tenant_setting", "tenant_id > 100"},
+	{"player_email", "tenant_id > 100"},
+	{"mail_outbox", "tenant_id > 100"},
+	{"api_token", "tenant_id > 100"},
+	{"sso_identity", "tenant_id > 100"},
+	{"sso_state", "tenant_id > 100"},
+	{"scim_user", "tenant_id > 100"},
+	{"billing_invoice", "tenant_id > 100"},
+	{"billing_invoice_line", "tenant_id > 100"},
+}
+
+// 管理用DBを初期状態に戻すクエリ
+// 何度実行しても同じ状態になる
+var initializeAdminQueries = func() []string {
+	qs := make([]string, 0, len(initializeAdminCleanups)+2)
+	for _, c := range initializeAdminCleanups {
+		qs = append(qs, fmt.Sprintf("DELETE FROM %s WHERE %s", c.table, c.where))
+	}
+	return append(qs,
+		"UPDATE id_generator SET id=2678400000 WHERE stub='a'",
+		"ALTER TABLE id_generator AUTO_INCREMENT=2678400000",
+	)
+}()
+
+// 管理用DBとテナントDBを初期状態に戻す
+// init.shをシェル経由で実行する代わりに、テナントDBのファイルのコピーを並列に行う
+func initializeDatabases(ctx context.Context) error {
+	for _, q := range initializeAdminQueries {
+		if _, err := srv(ctx).adminDB.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("error initialize adminDB: query=%s, %w", q, err)
+		}
+	}
+
+	tenantDBDir := getEnv("ISUCON_TENANT_DB_DIR", "../tenant_db")
+	initialDataDir := getEnv("ISUCON_INITIAL_DATA_DIR", "../../initial_data")
+
+	// 差し替えたテナントDBは次に使うときに改めてマイグレーションする
+	srv(ctx).migratedTenants.reset()
+
+	// 初期データ以降に作られたテナントDBや、前回の初期化で途中まで書いたファイルも含めて消す
+	for _, pattern := range []string{"*.db", "*.db-journal", "*.db-wal", "*.db-shm", "*.db.tmp"} {
+		files, err := filepath.Glob(filepath.Join(tenantDBDir, pattern))
+		if err != nil {
+			return fmt.Errorf("error filepath.Glob: pattern=%s, %w", pattern, err)
+		}
+		for _, f := range files {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error os.Remove: path=%s, %w", f, err)
+			}
+		}
+	}
+
+	srcs, err := filepath.Glob(filepath.Join(initialDataDir, "*.db"))
+	if err != nil {
+		return fmt.Errorf("error filepath.Glob: dir=%s, %w", initialDataDir, err)
+	}
+	workers := getEnvInt("ISUCON_INITIALIZE_WORKERS", runtime.NumCPU())
+	return forEachParallel(ctx, workers, srcs, func(ctx context.Context, src string) error {
+		return copyFile(src, filepath.Join(tenantDBDir, filepath.Base(src)))
+	})
+}
+
+// ファイルをコピーする
+// 途中で失敗しても壊れたファイルが残らないよう、一時ファイルに書いてからリネームする
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error os.Open: path=%s, %w", src, err)
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error os.OpenFile: path=%s, %w", tmp, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("error io.Copy: src=%s, dst=%s, %w", src, tmp, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error Close: path=%s, %w", tmp, err)
+	}
+	// 初期化後の検証はサイズと更新日時で行うので、コピー元の更新日時に揃える
+	if fi, err := in.Stat(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error Stat: path=%s, %w", src, err)
+	} else if err := os.Chtimes(tmp, fi.ModTime(), fi.ModTime()); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error os.Chtimes: path=%s, %w", tmp, err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error os.Rename: src=%s, dst=%s, %w", tmp, dst, err)
+	}
+	return nil
+}
+
+type InitializeTableCount struct {
+	Table string `json:"table"`
+	Rows  int64  `json:"rows"`
+}
+
+type InitializeTenantDBFile struct {
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	ModifiedAt int64  `json:"modified_at"`
+}
+
+// 初期化後の検証結果
+// Problemsが空でなければ初期化は失敗している
+type InitializeVerification struct {
+	Tables    []InitializeTableCount   `json:"tables"`
+	TenantDBs []InitializeTenantDBFile `json:"tenant_dbs"`
+	Problems  []string                 `json:"problems"`
+}
+
+// 初期化した結果が初期データと一致しているか検証する
+// 管理用DBは消したはずの行が残っていないか、テナントDBは初期データと同じファイルが揃っているかを確かめる
+// 初期データは数GBあり、ベンチマーカーの初期化の制限時間内に読み直せないので、テナントDBはサイズと更新日時で比べる
+// 中身まで確かめる場合はサブコマンド verify-initial-data で行う
+func verifyInitialized(ctx context.Context) (*InitializeVerification, error) {
+	res := &InitializeVerification{
+		Tables:    make([]InitializeTableCount, 0, len(initializeAdminCleanups)),
+		TenantDBs: []InitializeTenantDBFile{},
+		Problems:  []string{},
+	}
+	for _, c := range initializeAdminCleanups {
+		var rows, left int64
+		if err := srv(ctx).adminDB.GetContext(ctx, &rows, "SELECT COUNT(*) FROM "+c.table); err != nil {
+			return nil, fmt.Errorf("error Select count %s: %w", c.table, err)
+		}
+		if err := srv(ctx).adminDB.GetContext(ctx, &left, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", c.table, c.where)); err != nil {
+			return nil, fmt.Errorf("error Select count %s: %w", c.table, err)
+		}
+		res.Tables = append(res.Tables, InitializeTableCount{Table: c.table, Rows: rows})
+		if left > 0 {
+			res.Problems = append(res.Problems, fmt.Sprintf("%s: %d rows left where %s", c.table, left, c.where))
+		}
+	}
+
+	tenantDBDir := getEnv("ISUCON_TENANT_DB_DIR", "../tenant_db")
+	initialDataDir := getEnv("ISUCON_INITIAL_DATA_DIR", "../../initial_data")
+	srcs, err := filepath.Glob(filepath.Join(initialDataDir, "*.db"))
+	if err != nil {
+		return nil, fmt.Errorf("error filepath.Glob: dir=%s, %w", initialDataDir, err)
+	}
+	dsts, err := filepath.Glob(filepath.Join(tenantDBDir, "*.db"))
+	if err != nil {
+		return nil, fmt.Errorf("error filepath.Glob: dir=%s, %w", tenantDBDir, err)
+	}
+	expected := make(map[string]bool, len(srcs))
+	for _, src := range srcs {
+		expected[filepath.Base(src)] = true
+	}
+	for _, dst := range dsts {
+		if !expected[filepath.Base(dst)] {
+			res.Problems = append(res.Problems, fmt.Sprintf("%s: not in initial data", filepath.Base(dst)))
+		}
+	}
+
+	for _, src := range srcs {
+		name := filepath.Base(src)
+		want, err := os.Stat(src)
+		if err != nil {
+			return nil, fmt.Errorf("error os.Stat: path=%s, %w", src, err)
+		}
+		got, err := os.Stat(filepath.Join(tenantDBDir, name))
+		if os.IsNotExist(err) {
+			res.Problems = append(res.Problems, fmt.Sprintf("%s: missing", name))
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("error os.Stat: path=%s, %w", filepath.Join(tenantDBDir, name), err)
+		}
+		res.TenantDBs = append(res.TenantDBs, InitializeTenantDBFile{Name: name, Size: got.Size(), ModifiedAt: got.ModTime().Unix()})
+		if got.Size() != want.Size() || got.ModTime().Unix() != want.ModTime().Unix() {
+			res.Problems = append(res.Problems, fmt.Sprintf("%s: size or modification time differs from initial data", name))
+		}
+	}
+	sort.Slice(res.TenantDBs, func(i, j int) bool { return res.TenantDBs[i].Name < res.TenantDBs[j].Name })
+	return res, nil
+}
+
+// テナントDBが初期データと同じ内容か、SHA-256で比べる
+// 初期データを全て読むので、/initialize ではなくサブコマンド verify-initial-data から呼ぶ
+// 一致しないファイルを返す
+func verifyTenantDBChecksums(ctx context.Context) ([]string, error) {
+	tenantDBDir := getEnv("ISUCON_TENANT_DB_DIR", "../tenant_db")
+	initialDataDir := getEnv("ISUCON_INITIAL_DATA_DIR", "../../initial_data")
+	srcs, err := filepath.Glob(filepath.Join(initialDataDir, "*.db"))
+	if err != nil {
+		return nil, fmt.Errorf("error filepath.Glob: dir=%s, %w", initialDataDir, err)
+	}
+	problems := make([]string, len(srcs))
+	indexes := make([]int, len(srcs))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	workers := getEnvInt("ISUCON_INITIALIZE_WORKERS", runtime.NumCPU())
+	if err := forEachParallel(ctx, workers, indexes, func(ctx context.Context, i int) error {
+		name := filepath.Base(srcs[i])
+		want, err := fileSHA256(srcs[i])
+		if err != nil {
+			return err
+		}
+		got, err := fileSHA256(filepath.Join(tenantDBDir, name))
+		if os.IsNotExist(err) {
+			problems[i] = fmt.Sprintf("%s: missing", name)
+		} else if err != nil {
+			return err
+		} else if got != want {
+			problems[i] = fmt.Sprintf("%s: checksum mismatch", name)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for _, p := range problems {
+		if p != "" {
+			res = append(res, p)
+		}
+	}
+	return res, nil
+}
+
+// ファイルのSHA-256を返す
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("error io.Copy: path=%s, %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
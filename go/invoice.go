@@ -0,0 +1,381 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 月ごとの請求書
+// その月に終了した大会の課金レポートをテナントごとにまとめて billing_invoice, billing_invoice_line に保存する
+// 作成した請求書はdraftで、Stripeに送るとopenになり、支払いの結果はStripeのWebhookで更新する (stripe.go を参照)
+// draftの間は作り直すと明細を置き換え、Stripeに送った後は変更しない
+
+// billing_invoice.status
+const (
+	invoiceStatusDraft         = "draft"          // 作成済み、Stripeに未送信
+	invoiceStatusOpen          = "open"           // Stripeで請求中
+	invoiceStatusPaid          = "paid"           // 支払い済み
+	invoiceStatusPaymentFailed = "payment_failed" // 支払いに失敗した (Stripeがリトライする)
+	invoiceStatusVoid          = "void"           // 取り消した
+	invoiceStatusUncollectible = "uncollectible"  // 回収不能
+)
+
+// 請求の締めは月単位、タイムゾーンを設定していないテナントはJST (timezone.go を参照)
+var billingLocation = time.FixedZone("Asia/Tokyo", 9*60*60)
+
+type InvoiceRow struct {
+	ID              int64  `db:"id"`
+	TenantID        int64  `db:"tenant_id"`
+	Period          string `db:"period"` // YYYY-MM
+	AmountYen       int64  `db:"amount_yen"`
+	Status          string `db:"status"`
+	StripeInvoiceID string `db:"stripe_invoice_id"`
+	LastError       string `db:"last_error"`
+	CreatedAt       int64  `db:"created_at"`
+	UpdatedAt       int64  `db:"updated_at"`
+}
+
+type InvoiceLineRow struct {
+	ID            int64  `db:"id"`
+	InvoiceID     int64  `db:"invoice_id"`
+	TenantID      int64  `db:"tenant_id"`
+	CompetitionID string `db:"competition_id"`
+	Description   string `db:"description"`
+	AmountYen     int64  `db:"amount_yen"`
+}
+
+// YYYY-MMを、locでの月の初めと次の月の初めに変換する
+func parseBillingPeriod(s string, loc *time.Location) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation("2006-01", s, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid period: %s", s)
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// 期間内に終了した大会の明細を作る
+func invoiceLines(ctx context.Context, tenantID int64, start, end time.Time) ([]InvoiceLineRow, error) {
+	tenantDB, err := connectToTenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer tenantDB.Close()
+	tx, err := beginBillingSnapshot(ctx, tenantDB, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+
+	cs := []CompetitionRow{}
+	if err := tx.SelectContext(
+		ctx,
+		&cs,
+		"SELECT * FROM competition WHERE tenant_id = ? AND finished_at >= ? AND finished_at < ? ORDER BY finished_at ASC",
+		tenantID, start.Unix(), end.Unix(),
+	); err != nil {
+		return nil, fmt.Errorf("error Select competition: tenantID=%d, %w", tenantID, err)
+	}
+	reports, err := billingReportsByTenant(ctx, tx, tenantID, cs)
+	if err != nil {
+		return nil, fmt.Errorf("error billingReportsByTenant: %w", err)
+	}
+	lines := make([]InvoiceLineRow, 0, len(reports))
+	for _, r := range reports {
+		if r.BillingYen == 0 {
+			continue
+		}
+		lines = append(lines, InvoiceLineRow{
+			TenantID:      tenantID,
+			CompetitionID: r.CompetitionID,
+			Description:   fmt.Sprintf("%s (参加者 %d人, 閲覧 %d人)", r.CompetitionTitle, r.PlayerCount, r.VisitorCount),
+			AmountYen:     r.BillingYen,
+		})
+	}
+	return lines, nil
+}
+
+// テナントの月の請求書を作る
+// 請求がなければnilを返す、Stripeに送った後の請求書はそのまま返す
+func generateInvoice(ctx context.Context, tenantID int64, period string) (*InvoiceRow, error) {
+	// 月の締めはテナントのタイムゾーンで行う (timezone.go を参照)
+	loc, err := tenantLocation(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := parseBillingPeriod(period, loc)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := invoiceLines(ctx, tenantID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	var amount int64
+	for _, l := range lines {
+		amount += l.AmountYen
+	}
+
+	tx, err := srv(ctx).adminDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
+
+	var inv InvoiceRow
+	err = tx.GetContext(ctx, &inv, "SELECT * FROM billing_invoice WHERE tenant_id = ? AND period = ? FOR UPDATE", tenantID, period)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if amount == 0 {
+			return nil, nil
+		}
+		now := srv(ctx).clock.Now().Unix()
+		inv = InvoiceRow{TenantID: tenantID, Period: period, Status: invoiceStatusDraft, CreatedAt: now, UpdatedAt: now}
+		res, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO billing_invoice (tenant_id, period, amount_yen, status, created_at, updated_at) VALUES (?, ?, 0, ?, ?, ?)",
+			inv.TenantID, inv.Period, inv.Status, inv.CreatedAt, inv.UpdatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error Insert billing_invoice: tenantID=%d, period=%s, %w", tenantID, period, err)
+		}
+		if inv.ID, err = res.LastInsertId(); err != nil {
+			return nil, fmt.Errorf("error get LastInsertId: %w", err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("error Select billing_invoice: tenantID=%d, period=%s, %w", tenantID, period, err)
+	case inv.Status != invoiceStatusDraft:
+		return &inv, nil
+	}
+
+	if err := replaceInvoiceLines(ctx, tx, &inv, lines, amount); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error Commit: %w", err)
+	}
+	return &inv, nil
+}
+
+func replaceInvoiceLines(ctx context.Context, tx *sqlx.Tx, inv *InvoiceRow, lines []InvoiceLineRow, amount int64) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM billing_invoice_line WHERE invoice_id = ?", inv.ID); err != nil {
+		return fmt.Errorf("error Delete billing_invoice_line: invoiceID=%d, %w", inv.ID, err)
+	}
+	for i := range lines {
+		lines[i].InvoiceID = inv.ID
+	}
+	if len(lines) > 0 {
+		if _, err := tx.NamedExecContext(
+			ctx,
+			"INSERT INTO billing_invoice_line (invoice_id, tenant_id, competition_id, description, amount_yen) VALUES (:invoice_id, :tenant_id, :competition_id, :description, :amount_yen)",
+			lines,
+		); err != nil {
+			return fmt.Errorf("error Insert billing_invoice_line: invoiceID=%d, %w", inv.ID, err)
+		}
+	}
+	inv.AmountYen = amount
+	inv.UpdatedAt = srv(ctx).clock.Now().Unix()
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE billing_invoice SET amount_yen = ?, updated_at = ? WHERE id = ?",
+		inv.AmountYen, inv.UpdatedAt, inv.ID,
+	); err != nil {
+		return fmt.Errorf("error Update billing_invoice: id=%d, %w", inv.ID, err)
+	}
+	return nil
+}
+
+type InvoiceLineDetail struct {
+	CompetitionID string `json:"competition_id"`
+	Description   string `json:"description"`
+	AmountYen     int64  `json:"amount_yen"`
+}
+
+type InvoiceDetail struct {
+	ID              string              `json:"id"`
+	TenantID        string              `json:"tenant_id"`
+	Period          string              `json:"period"`
+	AmountYen       int64               `json:"amount_yen"`
+	Status          string              `json:"status"`
+	StripeInvoiceID string              `json:"stripe_invoice_id,omitempty"`
+	LastError       string              `json:"last_error,omitempty"`
+	Lines           []InvoiceLineDetail `json:"lines"`
+	UpdatedAt       int64               `json:"updated_at"`
+}
+
+// 請求書を明細つきで返す
+func invoiceDetails(ctx context.Context, invs []InvoiceRow) ([]InvoiceDetail, error) {
+	ds := make([]InvoiceDetail, 0, len(invs))
+	if len(invs) == 0 {
+		return ds, nil
+	}
+	ids := make([]int64, 0, len(invs))
+	for _, inv := range invs {
+		ids = append(ids, inv.ID)
+	}
+	query, args, err := sqlx.In("SELECT * FROM billing_invoice_line WHERE invoice_id IN (?) ORDER BY id", ids)
+	if err != nil {
+		return nil, fmt.Errorf("error sqlx.In: %w", err)
+	}
+	ls := []InvoiceLineRow{}
+	if err := srv(ctx).adminDB.SelectContext(ctx, &ls, query, args...); err != nil {
+		return nil, fmt.Errorf("error Select billing_invoice_line: %w", err)
+	}
+	linesByInvoice := map[int64][]InvoiceLineDetail{}
+	for _, l := range ls {
+		linesByInvoice[l.InvoiceID] = append(linesByInvoice[l.InvoiceID], InvoiceLineDetail{
+			CompetitionID: l.CompetitionID,
+			Description:   l.Description,
+			AmountYen:     l.AmountYen,
+		})
+	}
+	for _, inv := range invs {
+		lines := linesByInvoice[inv.ID]
+		if lines == nil {
+			lines = []InvoiceLineDetail{}
+		}
+		ds = append(ds, InvoiceDetail{
+			ID:              strconv.FormatInt(inv.ID, 10),
+			TenantID:        strconv.FormatInt(inv.TenantID, 10),
+			Period:          inv.Period,
+			AmountYen:       inv.AmountYen,
+			Status:          inv.Status,
+			StripeInvoiceID: inv.StripeInvoiceID,
+			LastError:       inv.LastError,
+			Lines:           lines,
+			UpdatedAt:       inv.UpdatedAt,
+		})
+	}
+	return ds, nil
+}
+
+type InvoicesHandlerResult struct {
+	Invoices []InvoiceDetail `json:"invoices"`
+}
+
+// SaaS管理者用API
+// 月の請求書を全テナント分作る
+// POST /api/admin/invoices/generate
+// periodにYYYY-MMを指定する、Stripeに送った請求書は作り直さない
+func invoicesGenerateHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.tenantName != "admin" {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("%s has not this API", v.tenantName),
+		)
+	}
+	if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+
+	ctx := c.Request().Context()
+	period := c.FormValue("period")
+	if _, _, err := parseBillingPeriod(period, billingLocation); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	ts := []TenantRow{}
+	if err := srv(ctx).adminReadDB.SelectContext(ctx, &ts, "SELECT * FROM tenant WHERE provisioning = 0 ORDER BY id"); err != nil {
+		return fmt.Errorf("error Select tenant: %w", err)
+	}
+	invs := make([]*InvoiceRow, len(ts))
+	indexes := make([]int, len(ts))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	if err := forEachParallel(ctx, billingWorkers, indexes, func(ctx context.Context, i int) error {
+		inv, err := generateInvoice(ctx, ts[i].ID, period)
+		if err != nil {
+			return fmt.Errorf("failed to generateInvoice: tenantID=%d, %w", ts[i].ID, err)
+		}
+		invs[i] = inv
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	rows := make([]InvoiceRow, 0, len(invs))
+	for _, inv := range invs {
+		if inv != nil {
+			rows = append(rows, *inv)
+		}
+	}
+	ds, err := invoiceDetails(ctx, rows)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: InvoicesHandlerResult{Invoices: ds}})
+}
+
+// SaaS管理者用API
+// 月の請求書の一覧を取得する
+// GET /api/admin/invoices
+// periodにYYYY-MMを指定する
+func adminInvoicesHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.tenantName != "admin" {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("%s has not this API", v.tenantName),
+		)
+	}
+	if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+
+	ctx := c.Request().Context()
+	period := c.QueryParam("period")
+	if _, _, err := parseBillingPeriod(period, billingLocation); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	invs := []InvoiceRow{}
+	if err := srv(ctx).adminDB.SelectContext(ctx, &invs, "SELECT * FROM billing_invoice WHERE period = ? ORDER BY tenant_id", period); err != nil {
+		return fmt.Errorf("error Select billing_invoice: period=%s, %w", period, err)
+	}
+	ds, err := invoiceDetails(ctx, invs)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: InvoicesHandlerResult{Invoices: ds}})
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/invoices
+// テナントの請求書の一覧を新しい順に取得する
+func organizerInvoicesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	invs := []InvoiceRow{}
+	if err := srv(ctx).adminDB.SelectContext(ctx, &invs, "SELECT * FROM billing_invoice WHERE tenant_id = ? ORDER BY period DESC", v.tenantID); err != nil {
+		return fmt.Errorf("error Select billing_invoice: tenantID=%d, %w", v.tenantID, err)
+	}
+	ds, err := invoiceDetails(ctx, invs)
+	if err != nil {
+		return err
+	}
+	// Stripeの送信エラーはテナントには見せない
+	for i := range ds {
+		ds[i].LastError = ""
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: InvoicesHandlerResult{Invoices: ds}})
+}
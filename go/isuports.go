@@ -7,68 +7,141 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
-	"github.com/gofrs/flock"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"github.com/lestrrat-go/jwx/v2/jwa"
-	"github.com/lestrrat-go/jwx/v2/jwk"
-	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/logica0419/helpisu"
+	"go.uber.org/zap"
 )
 
 const (
-	tenantDBSchemaFilePath = "../sql/tenant/10_schema.sql"
-	initializeScript       = "../sql/init.sh"
-	cookieName             = "isuports_session"
+	cookieName = "isuports_session"
 
 	RoleAdmin     = "admin"
 	RoleOrganizer = "organizer"
 	RolePlayer    = "player"
+	RoleReader    = "reader" // 読み取り専用のAPIトークン (apitoken.go を参照)
 	RoleNone      = "none"
 )
 
 var (
 	// 正しいテナント名の正規表現
 	tenantNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9-]{0,61}[a-z0-9]$`)
-
-	adminDB *sqlx.DB
-
-	sqliteDriverName = "sqlite3"
-	tenantDBCache    = helpisu.NewCache[int64, *sqlx.DB]()
-	dispenseMu       = sync.Mutex{}
-	curId            = int64(-1)
 )
 
-// 環境変数を取得する、なければデフォルト値を返す
+// 払い出したIDの最大値
+// -1ならまだ払い出していない
+type dispensedID struct {
+	mu  sync.Mutex
+	cur int64
+}
+
+// 設定値を取得する、なければデフォルト値を返す
+// 環境変数、設定ファイルの順に探す (config.go を参照)
 func getEnv(key string, defaultValue string) string {
-	if val, ok := os.LookupEnv(key); ok {
+	if val, ok := lookupConfig(key); ok {
 		return val
 	}
 	return defaultValue
 }
 
+// 設定値を整数として取得する、なければデフォルト値を返す
+func getEnvInt(key string, defaultValue int) int {
+	val, ok := lookupConfig(key)
+	if !ok {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return defaultValue
+	}
+	return i
+}
+
+// 設定値を小数として取得する、なければデフォルト値を返す
+func getEnvFloat(key string, defaultValue float64) float64 {
+	val, ok := lookupConfig(key)
+	if !ok {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return defaultValue
+	}
+	return f
+}
+
+// 設定値を時間として取得する、なければデフォルト値を返す
+// 値は time.ParseDuration で解釈できる形式 (例: 30s, 5m)
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	val, ok := lookupConfig(key)
+	if !ok {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return defaultValue
+	}
+	return d
+}
+
+// 遅いクエリを記録する場合はラップしたドライバを使う (slowlog.go を参照)
+var adminDBDriverName = wrapSlowQueryDriver("mysql", &mysql.MySQLDriver{})
+
 // 管理用DBに接続する
 func connectAdminDB() (*sqlx.DB, error) {
+	return openAdminDB(
+		getEnv("ISUCON_DB_HOST", "127.0.0.1"),
+		getEnv("ISUCON_DB_PORT", "3306"),
+	)
+}
+
+// 管理用DBの読み取り用レプリカに接続する
+// ISUCON_DB_READ_HOST が未設定ならプライマリをそのまま返す
+func connectAdminReadDB(primary *sqlx.DB) (*sqlx.DB, error) {
+	host := getEnv("ISUCON_DB_READ_HOST", "")
+	if host == "" {
+		return primary, nil
+	}
+	return openAdminDB(host, getEnv("ISUCON_DB_READ_PORT", getEnv("ISUCON_DB_PORT", "3306")))
+}
+
+func openAdminDB(host, port string) (*sqlx.DB, error) {
 	config := mysql.NewConfig()
 	config.Net = "tcp"
-	config.Addr = getEnv("ISUCON_DB_HOST", "127.0.0.1") + ":" + getEnv("ISUCON_DB_PORT", "3306")
+	config.Addr = host + ":" + port
 	config.User = getEnv("ISUCON_DB_USER", "isucon")
 	config.Passwd = getEnv("ISUCON_DB_PASSWORD", "isucon")
 	config.DBName = getEnv("ISUCON_DB_NAME", "isuports")
 	config.ParseTime = true
 	config.InterpolateParams = true
+	// クエリの応答を待つ時間の上限 (0なら無制限)
+	config.ReadTimeout = dbQueryTimeout
+	config.WriteTimeout = dbQueryTimeout
 	dsn := config.FormatDSN()
-	return sqlx.Open("mysql", dsn)
+	return sqlx.Open(adminDBDriverName, dsn)
+}
+
+// 管理用DBのコネクションプールを設定する
+func configureAdminDBPool(db *sqlx.DB) {
+	// 同時に開ける接続数の上限 (default: 10)
+	db.SetMaxOpenConns(getEnvInt("ISUCON_DB_MAX_OPEN_CONNS", 10))
+	// プール内に保持できるアイドル接続数の制限を設定 (default: 1024)
+	db.SetMaxIdleConns(getEnvInt("ISUCON_DB_MAX_IDLE_CONNS", 1024))
+	// 接続してから再利用できる最大期間 (default: 無制限)
+	db.SetConnMaxLifetime(getEnvDuration("ISUCON_DB_CONN_MAX_LIFETIME", 0))
+	// アイドル接続してから再利用できる最大期間 (default: 無制限)
+	db.SetConnMaxIdleTime(getEnvDuration("ISUCON_DB_CONN_MAX_IDLE_TIME", 0))
 }
 
 // テナントDBのパスを返す
@@ -78,51 +151,63 @@ func tenantDBPath(id int64) string {
 }
 
 // テナントDBに接続する
-func connectToTenantDB(id int64) (*sqlx.DB, error) {
-	tenantDB, ok := tenantDBCache.Get(id)
-	if ok {
-		return tenantDB, nil
+// 使い終わったらCloseでプールに返却すること
+func connectToTenantDB(ctx context.Context, id int64) (*tenantDBConn, error) {
+	s := srv(ctx)
+	conn, err := s.tenantDBs.acquire(id, s.openTenantDB)
+	var me *tenantDBMissingError
+	if errors.As(err, &me) {
+		if err := s.createMissingTenantDB(ctx, me); err != nil {
+			return nil, err
+		}
+		conn, err = s.tenantDBs.acquire(id, s.openTenantDB)
 	}
-	p := tenantDBPath(id)
-	db, err := sqlx.Open(sqliteDriverName, fmt.Sprintf("file:%s?mode=rw", p))
 	if err != nil {
-		return nil, fmt.Errorf("failed to open tenant DB: %w", err)
-	}
-	tenantDBCache.Set(id, db)
-	return db, nil
-}
-
-// テナントDBを新規に作成する
-func createTenantDB(id int64) error {
-	if _, ok := tenantDBCache.Get(id); ok {
-		return nil
+		return nil, err
 	}
-
-	p := tenantDBPath(id)
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("sqlite3 %s < %s", p, tenantDBSchemaFilePath))
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to exec sqlite3 %s < %s, out=%s: %w", p, tenantDBSchemaFilePath, string(out), err)
+	// 古いスキーマのままのテナントDBは初めて使うときにマイグレーションする
+	if err := s.ensureTenantDBMigrated(id, conn.DB); err != nil {
+		conn.Close()
+		return nil, err
 	}
-	return nil
+	return conn, nil
 }
 
 // システム全体で一意なIDを生成する
 // これMutexと加算で置き換えられる
+// Serverに sequentialIDs が設定されていればそちらから払い出す (idgen.go を参照)
 func dispenseID(ctx context.Context) (string, error) {
-	if curId == -1 {
-		adminDB.Get(curId, "SELECT id FROM id_generator WHERE stub='a';")
+	s := srv(ctx)
+	if g := s.sequentialIDs; g != nil {
+		return g.dispense(), nil
 	}
-	dispenseMu.Lock()
-	curId += 1
-	dispenseMu.Unlock()
-	return fmt.Sprintf("%x", curId), nil
+	d := s.dispensed
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// 最初の払い出しでid_generatorから続きを読む
+	if d.cur == -1 {
+		var cur int64
+		if err := s.adminDB.Get(&cur, "SELECT id FROM id_generator WHERE stub='a';"); err != nil {
+			return "", fmt.Errorf("error Select id_generator: %w", err)
+		}
+		d.cur = cur
+	}
+	d.cur += 1
+	return fmt.Sprintf("%x", d.cur), nil
 }
 
-func dispenseUpdate() {
-	t := time.NewTicker(90 * time.Second)
-	defer t.Stop()
-	<-t.C
-	adminDB.Exec("UPDATE id_generator SET id = ?, stub=?;", curId, "a")
+// 払い出し済みのIDをid_generatorに書き戻す
+func saveDispensedID(s *Server) {
+	s.dispensed.mu.Lock()
+	id := s.dispensed.cur
+	s.dispensed.mu.Unlock()
+	if id == -1 {
+		return
+	}
+	_ = withRetry(context.Background(), func() error {
+		_, err := s.adminDB.Exec("UPDATE id_generator SET id = ?, stub=?;", id, "a")
+		return err
+	})
 }
 
 // 全APIにCache-Control: privateを設定する
@@ -133,15 +218,19 @@ func SetCacheControlPrivate(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
-var d *helpisu.DBDisconnectDetector
-
-// Run は cmd/isuports/main.go から呼ばれるエントリーポイントです
+// Run はHTTPサーバーを起動します (serveサブコマンド)
 func Run() {
 	e := echo.New()
 
+	if configFileErr != nil {
+		logger.Fatal("failed to load config file", zap.Error(configFileErr))
+		return
+	}
+
 	var (
-		sqlLogger io.Closer
-		err       error
+		sqliteDriverName string
+		sqlLogger        io.Closer
+		err              error
 	)
 	// sqliteのクエリログを出力する設定
 	// 環境変数 ISUCON_SQLITE_TRACE_FILE を設定すると、そのファイルにクエリログをJSON形式で出力する
@@ -149,86 +238,464 @@ func Run() {
 	// sqltrace.go を参照
 	sqliteDriverName, sqlLogger, err = initializeSQLLogger()
 	if err != nil {
-		e.Logger.Panicf("error initializeSQLLogger: %s", err)
+		logger.Panic("error initializeSQLLogger", zap.Error(err))
 	}
 	defer sqlLogger.Close()
 
-	e.Use(middleware.Recover())
+	// ログはリクエストIDつきのJSONで出力する
+	// ログレベルは ISUCON_APP_ENV と ISUCON_LOG_LEVEL で変える (logging.go を参照)
+	if err := configureLogging(e); err != nil {
+		logger.Fatal("failed to configure logging", zap.Error(err))
+	}
+	// /api/v2/... はv1のルートで処理してレスポンスを変換する (apiversion.go を参照)
+	e.Pre(apiVersionMiddleware())
+	e.Use(requestIDMiddleware())
+	// レイテンシの悪化を検知してプロファイルを取る (watchdog.go を参照)
+	wd := newWatchdogFromConfig()
+	e.Use(wd.middleware())
+	// ルートごとのレイテンシ (histogram.go を参照)
+	e.Use(latencyStatsMiddleware())
+	e.Use(slowRequestMiddleware())
+	// 同時実行数の上限 (loadshed.go を参照)
+	shedder, err := newLoadShedderFromConfig()
+	if err != nil {
+		logger.Fatal("failed to configure load shedding", zap.Error(err))
+	}
+	e.Use(shedder.middleware())
+	// 担当でないテナントへのリクエストの振り分け (shard.go を参照)
+	if mailerConfigErr != nil {
+		logger.Fatal("invalid mail config", zap.Error(mailerConfigErr))
+	}
+	if shardConfigErr != nil {
+		logger.Fatal("invalid shard config", zap.Error(shardConfigErr))
+	}
+	e.Use(shardMiddleware())
+	// テナントごとに許可したOriginからのAPI呼び出し (cors.go を参照)
+	e.Use(corsMiddleware())
+	// テナントごとのリクエスト数の上限 (quota.go を参照)
+	e.Use(tenantRateLimitMiddleware())
+	// アクセスログは開発環境か、ISUCON_ACCESS_LOG=1 のときだけ出力する
+	if accessLogEnabled() {
+		al, err := newAccessLoggerFromConfig()
+		if err != nil {
+			logger.Fatal("failed to open access log", zap.Error(err))
+		}
+		defer al.Close()
+		e.Use(accessLogMiddleware(al))
+	}
+	// panicはスタックトレースをつけてerrorResponseHandlerに渡し、そこで通知する (errorreport.go を参照)
+	e.Use(middleware.RecoverWithConfig(middleware.RecoverConfig{
+		DisableStackAll: true,
+		LogErrorFunc: func(c echo.Context, err error, stack []byte) error {
+			return &panicError{err: err, stack: stack}
+		},
+	}))
 	e.Use(SetCacheControlPrivate)
 
+	registerRoutes(e)
+
+	e.HTTPErrorHandler = errorResponseHandler
+	e.Validator = requestValidator{}
+
+	adminDB, err := connectAdminDB()
+	if err != nil {
+		logger.Fatal("failed to connect db", zap.Error(err))
+		return
+	}
+	configureAdminDBPool(adminDB)
+	defer adminDB.Close()
+
+	adminReadDB, err := connectAdminReadDB(adminDB)
+	if err != nil {
+		logger.Fatal("failed to connect read db", zap.Error(err))
+		return
+	}
+	if adminReadDB != adminDB {
+		configureAdminDBPool(adminReadDB)
+		defer adminReadDB.Close()
+	}
+	// ハンドラはリクエストのcontextからServerを取り出す (server.go を参照)
+	// Preのミドルウェアはルーティングと他のミドルウェアより前に実行される
+	s := NewServer(adminDB, WithAdminReadDB(adminReadDB), WithSQLiteDriver(sqliteDriverName))
+	defaultServer = s
+	e.Pre(s.middleware())
+	publishMetrics()
+
+	// テナントDBを大量に開くのでファイルディスクリプタ数の上限を引き上げておく
+	if limit, err := raiseFileDescriptorLimit(); err != nil {
+		logger.Warn("failed to raise file descriptor limit", zap.Error(err))
+	} else {
+		logger.Info("file descriptor limit", zap.Uint64("limit", limit))
+	}
+	defer s.tenantDBs.closeAll()
+
+	helpisu.WaitDBStartUp(adminDB.DB)
+
+	// 必要な設定とリソースが揃っているか確認する (validate.go を参照)
+	if err := validateStartup(withServer(context.Background(), s)); err != nil {
+		logger.Fatal("invalid startup configuration", zap.Error(err))
+		return
+	}
+
+	// 管理用DBのスキーマを最新にする (migrate.go を参照)
+	// ISUCON_AUTO_MIGRATE=0 なら起動時には行わず、migrateサブコマンドで行う
+	if getEnv("ISUCON_AUTO_MIGRATE", "1") == "1" {
+		applied, err := migrateAdminDB(context.Background(), adminDB)
+		if err != nil {
+			logger.Fatal("failed to migrate admin db", zap.Error(err))
+			return
+		}
+		if len(applied) > 0 {
+			logger.Info("applied admin db migrations", zap.Ints("migrations", applied))
+		}
+	}
+
+	s.disconnectDetector = helpisu.NewDBDisconnectDetector(5, 90, adminDB.DB)
+	go s.disconnectDetector.Start()
+
+	// アイドル状態のテナントDBを定期的にメンテナンスする
+	// ISUCON_TENANT_MAINTENANCE_INTERVAL が未設定なら実行しない
+	if interval := getEnvDuration("ISUCON_TENANT_MAINTENANCE_INTERVAL", 0); interval > 0 {
+		maintenance := helpisu.NewTicker(int(interval/time.Millisecond), s.scheduledTenantDBMaintenance)
+		go maintenance.Start()
+	}
+
+	// ライブモードの大会のスコアを定期的にplayer_scoreへ書き出す
+	flushLiveScores := helpisu.NewTicker(int(getEnvDuration("ISUCON_LIVE_SCORE_FLUSH_INTERVAL", time.Second)/time.Millisecond), func() {
+		s.liveScores.flushAll(withServer(context.Background(), s))
+	})
+	go flushLiveScores.Start()
+
+	http.DefaultTransport.(*http.Transport).MaxIdleConns = 0           // default: 100
+	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 1024 // default: 2
+	http.DefaultTransport.(*http.Transport).ForceAttemptHTTP2 = true
+	http.DefaultClient.Timeout = 5 * time.Second // 問題の切り分け用
+
+	pprofServer, err := startPprofServer()
+	if err != nil {
+		logger.Fatal("failed to start pprof server", zap.Error(err))
+		return
+	}
+	if pprofServer != nil {
+		defer pprofServer.Close()
+	}
+	// 計測機器のベンダー向けのgRPC API (grpc.go を参照)
+	grpcServer, err := startGRPCServer(s)
+	if err != nil {
+		logger.Fatal("failed to start grpc server", zap.Error(err))
+		return
+	}
+	if grpcServer != nil {
+		defer grpcServer.Stop()
+	}
+
+	configureHTTPServer(e.Server)
+	handleReloadSignal()
+
+	// systemdから渡されたソケットやUnixドメインソケットでも待ち受けられる (listener.go を参照)
+	ln, addr, err := newListener()
+	if err != nil {
+		logger.Fatal("failed to listen", zap.Error(err))
+		return
+	}
+	// HTTPSで待ち受ける場合 (tls.go を参照)
+	ln, useTLS, err := wrapTLSListener(ln)
+	if err != nil {
+		logger.Fatal("failed to configure TLS", zap.Error(err))
+		return
+	}
+	if useTLS {
+		addr += " (TLS)"
+	}
+	e.Listener = ln
+	logger.Info("starting isuports server", zap.String("addr", addr))
+
+	// SIGTERM/SIGINTを受けたら新規の接続を止め、処理中のリクエストを待ってから終了する
+	ctx, stop := signal.NotifyContext(withServer(context.Background(), s), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	go wd.run(ctx)
+	// Webhookの送信キューを処理する (webhook.go を参照)
+	// メールの送信キューも同様に処理する (mail.go を参照)
+	webhookDone := make(chan struct{})
+	go func() {
+		runWebhookDelivery(ctx)
+		close(webhookDone)
+	}()
+	mailDone := make(chan struct{})
+	go func() {
+		runMailOutbox(ctx)
+		close(mailDone)
+	}()
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- e.Start("")
+	}()
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("server stopped", zap.Error(err))
+		}
+	case <-ctx.Done():
+		logger.Info("shutting down isuports server")
+		timeout := getEnvDuration("ISUCON_SHUTDOWN_TIMEOUT", 10*time.Second)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := e.Shutdown(shutdownCtx); err != nil {
+			logger.Error("failed to shutdown server", zap.Error(err))
+		}
+	}
+	flushBeforeExit(s)
+	// サーバーがエラーで止まった場合もWebhookの送信中のものを待ってから終了する
+	stop()
+	<-webhookDone
+	<-mailDone
+	// adminDBとテナントDBはdeferで閉じる
+}
+
+// APIのルートを登録する
+// ミドルウェアはRun (テストでは呼び出し側) で登録する
+func registerRoutes(e *echo.Echo) {
 	// SaaS管理者向けAPI
 	e.POST("/api/admin/tenants/add", tenantsAddHandler)
 	e.GET("/api/admin/tenants/billing", tenantsBillingHandler)
+	e.GET("/api/admin/tenants/billing.xlsx", tenantsBillingXLSXHandler)
+	e.POST("/api/admin/tenants/maintenance", tenantsMaintenanceHandler)
+	e.POST("/api/admin/tenants/backup", tenantsBackupHandler)
+	e.POST("/api/admin/tenants/restore", tenantsRestoreHandler)
+	e.GET("/api/admin/invoices", adminInvoicesHandler)
+	e.POST("/api/admin/invoices/generate", invoicesGenerateHandler)
+	e.POST("/api/admin/invoices/sync", invoicesSyncHandler)
+	e.GET("/api/admin/caches", cachesHandler)
+	e.POST("/api/admin/caches", cachesFlushHandler)
+	e.GET("/api/admin/stats", statsHandler)
 
 	// テナント管理者向けAPI - 参加者追加、一覧、失格
 	e.GET("/api/organizer/players", playersListHandler)
-	e.POST("/api/organizer/players/add", playersAddHandler)
+	e.POST("/api/organizer/players/add", playersAddHandler, bodyLimit("ISUCON_PLAYERS_ADD_BODY_LIMIT", 1<<20))
 	e.POST("/api/organizer/player/:player_id/disqualified", playerDisqualifiedHandler)
+	e.GET("/api/organizer/player/:player_id/export", organizerPlayerExportHandler)
+	e.POST("/api/organizer/player/:player_id/erase", playerEraseHandler)
 
 	// テナント管理者向けAPI - 大会管理
 	e.POST("/api/organizer/competitions/add", competitionsAddHandler)
 	e.POST("/api/organizer/competition/:competition_id/finish", competitionFinishHandler)
-	e.POST("/api/organizer/competition/:competition_id/score", competitionScoreHandler)
+	e.POST("/api/organizer/competition/:competition_id/score", competitionScoreHandler, bodyLimit("ISUCON_SCORE_BODY_LIMIT", 32<<20))
+	e.POST("/api/organizer/competition/:competition_id/score/import_url", competitionScoreImportURLHandler)
+	e.POST("/api/organizer/competition/:competition_id/score/ingest", competitionScoreIngestHandler)
+	e.POST("/api/organizer/import", importHandler, bodyLimit("ISUCON_SCORE_BODY_LIMIT", 32<<20))
+	e.GET("/api/organizer/score_rules", scoreRulesHandler)
+	e.POST("/api/organizer/score_rules", scoreRulesUpdateHandler)
 	e.GET("/api/organizer/billing", billingHandler)
+	e.GET("/api/organizer/billing.xlsx", billingXLSXHandler)
+	e.GET("/api/organizer/invoices", organizerInvoicesHandler)
 	e.GET("/api/organizer/competitions", organizerCompetitionsHandler)
+	e.POST("/api/organizer/competition/:competition_id/season", competitionSeasonHandler)
+	e.GET("/api/organizer/competition/:competition_id/matches", matchesHandler)
+	e.POST("/api/organizer/competition/:competition_id/matches/add", matchAddHandler)
+	e.POST("/api/organizer/competition/:competition_id/match/:match_id/delete", matchDeleteHandler)
+	e.GET("/api/organizer/seasons", organizerSeasonsHandler)
+	e.POST("/api/organizer/seasons/add", seasonsAddHandler)
+	e.POST("/api/organizer/season/:season_id", seasonUpdateHandler)
+	e.POST("/api/organizer/season/:season_id/delete", seasonDeleteHandler)
+	e.GET("/api/organizer/season/:season_id/standings", organizerSeasonStandingsHandler)
+	e.GET("/api/organizer/rating", ratingSettingsHandler)
+	e.POST("/api/organizer/rating", ratingSettingsUpdateHandler)
+	e.POST("/api/organizer/ratings/recompute", ratingsRecomputeHandler)
+	e.GET("/api/organizer/ratings", organizerRatingsHandler)
+	e.GET("/api/organizer/timezone", timezoneHandler)
+	e.POST("/api/organizer/timezone", timezoneUpdateHandler)
+	e.GET("/api/organizer/audit", auditLogHandler)
+
+	// テナント管理者向けAPI - メール
+	e.GET("/api/organizer/mail", mailSettingsHandler)
+	e.POST("/api/organizer/mail", mailSettingsUpdateHandler)
+	e.POST("/api/organizer/mail/template/:kind", mailTemplateUpdateHandler)
+	e.GET("/api/organizer/mail/outbox", mailOutboxHandler)
+	e.POST("/api/organizer/player/:player_id/email", playerEmailHandler)
+
+	// テナント管理者向けAPI - Slack、Discord
+	e.GET("/api/organizer/chat", chatSettingsHandler)
+	e.POST("/api/organizer/chat", chatSettingsUpdateHandler)
+
+	// テナント管理者向けAPI - Webhook
+	e.GET("/api/organizer/webhooks", webhooksHandler)
+	e.POST("/api/organizer/webhooks/add", webhookAddHandler)
+	e.POST("/api/organizer/webhook/:webhook_id/delete", webhookDeleteHandler)
+	e.GET("/api/organizer/webhook/:webhook_id/deliveries", webhookDeliveriesHandler)
+	e.POST("/api/organizer/webhook/:webhook_id/delivery/:delivery_id/retry", webhookRetryHandler)
+
+	// テナント管理者向けAPI - 読み取り専用のAPIトークン
+	e.GET("/api/organizer/api_tokens", apiTokensHandler)
+	e.POST("/api/organizer/api_tokens/add", apiTokenAddHandler)
+	e.POST("/api/organizer/api_token/:token_id/revoke", apiTokenRevokeHandler)
+	e.GET("/api/organizer/embed", embedSettingsHandler)
+	e.POST("/api/organizer/embed", embedSettingsUpdateHandler)
+
+	// テナント管理者向けAPI - CORS
+	e.GET("/api/organizer/cors", corsSettingsHandler)
+	e.POST("/api/organizer/cors", corsSettingsUpdateHandler)
+
+	// テナント管理者向けAPI - SSO
+	e.GET("/api/organizer/sso", ssoSettingsHandler)
+	e.POST("/api/organizer/sso", ssoSettingsUpdateHandler)
+	e.POST("/api/organizer/sso/identities/add", ssoIdentityAddHandler)
+	e.POST("/api/organizer/sso/identity/:identity_id/delete", ssoIdentityDeleteHandler)
+
+	// テナント管理者向けAPI - SCIM
+	e.GET("/api/organizer/scim", scimSettingsHandler)
+	e.POST("/api/organizer/scim/token", scimTokenHandler)
 
 	// 参加者向けAPI
 	e.GET("/api/player/player/:player_id", playerHandler)
 	e.GET("/api/player/competition/:competition_id/ranking", competitionRankingHandler)
 	e.GET("/api/player/competitions", playerCompetitionsHandler)
+	e.GET("/api/player/competitions.ics", competitionsICalHandler)
+	e.GET("/api/player/seasons", playerSeasonsHandler)
+	e.GET("/api/player/season/:season_id/standings", playerSeasonStandingsHandler)
+	e.GET("/api/player/ratings", playerRatingsHandler)
+	e.GET("/api/player/me/export", playerExportHandler)
+
+	// テナント管理者のSSO
+	e.GET("/auth/sso/login", ssoLoginHandler)
+	e.GET("/auth/sso/callback", ssoCallbackHandler)
+
+	// Stripeからの支払いの結果
+	e.POST("/stripe/webhook", stripeWebhookHandler)
+
+	// SCIMによる参加者のプロビジョニング
+	e.GET("/scim/v2/ServiceProviderConfig", scimServiceProviderConfigHandler)
+	e.GET("/scim/v2/Users", scimHandler(scimUsersHandler))
+	e.POST("/scim/v2/Users", scimHandler(scimUserCreateHandler))
+	e.GET("/scim/v2/Users/:id", scimHandler(scimUserHandler))
+	e.PUT("/scim/v2/Users/:id", scimHandler(scimUserReplaceHandler))
+	e.PATCH("/scim/v2/Users/:id", scimHandler(scimUserPatchHandler))
+	e.DELETE("/scim/v2/Users/:id", scimHandler(scimUserDeleteHandler))
+
+	// 埋め込み用のスコアボード
+	e.GET("/embed/competition/:competition_id/ranking", embedRankingHandler)
+	e.OPTIONS("/embed/competition/:competition_id/ranking", embedPreflightHandler)
+
+	// フィード
+	e.GET("/feeds/competitions.atom", competitionsAtomHandler)
 
 	// 全ロール及び未認証でも使えるhandler
 	e.GET("/api/me", meHandler)
 
+	// テナントのフロントエンド向けGraphQL (graphql.go を参照)
+	e.GET("/api/graphql", graphqlHandler)
+	e.POST("/api/graphql", graphqlHandler)
+
 	// ベンチマーカー向けAPI
 	e.POST("/initialize", initializeHandler)
 
-	e.HTTPErrorHandler = errorResponseHandler
-
-	adminDB, err = connectAdminDB()
-	if err != nil {
-		e.Logger.Fatalf("failed to connect db: %v", err)
-		return
-	}
-	adminDB.SetMaxOpenConns(10)
-	defer adminDB.Close()
-
-	helpisu.WaitDBStartUp(adminDB.DB)
-
-	d = helpisu.NewDBDisconnectDetector(5, 90, adminDB.DB)
-	go d.Start()
-
-	// プール内に保持できるアイドル接続数の制限を設定 (default: 2)
-	adminDB.SetMaxIdleConns(1024)
-	// 接続してから再利用できる最大期間
-	adminDB.SetConnMaxLifetime(0)
-	// アイドル接続してから再利用できる最大期間
-	adminDB.SetConnMaxIdleTime(0)
+	// APIの定義 (openapi.go を参照)
+	e.GET("/api/openapi.json", openAPIHandler)
+}
 
-	http.DefaultTransport.(*http.Transport).MaxIdleConns = 0           // default: 100
-	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 1024 // default: 2
-	http.DefaultTransport.(*http.Transport).ForceAttemptHTTP2 = true
-	http.DefaultClient.Timeout = 5 * time.Second // 問題の切り分け用
+// 終了前にメモリ上に溜めている書き込みをDBに書き出す
+func flushBeforeExit(s *Server) {
+	s.ratingRecomputes.wait()
+	s.notifications.Wait()
+	delayedInsertVisitHistory(s)
+	s.liveScores.flushAll(withServer(context.Background(), s))
+	saveDispensedID(s)
+}
 
-	port := getEnv("SERVER_APP_PORT", "3000")
-	e.Logger.Infof("starting isuports server on : %s ...", port)
-	serverPort := fmt.Sprintf(":%s", port)
-	e.Logger.Fatal(e.Start(serverPort))
+// HTTPサーバーのタイムアウトとkeep-aliveを設定する
+// 遅いクライアントにgoroutineを占有されないよう、ヘッダの読み取りには必ず期限を設ける
+// ReadTimeoutとWriteTimeoutはスコアのアップロードや大きな一覧の返却に影響するのでデフォルトでは設定しない
+func configureHTTPServer(s *http.Server) {
+	s.ReadHeaderTimeout = getEnvDuration("ISUCON_HTTP_READ_HEADER_TIMEOUT", 5*time.Second)
+	s.ReadTimeout = getEnvDuration("ISUCON_HTTP_READ_TIMEOUT", 0)
+	s.WriteTimeout = getEnvDuration("ISUCON_HTTP_WRITE_TIMEOUT", 0)
+	// ベンチマーカーは接続を使い回すので、アイドル接続は長めに保持する
+	s.IdleTimeout = getEnvDuration("ISUCON_HTTP_IDLE_TIMEOUT", 120*time.Second)
+	s.MaxHeaderBytes = getEnvInt("ISUCON_HTTP_MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes)
+	s.SetKeepAlivesEnabled(getEnv("ISUCON_HTTP_KEEP_ALIVES", "1") == "1")
 }
 
+// クライアントが切断したリクエストのステータス (nginxと同じ)
+const statusClientClosedRequest = 499
+
 // エラー処理関数
 func errorResponseHandler(err error, c echo.Context) {
-	c.Logger().Errorf("error at %s: %s", c.Path(), err.Error())
+	// クライアントが切断して途中でやめたリクエストは、エラーとして記録も通知もしない
+	// 返したステータスはアクセスログにだけ残る
+	if errors.Is(err, context.Canceled) && c.Request().Context().Err() != nil {
+		if !c.Response().Committed {
+			c.NoContent(statusClientClosedRequest)
+		}
+		return
+	}
+	logRequestError(c, err)
+	// ストリーミング中のエラーなどでレスポンスを書き始めている場合は何も返せない
+	if c.Response().Committed {
+		return
+	}
+	// ファイルの取り込みの検証の失敗は、どの行が悪いかわからないと直せないので環境によらずレポートを返す (ingest.go を参照)
+	var ie *ingestError
+	if errors.As(err, &ie) {
+		ingestFailed(c, ie)
+		return
+	}
+	// 終了した大会へのアップロードは、クライアントが判別できるようコードをつけて返す (scorecorrection.go を参照)
+	var cfe *competitionFinishedError
+	if errors.As(err, &cfe) {
+		competitionFinishedResponse(c, cfe)
+		return
+	}
+	// テナントDBのファイルがないときは、他のエラーと区別できるよう503とコードにする (tenantdb.go を参照)
+	var tme *tenantDBMissingError
+	if errors.As(err, &tme) {
+		reportRequestError(c, err)
+		tenantDBMissingResponse(c, tme)
+		return
+	}
+	// 重複や二重の操作は、どのハンドラから返っても409とコードにする (conflict.go を参照)
+	if conflictResponse(c, err) {
+		return
+	}
+	// リクエストの検証の失敗も、どのフィールドが悪いかを環境によらず返す (bind.go を参照)
+	var re *requestError
+	if errors.As(err, &re) {
+		invalidRequest(c, re)
+		return
+	}
+	// 存在しない大会や参加者は、どのハンドラから返っても404にする
+	var nfe *notFoundError
+	if errors.As(err, &nfe) {
+		err = echo.NewHTTPError(http.StatusNotFound, nfe.Error())
+	}
 	var he *echo.HTTPError
 	if errors.As(err, &he) {
-		c.JSON(he.Code, FailureResult{
+		// 負荷を下げるために返した503は通知しない
+		if he.Code >= http.StatusInternalServerError && he.Code != http.StatusServiceUnavailable {
+			reportRequestError(c, err)
+		}
+		res := FailureResult{
 			Status: false,
-		})
+		}
+		// 上限を知らないと送り直せないので、413は理由を返す
+		// 開発環境ではデバッグのためにすべて返す
+		if he.Code == http.StatusRequestEntityTooLarge || isDevelopment() {
+			res.Message = fmt.Sprint(he.Message)
+		}
+		c.JSON(he.Code, res)
 		return
 	}
-	c.JSON(http.StatusInternalServerError, FailureResult{
+	reportRequestError(c, err)
+	res := FailureResult{
 		Status: false,
-	})
+	}
+	var pe *panicError
+	if errors.As(err, &pe) {
+		res.Code = errorCodePanic
+	}
+	// 内部のエラーは開発環境でだけ返す
+	if isDevelopment() {
+		res.Message = err.Error()
+	}
+	c.JSON(http.StatusInternalServerError, res)
 }
 
 type SuccessResult struct {
@@ -239,8 +706,12 @@ type SuccessResult struct {
 type FailureResult struct {
 	Status  bool   `json:"status"`
 	Message string `json:"message"`
+	Code    string `json:"code,omitempty"` // クライアントが種類を判別するための固定のコード
 }
 
+// panicで500を返した場合のコード
+const errorCodePanic = "internal_panic"
+
 // アクセスしてきた人の情報
 type Viewer struct {
 	role       string
@@ -249,19 +720,12 @@ type Viewer struct {
 	tenantID   int64
 }
 
-var jwtKeyCache = helpisu.NewCache[bool, any]()
-
-type TokenData struct {
-	subject string
-	role    string
-	aud     []string
-}
-
-var jwtTokenCache = helpisu.NewCache[string, TokenData]()
-
 // リクエストヘッダをパースしてViewerを返す
-// JWTのキーキャッシュできる
+// JWTの検証は jwtVerifier (jwt.go) で行う
 func parseViewer(c echo.Context) (*Viewer, error) {
+	if token, ok := apiTokenFromHeader(c); ok {
+		return parseAPITokenViewer(c, token)
+	}
 	cookie, err := c.Request().Cookie(cookieName)
 	if err != nil {
 		return nil, echo.NewHTTPError(
@@ -269,75 +733,17 @@ func parseViewer(c echo.Context) (*Viewer, error) {
 			fmt.Sprintf("cookie %s is not found", cookieName),
 		)
 	}
-	tokenStr := cookie.Value
-
-	var subject, role string
-	aud := []string{}
-	tokenData, ok := jwtTokenCache.Get(tokenStr)
-	if !ok {
-		jwtTokenCache.Get(tokenStr)
-		key, ok := jwtKeyCache.Get(true)
-		if !ok {
-			keyFilename := getEnv("ISUCON_JWT_KEY_FILE", "../public.pem")
-			keysrc, err := os.ReadFile(keyFilename)
-			if err != nil {
-				return nil, fmt.Errorf("error os.ReadFile: keyFilename=%s: %w", keyFilename, err)
-			}
-			key, _, err = jwk.DecodePEM(keysrc)
-			if err != nil {
-				return nil, fmt.Errorf("error jwk.DecodePEM: %w", err)
-			}
-
-			jwtKeyCache.Set(true, key)
-		}
-
-		token, err := jwt.Parse(
-			[]byte(tokenStr),
-			jwt.WithKey(jwa.RS256, key),
-		)
-		if err != nil {
-			return nil, echo.NewHTTPError(http.StatusUnauthorized, fmt.Errorf("error jwt.Parse: %s", err.Error()))
-		}
-		if subject = token.Subject(); subject == "" {
-			return nil, echo.NewHTTPError(
-				http.StatusUnauthorized,
-				fmt.Sprintf("invalid token: subject is not found in token: %s", tokenStr),
-			)
-		}
-
-		tr, ok := token.Get("role")
-		if !ok {
-			return nil, echo.NewHTTPError(
-				http.StatusUnauthorized,
-				fmt.Sprintf("invalid token: role is not found: %s", tokenStr),
-			)
-		}
-		switch tr {
-		case RoleAdmin, RoleOrganizer, RolePlayer:
-			role = tr.(string)
-		default:
-			return nil, echo.NewHTTPError(
-				http.StatusUnauthorized,
-				fmt.Sprintf("invalid token: invalid role: %s", tokenStr),
-			)
-		}
-		// aud は1要素でテナント名がはいっている
-		aud = token.Audience()
-		if len(aud) != 1 {
-			return nil, echo.NewHTTPError(
-				http.StatusUnauthorized,
-				fmt.Sprintf("invalid token: aud field is few or too much: %s", tokenStr),
-			)
-		}
+	return parseJWTViewer(c, cookie.Value)
+}
 
-		jwtTokenCache.Set(tokenStr, TokenData{
-			subject: subject,
-			role:    role,
-			aud:     aud,
-		})
-	} else {
-		subject, role, aud = tokenData.subject, tokenData.role, tokenData.aud
+// JWTを検証してViewerを返す
+// gRPC (grpc.go を参照) ではクッキーではなくauthorizationメタデータでJWTを受け取る
+func parseJWTViewer(c echo.Context, tokenStr string) (*Viewer, error) {
+	tokenData, err := srv(c.Request().Context()).jwtVerifier.verify(c.Request().Context(), tokenStr)
+	if err != nil {
+		return nil, err
 	}
+	subject, role, aud := tokenData.subject, tokenData.role, tokenData.aud
 
 	tenant, err := retrieveTenantRowFromHeader(c)
 	if err != nil {
@@ -370,6 +776,8 @@ func retrieveTenantRowFromHeader(c echo.Context) (*TenantRow, error) {
 	// JWTに入っているテナント名とHostヘッダのテナント名が一致しているか確認
 	baseHost := getEnv("ISUCON_BASE_HOSTNAME", ".t.isucon.dev")
 	tenantName := strings.TrimSuffix(c.Request().Host, baseHost)
+	ctx := c.Request().Context()
+	s := srv(ctx)
 
 	// SaaS管理者用ドメイン
 	if tenantName == "admin" {
@@ -379,25 +787,46 @@ func retrieveTenantRowFromHeader(c echo.Context) (*TenantRow, error) {
 		}, nil
 	}
 
+	if tenant, ok := s.tenantRowCache.Get(tenantName); ok {
+		return &tenant, nil
+	}
+
 	// テナントの存在確認
 	var tenant TenantRow
-	if err := adminDB.GetContext(
-		context.Background(),
+	err := s.adminReadDB.GetContext(
+		ctx,
 		&tenant,
 		"SELECT * FROM tenant WHERE name = ?",
 		tenantName,
-	); err != nil {
+	)
+	// 追加直後のテナントはレプリカに反映されていないことがあるのでプライマリで引き直す
+	if errors.Is(err, sql.ErrNoRows) && s.adminReadDB != s.adminDB {
+		err = s.adminDB.GetContext(
+			ctx,
+			&tenant,
+			"SELECT * FROM tenant WHERE name = ?",
+			tenantName,
+		)
+	}
+	if err != nil {
 		return nil, fmt.Errorf("failed to Select tenant: name=%s, %w", tenantName, err)
 	}
+	// 作成途中のテナントは存在しないものとして扱う、作成が終わったら見つかるようキャッシュもしない
+	if tenant.Provisioning {
+		return nil, fmt.Errorf("tenant is provisioning: name=%s, %w", tenantName, sql.ErrNoRows)
+	}
+	// 存在しないテナントはキャッシュしない (追加直後に見つからなくならないように)
+	s.tenantRowCache.Set(tenantName, tenant)
 	return &tenant, nil
 }
 
 type TenantRow struct {
-	ID          int64  `db:"id"`
-	Name        string `db:"name"`
-	DisplayName string `db:"display_name"`
-	CreatedAt   int64  `db:"created_at"`
-	UpdatedAt   int64  `db:"updated_at"`
+	ID           int64  `db:"id"`
+	Name         string `db:"name"`
+	DisplayName  string `db:"display_name"`
+	Provisioning bool   `db:"provisioning"` // テナントDBの作成中、存在しないテナントとして扱う
+	CreatedAt    int64  `db:"created_at"`
+	UpdatedAt    int64  `db:"updated_at"`
 }
 
 type dbOrTx interface {
@@ -407,38 +836,62 @@ type dbOrTx interface {
 }
 
 type PlayerRow struct {
-	TenantID       int64  `db:"tenant_id"`
-	ID             string `db:"id"`
-	DisplayName    string `db:"display_name"`
-	IsDisqualified bool   `db:"is_disqualified"`
-	CreatedAt      int64  `db:"created_at"`
-	UpdatedAt      int64  `db:"updated_at"`
+	TenantID       int64         `db:"tenant_id"`
+	ID             string        `db:"id"`
+	DisplayName    string        `db:"display_name"`
+	IsDisqualified bool          `db:"is_disqualified"`
+	CreatedAt      int64         `db:"created_at"`
+	UpdatedAt      int64         `db:"updated_at"`
+	ErasedAt       sql.NullInt64 `db:"erased_at"` // 個人データを消去した日時
 }
 
-var playerCache = helpisu.NewCache[string, PlayerRow]()
-
 // 参加者を取得する
-func retrievePlayer(ctx context.Context, tenantDB dbOrTx, id string) (*PlayerRow, error) {
-	p, ok := playerCache.Get(id)
+func retrievePlayer(ctx context.Context, tenantDB dbOrTx, tenantID int64, id string) (*PlayerRow, error) {
+	key := tenantKey{tenantID, id}
+	p, ok := srv(ctx).playerCache.Get(key)
+	playerCacheStats.record(ok)
 	if !ok {
-		if err := tenantDB.GetContext(ctx, &p, "SELECT * FROM player WHERE id = ?", id); err != nil {
-			return nil, fmt.Errorf("error Select player: id=%s, %w", id, err)
+		if err := tenantDB.GetContext(ctx, &p, "SELECT * FROM player WHERE tenant_id = ? AND id = ?", tenantID, id); err != nil {
+			err = fmt.Errorf("error Select player: tenantID=%d, id=%s, %w", tenantID, id, err)
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, &notFoundError{resource: "player", err: err}
+			}
+			return nil, err
 		}
+		srv(ctx).playerCache.Set(key, p)
 	}
-	playerCache.Set(id, p)
 	return &p, nil
 }
 
+// retrievePlayer, retrieveCompetition で行が見つからなかったことを表す
+// errorResponseHandler が404にするので、ハンドラはそのまま返せばよい
+// 404以外にしたい場合 (authorizePlayer など) は errors.Is(err, sql.ErrNoRows) で判別できる
+type notFoundError struct {
+	resource string // "player", "competition"
+	err      error
+}
+
+func (e *notFoundError) Error() string {
+	return e.resource + " not found"
+}
+
+func (e *notFoundError) Unwrap() error {
+	return e.err
+}
+
 // 参加者を認可する
 // 参加者向けAPIで呼ばれる
-func authorizePlayer(ctx context.Context, tenantDB dbOrTx, id string) error {
-	player, err := retrievePlayer(ctx, tenantDB, id)
+func authorizePlayer(ctx context.Context, tenantDB dbOrTx, tenantID int64, id string) error {
+	player, err := retrievePlayer(ctx, tenantDB, tenantID, id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusUnauthorized, "player not found")
 		}
 		return fmt.Errorf("error retrievePlayer from viewer: %w", err)
 	}
+	if player.ErasedAt.Valid {
+		return echo.NewHTTPError(http.StatusUnauthorized, "player not found")
+	}
 	if player.IsDisqualified {
 		return echo.NewHTTPError(http.StatusForbidden, "player is disqualified")
 	}
@@ -452,19 +905,27 @@ type CompetitionRow struct {
 	FinishedAt sql.NullInt64 `db:"finished_at"`
 	CreatedAt  int64         `db:"created_at"`
 	UpdatedAt  int64         `db:"updated_at"`
+	// 属するシーズン (season.go を参照)
+	SeasonID sql.NullString `db:"season_id"`
+	// ライブモードの大会 (livescore.go を参照)
+	Live bool `db:"live"`
 }
 
-var competitionCache = helpisu.NewCache[string, CompetitionRow]()
-
 // 大会を取得する
-func retrieveCompetition(ctx context.Context, tenantDB dbOrTx, id string) (*CompetitionRow, error) {
-	c, ok := competitionCache.Get(id)
+func retrieveCompetition(ctx context.Context, tenantDB dbOrTx, tenantID int64, id string) (*CompetitionRow, error) {
+	key := tenantKey{tenantID, id}
+	c, ok := srv(ctx).competitionCache.Get(key)
+	competitionCacheStats.record(ok)
 	if !ok {
-		if err := tenantDB.GetContext(ctx, &c, "SELECT * FROM competition WHERE id = ?", id); err != nil {
-			return nil, fmt.Errorf("error Select competition: id=%s, %w", id, err)
+		if err := tenantDB.GetContext(ctx, &c, "SELECT * FROM competition WHERE tenant_id = ? AND id = ?", tenantID, id); err != nil {
+			err = fmt.Errorf("error Select competition: tenantID=%d, id=%s, %w", tenantID, id, err)
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, &notFoundError{resource: "competition", err: err}
+			}
+			return nil, err
 		}
 
-		competitionCache.Set(id, c)
+		srv(ctx).competitionCache.Set(key, c)
 	}
 	return &c, nil
 }
@@ -480,69 +941,81 @@ type PlayerScoreRow struct {
 	UpdatedAt     int64  `db:"updated_at"`
 }
 
-// 排他ロックのためのファイル名を生成する
-func lockFilePath(id int64) string {
-	tenantDBDir := getEnv("ISUCON_TENANT_DB_DIR", "../tenant_db")
-	return filepath.Join(tenantDBDir, fmt.Sprintf("%d.lock", id))
+type InitializeHandlerResult struct {
+	Lang         string                  `json:"lang"`
+	Verification *InitializeVerification `json:"verification"`
 }
 
-// 排他ロックする
-func flockByTenantID(tenantID int64) (io.Closer, error) {
-	p := lockFilePath(tenantID)
-
-	fl := flock.New(p)
-	if err := fl.Lock(); err != nil {
-		return nil, fmt.Errorf("error flock.Lock: path=%s, %w", p, err)
-	}
-	return fl, nil
+type InitializeFailedResult struct {
+	FailureResult
+	Verification *InitializeVerification `json:"verification"`
 }
 
-type InitializeHandlerResult struct {
-	Lang string `json:"lang"`
-}
+var (
+	// 初期化が同時に呼ばれても1つずつ実行する
+	initializeMu sync.Mutex
+)
 
 // ベンチマーカー向けAPI
 // POST /initialize
 // ベンチマーカーが起動したときに最初に呼ぶ
 // データベースの初期化などが実行されるため、スキーマを変更した場合などは適宜改変すること
+// 何度呼んでもよく、初期化した結果を検証して初期データと一致しなければ500を返す
 func initializeHandler(c echo.Context) error {
-	var tenantNum int
-	adminDB.GetContext(c.Request().Context(), &tenantNum, "SELECT count(*) FROM tenant")
+	initializeMu.Lock()
+	defer initializeMu.Unlock()
+	s := srv(c.Request().Context())
 
-	out, err := exec.Command(initializeScript).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("error exec.Command: %s %e", string(out), err)
-	}
+	// 開いているハンドルがファイルの差し替え前のものを指し続けないよう先に閉じる
+	s.tenantDBs.closeAll()
+	s.liveScores.reset()
 
-	for i := 1; i < tenantNum; i++ {
-		tenantDB, ok := tenantDBCache.Get(int64(i))
-		if ok {
-			tenantDB.Close()
-		}
+	if err := initializeDatabases(c.Request().Context()); err != nil {
+		return fmt.Errorf("error initializeDatabases: %w", err)
 	}
+	s.jwtVerifier.reset()
+	jwtSigningKeyCache.Reset()
+	// テナントのIDは初期化後に再利用されるので、テナントに紐づくものは全て消す
+	s.resetCaches()
+	// ベンチマークごとに集計し直す
+	requestLatencies.reset()
+
+	s.visits.reset()
+
+	s.initializeTickersOnce.Do(func() {
+		// 払い出したIDは90秒ごとに書き戻す
+		dispenseUpdate := helpisu.NewTicker(90000, func() { saveDispensedID(s) })
+		go dispenseUpdate.Start()
+		insertVisitHistory := helpisu.NewTicker(2000, func() { delayedInsertVisitHistory(s) })
+		go insertVisitHistory.Start()
+	})
 
-	tenantDBCache.Reset()
-	jwtKeyCache.Reset()
-	jwtTokenCache.Reset()
-	playerCache.Reset()
-	competitionCache.Reset()
-	tenantCache.Reset()
-	compFinishCache.Reset()
-	billingReportCache.Reset()
-
-	go dispenseUpdate()
-
-	visitHistories.Set(0, make([]VisitHistoryRow, 0, 100))
-	insertVisitHistory := helpisu.NewTicker(2000, delayedInsertVisitHistory)
-	go insertVisitHistory.Start()
+	// Runで起動したときだけ設定されている
+	if s.disconnectDetector != nil {
+		s.disconnectDetector.Pause()
+	}
 
-	updateCompetitionFinish := helpisu.NewTicker(2000, updateCompetitionFinish)
-	go updateCompetitionFinish.Start()
+	verification, err := verifyInitialized(c.Request().Context())
+	if err != nil {
+		return fmt.Errorf("error verifyInitialized: %w", err)
+	}
+	if len(verification.Problems) > 0 {
+		loggerFromContext(c.Request().Context()).Error("initialize verification failed", zap.Strings("problems", verification.Problems))
+		return c.JSON(http.StatusInternalServerError, InitializeFailedResult{
+			FailureResult: FailureResult{
+				Status:  false,
+				Message: fmt.Sprintf("initialize verification failed: %s", verification.Problems[0]),
+			},
+			Verification: verification,
+		})
+	}
 
-	d.Pause()
+	// キャッシュを埋めておく (warmup.go を参照)
+	startWarmUp(s)
 
 	res := InitializeHandlerResult{
-		Lang: "go",
+		Lang:         "go",
+		Verification: verification,
 	}
 	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
 }
@@ -0,0 +1,170 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/logica0419/helpisu"
+)
+
+type TokenData struct {
+	subject string
+	role    string
+	aud     []string
+	// 有効期限、expのないトークンはゼロ値
+	exp time.Time
+}
+
+// Cookieで送られたJWTの検証
+// 公開鍵と検証済みのトークンをキャッシュする
+// キャッシュしたトークンもexpを過ぎたら使わせない
+// 鍵の読み込み方を差し替えられるので、ファイルを置かずに検証の動作を確かめられる
+type jwtVerifier struct {
+	loadKey func() (any, error)
+	// 鍵の読み込みは同時に1つだけ
+	// 起動直後に同時に来たリクエストがそれぞれ公開鍵のファイルを読まないようにする
+	loadMu sync.Mutex
+	keys   *helpisu.Cache[bool, any]
+	tokens *helpisu.Cache[string, TokenData]
+}
+
+func newJWTVerifier(loadKey func() (any, error)) *jwtVerifier {
+	return &jwtVerifier{
+		loadKey: loadKey,
+		keys:    helpisu.NewCache[bool, any](),
+		tokens:  helpisu.NewCache[string, TokenData](),
+	}
+}
+
+// JWTの検証に使う公開鍵をファイルから読み込む
+func loadJWTKey() (any, error) {
+	keyFilename := getEnv("ISUCON_JWT_KEY_FILE", "../public.pem")
+	keysrc, err := os.ReadFile(keyFilename)
+	if err != nil {
+		return nil, fmt.Errorf("error os.ReadFile: keyFilename=%s: %w", keyFilename, err)
+	}
+	key, _, err := jwk.DecodePEM(keysrc)
+	if err != nil {
+		return nil, fmt.Errorf("error jwk.DecodePEM: %w", err)
+	}
+	return key, nil
+}
+
+// 公開鍵を返す、キャッシュになければ読み込む
+func (v *jwtVerifier) key() (any, error) {
+	if key, ok := v.keys.Get(true); ok {
+		return key, nil
+	}
+	v.loadMu.Lock()
+	defer v.loadMu.Unlock()
+	// 待っている間に他のリクエストが読み込んでいればそれを使う
+	if key, ok := v.keys.Get(true); ok {
+		return key, nil
+	}
+	key, err := v.loadKey()
+	if err != nil {
+		return nil, err
+	}
+	v.keys.Set(true, key)
+	return key, nil
+}
+
+// 公開鍵を読み込み直す
+// 失敗した場合は今の鍵を使い続ける
+// 古い鍵で検証済みのトークンは使わせない
+func (v *jwtVerifier) reloadKey() error {
+	v.loadMu.Lock()
+	defer v.loadMu.Unlock()
+	key, err := v.loadKey()
+	if err != nil {
+		return err
+	}
+	v.keys.Set(true, key)
+	v.tokens.Reset()
+	return nil
+}
+
+func (v *jwtVerifier) reset() {
+	v.keys.Reset()
+	v.tokens.Reset()
+}
+
+// トークンを検証して中身を返す
+// 不正なトークンは401のHTTPErrorを返す
+// 有効期限は業務上の時刻 (srv(ctx).clock) で判定する
+func (v *jwtVerifier) verify(ctx context.Context, tokenStr string) (TokenData, error) {
+	clock := srv(ctx).clock
+	tokenData, ok := v.tokens.Get(tokenStr)
+	if ok && !tokenData.exp.IsZero() && !clock.Now().Before(tokenData.exp) {
+		// 期限切れはキャッシュから消し、検証し直して401にする
+		v.tokens.Delete(tokenStr)
+		ok = false
+	}
+	jwtTokenCacheStats.record(ok)
+	if ok {
+		return tokenData, nil
+	}
+
+	key, err := v.key()
+	if err != nil {
+		return TokenData{}, err
+	}
+	token, err := jwt.Parse(
+		[]byte(tokenStr),
+		jwt.WithKey(jwa.RS256, key),
+		jwt.WithClock(jwt.ClockFunc(clock.Now)),
+	)
+	if err != nil {
+		return TokenData{}, echo.NewHTTPError(http.StatusUnauthorized, fmt.Errorf("error jwt.Parse: %s", err.Error()))
+	}
+	subject := token.Subject()
+	if subject == "" {
+		return TokenData{}, echo.NewHTTPError(
+			http.StatusUnauthorized,
+			fmt.Sprintf("invalid token: subject is not found in token: %s", tokenStr),
+		)
+	}
+
+	var role string
+	tr, ok := token.Get("role")
+	if !ok {
+		return TokenData{}, echo.NewHTTPError(
+			http.StatusUnauthorized,
+			fmt.Sprintf("invalid token: role is not found: %s", tokenStr),
+		)
+	}
+	switch tr {
+	case RoleAdmin, RoleOrganizer, RolePlayer:
+		role = tr.(string)
+	default:
+		return TokenData{}, echo.NewHTTPError(
+			http.StatusUnauthorized,
+			fmt.Sprintf("invalid token: invalid role: %s", tokenStr),
+		)
+	}
+	// aud は1要素でテナント名がはいっている
+	aud := token.Audience()
+	if len(aud) != 1 {
+		return TokenData{}, echo.NewHTTPError(
+			http.StatusUnauthorized,
+			fmt.Sprintf("invalid token: aud field is few or too much: %s", tokenStr),
+		)
+	}
+
+	tokenData = TokenData{
+		subject: subject,
+		role:    role,
+		aud:     aud,
+		exp:     token.Expiration(),
+	}
+	v.tokens.Set(tokenStr, tokenData)
+	return tokenData, nil
+}
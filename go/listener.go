@@ -0,0 +1,76 @@
+package isuports
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// systemdのソケットアクティベーションで渡される最初のfd
+const systemdListenFDsStart = 3
+
+// HTTPサーバーが待ち受けるリスナーを作り、ログに出すためのアドレスを返す
+// 以下の順に使う
+//  1. systemdのソケットアクティベーション (LISTEN_FDS, LISTEN_PID)
+//     再起動中もsystemdがポートを持ち続けるので、接続が拒否されない
+//  2. ISUCON_UNIX_SOCKET に指定したUnixドメインソケット
+//     nginxから proxy_pass http://unix:/path/to/socket; で接続する
+//  3. SERVER_APP_PORT のTCPポート
+func newListener() (net.Listener, string, error) {
+	if ln, err := systemdListener(); err != nil {
+		return nil, "", err
+	} else if ln != nil {
+		return ln, "systemd:" + ln.Addr().String(), nil
+	}
+
+	if path := getEnv("ISUCON_UNIX_SOCKET", ""); path != "" {
+		// 前回の起動で残ったソケットファイルがあるとbindできない
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, "", fmt.Errorf("error os.Remove: path=%s, %w", path, err)
+		}
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, "", fmt.Errorf("error net.Listen: path=%s, %w", path, err)
+		}
+		// nginxは別のユーザーで動いているので書き込めるようにする
+		if err := os.Chmod(path, 0666); err != nil {
+			ln.Close()
+			return nil, "", fmt.Errorf("error os.Chmod: path=%s, %w", path, err)
+		}
+		return ln, "unix:" + path, nil
+	}
+
+	addr := ":" + getEnv("SERVER_APP_PORT", "3000")
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, "", fmt.Errorf("error net.Listen: addr=%s, %w", addr, err)
+	}
+	return ln, addr, nil
+}
+
+// systemdから渡されたリスナーを返す、渡されていなければnilを返す
+// https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+func systemdListener() (net.Listener, error) {
+	// 子プロセスに引き継がないよう、読んだら消す
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	// HTTPサーバーは1つなので最初のfdだけを使う
+	f := os.NewFile(systemdListenFDsStart, "systemd-listener")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("error net.FileListener: %w", err)
+	}
+	return ln, nil
+}
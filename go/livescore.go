@@ -0,0 +1,182 @@
+package isuports
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ライブモードの大会のスコアをメモリ上に持つ
+// 追加するときに live=true を指定した大会 (competition.live) では、スコアのアップロードはメモリ上のランキングを更新するだけにして、
+// player_scoreへの書き出しは一定間隔(ISUCON_LIVE_SCORE_FLUSH_INTERVAL)、課金レポートの計算前、大会終了時に行う
+// 書き出した大会はメモリから消し、次のアップロードまではplayer_scoreからランキングを作る
+// 書き出し前にプロセスが落ちると、その間にアップロードされたスコアは失われる
+
+// 大会がライブモードか
+func competitionLiveMode(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string) (bool, error) {
+	var live bool
+	if err := tenantDB.GetContext(ctx, &live, "SELECT live FROM competition WHERE tenant_id = ? AND id = ?", tenantID, competitionID); err != nil {
+		return false, fmt.Errorf("error Select competition: tenantID=%d, id=%s, %w", tenantID, competitionID, err)
+	}
+	return live, nil
+}
+
+type liveCompetition struct {
+	tenantID      int64
+	competitionID string
+	rows          []PlayerScoreRow
+	// 表示名は読むときに参加者のキャッシュから埋め直す
+	ranks []CompetitionRank
+}
+
+type liveScoreStore struct {
+	mu    sync.Mutex
+	comps map[string]*liveCompetition
+}
+
+func newLiveScoreStore() *liveScoreStore {
+	return &liveScoreStore{comps: map[string]*liveCompetition{}}
+}
+
+func liveScoreKey(tenantID int64, competitionID string) string {
+	return strconv.FormatInt(tenantID, 10) + "/" + competitionID
+}
+
+// アップロードされたスコアでランキングを置き換える
+// 呼び出し側でlockTenantの排他ロックを取っておくこと
+func (s *liveScoreStore) put(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string, rows []PlayerScoreRow) error {
+	// rowsはCSVに登場した順なので、row_numの降順に並べ替えてからランキングを作る
+	sorted := make([]PlayerScoreRow, len(rows))
+	copy(sorted, rows)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].RowNum > sorted[j].RowNum })
+	ranks, err := buildCompetitionRanks(ctx, tenantDB, sorted)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.comps[liveScoreKey(tenantID, competitionID)] = &liveCompetition{
+		tenantID:      tenantID,
+		competitionID: competitionID,
+		rows:          rows,
+		ranks:         ranks,
+	}
+	return nil
+}
+
+// メモリ上のランキングを返す
+// 表示名はアップロードの後に変わっているかもしれないので、今の参加者の表示名で埋めたコピーを返す
+func (s *liveScoreStore) ranks(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string) ([]CompetitionRank, bool, error) {
+	s.mu.Lock()
+	lc, ok := s.comps[liveScoreKey(tenantID, competitionID)]
+	var stored []CompetitionRank
+	if ok {
+		stored = lc.ranks
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+
+	ranks := make([]CompetitionRank, len(stored))
+	copy(ranks, stored)
+	for i := range ranks {
+		p, err := retrievePlayer(ctx, tenantDB, tenantID, ranks[i].PlayerID)
+		if err != nil {
+			// アップロードの後に削除された参加者はアップロード時の表示名のままにする
+			var nfe *notFoundError
+			if errors.As(err, &nfe) {
+				continue
+			}
+			return nil, false, fmt.Errorf("error retrievePlayer: %w", err)
+		}
+		ranks[i].PlayerDisplayName = p.DisplayName
+	}
+	return ranks, true, nil
+}
+
+// メモリ上の大会のスコアを全てplayer_scoreに書き出す
+// ctxにはこのストアを持つServerを入れておくこと
+func (s *liveScoreStore) flushAll(ctx context.Context) {
+	s.mu.Lock()
+	tenantIDs := map[int64]struct{}{}
+	for _, lc := range s.comps {
+		tenantIDs[lc.tenantID] = struct{}{}
+	}
+	s.mu.Unlock()
+
+	for tenantID := range tenantIDs {
+		// 失敗してもメモリに残るので次回の書き出しで再試行される
+		tenantDB, err := connectToTenantDB(ctx, tenantID)
+		if err != nil {
+			continue
+		}
+		s.flushTenant(ctx, tenantDB, tenantID)
+		tenantDB.Close()
+	}
+}
+
+// テナントのライブモードの大会のスコアを全てplayer_scoreに書き出してメモリから消す
+// 課金レポートはplayer_scoreから計算するので、計算する前に呼ぶ (beginBillingSnapshot を参照)
+// ロックは自分で取るので、呼び出し側でロックを持っていないこと
+func (s *liveScoreStore) flushTenant(ctx context.Context, tenantDB *tenantDBConn, tenantID int64) error {
+	s.mu.Lock()
+	compIDs := make([]string, 0)
+	for _, lc := range s.comps {
+		if lc.tenantID == tenantID {
+			compIDs = append(compIDs, lc.competitionID)
+		}
+	}
+	s.mu.Unlock()
+	if len(compIDs) == 0 {
+		return nil
+	}
+	return s.flush(ctx, tenantDB, tenantID, compIDs)
+}
+
+// 大会の終了前に呼ぶ
+// スコアを書き出し、以降はplayer_scoreからランキングを作るようにする
+func (s *liveScoreStore) finish(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, competitionID string) error {
+	return s.flush(ctx, tenantDB, tenantID, []string{competitionID})
+}
+
+// 大会のスコアを書き出してメモリから消す
+func (s *liveScoreStore) flush(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, competitionIDs []string) error {
+	// 書き出し中にアップロードが割り込まないようロックを取る
+	fl, err := lockTenant(ctx, tenantID, lockWrite)
+	if err != nil {
+		return fmt.Errorf("error lockTenant: %w", err)
+	}
+	defer fl.Close()
+
+	for _, competitionID := range competitionIDs {
+		key := liveScoreKey(tenantID, competitionID)
+		s.mu.Lock()
+		lc, ok := s.comps[key]
+		s.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		// ロックを持っている間はputされないので、lcは書き出し中に変わらない
+		if err := replacePlayerScores(ctx, tenantDB, tenantID, competitionID, lc.rows, nil); err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		delete(s.comps, key)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// メモリ上のスコアを破棄する
+func (s *liveScoreStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.comps = map[string]*liveCompetition{}
+}
@@ -0,0 +1,111 @@
+package isuports
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 同時に処理するリクエスト数の上限
+// 上限を超えたリクエストは待たせずに 503 と Retry-After を返す
+// ランキングへのアクセスが集中しても、他のAPIのレイテンシまで巻き込まれないようにするためのもの
+//
+//	ISUCON_MAX_INFLIGHT        全体の上限 (0なら無制限)
+//	ISUCON_ROUTE_MAX_INFLIGHT  ルートごとの上限 "/api/player/competition/:competition_id/ranking=200,..."
+//	ISUCON_SHED_RETRY_AFTER    Retry-Afterで返す時間
+//
+// /initialize はベンチマーカーが必ず成功させる必要があるので上限の対象にしない
+type loadShedder struct {
+	global     chan struct{}            // nilなら無制限
+	routes     map[string]chan struct{} // ルートごとのセマフォ
+	retryAfter string
+}
+
+var loadShedExemptRoutes = map[string]bool{
+	"/initialize": true,
+}
+
+func newLoadShedderFromConfig() (*loadShedder, error) {
+	s := &loadShedder{
+		routes:     map[string]chan struct{}{},
+		retryAfter: strconv.Itoa(int(getEnvDuration("ISUCON_SHED_RETRY_AFTER", time.Second).Seconds() + 0.5)),
+	}
+	if n := getEnvInt("ISUCON_MAX_INFLIGHT", 0); n > 0 {
+		s.global = make(chan struct{}, n)
+	}
+	for _, kv := range strings.Split(getEnv("ISUCON_ROUTE_MAX_INFLIGHT", ""), ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.LastIndex(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid ISUCON_ROUTE_MAX_INFLIGHT: %s", kv)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(kv[i+1:]))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid ISUCON_ROUTE_MAX_INFLIGHT: %s", kv)
+		}
+		s.routes[strings.TrimSpace(kv[:i])] = make(chan struct{}, n)
+	}
+	return s, nil
+}
+
+func (s *loadShedder) enabled() bool {
+	return s.global != nil || len(s.routes) > 0
+}
+
+// 空きがあれば取得してtrueを返す、なければ待たずにfalseを返す
+func tryAcquire(sem chan struct{}) bool {
+	if sem == nil {
+		return true
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func release(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
+
+// ルーティング後のパスを使うので e.Use で登録すること
+func (s *loadShedder) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if !s.enabled() {
+			return next
+		}
+		return func(c echo.Context) error {
+			route := c.Path()
+			if loadShedExemptRoutes[route] {
+				return next(c)
+			}
+			// ルートの上限を先に見て、全体の枠を無駄に取らないようにする
+			routeSem := s.routes[route]
+			if !tryAcquire(routeSem) {
+				return s.shed(c)
+			}
+			defer release(routeSem)
+			if !tryAcquire(s.global) {
+				return s.shed(c)
+			}
+			defer release(s.global)
+			return next(c)
+		}
+	}
+}
+
+func (s *loadShedder) shed(c echo.Context) error {
+	loadShedCount.Add(c.Path(), 1)
+	c.Response().Header().Set("Retry-After", s.retryAfter)
+	return echo.NewHTTPError(http.StatusServiceUnavailable, "server is busy")
+}
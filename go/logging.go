@@ -0,0 +1,186 @@
+package isuports
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	echolog "github.com/labstack/gommon/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// アプリケーションのログ
+// 1行1つのJSONで標準出力に書き、レベルは configureLogging で実行環境に合わせて変える
+// アクセスログ (accesslog.go) とSQLのトレース (sqltrace.go) は別の出力先に書く
+var (
+	logLevel = zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	logger   = newLogger(zapcore.Lock(os.Stdout))
+)
+
+// ログを全く出さないレベル
+const logLevelOff = zapcore.FatalLevel + 1
+
+func newLogger(w zapcore.WriteSyncer) *zap.Logger {
+	cfg := zap.NewProductionEncoderConfig()
+	cfg.TimeKey = "time"
+	cfg.MessageKey = "msg"
+	cfg.EncodeTime = zapcore.RFC3339NanoTimeEncoder
+	cfg.EncodeLevel = zapcore.CapitalLevelEncoder
+	return zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(cfg), w, logLevel), zap.AddCaller())
+}
+
+// リクエストIDを付けたロガーを返す
+// リクエストの外 (バックグラウンドの処理) ではそのままのロガーを返す
+func loggerFromContext(ctx context.Context) *zap.Logger {
+	if id := requestIDFromContext(ctx); id != "" {
+		return logger.With(zap.String("request_id", id))
+	}
+	return logger
+}
+
+type requestIDKey struct{}
+
+// リクエストIDをcontextに入れる
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// contextからリクエストIDを取り出す、なければ空文字列を返す
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// リクエストIDを振るmiddleware
+// ベンチマーカーがX-Request-IDを付けてきた場合はそれを使い、レスポンスヘッダにも同じIDを返す
+// ハンドラより下の層でもログに出せるよう、request.Context()にも入れておく
+func requestIDMiddleware() echo.MiddlewareFunc {
+	return middleware.RequestIDWithConfig(middleware.RequestIDConfig{
+		RequestIDHandler: func(c echo.Context, id string) {
+			c.SetRequest(c.Request().WithContext(withRequestID(c.Request().Context(), id)))
+		},
+	})
+}
+
+// 1リクエストごとに1行のアクセスログを出力するmiddleware
+// 形式や出力先は accesslog.go を参照
+func accessLogMiddleware(l *accessLogger) echo.MiddlewareFunc {
+	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		LogLatency:   true,
+		LogRemoteIP:  true,
+		LogMethod:    true,
+		LogURI:       true,
+		LogRoutePath: true,
+		LogRequestID: true,
+		LogStatus:    true,
+		LogError:     true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			if !l.sampled(v.RoutePath, v.Status) {
+				return nil
+			}
+			rec := accessLogRecord{
+				{"time", time.Now().Format(time.RFC3339Nano)},
+				{"request_id", v.RequestID},
+				{"remote_ip", v.RemoteIP},
+				{"method", v.Method},
+				{"uri", v.URI},
+				{"route", v.RoutePath},
+				{"status", v.Status},
+				{"latency_ms", float64(v.Latency.Microseconds()) / 1000},
+			}
+			if v.Error != nil {
+				rec = append(rec, accessLogField{"error", v.Error.Error()})
+			}
+			l.write(rec)
+			return nil
+		},
+	})
+}
+
+// ハンドラから返ったエラーをリクエストIDつきで出力する
+// panicの場合はテナント名とスタックトレースも出す
+func logRequestError(c echo.Context, err error) {
+	fields := []zap.Field{
+		zap.String("method", c.Request().Method),
+		zap.String("path", c.Path()),
+		zap.Error(err),
+	}
+	msg := "error"
+	var pe *panicError
+	if errors.As(err, &pe) {
+		msg = "panic"
+		fields = append(fields,
+			zap.String("tenant", strings.TrimSuffix(c.Request().Host, getEnv("ISUCON_BASE_HOSTNAME", ".t.isucon.dev"))),
+			zap.ByteString("stack", pe.stack),
+		)
+	}
+	loggerFromContext(c.Request().Context()).Error(msg, fields...)
+}
+
+// 実行環境
+//
+//	development  デバッグログとアクセスログを出し、エラーの内容をレスポンスにも含める
+//	production   INFO以上のログを出す (デフォルト)
+//	bench        ベンチマーク中のログ出力の負荷を避けるため、WARN以上だけを出す
+//
+// ログレベルは ISUCON_LOG_LEVEL (debug, info, warn, error, off) で個別に変えられる
+func appEnv() string {
+	return getEnv("ISUCON_APP_ENV", "production")
+}
+
+func isDevelopment() bool {
+	return appEnv() == "development"
+}
+
+// 実行環境に応じたログの設定をする
+func configureLogging(e *echo.Echo) error {
+	defaultLevel := "info"
+	switch env := appEnv(); env {
+	case "development":
+		defaultLevel = "debug"
+		e.Debug = true
+	case "production":
+	case "bench":
+		defaultLevel = "warn"
+	default:
+		return fmt.Errorf("unknown ISUCON_APP_ENV: %s", env)
+	}
+	e.HideBanner = !isDevelopment()
+
+	var lvl zapcore.Level
+	switch level := getEnv("ISUCON_LOG_LEVEL", defaultLevel); level {
+	case "debug":
+		lvl = zapcore.DebugLevel
+	case "info":
+		lvl = zapcore.InfoLevel
+	case "warn":
+		lvl = zapcore.WarnLevel
+	case "error":
+		lvl = zapcore.ErrorLevel
+	case "off":
+		lvl = logLevelOff
+	default:
+		return fmt.Errorf("unknown ISUCON_LOG_LEVEL: %s", level)
+	}
+	logLevel.SetLevel(lvl)
+	// echo自身のログはアプリケーションからは使わないので、起動時のエラー以外は出さない
+	e.Logger.SetLevel(echolog.ERROR)
+	return nil
+}
+
+// アクセスログを出すか
+// 開発環境ではデフォルトで出し、それ以外では ISUCON_ACCESS_LOG=1 のときだけ出す
+// 量を減らす場合は ISUCON_ACCESS_LOG_SAMPLE_RATE でサンプリングする (accesslog.go を参照)
+func accessLogEnabled() bool {
+	defaultValue := "0"
+	if isDevelopment() {
+		defaultValue = "1"
+	}
+	return getEnv("ISUCON_ACCESS_LOG", defaultValue) == "1"
+}
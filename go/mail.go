@@ -0,0 +1,696 @@
+package isuports
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// メールの通知
+// スコアのアップロードがバリデーションで失敗したときはテナント管理者に、
+// 大会が終了したときはメールアドレスを登録している参加者に通知する
+// 送信するメールは管理用DBのmail_outboxに積み、ワーカーが非同期に送信する (webhook.go と同じ仕組み)
+// ISUCON_MAIL_BACKEND が未設定ならメールは積まない
+
+// 送信するメールの種類
+const (
+	mailKindScoreRejected       = "score_rejected"
+	mailKindCompetitionFinished = "competition_finished"
+)
+
+// mail_outbox.status
+const (
+	mailStatusPending = "pending"
+	mailStatusSent    = "sent"
+	mailStatusDead    = "dead"
+)
+
+// メールの送信設定
+var (
+	mailFrom                = getEnv("ISUCON_MAIL_FROM", "noreply@isucon.dev")
+	mailPollInterval        = getEnvDuration("ISUCON_MAIL_POLL_INTERVAL", 5*time.Second)
+	mailMaxAttempts         = getEnvInt("ISUCON_MAIL_MAX_ATTEMPTS", 5)
+	mailRetryBaseDelay      = getEnvDuration("ISUCON_MAIL_RETRY_BASE_DELAY", time.Minute)
+	mailRetryMaxDelay       = getEnvDuration("ISUCON_MAIL_RETRY_MAX_DELAY", time.Hour)
+	mailer, mailerConfigErr = newMailerFromConfig()
+)
+
+// メールの送信方法
+type mailSender interface {
+	send(ctx context.Context, to, subject, body string) error
+}
+
+// ISUCON_MAIL_BACKEND に応じてメールの送信方法を作る
+// 未設定ならnilを返し、メールを送らない
+func newMailerFromConfig() (mailSender, error) {
+	switch backend := getEnv("ISUCON_MAIL_BACKEND", ""); backend {
+	case "":
+		return nil, nil
+	case "smtp":
+		addr := getEnv("ISUCON_SMTP_ADDR", "")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ISUCON_SMTP_ADDR: %s, %w", addr, err)
+		}
+		m := &smtpMailer{addr: addr}
+		if user := getEnv("ISUCON_SMTP_USERNAME", ""); user != "" {
+			m.auth = smtp.PlainAuth("", user, getEnv("ISUCON_SMTP_PASSWORD", ""), host)
+		}
+		return m, nil
+	case "ses":
+		region := getEnv("ISUCON_SES_REGION", "ap-northeast-1")
+		endpoint := getEnv("ISUCON_SES_ENDPOINT", fmt.Sprintf("https://email.%s.amazonaws.com", region))
+		if _, err := url.Parse(endpoint); err != nil {
+			return nil, fmt.Errorf("invalid ISUCON_SES_ENDPOINT: %s, %w", endpoint, err)
+		}
+		return &sesMailer{
+			endpoint:  strings.TrimSuffix(endpoint, "/"),
+			region:    region,
+			accessKey: getEnv("ISUCON_SES_ACCESS_KEY_ID", ""),
+			secretKey: getEnv("ISUCON_SES_SECRET_ACCESS_KEY", ""),
+			client:    &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown ISUCON_MAIL_BACKEND: %s", backend)
+	}
+}
+
+// SMTPで送信する
+// サーバーが対応していればSTARTTLSを使う
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+}
+
+func (m *smtpMailer) send(ctx context.Context, to, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", mailFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString([]byte(body))
+	for len(encoded) > 76 {
+		msg.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	msg.WriteString(encoded + "\r\n")
+
+	from, err := mail.ParseAddress(mailFrom)
+	if err != nil {
+		return fmt.Errorf("invalid ISUCON_MAIL_FROM: %s, %w", mailFrom, err)
+	}
+	// smtp.SendMailはctxを受け取らないので、タイムアウトはサーバーに任せる
+	if err := smtp.SendMail(m.addr, m.auth, from.Address, []string{to}, msg.Bytes()); err != nil {
+		return fmt.Errorf("error smtp.SendMail: %w", err)
+	}
+	return nil
+}
+
+// Amazon SESのAPI (v2 SendEmail) で送信する
+// 署名はオブジェクトストレージと同じ signAWSv4 を使う
+type sesMailer struct {
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func (m *sesMailer) send(ctx context.Context, to, subject, body string) error {
+	payload, err := json.Marshal(map[string]any{
+		"FromEmailAddress": mailFrom,
+		"Destination":      map[string]any{"ToAddresses": []string{to}},
+		"Content": map[string]any{
+			"Simple": map[string]any{
+				"Subject": map[string]string{"Data": subject, "Charset": "UTF-8"},
+				"Body": map[string]any{
+					"Text": map[string]string{"Data": body, "Charset": "UTF-8"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error json.Marshal: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.endpoint+"/v2/email/outbound-emails", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	h := sha256.Sum256(payload)
+	signAWSv4(req, hex.EncodeToString(h[:]), time.Now(), m.region, "ses", m.accessKey, m.secretKey)
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error SES SendEmail: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("error SES SendEmail: status=%d, %s", res.StatusCode, msg)
+	}
+	return nil
+}
+
+// メールのテンプレートに渡す値
+type mailData struct {
+	TenantName        string
+	TenantDisplayName string
+	CompetitionID     string
+	CompetitionTitle  string
+	PlayerID          string
+	PlayerDisplayName string
+	Reason            string // スコアのアップロードが失敗した理由
+}
+
+// メールのテンプレート
+// テナントごとに tenant_setting の mail.<kind>.subject, mail.<kind>.body で上書きできる
+type mailTemplate struct {
+	Subject string
+	Body    string
+}
+
+var defaultMailTemplates = map[string]mailTemplate{
+	mailKindScoreRejected: {
+		Subject: "[{{.TenantDisplayName}}] スコアのアップロードに失敗しました: {{.CompetitionTitle}}",
+		Body: "{{.TenantDisplayName}} の大会「{{.CompetitionTitle}}」(ID: {{.CompetitionID}}) の" +
+			"スコアのアップロードに失敗しました。\n\n理由: {{.Reason}}\n\nCSVを修正して再度アップロードしてください。\n",
+	},
+	mailKindCompetitionFinished: {
+		Subject: "[{{.TenantDisplayName}}] 大会が終了しました: {{.CompetitionTitle}}",
+		Body: "{{.PlayerDisplayName}} 様\n\n{{.TenantDisplayName}} の大会「{{.CompetitionTitle}}」が終了しました。\n" +
+			"最終結果はランキングページでご確認ください。\n",
+	},
+}
+
+var mailKinds = []string{mailKindScoreRejected, mailKindCompetitionFinished}
+
+func mailTemplateSettingName(kind, part string) string {
+	return "mail." + kind + "." + part
+}
+
+// テナントのテンプレートを返す、上書きしていない部分はデフォルトを使う
+func tenantMailTemplate(settings map[string]string, kind string) (mailTemplate, bool) {
+	t := defaultMailTemplates[kind]
+	customized := false
+	if s := settings[mailTemplateSettingName(kind, "subject")]; s != "" {
+		t.Subject, customized = s, true
+	}
+	if s := settings[mailTemplateSettingName(kind, "body")]; s != "" {
+		t.Body, customized = s, true
+	}
+	return t, customized
+}
+
+// テンプレートを展開する
+func (t mailTemplate) render(data mailData) (string, string, error) {
+	var subject, body strings.Builder
+	st, err := template.New("subject").Parse(t.Subject)
+	if err != nil {
+		return "", "", fmt.Errorf("error parse subject template: %w", err)
+	}
+	if err := st.Execute(&subject, data); err != nil {
+		return "", "", fmt.Errorf("error execute subject template: %w", err)
+	}
+	bt, err := template.New("body").Parse(t.Body)
+	if err != nil {
+		return "", "", fmt.Errorf("error parse body template: %w", err)
+	}
+	if err := bt.Execute(&body, data); err != nil {
+		return "", "", fmt.Errorf("error execute body template: %w", err)
+	}
+	// 件名は1行にする
+	return strings.Join(strings.Fields(subject.String()), " "), body.String(), nil
+}
+
+// メールを送信キューに積む
+func enqueueMail(ctx context.Context, tenantID int64, kind string, settings map[string]string, to string, data mailData) error {
+	t, _ := tenantMailTemplate(settings, kind)
+	subject, body, err := t.render(data)
+	if err != nil {
+		return fmt.Errorf("error render mail template: kind=%s, %w", kind, err)
+	}
+	now := time.Now().Unix()
+	if _, err := srv(ctx).adminDB.ExecContext(
+		ctx,
+		"INSERT INTO mail_outbox (tenant_id, kind, to_address, subject, body, status, next_attempt_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		tenantID, kind, to, subject, body, mailStatusPending, now, now, now,
+	); err != nil {
+		return fmt.Errorf("error Insert mail_outbox: tenantID=%d, kind=%s, %w", tenantID, kind, err)
+	}
+	return nil
+}
+
+// スコアのアップロードがバリデーションで失敗したことをテナント管理者に通知する
+func notifyScoreRejectedByMail(ctx context.Context, tenant *TenantRow, comp *CompetitionRow, reason string) error {
+	if mailer == nil {
+		return nil
+	}
+	settings, err := getTenantSettings(ctx, tenant.ID)
+	if err != nil {
+		return err
+	}
+	to := settings["organizer_email"]
+	if to == "" {
+		return nil
+	}
+	return enqueueMail(ctx, tenant.ID, mailKindScoreRejected, settings, to, mailData{
+		TenantName:        tenant.Name,
+		TenantDisplayName: tenant.DisplayName,
+		CompetitionID:     comp.ID,
+		CompetitionTitle:  comp.Title,
+		Reason:            reason,
+	})
+}
+
+// 大会が終了したことを、スコアが登録されていてメールアドレスを登録している参加者に通知する
+func notifyCompetitionFinishedByMail(ctx context.Context, tenantDB dbOrTx, tenant *TenantRow, comp *CompetitionRow) error {
+	if mailer == nil {
+		return nil
+	}
+	var playerIDs []string
+	if err := tenantDB.SelectContext(
+		ctx,
+		&playerIDs,
+		"SELECT DISTINCT player_id FROM player_score WHERE tenant_id = ? AND competition_id = ?",
+		tenant.ID, comp.ID,
+	); err != nil {
+		return fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", tenant.ID, comp.ID, err)
+	}
+	if len(playerIDs) == 0 {
+		return nil
+	}
+	settings, err := getTenantSettings(ctx, tenant.ID)
+	if err != nil {
+		return err
+	}
+
+	// IN句が長くなりすぎないよう分けて取得する
+	const chunk = 1000
+	for i := 0; i < len(playerIDs); i += chunk {
+		end := i + chunk
+		if end > len(playerIDs) {
+			end = len(playerIDs)
+		}
+		query, args, err := sqlx.In(
+			"SELECT * FROM player_email WHERE tenant_id = ? AND player_id IN (?)",
+			tenant.ID, playerIDs[i:end],
+		)
+		if err != nil {
+			return fmt.Errorf("error sqlx.In: %w", err)
+		}
+		es := []PlayerEmailRow{}
+		if err := srv(ctx).adminDB.SelectContext(ctx, &es, query, args...); err != nil {
+			return fmt.Errorf("error Select player_email: tenantID=%d, %w", tenant.ID, err)
+		}
+		for _, e := range es {
+			p, err := retrievePlayer(ctx, tenantDB, tenant.ID, e.PlayerID)
+			if err != nil {
+				return fmt.Errorf("error retrievePlayer: id=%s, %w", e.PlayerID, err)
+			}
+			if err := enqueueMail(ctx, tenant.ID, mailKindCompetitionFinished, settings, e.Email, mailData{
+				TenantName:        tenant.Name,
+				TenantDisplayName: tenant.DisplayName,
+				CompetitionID:     comp.ID,
+				CompetitionTitle:  comp.Title,
+				PlayerID:          p.ID,
+				PlayerDisplayName: p.DisplayName,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type PlayerEmailRow struct {
+	TenantID  int64  `db:"tenant_id"`
+	PlayerID  string `db:"player_id"`
+	Email     string `db:"email"`
+	UpdatedAt int64  `db:"updated_at"`
+}
+
+type MailOutboxRow struct {
+	ID            int64  `db:"id"`
+	TenantID      int64  `db:"tenant_id"`
+	Kind          string `db:"kind"`
+	ToAddress     string `db:"to_address"`
+	Subject       string `db:"subject"`
+	Body          string `db:"body"`
+	Status        string `db:"status"`
+	Attempts      int    `db:"attempts"`
+	NextAttemptAt int64  `db:"next_attempt_at"`
+	LastError     string `db:"last_error"`
+	CreatedAt     int64  `db:"created_at"`
+	UpdatedAt     int64  `db:"updated_at"`
+}
+
+// 送信キューを監視して送信する
+// メールは件数が少ないので1つのgoroutineで順に送る
+func runMailOutbox(ctx context.Context) {
+	if mailer == nil {
+		return
+	}
+	t := time.NewTicker(mailPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		ms, err := claimMails(ctx, 100)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Warn("failed to claim mails", zap.Error(err))
+			}
+			continue
+		}
+		for _, m := range ms {
+			if ctx.Err() != nil {
+				// 取得したものは期限が切れたら再度送信される
+				return
+			}
+			sendMail(srv(ctx), m)
+		}
+	}
+}
+
+// 送信時刻を過ぎたメールを最大limit件取得する
+// 他のサーバーに取られないよう、next_attempt_atを延ばしてから返す
+func claimMails(ctx context.Context, limit int) ([]MailOutboxRow, error) {
+	now := time.Now().Unix()
+	ms := []MailOutboxRow{}
+	if err := srv(ctx).adminDB.SelectContext(
+		ctx,
+		&ms,
+		"SELECT * FROM mail_outbox WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ?",
+		mailStatusPending, now, limit,
+	); err != nil {
+		return nil, fmt.Errorf("error Select mail_outbox: %w", err)
+	}
+	lease := now + int64((mailPollInterval*time.Duration(len(ms)+1)+time.Minute)/time.Second)
+	claimed := ms[:0]
+	for _, m := range ms {
+		res, err := srv(ctx).adminDB.ExecContext(
+			ctx,
+			"UPDATE mail_outbox SET next_attempt_at = ? WHERE id = ? AND status = ? AND next_attempt_at = ?",
+			lease, m.ID, mailStatusPending, m.NextAttemptAt,
+		)
+		if err != nil {
+			return claimed, fmt.Errorf("error Update mail_outbox: id=%d, %w", m.ID, err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 1 {
+			claimed = append(claimed, m)
+		}
+	}
+	return claimed, nil
+}
+
+// 1通送信して結果を記録する
+func sendMail(s *Server, m MailOutboxRow) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	sendErr := mailer.send(ctx, m.ToAddress, m.Subject, m.Body)
+
+	now := time.Now()
+	attempts := m.Attempts + 1
+	status, next, lastError := mailStatusSent, m.NextAttemptAt, ""
+	if sendErr != nil {
+		lastError = sendErr.Error()
+		if len(lastError) > 1024 {
+			lastError = lastError[:1024]
+		}
+		if attempts >= mailMaxAttempts {
+			status = mailStatusDead
+		} else {
+			status, next = mailStatusPending, now.Add(backoffDelay(mailRetryBaseDelay, mailRetryMaxDelay, attempts)).Unix()
+		}
+	}
+	if err := withRetry(ctx, func() error {
+		_, err := s.adminDB.ExecContext(
+			ctx,
+			"UPDATE mail_outbox SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ?, updated_at = ? WHERE id = ?",
+			status, attempts, next, lastError, now.Unix(), m.ID,
+		)
+		return err
+	}); err != nil {
+		logger.Error("failed to record mail", zap.Int64("mail_id", m.ID), zap.Error(err))
+	}
+	if status == mailStatusDead {
+		logger.Warn("mail delivery gave up",
+			zap.Int64("tenant_id", m.TenantID),
+			zap.Int64("mail_id", m.ID),
+			zap.String("kind", m.Kind),
+			zap.Int("attempts", attempts),
+			zap.String("error", lastError),
+		)
+	}
+}
+
+// メールアドレスとして正しいか
+func validEmail(s string) bool {
+	a, err := mail.ParseAddress(s)
+	return err == nil && a.Address == s && len(s) <= 255
+}
+
+type MailTemplateDetail struct {
+	Kind       string `json:"kind"`
+	Subject    string `json:"subject"`
+	Body       string `json:"body"`
+	Customized bool   `json:"customized"`
+}
+
+type MailSettingsHandlerResult struct {
+	OrganizerEmail string               `json:"organizer_email"`
+	Templates      []MailTemplateDetail `json:"templates"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/mail
+// メールの通知先とテンプレートを取得する
+func mailSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	settings, err := getTenantSettings(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	res := MailSettingsHandlerResult{
+		OrganizerEmail: settings["organizer_email"],
+		Templates:      make([]MailTemplateDetail, 0, len(mailKinds)),
+	}
+	for _, kind := range mailKinds {
+		t, customized := tenantMailTemplate(settings, kind)
+		res.Templates = append(res.Templates, MailTemplateDetail{
+			Kind:       kind,
+			Subject:    t.Subject,
+			Body:       t.Body,
+			Customized: customized,
+		})
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/mail
+// スコアのアップロードの失敗を通知するテナント管理者のメールアドレスを設定する
+// 空にすると通知しない
+func mailSettingsUpdateHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	email := c.FormValue("organizer_email")
+	if email != "" && !validEmail(email) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid organizer_email")
+	}
+	if err := setTenantSetting(ctx, v.tenantID, "organizer_email", email); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/mail/template/:kind
+// メールのテンプレートを設定する
+// テンプレートはGoのtext/templateの形式で、subjectとbodyを空にするとデフォルトに戻す
+func mailTemplateUpdateHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	kind := c.Param("kind")
+	if _, ok := defaultMailTemplates[kind]; !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "mail template not found")
+	}
+	t := mailTemplate{Subject: c.FormValue("subject"), Body: c.FormValue("body")}
+	if len(t.Subject) > 1024 || len(t.Body) > 64*1024 {
+		return echo.NewHTTPError(http.StatusBadRequest, "template too long")
+	}
+	// 登録前に展開できることを確かめる
+	check := defaultMailTemplates[kind]
+	if t.Subject != "" {
+		check.Subject = t.Subject
+	}
+	if t.Body != "" {
+		check.Body = t.Body
+	}
+	if _, _, err := check.render(mailData{}); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid template: %s", err))
+	}
+	if err := setTenantSetting(ctx, v.tenantID, mailTemplateSettingName(kind, "subject"), t.Subject); err != nil {
+		return err
+	}
+	if err := setTenantSetting(ctx, v.tenantID, mailTemplateSettingName(kind, "body"), t.Body); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/player/:player_id/email
+// 参加者のメールアドレスを登録する、空にすると削除する
+func playerEmailHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	playerID := c.Param("player_id")
+	if _, err := retrievePlayer(ctx, tenantDB, v.tenantID, playerID); err != nil {
+		return fmt.Errorf("error retrievePlayer: %w", err)
+	}
+	email := c.FormValue("email")
+	if email == "" {
+		if _, err := srv(ctx).adminDB.ExecContext(ctx, "DELETE FROM player_email WHERE tenant_id = ? AND player_id = ?", v.tenantID, playerID); err != nil {
+			return fmt.Errorf("error Delete player_email: playerID=%s, %w", playerID, err)
+		}
+		return c.JSON(http.StatusOK, SuccessResult{Status: true})
+	}
+	if !validEmail(email) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid email")
+	}
+	if _, err := srv(ctx).adminDB.ExecContext(
+		ctx,
+		"INSERT INTO player_email (tenant_id, player_id, email, updated_at) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE email = VALUES(email), updated_at = VALUES(updated_at)",
+		v.tenantID, playerID, email, srv(ctx).clock.Now().Unix(),
+	); err != nil {
+		return fmt.Errorf("error Upsert player_email: playerID=%s, %w", playerID, err)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
+
+type MailOutboxDetail struct {
+	ID        string `json:"id"`
+	Kind      string `json:"kind"`
+	To        string `json:"to"`
+	Subject   string `json:"subject"`
+	Status    string `json:"status"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error"`
+	CreatedAt int64  `json:"created_at"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+type MailOutboxHandlerResult struct {
+	Mails []MailOutboxDetail `json:"mails"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/mail/outbox
+// 送信したメールを新しい順に最大100件取得する
+// URL引数beforeを指定した場合、指定した値よりもidが小さいものを取得する
+func mailOutboxHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	var beforeID int64
+	if before := c.QueryParam("before"); before != "" {
+		if beforeID, err = strconv.ParseInt(before, 10, 64); err != nil {
+			return echo.NewHTTPError(
+				http.StatusBadRequest,
+				fmt.Sprintf("failed to parse query parameter 'before': %s", err.Error()),
+			)
+		}
+	}
+	ms := []MailOutboxRow{}
+	if beforeID != 0 {
+		err = srv(ctx).adminDB.SelectContext(ctx, &ms, "SELECT * FROM mail_outbox WHERE tenant_id = ? AND id < ? ORDER BY id DESC LIMIT 100", v.tenantID, beforeID)
+	} else {
+		err = srv(ctx).adminDB.SelectContext(ctx, &ms, "SELECT * FROM mail_outbox WHERE tenant_id = ? ORDER BY id DESC LIMIT 100", v.tenantID)
+	}
+	if err != nil {
+		return fmt.Errorf("error Select mail_outbox: tenantID=%d, %w", v.tenantID, err)
+	}
+	res := make([]MailOutboxDetail, 0, len(ms))
+	for _, m := range ms {
+		res = append(res, MailOutboxDetail{
+			ID:        strconv.FormatInt(m.ID, 10),
+			Kind:      m.Kind,
+			To:        m.ToAddress,
+			Subject:   m.Subject,
+			Status:    m.Status,
+			Attempts:  m.Attempts,
+			LastError: m.LastError,
+			CreatedAt: m.CreatedAt,
+			UpdatedAt: m.UpdatedAt,
+		})
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: MailOutboxHandlerResult{Mails: res}})
+}
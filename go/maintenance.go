@@ -0,0 +1,139 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// テナントDBのメンテナンス結果
+type TenantMaintenanceResult struct {
+	TenantID   string `json:"tenant_id"`
+	Integrity  string `json:"integrity"`
+	SizeBefore int64  `json:"size_before"`
+	SizeAfter  int64  `json:"size_after"`
+	Skipped    bool   `json:"skipped"`
+	Error      string `json:"error,omitempty"`
+}
+
+var (
+	// テナントごとの最後にメンテナンスした時刻
+	lastMaintainedMu sync.Mutex
+	lastMaintained   = map[int64]time.Time{}
+)
+
+// テナントDBのファイルがあるテナントIDを列挙する
+func listTenantDBIDs() ([]int64, error) {
+	tenantDBDir := getEnv("ISUCON_TENANT_DB_DIR", "../tenant_db")
+	files, err := filepath.Glob(filepath.Join(tenantDBDir, "*.db"))
+	if err != nil {
+		return nil, fmt.Errorf("error filepath.Glob: dir=%s, %w", tenantDBDir, err)
+	}
+	ids := make([]int64, 0, len(files))
+	for _, f := range files {
+		id, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(f), ".db"), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// 定期メンテナンス
+// 一定時間使われておらず、前回のメンテナンスから十分に時間が経ったテナントDBだけを対象にする
+func (s *Server) scheduledTenantDBMaintenance() {
+	idle := getEnvDuration("ISUCON_TENANT_MAINTENANCE_IDLE", 10*time.Minute)
+	interval := getEnvDuration("ISUCON_TENANT_MAINTENANCE_INTERVAL", 0)
+
+	ids, err := listTenantDBIDs()
+	if err != nil {
+		return
+	}
+	targets := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if d, ok := s.tenantDBs.idleFor(id); !ok || d < idle {
+			continue
+		}
+		lastMaintainedMu.Lock()
+		last := lastMaintained[id]
+		lastMaintainedMu.Unlock()
+		if time.Since(last) < interval {
+			continue
+		}
+		targets = append(targets, id)
+	}
+	maintainTenantDBs(withServer(context.Background(), s), targets, false)
+}
+
+// テナントDBに VACUUM, ANALYZE, integrity_check を実行する
+// forceがfalseの場合、実行直前に使用中になったテナントDBはスキップする
+func maintainTenantDBs(ctx context.Context, ids []int64, force bool) []TenantMaintenanceResult {
+	results := make([]TenantMaintenanceResult, 0, len(ids))
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+		res := TenantMaintenanceResult{TenantID: strconv.FormatInt(id, 10)}
+		if _, ok := srv(ctx).tenantDBs.idleFor(id); !ok && !force {
+			res.Skipped = true
+			results = append(results, res)
+			continue
+		}
+		if err := maintainTenantDB(ctx, id, &res); err != nil {
+			res.Error = err.Error()
+		}
+		lastMaintainedMu.Lock()
+		lastMaintained[id] = time.Now()
+		lastMaintainedMu.Unlock()
+		results = append(results, res)
+	}
+	return results
+}
+
+func maintainTenantDB(ctx context.Context, id int64, res *TenantMaintenanceResult) error {
+	p := tenantDBPath(id)
+	if st, err := os.Stat(p); err == nil {
+		res.SizeBefore = st.Size()
+	}
+
+	// VACUUMはファイル全体を書き換えるので、スコアの更新と重ならないようロックを取る
+	fl, err := lockTenant(ctx, id, lockWrite)
+	if err != nil {
+		return fmt.Errorf("error lockTenant: %w", err)
+	}
+	defer fl.Close()
+
+	// リクエスト処理用のプールとは別のハンドルで実行する
+	db, err := srv(ctx).openTenantDB(id)
+	if err != nil {
+		return fmt.Errorf("error openTenantDB: %w", err)
+	}
+	defer db.Close()
+
+	if err := db.GetContext(ctx, &res.Integrity, "PRAGMA integrity_check"); err != nil {
+		return fmt.Errorf("error integrity_check: tenantID=%d, %w", id, err)
+	}
+	if res.Integrity != "ok" {
+		// 壊れている場合にVACUUMすると状況が悪化しうるので何もしない
+		return fmt.Errorf("integrity_check failed: tenantID=%d, %s", id, res.Integrity)
+	}
+	if _, err := db.ExecContext(ctx, "VACUUM"); err != nil {
+		return fmt.Errorf("error VACUUM: tenantID=%d, %w", id, err)
+	}
+	if _, err := db.ExecContext(ctx, "ANALYZE"); err != nil {
+		return fmt.Errorf("error ANALYZE: tenantID=%d, %w", id, err)
+	}
+
+	if st, err := os.Stat(p); err == nil {
+		res.SizeAfter = st.Size()
+	}
+	return nil
+}
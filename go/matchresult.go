@@ -0,0 +1,392 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 対戦の結果
+// 1対1の対戦形式の大会は、スコアのCSVの代わりに1試合ずつ結果を登録できる
+// 登録と削除のたびに全試合から勝ち点の順位表を作り直し、勝ち点をスコアとしてplayer_scoreを置き換える
+// そのためランキング、ライブスコア、課金、シーズンの集計は他の大会と同じように動く
+// 勝ち点が同じ参加者は勝ち数、得失点差の順に上位にする (row_numを小さくする)
+// 対戦の結果を登録した大会にスコアのCSVをアップロードすると、次に結果を登録するまではCSVのスコアになる
+
+// 勝ち点
+const (
+	matchPointsWin  = 3
+	matchPointsDraw = 1
+	matchPointsLoss = 0
+)
+
+type MatchResultRow struct {
+	TenantID      int64  `db:"tenant_id"`
+	ID            string `db:"id"`
+	CompetitionID string `db:"competition_id"`
+	PlayerAID     string `db:"player_a_id"`
+	PlayerBID     string `db:"player_b_id"`
+	ScoreA        int64  `db:"score_a"`
+	ScoreB        int64  `db:"score_b"`
+	PlayedAt      int64  `db:"played_at"`
+	CreatedAt     int64  `db:"created_at"`
+	UpdatedAt     int64  `db:"updated_at"`
+}
+
+type MatchDetail struct {
+	ID        string `json:"id"`
+	PlayerAID string `json:"player_a_id"`
+	PlayerBID string `json:"player_b_id"`
+	ScoreA    int64  `json:"score_a"`
+	ScoreB    int64  `json:"score_b"`
+	PlayedAt  int64  `json:"played_at"`
+}
+
+func newMatchDetail(m *MatchResultRow) MatchDetail {
+	return MatchDetail{
+		ID:        m.ID,
+		PlayerAID: m.PlayerAID,
+		PlayerBID: m.PlayerBID,
+		ScoreA:    m.ScoreA,
+		ScoreB:    m.ScoreB,
+		PlayedAt:  m.PlayedAt,
+	}
+}
+
+// 参加者ごとの対戦の成績
+type MatchStanding struct {
+	PlayerID     string `json:"player_id"`
+	Played       int64  `json:"played"`
+	Wins         int64  `json:"wins"`
+	Draws        int64  `json:"draws"`
+	Losses       int64  `json:"losses"`
+	Points       int64  `json:"points"`
+	ScoreFor     int64  `json:"score_for"`
+	ScoreAgainst int64  `json:"score_against"`
+}
+
+// 全試合から順位表を作る
+func buildMatchStandings(ms []MatchResultRow) []MatchStanding {
+	byPlayer := map[string]*MatchStanding{}
+	standing := func(id string) *MatchStanding {
+		s, ok := byPlayer[id]
+		if !ok {
+			s = &MatchStanding{PlayerID: id}
+			byPlayer[id] = s
+		}
+		return s
+	}
+	for _, m := range ms {
+		a, b := standing(m.PlayerAID), standing(m.PlayerBID)
+		a.Played++
+		b.Played++
+		a.ScoreFor += m.ScoreA
+		a.ScoreAgainst += m.ScoreB
+		b.ScoreFor += m.ScoreB
+		b.ScoreAgainst += m.ScoreA
+		switch {
+		case m.ScoreA > m.ScoreB:
+			a.Wins, b.Losses = a.Wins+1, b.Losses+1
+			a.Points, b.Points = a.Points+matchPointsWin, b.Points+matchPointsLoss
+		case m.ScoreA < m.ScoreB:
+			a.Losses, b.Wins = a.Losses+1, b.Wins+1
+			a.Points, b.Points = a.Points+matchPointsLoss, b.Points+matchPointsWin
+		default:
+			a.Draws, b.Draws = a.Draws+1, b.Draws+1
+			a.Points, b.Points = a.Points+matchPointsDraw, b.Points+matchPointsDraw
+		}
+	}
+
+	standings := make([]MatchStanding, 0, len(byPlayer))
+	for _, s := range byPlayer {
+		standings = append(standings, *s)
+	}
+	sort.Slice(standings, func(i, j int) bool {
+		a, b := &standings[i], &standings[j]
+		if a.Points != b.Points {
+			return a.Points > b.Points
+		}
+		if a.Wins != b.Wins {
+			return a.Wins > b.Wins
+		}
+		if da, db := a.ScoreFor-a.ScoreAgainst, b.ScoreFor-b.ScoreAgainst; da != db {
+			return da > db
+		}
+		return a.PlayerID < b.PlayerID
+	})
+	return standings
+}
+
+func selectMatchResults(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string) ([]MatchResultRow, error) {
+	ms := []MatchResultRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&ms,
+		"SELECT * FROM match_result WHERE tenant_id = ? AND competition_id = ? ORDER BY played_at ASC, id ASC",
+		tenantID, competitionID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select match_result: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	return ms, nil
+}
+
+// 対戦の結果を変更し、順位表からplayer_scoreを作り直す
+// changeは結果の追加や削除を行い、同じトランザクションでplayer_scoreを置き換える
+// addedはchangeで追加した結果、削除ならnil
+// 大会が終了していれば *competitionFinishedError を返す
+func applyMatchResults(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, competitionID string, added *MatchResultRow, change func(tx *sqlx.Tx) error) error {
+	// スコアのアップロードと同じく、置き換えている間にランキングを読ませない
+	fl, err := lockTenant(ctx, tenantID, lockWrite)
+	if err != nil {
+		return fmt.Errorf("error lockTenant: %w", err)
+	}
+	defer fl.Close()
+	finishedAt, err := competitionFinishedAt(ctx, tenantDB, tenantID, competitionID)
+	if err != nil {
+		return err
+	}
+	if finishedAt.Valid {
+		return &competitionFinishedError{competitionID: competitionID}
+	}
+
+	live, err := competitionLiveMode(ctx, tenantDB, tenantID, competitionID)
+	if err != nil {
+		return err
+	}
+	var rows []PlayerScoreRow
+	if err := withRetry(ctx, func() error {
+		tx, err := tenantDB.BeginTxx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("error BeginTxx: tenantID=%d, %w", tenantID, err)
+		}
+		defer tx.Rollback()
+
+		if err := change(tx); err != nil {
+			return err
+		}
+		ms, err := selectMatchResults(ctx, tx, tenantID, competitionID)
+		if err != nil {
+			return err
+		}
+		now := srv(ctx).clock.Now().Unix()
+		standings := buildMatchStandings(ms)
+		rows = make([]PlayerScoreRow, 0, len(standings))
+		for i, s := range standings {
+			id, err := dispenseID(ctx)
+			if err != nil {
+				return fmt.Errorf("error dispenseID: %w", err)
+			}
+			rows = append(rows, PlayerScoreRow{
+				ID:            id,
+				TenantID:      tenantID,
+				PlayerID:      s.PlayerID,
+				CompetitionID: competitionID,
+				Score:         s.Points,
+				RowNum:        int64(i + 1),
+				CreatedAt:     now,
+				UpdatedAt:     now,
+			})
+		}
+		// ライブモードではメモリ上のランキングを更新し、player_scoreへは定期的に書き出す
+		if !live {
+			if err := writePlayerScoresTx(ctx, tx, tenantID, competitionID, rows); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}); err != nil {
+		return err
+	}
+	if live {
+		if err := srv(ctx).liveScores.put(ctx, tenantDB, tenantID, competitionID, rows); err != nil {
+			return fmt.Errorf("error liveScores.put: %w", err)
+		}
+	}
+	// 追加した対戦の結果はすぐにレーティングに反映し、削除した場合はバックグラウンドで計算し直す (rating.go を参照)
+	if added != nil {
+		applyRatingEvent(ctx, tenantDB, tenantID, ratingEvent{at: added.CreatedAt, id: added.ID, match: added})
+	} else {
+		scheduleRatingsRecompute(ctx, tenantID)
+	}
+	publishWebhookEvent(ctx, tenantID, webhookEventScoreUploaded, map[string]any{
+		"competition_id": competitionID,
+		"rows":           len(rows),
+	})
+	return nil
+}
+
+type MatchesHandlerResult struct {
+	Matches   []MatchDetail   `json:"matches"`
+	Standings []MatchStanding `json:"standings"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/competition/:competition_id/matches
+// 大会の対戦の結果と順位表を取得する
+func matchesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	competitionID := c.Param("competition_id")
+	if _, err := retrieveCompetition(ctx, tenantDB, v.tenantID, competitionID); err != nil {
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	ms, err := selectMatchResults(ctx, tenantDB, v.tenantID, competitionID)
+	if err != nil {
+		return err
+	}
+	res := MatchesHandlerResult{
+		Matches:   make([]MatchDetail, 0, len(ms)),
+		Standings: buildMatchStandings(ms),
+	}
+	for i := range ms {
+		res.Matches = append(res.Matches, newMatchDetail(&ms[i]))
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+type MatchAddRequest struct {
+	CompetitionID string `param:"competition_id" validate:"required"`
+	PlayerAID     string `form:"player_a_id" validate:"required"`
+	PlayerBID     string `form:"player_b_id" validate:"required"`
+	ScoreA        int64  `form:"score_a" validate:"min=0"`
+	ScoreB        int64  `form:"score_b" validate:"min=0"`
+	// 省略時は登録した時刻
+	PlayedAt int64 `form:"played_at" validate:"min=0"`
+}
+
+type MatchAddHandlerResult struct {
+	Match MatchDetail `json:"match"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/competition/:competition_id/matches/add
+// 対戦の結果を登録する
+func matchAddHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	var req MatchAddRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+	if req.PlayerAID == req.PlayerBID {
+		return &requestError{fields: []FieldError{{Field: "player_b_id", Code: fieldErrInvalid, Message: "player_b_id must differ from player_a_id"}}}
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	if _, err := retrieveCompetition(ctx, tenantDB, v.tenantID, req.CompetitionID); err != nil {
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	for _, id := range []string{req.PlayerAID, req.PlayerBID} {
+		if _, err := retrievePlayer(ctx, tenantDB, v.tenantID, id); err != nil {
+			return fmt.Errorf("error retrievePlayer: %w", err)
+		}
+	}
+
+	id, err := dispenseID(ctx)
+	if err != nil {
+		return fmt.Errorf("error dispenseID: %w", err)
+	}
+	now := srv(ctx).clock.Now().Unix()
+	m := MatchResultRow{
+		TenantID:      v.tenantID,
+		ID:            id,
+		CompetitionID: req.CompetitionID,
+		PlayerAID:     req.PlayerAID,
+		PlayerBID:     req.PlayerBID,
+		ScoreA:        req.ScoreA,
+		ScoreB:        req.ScoreB,
+		PlayedAt:      req.PlayedAt,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if m.PlayedAt == 0 {
+		m.PlayedAt = now
+	}
+	if err := applyMatchResults(ctx, tenantDB, v.tenantID, req.CompetitionID, &m, func(tx *sqlx.Tx) error {
+		if _, err := tx.NamedExecContext(
+			ctx,
+			`INSERT INTO match_result (id, tenant_id, competition_id, player_a_id, player_b_id, score_a, score_b, played_at, created_at, updated_at)
+			 VALUES (:id, :tenant_id, :competition_id, :player_a_id, :player_b_id, :score_a, :score_b, :played_at, :created_at, :updated_at)`,
+			m,
+		); err != nil {
+			return fmt.Errorf("error Insert match_result: tenantID=%d, competitionID=%s, %w", v.tenantID, req.CompetitionID, err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: MatchAddHandlerResult{Match: newMatchDetail(&m)}})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/competition/:competition_id/match/:match_id/delete
+// 対戦の結果を削除する
+func matchDeleteHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	competitionID := c.Param("competition_id")
+	matchID := c.Param("match_id")
+	if _, err := retrieveCompetition(ctx, tenantDB, v.tenantID, competitionID); err != nil {
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	if err := applyMatchResults(ctx, tenantDB, v.tenantID, competitionID, nil, func(tx *sqlx.Tx) error {
+		r, err := tx.ExecContext(
+			ctx,
+			"DELETE FROM match_result WHERE tenant_id = ? AND competition_id = ? AND id = ?",
+			v.tenantID, competitionID, matchID,
+		)
+		if err != nil {
+			return fmt.Errorf("error Delete match_result: tenantID=%d, id=%s, %w", v.tenantID, matchID, err)
+		}
+		if n, _ := r.RowsAffected(); n == 0 {
+			return &notFoundError{resource: "match", err: sql.ErrNoRows}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
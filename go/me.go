@@ -1,7 +1,6 @@
 package isuports
 
 import (
-	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -38,7 +37,7 @@ func meHandler(c echo.Context) error {
 		}
 		return fmt.Errorf("error parseViewer: %w", err)
 	}
-	if v.role == RoleAdmin || v.role == RoleOrganizer {
+	if v.role == RoleAdmin || v.role == RoleOrganizer || v.role == RoleReader {
 		return c.JSON(http.StatusOK, SuccessResult{
 			Status: true,
 			Data: MeHandlerResult{
@@ -50,12 +49,13 @@ func meHandler(c echo.Context) error {
 		})
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := connectToTenantDB(c.Request().Context(), v.tenantID)
 	if err != nil {
 		return fmt.Errorf("error connectToTenantDB: %w", err)
 	}
-	ctx := context.Background()
-	p, err := retrievePlayer(ctx, tenantDB, v.playerID)
+	defer tenantDB.Close()
+	ctx := c.Request().Context()
+	p, err := retrievePlayer(ctx, tenantDB, v.tenantID, v.playerID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c.JSON(http.StatusOK, SuccessResult{
@@ -71,15 +71,16 @@ func meHandler(c echo.Context) error {
 		return fmt.Errorf("error retrievePlayer: %w", err)
 	}
 
+	loc, err := tenantLocation(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	me := newPlayerDetail(p, loc)
 	return c.JSON(http.StatusOK, SuccessResult{
 		Status: true,
 		Data: MeHandlerResult{
-			Tenant: td,
-			Me: &PlayerDetail{
-				ID:             p.ID,
-				DisplayName:    p.DisplayName,
-				IsDisqualified: p.IsDisqualified,
-			},
+			Tenant:   td,
+			Me:       &me,
 			Role:     v.role,
 			LoggedIn: true,
 		},
@@ -0,0 +1,102 @@
+package isuports
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+// キャッシュのヒット率を数える
+type cacheStats struct {
+	hits   int64
+	misses int64
+}
+
+func (s *cacheStats) record(hit bool) {
+	if hit {
+		atomic.AddInt64(&s.hits, 1)
+	} else {
+		atomic.AddInt64(&s.misses, 1)
+	}
+}
+
+func (s *cacheStats) snapshot() map[string]any {
+	hits := atomic.LoadInt64(&s.hits)
+	misses := atomic.LoadInt64(&s.misses)
+	rate := 0.0
+	if total := hits + misses; total > 0 {
+		rate = float64(hits) / float64(total)
+	}
+	return map[string]any{
+		"hits":     hits,
+		"misses":   misses,
+		"hit_rate": rate,
+	}
+}
+
+var (
+	jwtTokenCacheStats      = &cacheStats{}
+	playerCacheStats        = &cacheStats{}
+	competitionCacheStats   = &cacheStats{}
+	billingReportCacheStats = &cacheStats{}
+
+	// 同時実行数の上限で503を返した回数 (ルートごと)
+	loadShedCount = expvar.NewMap("load_shed")
+)
+
+// 運用中の状態を expvar で公開する
+// ベンチ中に何が詰まっているかを /debug/vars で確認するためのもの (pprof.go を参照)
+func publishMetrics() {
+	// 管理用DBのコネクションプールの状態 (使用中、アイドル、待ち回数など)
+	expvar.Publish("admin_db", expvar.Func(func() any {
+		if defaultServer == nil {
+			return nil
+		}
+		return defaultServer.adminDB.Stats()
+	}))
+	// 読み取り用レプリカのコネクションプールの状態
+	expvar.Publish("admin_read_db", expvar.Func(func() any {
+		if defaultServer == nil || defaultServer.adminReadDB == defaultServer.adminDB {
+			return nil
+		}
+		return defaultServer.adminReadDB.Stats()
+	}))
+	// 開いているテナントDBの数と再利用状況
+	expvar.Publish("tenant_dbs", expvar.Func(func() any {
+		if defaultServer == nil {
+			return nil
+		}
+		return defaultServer.tenantDBs.stats()
+	}))
+	// Hostヘッダからテナントを引くキャッシュのヒット率
+	expvar.Publish("tenant_row_cache", expvar.Func(func() any {
+		if defaultServer == nil {
+			return nil
+		}
+		s := defaultServer.tenantRowCache.stats.snapshot()
+		s["size"] = defaultServer.tenantRowCache.Len()
+		return s
+	}))
+	// ルートごとのレイテンシ
+	expvar.Publish("request_latency", expvar.Func(func() any {
+		return requestLatencies.details()
+	}))
+	// テナントのロックの待ち時間と、今持っているロック (tenantlock.go を参照)
+	expvar.Publish("tenant_lock", expvar.Func(func() any {
+		if defaultServer == nil {
+			return nil
+		}
+		return defaultServer.tenantLocks.detail()
+	}))
+	// 書き出し待ちの訪問履歴の数
+	// 管理用DBへの書き込みが失敗し続けると増えていく (visit.go を参照)
+	expvar.Publish("pending_visits", expvar.Func(func() any {
+		if defaultServer == nil {
+			return nil
+		}
+		return defaultServer.visits.len()
+	}))
+	// JWTの検証結果キャッシュのヒット率
+	expvar.Publish("jwt_token_cache", expvar.Func(func() any {
+		return jwtTokenCacheStats.snapshot()
+	}))
+}
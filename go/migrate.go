@@ -0,0 +1,244 @@
+package isuports
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// スキーマのマイグレーション
+// schema/admin, schema/tenant 以下に 0001_xxx.sql の形式で置き、番号順に適用する
+// 適用済みのバージョンは、管理用DBは schema_migrations テーブル、テナントDBは PRAGMA user_version で管理する
+// 一度リリースしたファイルは書き換えず、変更は新しい番号のファイルで行うこと
+//
+//go:embed schema/admin/*.sql schema/tenant/*.sql
+var migrationFS embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// dir以下のマイグレーションをバージョン順に読み込む
+func loadMigrations(dir string) ([]migration, error) {
+	entries, err := migrationFS.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error ReadDir: dir=%s, %w", dir, err)
+	}
+	ms := make([]migration, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		i := strings.Index(name, "_")
+		if i < 0 || !strings.HasSuffix(name, ".sql") {
+			return nil, fmt.Errorf("invalid migration file name: %s", name)
+		}
+		version, err := strconv.Atoi(name[:i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version: %s, %w", name, err)
+		}
+		b, err := migrationFS.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("error ReadFile: %s, %w", name, err)
+		}
+		ms = append(ms, migration{
+			version: version,
+			name:    strings.TrimSuffix(name[i+1:], ".sql"),
+			sql:     string(b),
+		})
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].version < ms[j].version })
+	for i := 1; i < len(ms); i++ {
+		if ms[i].version == ms[i-1].version {
+			return nil, fmt.Errorf("duplicate migration version: dir=%s, version=%d", dir, ms[i].version)
+		}
+	}
+	return ms, nil
+}
+
+// SQLファイルを文ごとに分割する
+// MySQLドライバは複数の文を一度に実行できないため
+func splitStatements(sql string) []string {
+	var (
+		stmts []string
+		buf   strings.Builder
+	)
+	for _, line := range strings.Split(sql, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSpace(buf.String()))
+			buf.Reset()
+		}
+	}
+	if s := strings.TrimSpace(buf.String()); s != "" {
+		stmts = append(stmts, s)
+	}
+	return stmts
+}
+
+// 管理用DBにマイグレーションを適用し、適用したバージョンを返す
+// 複数のサーバーが同時に起動しても1台だけが適用するよう、GET_LOCKで排他する
+// MySQLのDDLはトランザクションで巻き戻せないので、途中で失敗した場合は手で直してから再実行すること
+func migrateAdminDB(ctx context.Context, db *sqlx.DB) ([]int, error) {
+	ms, err := loadMigrations("schema/admin")
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error Connx: %w", err)
+	}
+	defer conn.Close()
+
+	var locked int
+	if err := conn.GetContext(ctx, &locked, "SELECT GET_LOCK('isuports_schema_migrations', 60)"); err != nil {
+		return nil, fmt.Errorf("error GET_LOCK: %w", err)
+	}
+	if locked != 1 {
+		return nil, fmt.Errorf("timeout waiting for schema migration lock")
+	}
+	defer conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK('isuports_schema_migrations')")
+
+	if _, err := conn.ExecContext(
+		ctx,
+		"CREATE TABLE IF NOT EXISTS `schema_migrations` (`version` INT NOT NULL PRIMARY KEY, `name` VARCHAR(255) NOT NULL, `applied_at` BIGINT NOT NULL) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4",
+	); err != nil {
+		return nil, fmt.Errorf("error Create schema_migrations: %w", err)
+	}
+	var versions []int
+	if err := conn.SelectContext(ctx, &versions, "SELECT version FROM schema_migrations"); err != nil {
+		return nil, fmt.Errorf("error Select schema_migrations: %w", err)
+	}
+	done := make(map[int]bool, len(versions))
+	for _, v := range versions {
+		done[v] = true
+	}
+
+	applied := []int{}
+	for _, m := range ms {
+		if done[m.version] {
+			continue
+		}
+		for _, stmt := range splitStatements(m.sql) {
+			if _, err := conn.ExecContext(ctx, stmt); err != nil {
+				return applied, fmt.Errorf("error apply admin migration: version=%d, name=%s, %w", m.version, m.name, err)
+			}
+		}
+		if _, err := conn.ExecContext(
+			ctx,
+			"INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+			m.version, m.name, time.Now().Unix(),
+		); err != nil {
+			return applied, fmt.Errorf("error Insert schema_migrations: version=%d, %w", m.version, err)
+		}
+		applied = append(applied, m.version)
+	}
+	return applied, nil
+}
+
+// テナントDBにマイグレーションを適用し、適用後のバージョンを返す
+// 他のプロセスやスコアの更新と重ならないよう、テナントのロックを取ってから行う
+// 1つのマイグレーションとuser_versionの更新は同じトランザクションで行う
+func migrateTenantDB(ctx context.Context, tenantID int64, db *sqlx.DB) (int, error) {
+	ms, err := loadMigrations("schema/tenant")
+	if err != nil {
+		return 0, err
+	}
+
+	fl, err := lockTenant(ctx, tenantID, lockWrite)
+	if err != nil {
+		return 0, fmt.Errorf("error lockTenant: %w", err)
+	}
+	defer fl.Close()
+
+	var current int
+	if err := db.GetContext(ctx, &current, "PRAGMA user_version"); err != nil {
+		return 0, fmt.Errorf("error PRAGMA user_version: tenantID=%d, %w", tenantID, err)
+	}
+	for _, m := range ms {
+		if m.version <= current {
+			continue
+		}
+		if err := func() error {
+			tx, err := db.BeginTxx(ctx, nil)
+			if err != nil {
+				return fmt.Errorf("error BeginTxx: %w", err)
+			}
+			defer tx.Rollback()
+			if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+				return err
+			}
+			// PRAGMAはプレースホルダを使えない
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", m.version)); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}(); err != nil {
+			return current, fmt.Errorf("error apply tenant migration: tenantID=%d, version=%d, name=%s, %w", tenantID, m.version, m.name, err)
+		}
+		current = m.version
+	}
+	return current, nil
+}
+
+// Serverがマイグレーション済みのテナントID
+type migratedTenantSet struct {
+	mu  sync.Mutex
+	ids map[int64]bool
+}
+
+func newMigratedTenantSet() *migratedTenantSet {
+	return &migratedTenantSet{ids: map[int64]bool{}}
+}
+
+func (m *migratedTenantSet) has(tenantID int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ids[tenantID]
+}
+
+func (m *migratedTenantSet) add(tenantID int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ids[tenantID] = true
+}
+
+// テナントDBのファイルを差し替えたときに、次に使うときに再度マイグレーションするようにする
+func (m *migratedTenantSet) remove(tenantID int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.ids, tenantID)
+}
+
+func (m *migratedTenantSet) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ids = map[int64]bool{}
+}
+
+// テナントDBを初めて使うときにマイグレーションを適用する
+// ロックを取る必要があるので、lockTenantでロックを取る前に呼ぶこと
+func (s *Server) ensureTenantDBMigrated(tenantID int64, db *sqlx.DB) error {
+	if s.migratedTenants.has(tenantID) {
+		return nil
+	}
+	if _, err := migrateTenantDB(withServer(context.Background(), s), tenantID, db); err != nil {
+		return err
+	}
+	s.migratedTenants.add(tenantID)
+	return nil
+}
@@ -0,0 +1,69 @@
+package isuports
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// テナント管理者や参加者への通知
+// 通知の失敗でAPIのレスポンスを失敗にしないよう、リクエストとは別のgoroutineでログに残すだけにする
+// 送信中の通知は Server.notifications で数え、終了前に待つ
+
+// 通知を送る時間の上限
+const notifyTimeout = 30 * time.Second
+
+// スコアのアップロードがバリデーションで失敗したことを通知する
+func notifyScoreRejected(c echo.Context, comp *CompetitionRow, reason string) {
+	tenant, err := retrieveTenantRowFromHeader(c)
+	if err != nil {
+		return
+	}
+	s := srv(c.Request().Context())
+	s.notifications.Add(1)
+	go func() {
+		defer s.notifications.Done()
+		ctx, cancel := context.WithTimeout(withServer(context.Background(), s), notifyTimeout)
+		defer cancel()
+		if err := notifyScoreRejectedByMail(ctx, tenant, comp, reason); err != nil {
+			logNotifyError("score_rejected", tenant.ID, err)
+		}
+		if err := notifyScoreRejectedByChat(ctx, tenant, comp, reason); err != nil {
+			logNotifyError("score_rejected", tenant.ID, err)
+		}
+	}()
+}
+
+// 大会が終了したことを通知する
+func notifyCompetitionFinished(c echo.Context, comp *CompetitionRow) {
+	tenant, err := retrieveTenantRowFromHeader(c)
+	if err != nil {
+		return
+	}
+	s := srv(c.Request().Context())
+	s.notifications.Add(1)
+	go func() {
+		defer s.notifications.Done()
+		ctx, cancel := context.WithTimeout(withServer(context.Background(), s), notifyTimeout)
+		defer cancel()
+		if err := notifyCompetitionFinishedByChat(ctx, tenant, comp); err != nil {
+			logNotifyError("competition_finished", tenant.ID, err)
+		}
+		// リクエストのテナントDBの接続はレスポンスを返すと閉じるので、別に開く
+		tenantDB, err := connectToTenantDB(ctx, tenant.ID)
+		if err != nil {
+			logNotifyError("competition_finished", tenant.ID, err)
+			return
+		}
+		defer tenantDB.Close()
+		if err := notifyCompetitionFinishedByMail(ctx, tenantDB, tenant, comp); err != nil {
+			logNotifyError("competition_finished", tenant.ID, err)
+		}
+	}()
+}
+
+func logNotifyError(kind string, tenantID int64, err error) {
+	logger.Error("failed to notify", zap.String("kind", kind), zap.Int64("tenant_id", tenantID), zap.Error(err))
+}
@@ -0,0 +1,383 @@
+package isuports
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// S3互換のオブジェクトストレージ
+// ISUCON_S3_BUCKET を設定すると、テナントDBのバックアップとスコアのCSVの原本を保存する
+// 署名はAWS Signature Version 4をそのまま実装している
+type objectStore struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	pathStyle bool // MinIOなどはバケットをパスに含める
+	client    *http.Client
+}
+
+var objectStorage = newObjectStoreFromConfig()
+
+func newObjectStoreFromConfig() *objectStore {
+	bucket := getEnv("ISUCON_S3_BUCKET", "")
+	if bucket == "" {
+		return nil
+	}
+	region := getEnv("ISUCON_S3_REGION", "ap-northeast-1")
+	endpoint, err := url.Parse(getEnv("ISUCON_S3_ENDPOINT", fmt.Sprintf("https://s3.%s.amazonaws.com", region)))
+	if err != nil {
+		return nil
+	}
+	return &objectStore{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    bucket,
+		prefix:    strings.Trim(getEnv("ISUCON_S3_PREFIX", "isuports"), "/"),
+		accessKey: getEnv("ISUCON_S3_ACCESS_KEY_ID", ""),
+		secretKey: getEnv("ISUCON_S3_SECRET_ACCESS_KEY", ""),
+		pathStyle: getEnv("ISUCON_S3_PATH_STYLE", "0") == "1",
+		client:    &http.Client{Timeout: getEnvDuration("ISUCON_S3_TIMEOUT", 5*time.Minute)},
+	}
+}
+
+// プレフィックスをつけたキーを返す
+func (s *objectStore) key(parts ...string) string {
+	if s.prefix == "" {
+		return strings.Join(parts, "/")
+	}
+	return s.prefix + "/" + strings.Join(parts, "/")
+}
+
+func (s *objectStore) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucket + "/" + strings.TrimPrefix(key, "/")
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + strings.TrimPrefix(key, "/")
+	}
+	return &u
+}
+
+// オブジェクトを保存する
+// metaはx-amz-meta-*として、tagsはライフサイクルルールで使えるようオブジェクトタグとして付ける
+func (s *objectStore) put(ctx context.Context, key string, body io.ReadSeeker, contentType string, meta, tags map[string]string) error {
+	h := sha256.New()
+	size, err := io.Copy(h, body)
+	if err != nil {
+		return fmt.Errorf("error hash body: %w", err)
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error seek body: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key).String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range meta {
+		req.Header.Set("X-Amz-Meta-"+k, v)
+	}
+	if len(tags) > 0 {
+		q := url.Values{}
+		for k, v := range tags {
+			q.Set(k, v)
+		}
+		req.Header.Set("X-Amz-Tagging", q.Encode())
+	}
+	s.sign(req, hex.EncodeToString(h.Sum(nil)), time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error PUT object: key=%s, %w", key, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("error PUT object: key=%s, status=%d, %s", key, res.StatusCode, msg)
+	}
+	return nil
+}
+
+// オブジェクトを取得する、使い終わったらCloseすること
+func (s *objectStore) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, emptyPayloadHash, time.Now())
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error GET object: key=%s, %w", key, err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, fmt.Errorf("error GET object: key=%s, %w", key, errObjectNotFound)
+	}
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("error GET object: key=%s, status=%d, %s", key, res.StatusCode, msg)
+	}
+	return res.Body, nil
+}
+
+var errObjectNotFound = errors.New("object not found")
+
+// 署名付きURLを返す
+// 受け取った側は認証情報なしでexpiresまでmethodでアクセスできる
+func (s *objectStore) presign(method, key string, expires time.Duration, now time.Time) string {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+
+	u := s.objectURL(key)
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", s.accessKey+"/"+scope)
+	q.Set("X-Amz-Date", amzDate)
+	q.Set("X-Amz-Expires", fmt.Sprint(int64(expires/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		canonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(crHash[:]),
+	}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(awsSigningKey(s.secretKey, date, s.region, "s3"), stringToSign))
+
+	u.RawQuery = canonicalQuery(q) + "&X-Amz-Signature=" + signature
+	return u.String()
+}
+
+// 空のボディのSHA-256
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *objectStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	signAWSv4(req, payloadHash, now, s.region, "s3", s.accessKey, s.secretKey)
+}
+
+// AWS Signature Version 4 で署名する
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func signAWSv4(req *http.Request, payloadHash string, now time.Time, region, service, accessKey, secretKey string) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// 署名対象のヘッダ (Host, Content-Type, X-Amz-*)
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "content-type" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(vs, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(crHash[:]),
+	}, "\n")
+
+	signature := hex.EncodeToString(hmacSHA256(awsSigningKey(secretKey, date, region, service), stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func awsSigningKey(secretKey, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// SigV4はスペースを%20でエスケープする
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// テナントDBのバックアップファイルをアップロードし、オブジェクトキーを返す
+func uploadTenantBackup(ctx context.Context, tenantID int64, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("error os.Open: path=%s, %w", path, err)
+	}
+	defer f.Close()
+
+	key := objectStorage.key("backups", fmt.Sprintf("tenant-%d", tenantID), filepath.Base(path))
+	contentType := "application/vnd.sqlite3"
+	if strings.HasSuffix(path, ".gz") {
+		contentType = "application/gzip"
+	}
+	err = objectStorage.put(ctx, key, f, contentType,
+		map[string]string{
+			"Tenant-Id":  fmt.Sprint(tenantID),
+			"Created-At": time.Now().UTC().Format(time.RFC3339),
+		},
+		map[string]string{"type": "tenant-backup", "tenant": fmt.Sprint(tenantID)},
+	)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// オブジェクトストレージ上のバックアップからテナントDBを復元する
+func restoreTenantDBFromObject(ctx context.Context, tenantID int64, key string) error {
+	if objectStorage == nil {
+		return fmt.Errorf("object storage is not configured")
+	}
+	body, err := objectStorage.get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// .gzかどうかで展開の要否を判断するので、拡張子を引き継ぐ
+	tmp, err := os.CreateTemp("", "isuports-restore-*-"+filepath.Base(key))
+	if err != nil {
+		return fmt.Errorf("error os.CreateTemp: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error download object: key=%s, %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return restoreTenantDB(ctx, tenantID, tmp.Name())
+}
+
+// アップロードされたスコアのCSVの原本を保存する
+// リクエストの応答を遅らせないよう、内容をメモリに読んでから非同期でアップロードする
+func archiveScoreUpload(tenantID int64, competitionID string, fh *multipart.FileHeader) {
+	if objectStorage == nil {
+		return
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return
+	}
+	b, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return
+	}
+	archiveScoreCSV(tenantID, competitionID, fh.Filename, b)
+}
+
+// 取り込んだスコアのCSVをオブジェクトストレージに保存する
+func archiveScoreCSV(tenantID int64, competitionID, filename string, b []byte) {
+	if objectStorage == nil {
+		return
+	}
+	go func() {
+		now := time.Now().UTC()
+		key := objectStorage.key(
+			"scores",
+			fmt.Sprintf("tenant-%d", tenantID),
+			competitionID,
+			now.Format("20060102T150405.000000000Z")+".csv",
+		)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := objectStorage.put(ctx, key, bytes.NewReader(b), "text/csv",
+			map[string]string{
+				"Tenant-Id":         fmt.Sprint(tenantID),
+				"Competition-Id":    competitionID,
+				"Original-Filename": url.QueryEscape(filename),
+			},
+			map[string]string{"type": "score-upload", "tenant": fmt.Sprint(tenantID)},
+		); err != nil {
+			logger.Error("failed to archive score upload",
+				zap.Int64("tenant_id", tenantID),
+				zap.String("competition_id", competitionID),
+				zap.Error(err),
+			)
+		}
+	}()
+}
@@ -0,0 +1,576 @@
+package isuports
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// OpenAPIの定義
+// レスポンスのスキーマはハンドラが返す構造体からreflectで作るので、構造体を変更すれば定義も追従する
+// APIを追加したら apiOperations にも追加すること
+
+// APIの説明
+type apiOperation struct {
+	method  string
+	path    string // echoの形式 (:param)
+	summary string
+	role    string // 必要なロール、空なら認証不要
+	params  []apiParam
+	result  any // SuccessResult.Data の型、nilならdataなし
+}
+
+// JSONではなくファイルを返すAPIのresultに指定する
+type apiFile struct {
+	contentType string
+}
+
+type apiParam struct {
+	name     string
+	in       string // path, query, formData
+	typ      string // string, integer, boolean, file
+	required bool
+	desc     string
+}
+
+// 一覧のページングのパラメータ (pagination.go を参照)
+func withPageParams(params ...apiParam) []apiParam {
+	return append(params,
+		apiParam{"cursor", "query", "string", false, "前のレスポンスのpaginationで返したカーソル"},
+		apiParam{"limit", "query", "integer", false, "1ページの件数"},
+	)
+}
+
+// シーズンの追加と変更のパラメータ (season.go を参照)
+func seasonParams(params ...apiParam) []apiParam {
+	return append(params,
+		apiParam{"title", "formData", "string", true, "シーズン名"},
+		apiParam{"aggregation", "formData", "string", false, "sum (全大会のスコアの合計、デフォルト) か best (上位best_n大会のスコアの合計)"},
+		apiParam{"best_n", "formData", "integer", false, "aggregationがbestの場合に集計する大会の数"},
+	)
+}
+
+var apiOperations = []apiOperation{
+	// SaaS管理者向けAPI
+	{http.MethodPost, "/api/admin/tenants/add", "テナントを追加する", RoleAdmin, []apiParam{
+		{"name", "formData", "string", true, "テナント名"},
+		{"display_name", "formData", "string", true, "テナントの表示名"},
+	}, TenantsAddHandlerResult{}},
+	{http.MethodGet, "/api/admin/tenants/billing", "テナントごとの課金レポートを取得する", RoleAdmin, withPageParams(
+		apiParam{"before", "query", "string", false, "このテナントIDより前のテナントを返す (cursorを使うこと)"},
+	), TenantsBillingHandlerResult{}},
+	{http.MethodGet, "/api/admin/tenants/billing.xlsx", "全テナントの課金レポートをxlsxで取得する", RoleAdmin, nil, apiFile{mimeXLSX}},
+	{http.MethodPost, "/api/admin/tenants/maintenance", "テナントDBの整合性チェックとVACUUMを行う", RoleAdmin, []apiParam{
+		{"tenant_id", "formData", "integer", false, "対象のテナントID、指定した場合は使用中でも行う (省略時はアイドル状態の全テナント)"},
+	}, TenantsMaintenanceHandlerResult{}},
+	{http.MethodPost, "/api/admin/tenants/backup", "テナントDBのバックアップを取る", RoleAdmin, []apiParam{
+		{"tenant_id", "formData", "integer", true, "テナントID"},
+		{"compress", "formData", "string", false, "1ならgzipで圧縮する"},
+	}, TenantsBackupHandlerResult{}},
+	{http.MethodPost, "/api/admin/tenants/restore", "バックアップからテナントDBを復元する", RoleAdmin, []apiParam{
+		{"tenant_id", "formData", "integer", true, "テナントID"},
+		{"file", "formData", "string", false, "バックアップのファイル名"},
+		{"object_key", "formData", "string", false, "オブジェクトストレージ上のバックアップのキー"},
+	}, nil},
+	{http.MethodGet, "/api/admin/invoices", "月ごとの請求書の一覧を取得する", RoleAdmin, []apiParam{
+		{"period", "query", "string", true, "請求の対象の月 (YYYY-MM)"},
+	}, InvoicesHandlerResult{}},
+	{http.MethodPost, "/api/admin/invoices/generate", "課金レポートから月ごとの請求書を作る", RoleAdmin, []apiParam{
+		{"period", "formData", "string", true, "請求の対象の月 (YYYY-MM)"},
+	}, InvoicesHandlerResult{}},
+	{http.MethodPost, "/api/admin/invoices/sync", "draftの請求書をStripeに送る", RoleAdmin, []apiParam{
+		{"period", "formData", "string", true, "請求の対象の月 (YYYY-MM)"},
+	}, InvoicesHandlerResult{}},
+	{http.MethodGet, "/api/admin/caches", "キャッシュの件数とヒット率を取得する", RoleAdmin, nil, CachesHandlerResult{}},
+	{http.MethodPost, "/api/admin/caches", "キャッシュを破棄する", RoleAdmin, []apiParam{
+		{"name", "formData", "string", true, "キャッシュの名前"},
+	}, CachesHandlerResult{}},
+	{http.MethodGet, "/api/admin/stats", "ルートごとのレイテンシを取得する", RoleAdmin, []apiParam{
+		{"reset", "query", "string", false, "1なら取得後に集計をやり直す"},
+	}, StatsHandlerResult{}},
+
+	// テナント管理者向けAPI
+	{http.MethodGet, "/api/organizer/players", "参加者の一覧を取得する", RoleOrganizer, withPageParams(
+		apiParam{"format", "query", "string", false, "csvを指定するとCSVで返す"},
+	), PlayersListHandlerResult{}},
+	{http.MethodPost, "/api/organizer/players/add", "参加者を追加する", RoleOrganizer, []apiParam{
+		{"display_name[]", "formData", "string", false, "参加者の表示名、複数指定できる"},
+		{"players", "formData", "file", false, "display_name のヘッダを持つCSVか、display_nameを持つオブジェクトの配列のJSON"},
+	}, PlayersAddHandlerResult{}},
+	{http.MethodPost, "/api/organizer/player/:player_id/disqualified", "参加者を失格にする", RoleOrganizer, []apiParam{
+		{"player_id", "path", "string", true, "参加者ID"},
+	}, PlayerDisqualifiedHandlerResult{}},
+	{http.MethodGet, "/api/organizer/player/:player_id/export", "参加者について保存しているデータを全て取得する", RoleOrganizer, []apiParam{
+		{"player_id", "path", "string", true, "参加者ID"},
+		{"format", "query", "string", false, "csvを指定するとCSVをまとめたzipで返す"},
+	}, PlayerExport{}},
+	{http.MethodPost, "/api/organizer/player/:player_id/erase", "参加者の個人データを消去する", RoleOrganizer, []apiParam{
+		{"player_id", "path", "string", true, "参加者ID"},
+		{"mode", "formData", "string", false, "anonymize (デフォルト) か、終了していない大会のスコアと訪問履歴も削除する delete"},
+	}, PlayerEraseHandlerResult{}},
+	{http.MethodPost, "/api/organizer/competitions/add", "大会を追加する", RoleOrganizer, []apiParam{
+		{"title", "formData", "string", true, "大会名"},
+		{"season_id", "formData", "string", false, "大会が属するシーズンのID"},
+		{"live", "formData", "boolean", false, "trueならライブモード (スコアをメモリ上に持ち、定期的に書き出す)"},
+	}, CompetitionsAddHandlerResult{}},
+	{http.MethodPost, "/api/organizer/competition/:competition_id/finish", "大会を終了する", RoleOrganizer, []apiParam{
+		{"competition_id", "path", "string", true, "大会ID"},
+	}, nil},
+	{http.MethodPost, "/api/organizer/competition/:competition_id/score", "大会のスコアをCSVでアップロードする", RoleOrganizer, []apiParam{
+		{"competition_id", "path", "string", true, "大会ID"},
+		{"scores", "formData", "file", false, "player_id,score のヘッダを持つCSVか、player_id,scoreを持つオブジェクトの配列のJSON (presignを指定しない場合は必須)"},
+		{"presign", "query", "string", false, "1ならアップロードせず、CSVをPUTする署名付きURLを発行してScoreUploadURLHandlerResultを返す"},
+		{"dry_run", "query", "string", false, "1なら検証だけ行い、置き換えた場合のランキングの変化 (dry_run) を返す、何も書き込まない"},
+		{"override", "formData", "string", false, "1なら終了した大会のスコアを訂正する (reasonが必須、監査ログに残る)、指定しなければ終了した大会へのアップロードはコードcompetition_finishedの400になる"},
+		{"reason", "formData", "string", false, "訂正の理由 (overrideを指定した場合は必須)"},
+		{"player_check", "formData", "string", false, "存在しない参加者の行の扱い、strict (デフォルト) ならファイル全体を拒否、lenient ならその行を飛ばして取り込む"},
+	}, ScoreHandlerResult{}},
+	{http.MethodPost, "/api/organizer/competition/:competition_id/score/ingest", "署名付きURLにアップロードしたCSVで大会のスコアを置き換える", RoleOrganizer, []apiParam{
+		{"competition_id", "path", "string", true, "大会ID"},
+		{"upload_id", "formData", "string", true, "presign=1で発行したupload_id"},
+		{"player_check", "formData", "string", false, "存在しない参加者の行の扱い、strict (デフォルト) ならファイル全体を拒否、lenient ならその行を飛ばして取り込む"},
+	}, ScoreHandlerResult{}},
+	{http.MethodPost, "/api/organizer/competition/:competition_id/score/import_url", "URLから取得したCSVで大会のスコアを置き換える", RoleOrganizer, []apiParam{
+		{"competition_id", "path", "string", true, "大会ID"},
+		{"url", "formData", "string", true, "player_id,score のヘッダを持つCSVかJSONのURL (https、GoogleスプレッドシートのURLも可)"},
+		{"player_check", "formData", "string", false, "存在しない参加者の行の扱い、strict (デフォルト) ならファイル全体を拒否、lenient ならその行を飛ばして取り込む"},
+	}, ScoreHandlerResult{}},
+	{http.MethodPost, "/api/organizer/import", "外部の形式の結果のCSVで大会のスコアを置き換える", RoleOrganizer, []apiParam{
+		{"format", "formData", "string", true, "race_timing, google_forms, kaggle のいずれか"},
+		{"competition_id", "formData", "string", true, "大会ID"},
+		{"results", "formData", "file", true, "結果のCSV"},
+		{"name_column", "formData", "string", false, "参加者の表示名の列名、形式ごとの候補の代わりに使う"},
+	}, ImportHandlerResult{}},
+	{http.MethodGet, "/api/organizer/score_rules", "スコアのファイルを取り込むときのスコアの範囲を取得する", RoleOrganizer, nil, ScoreRulesHandlerResult{}},
+	{http.MethodPost, "/api/organizer/score_rules", "スコアのファイルを取り込むときのスコアの範囲を設定する", RoleOrganizer, []apiParam{
+		{"min_score", "formData", "integer", false, "スコアの下限 (空なら制限しない)"},
+		{"max_score", "formData", "integer", false, "スコアの上限 (空なら制限しない)"},
+	}, ScoreRulesHandlerResult{}},
+	{http.MethodGet, "/api/organizer/billing", "テナントの大会ごとの課金レポートを取得する", RoleOrganizer, nil, BillingHandlerResult{}},
+	{http.MethodGet, "/api/organizer/billing.xlsx", "テナントの大会ごとの課金レポートをxlsxで取得する", RoleOrganizer, nil, apiFile{mimeXLSX}},
+	{http.MethodGet, "/api/organizer/invoices", "テナントの請求書の一覧を取得する", RoleOrganizer, nil, InvoicesHandlerResult{}},
+	{http.MethodGet, "/api/organizer/competitions", "大会の一覧を取得する", RoleOrganizer, withPageParams(
+		apiParam{"season_id", "query", "string", false, "このシーズンの大会だけを返す"},
+	), CompetitionsHandlerResult{}},
+	{http.MethodPost, "/api/organizer/competition/:competition_id/season", "大会の属するシーズンを変更する", RoleOrganizer, []apiParam{
+		{"competition_id", "path", "string", true, "大会ID"},
+		{"season_id", "formData", "string", false, "シーズンID (空ならどのシーズンにも属さない)"},
+	}, CompetitionsAddHandlerResult{}},
+	{http.MethodGet, "/api/organizer/competition/:competition_id/matches", "大会の対戦の結果と順位表を取得する", RoleOrganizer, []apiParam{
+		{"competition_id", "path", "string", true, "大会ID"},
+	}, MatchesHandlerResult{}},
+	{http.MethodPost, "/api/organizer/competition/:competition_id/matches/add", "対戦の結果を登録し、勝ち点で大会のスコアを置き換える", RoleOrganizer, []apiParam{
+		{"competition_id", "path", "string", true, "大会ID"},
+		{"player_a_id", "formData", "string", true, "参加者AのID"},
+		{"player_b_id", "formData", "string", true, "参加者BのID"},
+		{"score_a", "formData", "integer", true, "参加者Aの得点"},
+		{"score_b", "formData", "integer", true, "参加者Bの得点"},
+		{"played_at", "formData", "integer", false, "対戦した日時 (UNIX時間、省略時は登録した時刻)"},
+	}, MatchAddHandlerResult{}},
+	{http.MethodPost, "/api/organizer/competition/:competition_id/match/:match_id/delete", "対戦の結果を削除し、勝ち点で大会のスコアを置き換える", RoleOrganizer, []apiParam{
+		{"competition_id", "path", "string", true, "大会ID"},
+		{"match_id", "path", "string", true, "対戦の結果のID"},
+	}, nil},
+	{http.MethodGet, "/api/organizer/seasons", "シーズンの一覧を取得する", RoleOrganizer, nil, SeasonsHandlerResult{}},
+	{http.MethodPost, "/api/organizer/seasons/add", "シーズンを追加する", RoleOrganizer, seasonParams(), SeasonHandlerResult{}},
+	{http.MethodPost, "/api/organizer/season/:season_id", "シーズンの名前と集計方法を変更する", RoleOrganizer, seasonParams(
+		apiParam{"season_id", "path", "string", true, "シーズンID"},
+	), SeasonHandlerResult{}},
+	{http.MethodPost, "/api/organizer/season/:season_id/delete", "シーズンを削除する (属していた大会は残る)", RoleOrganizer, []apiParam{
+		{"season_id", "path", "string", true, "シーズンID"},
+	}, nil},
+	{http.MethodGet, "/api/organizer/season/:season_id/standings", "シーズンの通算の順位を取得する", RoleOrganizer, withPageParams(
+		apiParam{"season_id", "path", "string", true, "シーズンID"},
+	), SeasonStandingsHandlerResult{}},
+	{http.MethodGet, "/api/organizer/rating", "レーティングの設定を取得する", RoleOrganizer, nil, RatingSettingsHandlerResult{}},
+	{http.MethodPost, "/api/organizer/rating", "レーティングの設定を変更し、全ての結果から計算し直す", RoleOrganizer, []apiParam{
+		{"k_factor", "formData", "integer", false, "K係数 (空なら32)"},
+		{"initial_rating", "formData", "integer", false, "初期レーティング (空なら1500)"},
+	}, RatingSettingsHandlerResult{}},
+	{http.MethodPost, "/api/organizer/ratings/recompute", "全ての結果からレーティングを計算し直す", RoleOrganizer, nil, nil},
+	{http.MethodGet, "/api/organizer/ratings", "レーティングの高い順に参加者を取得する", RoleOrganizer, withPageParams(), RatingsHandlerResult{}},
+	{http.MethodGet, "/api/organizer/timezone", "テナントのタイムゾーンを取得する", RoleOrganizer, nil, TimezoneHandlerResult{}},
+	{http.MethodPost, "/api/organizer/timezone", "テナントのタイムゾーンを設定する", RoleOrganizer, []apiParam{
+		{"timezone", "formData", "string", false, "IANAのタイムゾーン名 (Asia/Tokyo など)、空なら日本時間"},
+	}, TimezoneHandlerResult{}},
+	{http.MethodGet, "/api/organizer/audit", "監査ログを新しい順に取得する", RoleOrganizer, withPageParams(), AuditLogHandlerResult{}},
+	{http.MethodGet, "/api/organizer/mail", "メールの通知先とテンプレートを取得する", RoleOrganizer, nil, MailSettingsHandlerResult{}},
+	{http.MethodPost, "/api/organizer/mail", "スコアのアップロードの失敗を通知するメールアドレスを設定する", RoleOrganizer, []apiParam{
+		{"organizer_email", "formData", "string", false, "テナント管理者のメールアドレス (空なら通知しない)"},
+	}, nil},
+	{http.MethodPost, "/api/organizer/mail/template/:kind", "メールのテンプレートを設定する", RoleOrganizer, []apiParam{
+		{"kind", "path", "string", true, "score_rejected, competition_finished"},
+		{"subject", "formData", "string", false, "件名のテンプレート (空ならデフォルト)"},
+		{"body", "formData", "string", false, "本文のテンプレート (空ならデフォルト)"},
+	}, nil},
+	{http.MethodGet, "/api/organizer/mail/outbox", "送信したメールを取得する", RoleOrganizer, []apiParam{
+		{"before", "query", "string", false, "このIDより前のメールを返す"},
+	}, MailOutboxHandlerResult{}},
+	{http.MethodPost, "/api/organizer/player/:player_id/email", "参加者のメールアドレスを登録する", RoleOrganizer, []apiParam{
+		{"player_id", "path", "string", true, "参加者ID"},
+		{"email", "formData", "string", false, "メールアドレス (空なら削除)"},
+	}, nil},
+	{http.MethodGet, "/api/organizer/chat", "SlackやDiscordのIncoming WebhookのURLを取得する", RoleOrganizer, nil, ChatSettingsHandlerResult{}},
+	{http.MethodPost, "/api/organizer/chat", "SlackやDiscordのIncoming WebhookのURLを設定する", RoleOrganizer, []apiParam{
+		{"webhook_url", "formData", "string", false, "Incoming WebhookのURL (空なら投稿しない)"},
+		{"test", "formData", "string", false, "1ならテストのメッセージを投稿して確認する"},
+	}, nil},
+	{http.MethodGet, "/api/organizer/webhooks", "Webhookの送信先の一覧を取得する", RoleOrganizer, nil, WebhooksHandlerResult{}},
+	{http.MethodPost, "/api/organizer/webhooks/add", "Webhookの送信先を登録する", RoleOrganizer, []apiParam{
+		{"url", "formData", "string", true, "送信先のURL (httpsのみ)"},
+		{"events", "formData", "string", false, "送信するイベントのカンマ区切り (省略時は全て)"},
+		{"format", "formData", "string", false, "full (署名付きの完全な形式), simple (dataを展開したフラットな形式) (省略時はfull)"},
+	}, WebhookAddHandlerResult{}},
+	{http.MethodPost, "/api/organizer/webhook/:webhook_id/delete", "Webhookの送信先を削除する", RoleOrganizer, []apiParam{
+		{"webhook_id", "path", "string", true, "WebhookのID"},
+	}, nil},
+	{http.MethodGet, "/api/organizer/webhook/:webhook_id/deliveries", "Webhookの送信履歴を取得する", RoleOrganizer, []apiParam{
+		{"webhook_id", "path", "string", true, "WebhookのID"},
+		{"before", "query", "string", false, "このIDより前の送信履歴を返す"},
+	}, WebhookDeliveriesHandlerResult{}},
+	{http.MethodPost, "/api/organizer/webhook/:webhook_id/delivery/:delivery_id/retry", "deadになった送信をやり直す", RoleOrganizer, []apiParam{
+		{"webhook_id", "path", "string", true, "WebhookのID"},
+		{"delivery_id", "path", "string", true, "送信のID"},
+	}, nil},
+	{http.MethodGet, "/api/organizer/api_tokens", "読み取り専用のAPIトークンの一覧を取得する", RoleOrganizer, nil, APITokensHandlerResult{}},
+	{http.MethodPost, "/api/organizer/api_tokens/add", "読み取り専用のAPIトークンを発行する", RoleOrganizer, []apiParam{
+		{"name", "formData", "string", true, "用途がわかる名前"},
+	}, APITokenAddHandlerResult{}},
+	{http.MethodPost, "/api/organizer/api_token/:token_id/revoke", "APIトークンを失効させる", RoleOrganizer, []apiParam{
+		{"token_id", "path", "string", true, "APIトークンのID"},
+	}, nil},
+	{http.MethodGet, "/api/organizer/embed", "埋め込み用のスコアボードを呼べるOriginを取得する", RoleOrganizer, nil, EmbedSettingsHandlerResult{}},
+	{http.MethodPost, "/api/organizer/embed", "埋め込み用のスコアボードを呼べるOriginを設定する", RoleOrganizer, []apiParam{
+		{"allowed_origins", "formData", "string", false, "Originのカンマ区切り (*なら全て、空ならCORSのヘッダを返さない)"},
+	}, nil},
+	{http.MethodGet, "/api/organizer/cors", "APIを呼べるOriginを取得する", RoleOrganizer, nil, CORSSettingsHandlerResult{}},
+	{http.MethodPost, "/api/organizer/cors", "APIを呼べるOriginを設定する", RoleOrganizer, []apiParam{
+		{"allowed_origins", "formData", "string", false, "Originのカンマ区切り (*は指定できない、空ならCORSのヘッダを返さない)"},
+	}, nil},
+	{http.MethodGet, "/api/organizer/sso", "SSOの設定とログインできるIdPのユーザーを取得する", RoleOrganizer, nil, SSOSettingsHandlerResult{}},
+	{http.MethodPost, "/api/organizer/sso", "SSOのIdPを設定する", RoleOrganizer, []apiParam{
+		{"issuer", "formData", "string", false, "OpenID ConnectのIssuerのURL (空ならSSOを使わない)"},
+		{"client_id", "formData", "string", false, "クライアントID"},
+		{"client_secret", "formData", "string", false, "クライアントシークレット (省略時は設定済みの値)"},
+	}, nil},
+	{http.MethodPost, "/api/organizer/sso/identities/add", "SSOでログインできるIdPのユーザーを登録する", RoleOrganizer, []apiParam{
+		{"subject", "formData", "string", false, "IdPのsub (subjectかemailのどちらかを指定する)"},
+		{"email", "formData", "string", false, "IdPが確認済みのメールアドレス"},
+		{"organizer_id", "formData", "string", false, "発行するJWTのsub (省略時はsubjectかemail)"},
+	}, SSOIdentityAddHandlerResult{}},
+	{http.MethodPost, "/api/organizer/sso/identity/:identity_id/delete", "SSOでログインできるIdPのユーザーを削除する", RoleOrganizer, []apiParam{
+		{"identity_id", "path", "string", true, "ID"},
+	}, nil},
+	{http.MethodGet, "/api/organizer/scim", "SCIMのエンドポイントとトークンを発行済みかを取得する", RoleOrganizer, nil, SCIMSettingsHandlerResult{}},
+	{http.MethodPost, "/api/organizer/scim/token", "SCIMのトークンを発行する", RoleOrganizer, []apiParam{
+		{"disable", "formData", "string", false, "1ならトークンを削除してSCIMを使えなくする"},
+	}, SCIMSettingsHandlerResult{}},
+
+	// 参加者向けAPI
+	{http.MethodGet, "/api/player/player/:player_id", "参加者と大会ごとのスコアを取得する", RolePlayer, []apiParam{
+		{"player_id", "path", "string", true, "参加者ID"},
+	}, PlayerHandlerResult{}},
+	{http.MethodGet, "/api/player/competition/:competition_id/ranking", "大会のランキングを取得する", RolePlayer, withPageParams(
+		apiParam{"competition_id", "path", "string", true, "大会ID"},
+		apiParam{"rank_after", "query", "integer", false, "この順位より後を返す (cursorを使うこと)"},
+		apiParam{"format", "query", "string", false, "csvを指定するとCSVで返す"},
+	), CompetitionRankingHandlerResult{}},
+	{http.MethodGet, "/api/player/competitions", "大会の一覧を取得する", RolePlayer, withPageParams(
+		apiParam{"season_id", "query", "string", false, "このシーズンの大会だけを返す"},
+	), CompetitionsHandlerResult{}},
+	{http.MethodGet, "/api/player/ratings", "レーティングの高い順に参加者を取得する", RolePlayer, withPageParams(), RatingsHandlerResult{}},
+	{http.MethodGet, "/api/player/seasons", "シーズンの一覧を取得する", RolePlayer, nil, SeasonsHandlerResult{}},
+	{http.MethodGet, "/api/player/season/:season_id/standings", "シーズンの通算の順位を取得する", RolePlayer, withPageParams(
+		apiParam{"season_id", "path", "string", true, "シーズンID"},
+	), SeasonStandingsHandlerResult{}},
+	{http.MethodGet, "/api/player/competitions.ics", "大会の一覧をiCalendar形式で取得する", RolePlayer, []apiParam{
+		{"token", "query", "string", false, "APIトークン (Cookieを送れないカレンダーアプリ向け)"},
+	}, apiFile{"text/calendar"}},
+	{http.MethodGet, "/api/player/me/export", "自分について保存しているデータを全て取得する", RolePlayer, []apiParam{
+		{"format", "query", "string", false, "csvを指定するとCSVをまとめたzipで返す"},
+	}, PlayerExport{}},
+
+	// 埋め込み用API
+	{http.MethodGet, "/embed/competition/:competition_id/ranking", "大会のランキングの上位を取得する", RoleReader, []apiParam{
+		{"competition_id", "path", "string", true, "大会ID"},
+		{"limit", "query", "integer", false, "件数 (デフォルト20、最大100)"},
+		{"token", "query", "string", false, "APIトークン (Authorizationヘッダを送れない場合)"},
+	}, EmbedRankingHandlerResult{}},
+
+	// SCIM (RFC 7644、レスポンスはSCIMの形式でSCIMのトークンで認証する)
+	{http.MethodGet, "/scim/v2/ServiceProviderConfig", "SCIMで対応している機能を取得する", "", nil, apiFile{"application/scim+json"}},
+	{http.MethodGet, "/scim/v2/Users", "参加者の一覧を取得する", "", []apiParam{
+		{"filter", "query", "string", false, `userName eq "..." か externalId eq "..."`},
+		{"startIndex", "query", "integer", false, "1から始まる位置"},
+		{"count", "query", "integer", false, "件数"},
+	}, apiFile{"application/scim+json"}},
+	{http.MethodPost, "/scim/v2/Users", "参加者を追加する", "", nil, apiFile{"application/scim+json"}},
+	{http.MethodGet, "/scim/v2/Users/:id", "参加者を取得する", "", []apiParam{
+		{"id", "path", "string", true, "参加者ID"},
+	}, apiFile{"application/scim+json"}},
+	{http.MethodPut, "/scim/v2/Users/:id", "参加者を置き換える", "", []apiParam{
+		{"id", "path", "string", true, "参加者ID"},
+	}, apiFile{"application/scim+json"}},
+	{http.MethodPatch, "/scim/v2/Users/:id", "参加者の属性を変更する (active=falseで失格)", "", []apiParam{
+		{"id", "path", "string", true, "参加者ID"},
+	}, apiFile{"application/scim+json"}},
+	{http.MethodDelete, "/scim/v2/Users/:id", "参加者を失格にする", "", []apiParam{
+		{"id", "path", "string", true, "参加者ID"},
+	}, nil},
+
+	// SSO (成功するとリダイレクトする)
+	{http.MethodGet, "/auth/sso/login", "テナントのIdPにリダイレクトする", "", []apiParam{
+		{"redirect", "query", "string", false, "ログイン後に戻るパス"},
+	}, nil},
+	{http.MethodGet, "/auth/sso/callback", "IdPからのリダイレクトを受けてJWTをCookieに設定する", "", []apiParam{
+		{"code", "query", "string", true, "認可コード"},
+		{"state", "query", "string", true, "state"},
+	}, nil},
+
+	// Stripe (Stripe-Signatureヘッダで認証する)
+	{http.MethodPost, "/stripe/webhook", "Stripeから請求書の支払いの結果を受け取る", "", nil, nil},
+
+	// フィード
+	{http.MethodGet, "/feeds/competitions.atom", "最近終了した大会をAtom形式で取得する", RolePlayer, []apiParam{
+		{"token", "query", "string", false, "APIトークン (Cookieを送れないフィードリーダー向け)"},
+	}, apiFile{"application/atom+xml"}},
+
+	// GraphQL (graphql.go を参照、レスポンスはGraphQLの {"data", "errors"} の形式)
+	// ロールによって参照できるフィールドが異なる (graphql/schema.graphql を参照)
+	{http.MethodGet, "/api/graphql", "GraphQLのクエリを実行する", RoleOrganizer + ", " + RolePlayer, []apiParam{
+		{"query", "query", "string", true, "クエリ"},
+		{"operationName", "query", "string", false, "実行する操作の名前"},
+		{"variables", "query", "string", false, "変数 (JSONのオブジェクト)"},
+	}, apiFile{"application/json"}},
+	{http.MethodPost, "/api/graphql", "GraphQLのクエリを実行する (ボディは {\"query\", \"operationName\", \"variables\"} のJSON)", RoleOrganizer + ", " + RolePlayer, nil, apiFile{"application/json"}},
+
+	// 全ロール
+	{http.MethodGet, "/api/me", "ログイン中のユーザーの情報を取得する", "", nil, MeHandlerResult{}},
+
+	// ベンチマーカー向けAPI
+	{http.MethodPost, "/initialize", "データベースを初期化する", "", nil, InitializeHandlerResult{}},
+}
+
+// 読み取り専用のAPIトークンでも使えるAPI (apitoken.go を参照)
+var apiTokenReadablePaths = map[string]bool{
+	"/api/player/competition/:competition_id/ranking": true,
+	"/api/player/competitions":                        true,
+	"/api/player/competitions.ics":                    true,
+	"/feeds/competitions.atom":                        true,
+	"/api/graphql":                                    true,
+}
+
+// 構造体からJSON Schemaを作る
+// 同じ型はcomponents/schemasに1つだけ定義して$refで参照する
+type openAPISchemas map[string]any
+
+func (s openAPISchemas) schemaOf(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": s.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.PkgPath() == "time" && t.Name() == "Time" {
+			return map[string]any{"type": "string", "format": "date-time"}
+		}
+		if _, ok := s[t.Name()]; !ok {
+			// 再帰的な型に備えて先に登録しておく
+			s[t.Name()] = nil
+			s[t.Name()] = s.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+func (s openAPISchemas) structSchema(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || !f.IsExported() && !f.Anonymous {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		// 埋め込みの構造体はフィールドを展開する
+		if f.Anonymous && name == "" {
+			if sub, ok := s.structSchema(f.Type)["properties"].(map[string]any); ok {
+				for k, v := range sub {
+					props[k] = v
+				}
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = s.schemaOf(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// OpenAPI 3.0の定義を作る
+func buildOpenAPI() map[string]any {
+	schemas := openAPISchemas{}
+	failure := schemas.schemaOf(reflect.TypeOf(FailureResult{}))
+	paths := map[string]map[string]any{}
+	for _, op := range apiOperations {
+		// echoの :param をOpenAPIの {param} にする
+		segs := strings.Split(op.path, "/")
+		for i, seg := range segs {
+			if strings.HasPrefix(seg, ":") {
+				segs[i] = "{" + seg[1:] + "}"
+			}
+		}
+		path := strings.Join(segs, "/")
+
+		success := map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"status": map[string]any{"type": "boolean"},
+			},
+			"required": []string{"status"},
+		}
+		if _, isFile := op.result.(apiFile); op.result != nil && !isFile {
+			success["properties"].(map[string]any)["data"] = schemas.schemaOf(reflect.TypeOf(op.result))
+		}
+
+		var (
+			params    []map[string]any
+			formProps = map[string]any{}
+			formReq   []string
+			hasFile   bool
+		)
+		for _, p := range op.params {
+			if p.in == "formData" {
+				if p.typ == "file" {
+					hasFile = true
+					formProps[p.name] = map[string]any{"type": "string", "format": "binary", "description": p.desc}
+				} else {
+					formProps[p.name] = map[string]any{"type": p.typ, "description": p.desc}
+				}
+				if p.required {
+					formReq = append(formReq, p.name)
+				}
+				continue
+			}
+			params = append(params, map[string]any{
+				"name":        p.name,
+				"in":          p.in,
+				"required":    p.required,
+				"description": p.desc,
+				"schema":      map[string]any{"type": p.typ},
+			})
+		}
+
+		ok := map[string]any{"description": "成功", "content": jsonContent(success)}
+		if f, isFile := op.result.(apiFile); isFile {
+			ok["content"] = map[string]any{
+				f.contentType: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}},
+			}
+		}
+		operation := map[string]any{
+			"summary": op.summary,
+			"responses": map[string]any{
+				"200":     ok,
+				"default": map[string]any{"description": "失敗", "content": jsonContent(failure)},
+			},
+		}
+		if op.role != "" {
+			operation["description"] = "ロール: " + op.role
+			operation["security"] = []map[string][]string{{"cookieAuth": {}}}
+			if op.role == RoleReader {
+				operation["security"] = []map[string][]string{{"apiToken": {}}}
+			}
+			if apiTokenReadablePaths[op.path] {
+				operation["description"] = "ロール: " + op.role + ", " + RoleReader
+				operation["security"] = []map[string][]string{{"cookieAuth": {}}, {"apiToken": {}}}
+			}
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if len(formProps) > 0 {
+			contentType := "application/x-www-form-urlencoded"
+			if hasFile {
+				contentType = "multipart/form-data"
+			}
+			form := map[string]any{"type": "object", "properties": formProps}
+			if len(formReq) > 0 {
+				form["required"] = formReq
+			}
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{contentType: map[string]any{"schema": form}},
+			}
+		}
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(op.method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "ISUPORTS API",
+			"version": "1.0.0",
+			// v2の差分は apiV2Transforms を参照
+			"description": "/api/v2/ 以下では、ページングの情報をトップレベルのpaginationで、*_at の日時をRFC3339の文字列で返す",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				// JWTは isuports_session Cookie で送る
+				"cookieAuth": map[string]any{"type": "apiKey", "in": "cookie", "name": "isuports_session"},
+				// 読み取り専用のAPIトークンは Authorization: Bearer で送る
+				"apiToken": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIJSON []byte
+)
+
+// 誰でも参照できるAPI
+// OpenAPIの定義を返す
+// GET /api/openapi.json
+func openAPIHandler(c echo.Context) error {
+	openAPIOnce.Do(func() {
+		openAPIJSON, _ = json.MarshalIndent(buildOpenAPI(), "", "  ")
+	})
+	return c.JSONBlob(http.StatusOK, openAPIJSON)
+}
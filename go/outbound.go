@@ -0,0 +1,84 @@
+package isuports
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// テナントが指定したURLへの接続
+// Webhook、チャットへの投稿、SSOのIdP、URLからのスコアの取り込みはテナントが指定した宛先にサーバーから接続するので、
+// 内部のネットワークやメタデータサービスに届かないよう、名前解決した後の接続先のアドレスを接続の直前に検査する
+// リダイレクト先やDNSの応答が変わった場合も拒否できる
+
+// 開発環境などでプライベートなアドレスへの接続を許す
+var outboundAllowPrivate = getEnv("ISUCON_OUTBOUND_ALLOW_PRIVATE", "0") == "1"
+
+// 接続を拒否するアドレス
+// グローバルに到達できない特殊用途のアドレス (RFC 6890 など) と、IPv4のアドレスを埋め込んで内部に届きうるIPv6の範囲
+var outboundBlockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // this network
+	netip.MustParsePrefix("10.0.0.0/8"),      // private
+	netip.MustParsePrefix("100.64.0.0/10"),   // CGNAT
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link local (クラウドのメタデータサービスを含む)
+	netip.MustParsePrefix("172.16.0.0/12"),   // private
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // TEST-NET-1
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("192.168.0.0/16"),  // private
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // TEST-NET-2
+	netip.MustParsePrefix("203.0.113.0/24"),  // TEST-NET-3
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, broadcast
+	netip.MustParsePrefix("::/128"),          // unspecified
+	netip.MustParsePrefix("::1/128"),         // loopback
+	netip.MustParsePrefix("::/96"),           // IPv4-compatible (deprecated)
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("100::/64"),        // discard
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments (Teredoを含む)
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4
+	netip.MustParsePrefix("fc00::/7"),        // unique local
+	netip.MustParsePrefix("fe80::/10"),       // link local
+	netip.MustParsePrefix("fec0::/10"),       // site local (deprecated)
+	netip.MustParsePrefix("ff00::/8"),        // multicast
+}
+
+// 接続してよいアドレスか
+func outboundAddrAllowed(addr netip.Addr) bool {
+	// IPv4射影アドレス (::ffff:a.b.c.d) はIPv4として調べる
+	addr = addr.Unmap()
+	for _, p := range outboundBlockedPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// 接続先のアドレスを検査するnet.DialerのControl
+type outboundGuard struct {
+	allowPrivate bool
+}
+
+// テナントが指定したURLへの接続で使う
+var outboundDialGuard = outboundGuard{allowPrivate: outboundAllowPrivate}
+
+func (g outboundGuard) control(network, address string, _ syscall.RawConn) error {
+	if g.allowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !outboundAddrAllowed(addr) {
+		return fmt.Errorf("connection to %s is not allowed", host)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package isuports
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestOutboundAddrAllowed(t *testing.T) {
+	cases := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"10.1.2.3", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"172.31.0.1", false},
+		{"192.168.1.1", false},
+		{"198.18.0.1", false},
+		{"0.0.0.0", false},
+		{"255.255.255.255", false},
+		{"::1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:8.8.8.8", true},
+		{"64:ff9b::a00:1", false},
+		{"2002:a00:1::", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+	}
+	for _, tc := range cases {
+		if got := outboundAddrAllowed(netip.MustParseAddr(tc.addr)); got != tc.want {
+			t.Errorf("outboundAddrAllowed(%s) = %v, want %v", tc.addr, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package isuports
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 一覧を返すAPIのページング
+// どの一覧も cursor と limit を受け取り、data.pagination に前後のページのカーソルとURLを返す
+// 同じURLはLinkヘッダ (rel="next", rel="prev") でも返す
+// カーソルはエンドポイントごとの位置をbase64urlにしたもので、クライアントは中身を解釈しないこと
+// 以前からある rank_after, before も互換のため受け付ける
+
+type PaginationLinks struct {
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+type Pagination struct {
+	NextCursor string          `json:"next_cursor,omitempty"` // 空なら次のページはない
+	PrevCursor string          `json:"prev_cursor,omitempty"` // 空なら前のページはない
+	Total      *int64          `json:"total,omitempty"`       // 件数がすぐにわかる一覧だけ返す
+	Links      PaginationLinks `json:"links"`
+}
+
+// ページングの指定
+type pageParams struct {
+	cursor string // デコード済みのカーソル、空なら先頭から
+	limit  int    // 0なら全件
+}
+
+// cursorとlimitを読む
+// limitを省略した場合はdefaultLimit (0なら全件)、maxLimitを超える場合はmaxLimitにする
+func parsePageParams(c echo.Context, defaultLimit, maxLimit int) (pageParams, error) {
+	p := pageParams{limit: defaultLimit}
+	if s := c.QueryParam("cursor"); s != "" {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return p, echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+		}
+		p.cursor = string(b)
+	}
+	if s := c.QueryParam("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			return p, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid limit: %s", s))
+		}
+		p.limit = limit
+	}
+	if maxLimit > 0 && p.limit > maxLimit {
+		p.limit = maxLimit
+	}
+	return p, nil
+}
+
+func encodeCursor(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// 先頭からの位置でページングする
+// カーソルを指定していなければlegacyOffsetから始める
+// 返したページの範囲 [start, end) と前後のページを返す
+func offsetPage(p pageParams, legacyOffset int64, total int) (int, int, Pagination, error) {
+	start := int(legacyOffset)
+	if p.cursor != "" {
+		offset, err := strconv.Atoi(p.cursor)
+		if err != nil || offset < 0 {
+			return 0, 0, Pagination{}, echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+		}
+		start = offset
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > total {
+		start = total
+	}
+	end := total
+	if p.limit > 0 && start+p.limit < total {
+		end = start + p.limit
+	}
+
+	t := int64(total)
+	pg := Pagination{Total: &t}
+	if end < total {
+		pg.NextCursor = encodeCursor(strconv.Itoa(end))
+	}
+	if start > 0 {
+		prev := 0
+		if p.limit > 0 && start-p.limit > 0 {
+			prev = start - p.limit
+		}
+		pg.PrevCursor = encodeCursor(strconv.Itoa(prev))
+	}
+	return start, end, pg, nil
+}
+
+// 前後のページのURLを作り、Linkヘッダにも設定する
+// legacyParamsに指定したクエリパラメータはカーソルと矛盾するので取り除く
+func (pg *Pagination) setLinks(c echo.Context, legacyParams ...string) {
+	link := func(cursor string) string {
+		u := *c.Request().URL
+		u.Path, u.RawPath = versionedAPIPath(c, u.Path), ""
+		q := u.Query()
+		for _, k := range legacyParams {
+			q.Del(k)
+		}
+		q.Set("cursor", cursor)
+		u.RawQuery = q.Encode()
+		return u.RequestURI()
+	}
+	var header []string
+	if pg.NextCursor != "" {
+		pg.Links.Next = link(pg.NextCursor)
+		header = append(header, fmt.Sprintf(`<%s>; rel="next"`, pg.Links.Next))
+	}
+	if pg.PrevCursor != "" {
+		pg.Links.Prev = link(pg.PrevCursor)
+		header = append(header, fmt.Sprintf(`<%s>; rel="prev"`, pg.Links.Prev))
+	}
+	if len(header) > 0 {
+		c.Response().Header().Set("Link", strings.Join(header, ", "))
+	}
+}
@@ -2,20 +2,12 @@ package isuports
 
 import (
 	"context"
-	"database/sql"
-	"errors"
 	"fmt"
 	"net/http"
 	"sort"
 	"strconv"
-	"time"
 
 	"github.com/labstack/echo/v4"
-	"github.com/logica0419/helpisu"
-)
-
-var (
-	visitHistories = helpisu.NewCache[int, []VisitHistoryRow]()
 )
 
 type PlayerScoreDetail struct {
@@ -26,13 +18,15 @@ type PlayerScoreDetail struct {
 type PlayerHandlerResult struct {
 	Player PlayerDetail        `json:"player"`
 	Scores []PlayerScoreDetail `json:"scores"`
+	// まだ結果のない参加者は返さない (rating.go を参照)
+	Rating *PlayerRatingDetail `json:"rating,omitempty"`
 }
 
 // 参加者向けAPI
 // GET /api/player/player/:player_id
 // 参加者の詳細情報を取得する
 func playerHandler(c echo.Context) error {
-	ctx := context.Background()
+	ctx := c.Request().Context()
 
 	v, err := parseViewer(c)
 	if err != nil {
@@ -42,12 +36,13 @@ func playerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "role player required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
+	defer tenantDB.Close()
 
-	if err := authorizePlayer(ctx, tenantDB, v.playerID); err != nil {
+	if err := authorizePlayer(ctx, tenantDB, v.tenantID, v.playerID); err != nil {
 		return err
 	}
 
@@ -55,11 +50,8 @@ func playerHandler(c echo.Context) error {
 	if playerID == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "player_id is required")
 	}
-	p, err := retrievePlayer(ctx, tenantDB, playerID)
+	p, err := retrievePlayer(ctx, tenantDB, v.tenantID, playerID)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "player not found")
-		}
 		return fmt.Errorf("error retrievePlayer: %w", err)
 	}
 	// cs := []CompetitionRow{}
@@ -72,21 +64,58 @@ func playerHandler(c echo.Context) error {
 	// 	return fmt.Errorf("error Select competition: %w", err)
 	// }
 
-	type Row struct {
-		Score  int64  `db:"score"`
-		Title  string `db:"title"`
-		CompID string `db:"comp_id"`
+	scores, err := loadPlayerScores(ctx, tenantDB, v.tenantID, p.ID)
+	if err != nil {
+		return err
+	}
+	psds := make([]PlayerScoreDetail, 0, len(scores))
+	for _, ps := range scores {
+		psds = append(psds, PlayerScoreDetail{
+			CompetitionTitle: ps.Title,
+			Score:            ps.Score,
+		})
 	}
 
+	var rating *PlayerRatingDetail
+	if r, err := retrievePlayerRating(ctx, tenantDB, v.tenantID, p.ID); err != nil {
+		return err
+	} else if r != nil {
+		d := newPlayerRatingDetail(r)
+		rating = &d
+	}
+
+	loc, err := tenantLocation(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	res := SuccessResult{
+		Status: true,
+		Data: PlayerHandlerResult{
+			Player: newPlayerDetail(p, loc),
+			Scores: psds,
+			Rating: rating,
+		},
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// 参加者が大会ごとに最後に登録したスコア
+type playerCompetitionScore struct {
+	Score  int64  `db:"score"`
+	Title  string `db:"title"`
+	CompID string `db:"comp_id"`
+}
+
+// 参加者のスコアを大会の作成日時の昇順で返す
+// GET /api/player/player/:player_id とGraphQLの Player.scores (graphql.go を参照) で使う
+func loadPlayerScores(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, playerID string) ([]playerCompetitionScore, error) {
 	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
-	fl, err := flockByTenantID(v.tenantID)
+	fl, err := lockTenant(ctx, tenantID, lockRead)
 	if err != nil {
-		return fmt.Errorf("error flockByTenantID: %w", err)
+		return nil, fmt.Errorf("error lockTenant: %w", err)
 	}
 	defer fl.Close()
-	pss := make([]Row, 0, 10000)
-	// for _, c := range cs {
-	// ps := PlayerScoreRow{}
+	pss := make([]playerCompetitionScore, 0, 10000)
 	if err := tenantDB.SelectContext(
 		ctx,
 		&pss,
@@ -95,47 +124,21 @@ func playerHandler(c echo.Context) error {
 			"FROM player_score JOIN competition ON competition.id = player_score.competition_id "+
 			"WHERE player_score.tenant_id = ? AND player_score.player_id = ? "+
 			"ORDER BY competition.created_at ASC, player_score.competition_id ASC, player_score.row_num DESC",
-		v.tenantID,
-		p.ID,
+		tenantID,
+		playerID,
 	); err != nil {
-		// // 行がない = スコアが記録されてない
-		// if errors.Is(err, sql.ErrNoRows) {
-		// 	continue
-		// }
-		return fmt.Errorf("error Select player_score: tenantID=%d, playerID=%s, %w", v.tenantID, p.ID, err)
+		return nil, fmt.Errorf("error Select player_score: tenantID=%d, playerID=%s, %w", tenantID, playerID, err)
 	}
-	// pss = append(pss, ps)
-	// }
 
-	psds := make([]PlayerScoreDetail, 0, len(pss))
+	scores := make([]playerCompetitionScore, 0, len(pss))
 	curCompID := ""
 	for _, ps := range pss {
-		// comp, err := retrieveCompetition(ctx, tenantDB, ps.CompetitionID)
-		// if err != nil {
-		// 	return fmt.Errorf("error retrieveCompetition: %w", err)
-		// }
 		if ps.CompID != curCompID {
 			curCompID = ps.CompID
-
-			psds = append(psds, PlayerScoreDetail{
-				CompetitionTitle: ps.Title,
-				Score:            ps.Score,
-			})
+			scores = append(scores, ps)
 		}
 	}
-
-	res := SuccessResult{
-		Status: true,
-		Data: PlayerHandlerResult{
-			Player: PlayerDetail{
-				ID:             p.ID,
-				DisplayName:    p.DisplayName,
-				IsDisqualified: p.IsDisqualified,
-			},
-			Scores: psds,
-		},
-	}
-	return c.JSON(http.StatusOK, res)
+	return scores, nil
 }
 
 type CompetitionRank struct {
@@ -148,74 +151,146 @@ type CompetitionRank struct {
 
 type CompetitionRankingHandlerResult struct {
 	Competition CompetitionDetail `json:"competition"`
+	Pagination  Pagination        `json:"pagination"`
 	Ranks       []CompetitionRank `json:"ranks"`
 }
 
-var tenantCache = helpisu.NewCache[int64, struct{}]()
+type CompetitionRankingRequest struct {
+	CompetitionID string `param:"competition_id" validate:"required"`
+	RankAfter     int64  `query:"rank_after" validate:"min=0"`
+}
 
 // 参加者向けAPI
 // GET /api/player/competition/:competition_id/ranking
 // 大会ごとのランキングを取得する
 func competitionRankingHandler(c echo.Context) error {
-	ctx := context.Background()
+	ctx := c.Request().Context()
 	v, err := parseViewer(c)
 	if err != nil {
 		return err
 	}
-	if v.role != RolePlayer {
+	// 読み取り専用のAPIトークンでも取得できる
+	if v.role != RolePlayer && v.role != RoleReader {
 		return echo.NewHTTPError(http.StatusForbidden, "role player required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
+	defer tenantDB.Close()
 
-	if err := authorizePlayer(ctx, tenantDB, v.playerID); err != nil {
-		return err
+	if v.role == RolePlayer {
+		if err := authorizePlayer(ctx, tenantDB, v.tenantID, v.playerID); err != nil {
+			return err
+		}
 	}
 
-	competitionID := c.Param("competition_id")
-	if competitionID == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "competition_id is required")
+	var req CompetitionRankingRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
+	competitionID := req.CompetitionID
 
 	// 大会の存在確認
-	competition, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	competition, err := retrieveCompetition(ctx, tenantDB, v.tenantID, competitionID)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "competition not found")
-		}
 		return fmt.Errorf("error retrieveCompetition: %w", err)
 	}
 
-	now := time.Now().Unix()
+	now := srv(ctx).clock.Now().Unix()
 	var tenant TenantRow
-	_, ok := tenantCache.Get(v.tenantID)
+	_, ok := srv(ctx).tenantCache.Get(v.tenantID)
 	if !ok {
-		if err := adminDB.GetContext(ctx, &tenant, "SELECT id FROM tenant WHERE id = ?", v.tenantID); err != nil {
+		if err := srv(ctx).adminDB.GetContext(ctx, &tenant, "SELECT id FROM tenant WHERE id = ?", v.tenantID); err != nil {
 			return fmt.Errorf("error Select tenant: id=%d, %w", v.tenantID, err)
 		}
 	} else {
 		tenant.ID = v.tenantID
 	}
 
-	visitHistory, _ := visitHistories.Get(0)
-	visitHistory = append(visitHistory, VisitHistoryRow{v.playerID, tenant.ID, competitionID, now, now})
-	visitHistories.Set(0, visitHistory)
+	// APIトークンでの閲覧は参加者の訪問ではないので課金の対象にしない
+	if v.role == RolePlayer {
+		srv(ctx).visits.record(VisitHistoryRow{v.playerID, tenant.ID, competitionID, now, now})
+	}
+
+	rankAfter := req.RankAfter
+	page, err := parsePageParams(c, 100, 1000)
+	if err != nil {
+		return err
+	}
+
+	ranks, err := competitionRanks(ctx, tenantDB, tenant.ID, competitionID)
+	if err != nil {
+		return err
+	}
+	start, end, pg, err := offsetPage(page, rankAfter, len(ranks))
+	if err != nil {
+		return err
+	}
+	pg.setLinks(c, "rank_after")
 
-	var rankAfter int64
-	rankAfterStr := c.QueryParam("rank_after")
-	if rankAfterStr != "" {
-		if rankAfter, err = strconv.ParseInt(rankAfterStr, 10, 64); err != nil {
-			return fmt.Errorf("error strconv.ParseUint: rankAfterStr=%s, %w", rankAfterStr, err)
+	// CompetitionRankingHandlerResultの形でストリーミングで返す
+	loc, err := tenantLocation(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	competitionDetail := newCompetitionDetail(competition, loc)
+	fields := []streamField{
+		{Key: "competition", Value: competitionDetail},
+		{Key: "pagination", Value: pg},
+	}
+	return streamSuccessListOrCSV(c, fields, "ranks", competitionRankCSVColumns, func(emit func(v any) error) error {
+		for i := start; i < end; i++ {
+			rank := ranks[i]
+			if err := emit(CompetitionRank{
+				Rank:              int64(i + 1),
+				Score:             rank.Score,
+				PlayerID:          rank.PlayerID,
+				PlayerDisplayName: rank.PlayerDisplayName,
+			}); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+}
+
+// ランキングをCSVで返す場合の列
+var competitionRankCSVColumns = csvColumns{
+	header: []string{"rank", "score", "player_id", "player_display_name"},
+	record: func(v any) []string {
+		r := v.(CompetitionRank)
+		return []string{strconv.FormatInt(r.Rank, 10), strconv.FormatInt(r.Score, 10), r.PlayerID, r.PlayerDisplayName}
+	},
+}
+
+// player_scoreから大会のランキングを作る
+// 大会のランキングを順位順に返す
+// ライブモードの大会はメモリ上のランキング、それ以外は同じ大会への同時アクセスをまとめてplayer_scoreから作る
+// 返したスライスは他のリクエストと共有しているので書き換えないこと
+func competitionRanks(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, competitionID string) ([]CompetitionRank, error) {
+	ranks, ok, err := srv(ctx).liveScores.ranks(ctx, tenantDB, tenantID, competitionID)
+	if err != nil {
+		return nil, err
 	}
+	if ok {
+		return ranks, nil
+	}
+	return srv(ctx).rankingFlight.Do(
+		ctx,
+		fmt.Sprintf("%d/%s", tenantID, competitionID),
+		func(ctx context.Context) ([]CompetitionRank, error) {
+			return loadCompetitionRanks(ctx, tenantDB, tenantID, competitionID)
+		},
+	)
+}
 
+func loadCompetitionRanks(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, competitionID string) ([]CompetitionRank, error) {
 	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
-	fl, err := flockByTenantID(v.tenantID)
+	fl, err := lockTenant(ctx, tenantID, lockRead)
 	if err != nil {
-		return fmt.Errorf("error flockByTenantID: %w", err)
+		return nil, fmt.Errorf("error lockTenant: %w", err)
 	}
 	defer fl.Close()
 	pss := []PlayerScoreRow{}
@@ -223,23 +298,34 @@ func competitionRankingHandler(c echo.Context) error {
 		ctx,
 		&pss,
 		"SELECT * FROM player_score WHERE tenant_id = ? AND competition_id = ? ORDER BY row_num DESC",
-		tenant.ID,
+		tenantID,
 		competitionID,
 	); err != nil {
-		return fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", tenant.ID, competitionID, err)
+		return nil, fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
 	}
+	return buildCompetitionRanks(ctx, tenantDB, pss)
+}
+
+// スコアの行から順位順に並んだランキングを作る
+// pssは同一player_id内でrow_numの降順に並んでいること
+func buildCompetitionRanks(ctx context.Context, tenantDB dbOrTx, pss []PlayerScoreRow) ([]CompetitionRank, error) {
 	ranks := make([]CompetitionRank, 0, len(pss))
 	scoredPlayerSet := make(map[string]struct{}, len(pss))
-	for _, ps := range pss {
+	for i, ps := range pss {
+		if i%ingestCancelCheckRows == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
 		// player_scoreが同一player_id内ではrow_numの降順でソートされているので
 		// 現れたのが2回目以降のplayer_idはより大きいrow_numでスコアが出ているとみなせる
 		if _, ok := scoredPlayerSet[ps.PlayerID]; ok {
 			continue
 		}
 		scoredPlayerSet[ps.PlayerID] = struct{}{}
-		p, err := retrievePlayer(ctx, tenantDB, ps.PlayerID)
+		p, err := retrievePlayer(ctx, tenantDB, ps.TenantID, ps.PlayerID)
 		if err != nil {
-			return fmt.Errorf("error retrievePlayer: %w", err)
+			return nil, fmt.Errorf("error retrievePlayer: %w", err)
 		}
 		ranks = append(ranks, CompetitionRank{
 			Score:             ps.Score,
@@ -248,53 +334,41 @@ func competitionRankingHandler(c echo.Context) error {
 			RowNum:            ps.RowNum,
 		})
 	}
-	sort.Slice(ranks, func(i, j int) bool {
-		if ranks[i].Score == ranks[j].Score {
-			return ranks[i].RowNum < ranks[j].RowNum
-		}
-		return ranks[i].Score > ranks[j].Score
-	})
-	pagedRanks := make([]CompetitionRank, 0, 100)
-	for i, rank := range ranks {
-		if int64(i) < rankAfter {
-			continue
-		}
-		pagedRanks = append(pagedRanks, CompetitionRank{
-			Rank:              int64(i + 1),
-			Score:             rank.Score,
-			PlayerID:          rank.PlayerID,
-			PlayerDisplayName: rank.PlayerDisplayName,
-		})
-		if len(pagedRanks) >= 100 {
-			break
-		}
-	}
+	sortCompetitionRanks(ranks)
+	return ranks, nil
+}
 
-	res := SuccessResult{
-		Status: true,
-		Data: CompetitionRankingHandlerResult{
-			Competition: CompetitionDetail{
-				ID:         competition.ID,
-				Title:      competition.Title,
-				IsFinished: competition.FinishedAt.Valid,
-			},
-			Ranks: pagedRanks,
-		},
+// ランキングの並び順
+//  1. スコアの降順
+//  2. スコアが同じならCSVの行番号 (row_num) の昇順、先に登録した参加者が上位
+//     ISUCON_RANKING_TIEBREAK = "last" にすると降順になり、後に登録した参加者が上位
+//  3. それも同じならplayer_idの昇順
+//
+// 最後にplayer_idで比べるので、同じスコアの行からは常に同じ順序になる
+// ランキングAPI、CSVでの出力、ライブスコア (livescore.go)、スコアボードの埋め込みは全てこの順序で並べる
+var rankingTiebreakLast = getEnv("ISUCON_RANKING_TIEBREAK", "first") == "last"
+
+// aがbより上位ならtrue
+func lessCompetitionRank(a, b *CompetitionRank) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	if a.RowNum != b.RowNum {
+		if rankingTiebreakLast {
+			return a.RowNum > b.RowNum
+		}
+		return a.RowNum < b.RowNum
 	}
-	return c.JSON(http.StatusOK, res)
+	return a.PlayerID < b.PlayerID
 }
 
-func delayedInsertVisitHistory() {
-	visitHistory, _ := visitHistories.Get(0)
-	_, _ = adminDB.NamedExec(
-		"INSERT INTO visit_history (player_id, tenant_id, competition_id, created_at, updated_at) VALUES (:player_id, :tenant_id, :competition_id, :created_at, :updated_at)",
-		visitHistory,
-	)
-	visitHistory = make([]VisitHistoryRow, 0, 100)
-	visitHistories.Set(0, visitHistory)
+// ランキングを順位順に並べる
+func sortCompetitionRanks(ranks []CompetitionRank) {
+	sort.Slice(ranks, func(i, j int) bool { return lessCompetitionRank(&ranks[i], &ranks[j]) })
 }
 
 type CompetitionsHandlerResult struct {
+	Pagination   Pagination          `json:"pagination"`
 	Competitions []CompetitionDetail `json:"competitions"`
 }
 
@@ -302,23 +376,27 @@ type CompetitionsHandlerResult struct {
 // GET /api/player/competitions
 // 大会の一覧を取得する
 func playerCompetitionsHandler(c echo.Context) error {
-	ctx := context.Background()
+	ctx := c.Request().Context()
 
 	v, err := parseViewer(c)
 	if err != nil {
 		return err
 	}
-	if v.role != RolePlayer {
+	// 読み取り専用のAPIトークンでも取得できる
+	if v.role != RolePlayer && v.role != RoleReader {
 		return echo.NewHTTPError(http.StatusForbidden, "role player required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
+	defer tenantDB.Close()
 
-	if err := authorizePlayer(ctx, tenantDB, v.playerID); err != nil {
-		return err
+	if v.role == RolePlayer {
+		if err := authorizePlayer(ctx, tenantDB, v.tenantID, v.playerID); err != nil {
+			return err
+		}
 	}
 	return competitionsHandler(c, v, tenantDB)
 }
@@ -335,42 +413,73 @@ func organizerCompetitionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := connectToTenantDB(c.Request().Context(), v.tenantID)
 	if err != nil {
 		return err
 	}
+	defer tenantDB.Close()
 
 	return competitionsHandler(c, v, tenantDB)
 }
 
 func competitionsHandler(c echo.Context, v *Viewer, tenantDB dbOrTx) error {
-	ctx := context.Background()
+	ctx := c.Request().Context()
 
+	// season_idを指定するとそのシーズンの大会だけを返す (season.go を参照)
+	query, args := "SELECT * FROM competition WHERE tenant_id=? ORDER BY created_at DESC", []any{v.tenantID}
+	if seasonID := c.QueryParam("season_id"); seasonID != "" {
+		if _, err := retrieveSeason(ctx, tenantDB, v.tenantID, seasonID); err != nil {
+			return err
+		}
+		query, args = "SELECT * FROM competition WHERE tenant_id=? AND season_id=? ORDER BY created_at DESC", []any{v.tenantID, seasonID}
+	}
 	cs := []CompetitionRow{}
-	if err := tenantDB.SelectContext(
-		ctx,
-		&cs,
-		"SELECT * FROM competition WHERE tenant_id=? ORDER BY created_at DESC",
-		v.tenantID,
-	); err != nil {
+	if err := tenantDB.SelectContext(ctx, &cs, query, args...); err != nil {
 		return fmt.Errorf("error Select competition: %w", err)
 	}
-	cds := make([]CompetitionDetail, 0, len(cs))
+	page, err := parsePageParams(c, 0, 1000)
+	if err != nil {
+		return err
+	}
+	start, end, pg, err := offsetPage(page, 0, len(cs))
+	if err != nil {
+		return err
+	}
+	pg.setLinks(c)
+	loc, err := tenantLocation(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	ds := make([]CompetitionDetail, 0, end-start)
+	for i := range cs[start:end] {
+		ds = append(ds, newCompetitionDetail(&cs[start+i], loc))
+	}
+	// 一覧はめったに変わらないので条件付きGETに応える (conditional.go を参照)
+	// Last-Modifiedは最後に更新された大会の日時にする
+	// テナントのタイムゾーンやシーズンの付け替えは大会の更新日時に出ないので、返す内容から作ったETagも付ける
+	var lastModified int64
 	for _, comp := range cs {
-		cds = append(cds, CompetitionDetail{
-			ID:         comp.ID,
-			Title:      comp.Title,
-			IsFinished: comp.FinishedAt.Valid,
-		})
+		if comp.UpdatedAt > lastModified {
+			lastModified = comp.UpdatedAt
+		}
 	}
-
-	res := SuccessResult{
-		Status: true,
-		Data: CompetitionsHandlerResult{
-			Competitions: cds,
-		},
+	etag, err := contentETag(CompetitionsHandlerResult{Pagination: pg, Competitions: ds})
+	if err != nil {
+		return err
 	}
-	return c.JSON(http.StatusOK, res)
+	if notModified(c, etag, lastModified) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	// CompetitionsHandlerResultの形でストリーミングで返す
+	fields := []streamField{{Key: "pagination", Value: pg}}
+	return streamSuccessList(c, fields, "competitions", func(emit func(v any) error) error {
+		for i := range ds {
+			if err := emit(ds[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 type TenantDetail struct {
@@ -0,0 +1,152 @@
+package isuports
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// sortCompetitionRanks に渡すランキング
+// 同点と同じ行番号が多くなるよう、スコアと行番号は狭い範囲から選ぶ
+type rankingInput []CompetitionRank
+
+func (rankingInput) Generate(r *rand.Rand, size int) reflect.Value {
+	n := r.Intn(size + 1)
+	ranks := make(rankingInput, n)
+	for i := range ranks {
+		ranks[i] = CompetitionRank{
+			Score:             int64(r.Intn(5)-1) * 100,
+			PlayerID:          fmt.Sprintf("p%04d", i),
+			PlayerDisplayName: fmt.Sprintf("name%d", i),
+			RowNum:            int64(r.Intn(n) + 1),
+		}
+	}
+	r.Shuffle(n, func(i, j int) { ranks[i], ranks[j] = ranks[j], ranks[i] })
+	return reflect.ValueOf(ranks)
+}
+
+func sortedCopy(ranks []CompetitionRank) []CompetitionRank {
+	s := make([]CompetitionRank, len(ranks))
+	copy(s, ranks)
+	sortCompetitionRanks(s)
+	return s
+}
+
+func shuffledCopy(ranks []CompetitionRank, seed int64) []CompetitionRank {
+	s := make([]CompetitionRank, len(ranks))
+	copy(s, ranks)
+	rand.New(rand.NewSource(seed)).Shuffle(len(s), func(i, j int) { s[i], s[j] = s[j], s[i] })
+	return s
+}
+
+// 隣り合う2つの順序がランキングの並び順 (lessCompetitionRank のコメントを参照) になっているか
+func checkRankOrder(t *testing.T, ranks []CompetitionRank, tiebreakLast bool) bool {
+	t.Helper()
+	for i := 1; i < len(ranks); i++ {
+		a, b := ranks[i-1], ranks[i]
+		switch {
+		case a.Score != b.Score:
+			if a.Score < b.Score {
+				t.Logf("score is not descending at %d: %+v, %+v", i, a, b)
+				return false
+			}
+		case a.RowNum != b.RowNum:
+			if (a.RowNum > b.RowNum) != tiebreakLast {
+				t.Logf("row_num is not in tiebreak order at %d: %+v, %+v", i, a, b)
+				return false
+			}
+		case a.PlayerID >= b.PlayerID:
+			t.Logf("player_id is not ascending at %d: %+v, %+v", i, a, b)
+			return false
+		}
+	}
+	return true
+}
+
+// スコアの降順、同点なら行番号の昇順 (ISUCON_RANKING_TIEBREAK=last なら降順) に並び、入力の行を過不足なく含む
+func TestSortCompetitionRanksOrder(t *testing.T) {
+	for _, tiebreakLast := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tiebreakLast=%t", tiebreakLast), func(t *testing.T) {
+			defer func(v bool) { rankingTiebreakLast = v }(rankingTiebreakLast)
+			rankingTiebreakLast = tiebreakLast
+
+			f := func(in rankingInput) bool {
+				sorted := sortedCopy(in)
+				if !checkRankOrder(t, sorted, tiebreakLast) {
+					return false
+				}
+				want := map[CompetitionRank]int{}
+				for _, r := range in {
+					want[r]++
+				}
+				for _, r := range sorted {
+					want[r]--
+				}
+				for r, n := range want {
+					if n != 0 {
+						t.Logf("row count differs: %+v, %d", r, n)
+						return false
+					}
+				}
+				return true
+			}
+			if err := quick.Check(f, nil); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// 入力の順序によらず同じ順序になる
+// 同じスコアの行をDBやメモリから読んだ順序が変わってもランキングは変わらない
+func TestSortCompetitionRanksDeterministic(t *testing.T) {
+	f := func(in rankingInput, seed int64) bool {
+		return reflect.DeepEqual(sortedCopy(in), sortedCopy(shuffledCopy(in, seed)))
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// ランキングAPIと同じく、ページごとにランキングを作り直して (入力の順序が変わって) も、
+// カーソルをたどった全ページをつなげると全件のランキングと一致し、重複も抜けもない
+func TestSortCompetitionRanksPagination(t *testing.T) {
+	f := func(in rankingInput, limit uint8, seed int64) bool {
+		want := sortedCopy(in)
+		p := pageParams{limit: int(limit)%20 + 1}
+		got := make([]CompetitionRank, 0, len(want))
+		for page := 0; ; page++ {
+			if page > len(want)+1 {
+				t.Logf("pagination does not terminate: limit=%d", p.limit)
+				return false
+			}
+			ranks := sortedCopy(shuffledCopy(in, seed+int64(page)))
+			start, end, pg, err := offsetPage(p, 0, len(ranks))
+			if err != nil {
+				t.Logf("offsetPage: %s", err)
+				return false
+			}
+			got = append(got, ranks[start:end]...)
+			if pg.NextCursor == "" {
+				break
+			}
+			cursor, err := base64.RawURLEncoding.DecodeString(pg.NextCursor)
+			if err != nil {
+				t.Logf("invalid cursor: %q", pg.NextCursor)
+				return false
+			}
+			p.cursor = string(cursor)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Logf("pages differ from full ranking: limit=%d\ngot  %+v\nwant %+v", p.limit, got, want)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,407 @@
+package isuports
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 参加者の個人データ (GDPR)
+// テナントDBと管理用DBに保存している参加者のデータを、本人かテナント管理者が一括で取得できるようにする
+// テナント管理者は参加者のデータを消去することもできる (erasePlayer)
+// 管理用DBへの書き込みを待っている訪問履歴と、ライブモードでまだ書き出していないスコアは含まない
+
+type PlayerExportProfile struct {
+	ID             string `json:"id"`
+	DisplayName    string `json:"display_name"`
+	IsDisqualified bool   `json:"is_disqualified"`
+	Email          string `json:"email,omitempty"`
+	SCIMUserName   string `json:"scim_user_name,omitempty"`
+	SCIMExternalID string `json:"scim_external_id,omitempty"`
+	CreatedAt      int64  `json:"created_at"`
+	UpdatedAt      int64  `json:"updated_at"`
+}
+
+type PlayerExportScore struct {
+	CompetitionID    string `json:"competition_id"`
+	CompetitionTitle string `json:"competition_title"`
+	Score            int64  `json:"score"`
+	RowNum           int64  `json:"row_num"`
+	CreatedAt        int64  `json:"created_at"`
+}
+
+type PlayerExportVisit struct {
+	CompetitionID    string `json:"competition_id"`
+	CompetitionTitle string `json:"competition_title"`
+	VisitedAt        int64  `json:"visited_at"`
+}
+
+type PlayerExportMail struct {
+	Kind      string `json:"kind"`
+	Subject   string `json:"subject"`
+	Status    string `json:"status"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type PlayerExport struct {
+	Player     PlayerExportProfile `json:"player"`
+	Scores     []PlayerExportScore `json:"scores"`
+	Visits     []PlayerExportVisit `json:"visits"`
+	Mails      []PlayerExportMail  `json:"mails"`
+	ExportedAt int64               `json:"exported_at"`
+}
+
+// 参加者のデータを集める
+// 参加者が存在しなければsql.ErrNoRowsを返す
+func buildPlayerExport(ctx context.Context, tenantDB dbOrTx, tenantID int64, playerID string) (*PlayerExport, error) {
+	var p PlayerRow
+	// 失格の参加者も対象なのでキャッシュを使わずに読む
+	if err := tenantDB.GetContext(ctx, &p, "SELECT * FROM player WHERE tenant_id = ? AND id = ?", tenantID, playerID); err != nil {
+		return nil, fmt.Errorf("error Select player: tenantID=%d, id=%s, %w", tenantID, playerID, err)
+	}
+	e := &PlayerExport{
+		Player: PlayerExportProfile{
+			ID:             p.ID,
+			DisplayName:    p.DisplayName,
+			IsDisqualified: p.IsDisqualified,
+			CreatedAt:      p.CreatedAt,
+			UpdatedAt:      p.UpdatedAt,
+		},
+		Scores:     []PlayerExportScore{},
+		Visits:     []PlayerExportVisit{},
+		Mails:      []PlayerExportMail{},
+		ExportedAt: srv(ctx).clock.Now().Unix(),
+	}
+
+	var email PlayerEmailRow
+	if err := srv(ctx).adminDB.GetContext(ctx, &email, "SELECT * FROM player_email WHERE tenant_id = ? AND player_id = ?", tenantID, playerID); err == nil {
+		e.Player.Email = email.Email
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("error Select player_email: tenantID=%d, playerID=%s, %w", tenantID, playerID, err)
+	}
+	var su SCIMUserRow
+	if err := srv(ctx).adminDB.GetContext(ctx, &su, "SELECT * FROM scim_user WHERE tenant_id = ? AND player_id = ?", tenantID, playerID); err == nil {
+		e.Player.SCIMUserName, e.Player.SCIMExternalID = su.UserName, su.ExternalID
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("error Select scim_user: tenantID=%d, playerID=%s, %w", tenantID, playerID, err)
+	}
+
+	cs := []CompetitionRow{}
+	if err := tenantDB.SelectContext(ctx, &cs, "SELECT * FROM competition WHERE tenant_id = ?", tenantID); err != nil {
+		return nil, fmt.Errorf("error Select competition: tenantID=%d, %w", tenantID, err)
+	}
+	titles := make(map[string]string, len(cs))
+	for _, comp := range cs {
+		titles[comp.ID] = comp.Title
+	}
+
+	pss := []PlayerScoreRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&pss,
+		"SELECT * FROM player_score WHERE tenant_id = ? AND player_id = ? ORDER BY competition_id, row_num",
+		tenantID, playerID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select player_score: tenantID=%d, playerID=%s, %w", tenantID, playerID, err)
+	}
+	for _, ps := range pss {
+		e.Scores = append(e.Scores, PlayerExportScore{
+			CompetitionID:    ps.CompetitionID,
+			CompetitionTitle: titles[ps.CompetitionID],
+			Score:            ps.Score,
+			RowNum:           ps.RowNum,
+			CreatedAt:        ps.CreatedAt,
+		})
+	}
+
+	vhs := []VisitHistoryRow{}
+	if err := srv(ctx).adminDB.SelectContext(
+		ctx,
+		&vhs,
+		"SELECT * FROM visit_history WHERE player_id = ? AND tenant_id = ? ORDER BY created_at",
+		playerID, tenantID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select visit_history: tenantID=%d, playerID=%s, %w", tenantID, playerID, err)
+	}
+	for _, vh := range vhs {
+		e.Visits = append(e.Visits, PlayerExportVisit{
+			CompetitionID:    vh.CompetitionID,
+			CompetitionTitle: titles[vh.CompetitionID],
+			VisitedAt:        vh.CreatedAt,
+		})
+	}
+
+	if e.Player.Email != "" {
+		ms := []MailOutboxRow{}
+		if err := srv(ctx).adminDB.SelectContext(
+			ctx,
+			&ms,
+			"SELECT * FROM mail_outbox WHERE tenant_id = ? AND to_address = ? ORDER BY id",
+			tenantID, e.Player.Email,
+		); err != nil {
+			return nil, fmt.Errorf("error Select mail_outbox: tenantID=%d, %w", tenantID, err)
+		}
+		for _, m := range ms {
+			e.Mails = append(e.Mails, PlayerExportMail{
+				Kind:      m.Kind,
+				Subject:   m.Subject,
+				Status:    m.Status,
+				CreatedAt: m.CreatedAt,
+			})
+		}
+	}
+	return e, nil
+}
+
+// JSONか、format=csvならCSVをまとめたzipでダウンロードさせる
+func writePlayerExport(c echo.Context, e *PlayerExport) error {
+	filename := "player-" + e.Player.ID
+	if c.QueryParam("format") != "csv" {
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename+".json"))
+		return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: e})
+	}
+
+	p := e.Player
+	files := []struct {
+		name    string
+		records [][]string
+	}{
+		{"player.csv", [][]string{
+			{"id", "display_name", "is_disqualified", "email", "scim_user_name", "scim_external_id", "created_at", "updated_at"},
+			{p.ID, p.DisplayName, strconv.FormatBool(p.IsDisqualified), p.Email, p.SCIMUserName, p.SCIMExternalID, strconv.FormatInt(p.CreatedAt, 10), strconv.FormatInt(p.UpdatedAt, 10)},
+		}},
+		{"scores.csv", [][]string{{"competition_id", "competition_title", "score", "row_num", "created_at"}}},
+		{"visits.csv", [][]string{{"competition_id", "competition_title", "visited_at"}}},
+		{"mails.csv", [][]string{{"kind", "subject", "status", "created_at"}}},
+	}
+	for _, s := range e.Scores {
+		files[1].records = append(files[1].records, []string{s.CompetitionID, s.CompetitionTitle, strconv.FormatInt(s.Score, 10), strconv.FormatInt(s.RowNum, 10), strconv.FormatInt(s.CreatedAt, 10)})
+	}
+	for _, v := range e.Visits {
+		files[2].records = append(files[2].records, []string{v.CompetitionID, v.CompetitionTitle, strconv.FormatInt(v.VisitedAt, 10)})
+	}
+	for _, m := range e.Mails {
+		files[3].records = append(files[3].records, []string{m.Kind, m.Subject, m.Status, strconv.FormatInt(m.CreatedAt, 10)})
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/zip")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename+".zip"))
+	res.WriteHeader(http.StatusOK)
+	zw := zip.NewWriter(res)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			return fmt.Errorf("error zip.Create: %w", err)
+		}
+		cw := csv.NewWriter(w)
+		if err := cw.WriteAll(f.records); err != nil {
+			return fmt.Errorf("error csv.WriteAll: %w", err)
+		}
+	}
+	return zw.Close()
+}
+
+// 参加者向けAPI
+// GET /api/player/me/export
+// 自分について保存しているデータを全て取得する
+// 失格になった参加者も取得できる
+func playerExportHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RolePlayer {
+		return echo.NewHTTPError(http.StatusForbidden, "role player required")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	e, err := buildPlayerExport(ctx, tenantDB, v.tenantID, v.playerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "player not found")
+		}
+		return err
+	}
+	return writePlayerExport(c, e)
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/player/:player_id/export
+// 参加者からの請求を受けて、参加者について保存しているデータを全て取得する
+func organizerPlayerExportHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	e, err := buildPlayerExport(ctx, tenantDB, v.tenantID, c.Param("player_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "player not found")
+		}
+		return err
+	}
+	return writePlayerExport(c, e)
+}
+
+// 消去した参加者の表示名
+// ランキングや参加者一覧では行を残したままこの名前で表示する
+const erasedPlayerDisplayName = "deleted participant"
+
+const (
+	playerEraseModeAnonymize = "anonymize"
+	playerEraseModeDelete    = "delete"
+)
+
+type PlayerEraseHandlerResult struct {
+	Player        PlayerDetail `json:"player"`
+	Mode          string       `json:"mode"`
+	DeletedScores int64        `json:"deleted_scores"`
+	DeletedVisits int64        `json:"deleted_visits"`
+}
+
+// 参加者の個人データを消去する
+// anonymize: 表示名を消去済みにし、メールアドレスやSCIMの情報、送ったメールを削除する
+// delete: anonymizeに加えて、終了していない大会のスコアと訪問履歴も削除する
+// 終了した大会のスコアと訪問履歴は請求額とランキングの順位に使われているので、どちらの場合も残す
+func erasePlayer(ctx context.Context, tenantDB dbOrTx, tenantID int64, playerID, mode string) (*PlayerEraseHandlerResult, error) {
+	var p PlayerRow
+	if err := tenantDB.GetContext(ctx, &p, "SELECT * FROM player WHERE tenant_id = ? AND id = ?", tenantID, playerID); err != nil {
+		return nil, fmt.Errorf("error Select player: tenantID=%d, id=%s, %w", tenantID, playerID, err)
+	}
+	res := &PlayerEraseHandlerResult{Mode: mode}
+
+	var email PlayerEmailRow
+	if err := srv(ctx).adminDB.GetContext(ctx, &email, "SELECT * FROM player_email WHERE tenant_id = ? AND player_id = ?", tenantID, playerID); err == nil {
+		if _, err := srv(ctx).adminDB.ExecContext(ctx, "DELETE FROM mail_outbox WHERE tenant_id = ? AND to_address = ?", tenantID, email.Email); err != nil {
+			return nil, fmt.Errorf("error Delete mail_outbox: tenantID=%d, %w", tenantID, err)
+		}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("error Select player_email: tenantID=%d, playerID=%s, %w", tenantID, playerID, err)
+	}
+	for _, table := range []string{"player_email", "scim_user"} {
+		if _, err := srv(ctx).adminDB.ExecContext(ctx, "DELETE FROM "+table+" WHERE tenant_id = ? AND player_id = ?", tenantID, playerID); err != nil {
+			return nil, fmt.Errorf("error Delete %s: tenantID=%d, playerID=%s, %w", table, tenantID, playerID, err)
+		}
+	}
+
+	if mode == playerEraseModeDelete {
+		cs := []CompetitionRow{}
+		if err := tenantDB.SelectContext(ctx, &cs, "SELECT * FROM competition WHERE tenant_id = ? AND finished_at IS NULL", tenantID); err != nil {
+			return nil, fmt.Errorf("error Select competition: tenantID=%d, %w", tenantID, err)
+		}
+		// 計算中の課金レポートと重ならないようロックを取る (beginBillingSnapshot を参照)
+		fl, err := lockTenant(ctx, tenantID, lockWrite)
+		if err != nil {
+			return nil, fmt.Errorf("error lockTenant: %w", err)
+		}
+		defer fl.Close()
+		for _, comp := range cs {
+			r, err := tenantDB.ExecContext(
+				ctx,
+				"DELETE FROM player_score WHERE tenant_id = ? AND competition_id = ? AND player_id = ?",
+				tenantID, comp.ID, playerID,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("error Delete player_score: tenantID=%d, competitionID=%s, playerID=%s, %w", tenantID, comp.ID, playerID, err)
+			}
+			n, _ := r.RowsAffected()
+			res.DeletedScores += n
+			r, err = srv(ctx).adminDB.ExecContext(
+				ctx,
+				"DELETE FROM visit_history WHERE tenant_id = ? AND competition_id = ? AND player_id = ?",
+				tenantID, comp.ID, playerID,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("error Delete visit_history: tenantID=%d, competitionID=%s, playerID=%s, %w", tenantID, comp.ID, playerID, err)
+			}
+			n, _ = r.RowsAffected()
+			// まだ書き出していない訪問も捨てる
+			res.DeletedVisits += n + srv(ctx).visits.discard(tenantID, comp.ID, playerID)
+		}
+	}
+
+	now := srv(ctx).clock.Now().Unix()
+	if !p.ErasedAt.Valid {
+		p.ErasedAt = sql.NullInt64{Int64: now, Valid: true}
+	}
+	if _, err := tenantDB.ExecContext(
+		ctx,
+		"UPDATE player SET display_name = ?, erased_at = ?, updated_at = ? WHERE tenant_id = ? AND id = ?",
+		erasedPlayerDisplayName, p.ErasedAt.Int64, now, tenantID, playerID,
+	); err != nil {
+		return nil, fmt.Errorf("error Update player: tenantID=%d, id=%s, %w", tenantID, playerID, err)
+	}
+	srv(ctx).playerCache.Delete(tenantKey{tenantID, playerID})
+
+	loc, err := tenantLocation(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	p.DisplayName = erasedPlayerDisplayName
+	res.Player = newPlayerDetail(&p, loc)
+	return res, nil
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/player/:player_id/erase
+// 参加者からの請求を受けて、参加者の個人データを消去する
+// 同じ参加者に何度呼んでもよい
+func playerEraseHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	mode := c.FormValue("mode")
+	switch mode {
+	case "":
+		mode = playerEraseModeAnonymize
+	case playerEraseModeAnonymize, playerEraseModeDelete:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid mode")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	res, err := erasePlayer(ctx, tenantDB, v.tenantID, c.Param("player_id"), mode)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "player not found")
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
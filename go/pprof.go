@@ -0,0 +1,89 @@
+package isuports
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// プロファイリング用のリスナーを起動する
+// ISUCON_PPROF_ADDR が未設定なら起動しない (本番ではデフォルトで無効)
+// ループバック以外にbindする場合は ISUCON_PPROF_TOKEN の設定を必須にし、
+// Authorization: Bearer <token> ヘッダか token クエリパラメータで認証する
+// expvarのカウンタも /debug/vars で、開いているテナントDBの一覧も /debug/tenant_dbs で同じリスナーから参照できる
+func startPprofServer() (*http.Server, error) {
+	addr := getEnv("ISUCON_PPROF_ADDR", "")
+	if addr == "" {
+		return nil, nil
+	}
+	token := getEnv("ISUCON_PPROF_TOKEN", "")
+	if token == "" && !isLoopbackAddr(addr) {
+		return nil, fmt.Errorf("ISUCON_PPROF_TOKEN is required to bind pprof on non-loopback address: %s", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/tenant_dbs", tenantDBsDebugHandler)
+
+	var handler http.Handler = mux
+	if token != "" {
+		handler = requireDebugToken(token, mux)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error net.Listen: addr=%s, %w", addr, err)
+	}
+	s := &http.Server{Handler: handler}
+	go s.Serve(ln)
+	return s, nil
+}
+
+// トークンを持たないリクエストを拒否する
+func requireDebugToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			got = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ループバックアドレスだけにbindするアドレスか
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// 開いているテナントDBのハンドルの一覧をJSONで返す
+func tenantDBsDebugHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(map[string]any{
+		"pool":    defaultServer.tenantDBs.stats(),
+		"handles": defaultServer.tenantDBs.handles(),
+	})
+}
@@ -0,0 +1,197 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// テナントごとのリソースの上限
+// 1つのテナントが共有のインスタンスを使い切らないよう、全テナントに同じ上限をかける
+// どれも0なら制限しない
+type tenantQuotaConfig struct {
+	maxPlayers        int64   // 参加者の数
+	maxCompetitions   int64   // 大会の数
+	maxScoreRows      int64   // 1回のスコアのアップロードの行数
+	requestsPerSecond float64 // 1秒あたりのリクエスト数
+	burst             float64 // 瞬間的に許すリクエスト数
+}
+
+func tenantQuotaConfigFromEnv() tenantQuotaConfig {
+	return tenantQuotaConfig{
+		maxPlayers:        int64(getEnvInt("ISUCON_QUOTA_MAX_PLAYERS", 0)),
+		maxCompetitions:   int64(getEnvInt("ISUCON_QUOTA_MAX_COMPETITIONS", 0)),
+		maxScoreRows:      int64(getEnvInt("ISUCON_QUOTA_MAX_SCORE_ROWS", 0)),
+		requestsPerSecond: getEnvFloat("ISUCON_QUOTA_REQUESTS_PER_SECOND", 0),
+		burst:             getEnvFloat("ISUCON_QUOTA_BURST", 0),
+	}
+}
+
+// 上限の種類
+const (
+	quotaPlayers      = "players"
+	quotaCompetitions = "competitions"
+	quotaScoreRows    = "score_rows"
+	quotaRequests     = "requests_per_second"
+)
+
+type QuotaDetail struct {
+	Quota     string  `json:"quota"`
+	Limit     float64 `json:"limit"` // リクエスト数の上限は1秒あたりなので小数になることがある
+	Current   int64   `json:"current"`
+	Requested int64   `json:"requested"`
+}
+
+type QuotaExceededResult struct {
+	FailureResult
+	Detail QuotaDetail `json:"quota"`
+}
+
+// 上限を超えたことを返す
+// 作成系の上限は403、リクエスト数の上限は429にする
+func quotaExceeded(c echo.Context, status int, d QuotaDetail) error {
+	return c.JSON(status, QuotaExceededResult{
+		FailureResult: FailureResult{
+			Status:  false,
+			Message: fmt.Sprintf("tenant quota exceeded: %s", d.Quota),
+			Code:    "quota_exceeded",
+		},
+		Detail: d,
+	})
+}
+
+// テナントにadd件追加すると上限を超えるなら、その内容を返す
+// 上限がなければ件数を数えない
+func checkCountQuota(ctx context.Context, tenantDB dbOrTx, quota string, limit int64, table string, tenantID int64, add int64) (*QuotaDetail, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	var current int64
+	if err := tenantDB.GetContext(ctx, &current, "SELECT COUNT(*) FROM "+table+" WHERE tenant_id = ?", tenantID); err != nil {
+		return nil, fmt.Errorf("error Select count %s: tenantID=%d, %w", table, tenantID, err)
+	}
+	if current+add <= limit {
+		return nil, nil
+	}
+	return &QuotaDetail{Quota: quota, Limit: float64(limit), Current: current, Requested: add}, nil
+}
+
+// 参加者を追加できるか
+func checkPlayersQuota(ctx context.Context, tenantDB dbOrTx, tenantID int64, add int) (*QuotaDetail, error) {
+	return checkCountQuota(ctx, tenantDB, quotaPlayers, srv(ctx).quotas.maxPlayers, "player", tenantID, int64(add))
+}
+
+// 大会を追加できるか
+func checkCompetitionsQuota(ctx context.Context, tenantDB dbOrTx, tenantID int64) (*QuotaDetail, error) {
+	return checkCountQuota(ctx, tenantDB, quotaCompetitions, srv(ctx).quotas.maxCompetitions, "competition", tenantID, 1)
+}
+
+// スコアのCSVの行数が上限を超えているなら、その内容を返す
+func checkScoreRowsQuota(ctx context.Context, rows int64) *QuotaDetail {
+	limit := srv(ctx).quotas.maxScoreRows
+	if limit <= 0 || rows <= limit {
+		return nil
+	}
+	return &QuotaDetail{Quota: quotaScoreRows, Limit: float64(limit), Requested: rows}
+}
+
+// テナントごとのリクエスト数の制限 (トークンバケット)
+// バケットは存在するテナントにだけ作り、満タンに戻るまで使われなかったバケットは消す
+// (満タンのバケットは消しても作り直しても同じなので、制限の結果は変わらない)
+type tenantRateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[int64]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTenantRateLimiter(q tenantQuotaConfig) *tenantRateLimiter {
+	return &tenantRateLimiter{
+		rate:    q.requestsPerSecond,
+		burst:   math.Max(q.burst, math.Max(q.requestsPerSecond, 1)),
+		buckets: map[int64]*tokenBucket{},
+	}
+}
+
+// 空のバケットが満タンに戻るまでの時間
+func (l *tenantRateLimiter) refillDuration() time.Duration {
+	return time.Duration(l.burst / l.rate * float64(time.Second))
+}
+
+// 1リクエスト分のトークンを取る
+// 取れなければ、次に取れるまでの時間を返す
+func (l *tenantRateLimiter) allow(tenantID int64, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= l.refillDuration() {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[tenantID]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[tenantID] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// 満タンに戻っているバケットを消す
+// l.muを取ってから呼ぶこと
+func (l *tenantRateLimiter) sweep(now time.Time) {
+	idle := l.refillDuration()
+	for id, b := range l.buckets {
+		if now.Sub(b.last) >= idle {
+			delete(l.buckets, id)
+		}
+	}
+	l.lastSweep = now
+}
+
+// テナントごとのリクエスト数を制限するmiddleware
+// テナントはHostヘッダで判別し、SaaS管理者向けAPIと /initialize は対象にしない
+// 存在しないテナントのリクエストは制限せずにハンドラに渡す (ハンドラがエラーを返す)
+func tenantRateLimitMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			limiter := srv(c.Request().Context()).requestLimiter
+			if limiter.rate <= 0 {
+				return next(c)
+			}
+			path := c.Path()
+			if path == "/initialize" || strings.HasPrefix(path, "/api/admin/") {
+				return next(c)
+			}
+			tenant, err := retrieveTenantRowFromHeader(c)
+			if err != nil || tenant.Name == "admin" {
+				return next(c)
+			}
+			ok, wait := limiter.allow(tenant.ID, time.Now())
+			if ok {
+				return next(c)
+			}
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return quotaExceeded(c, http.StatusTooManyRequests, QuotaDetail{
+				Quota: quotaRequests,
+				Limit: limiter.rate,
+			})
+		}
+	}
+}
@@ -0,0 +1,658 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// 参加者のレーティング (Elo)
+// 終了した大会の最終ランキング (competition_result) と対戦の結果 (match_result) を起きた順に適用して計算する
+//   - 対戦の結果: 1対1のEloで、勝ちは1、引き分けは0.5、負けは0として更新する
+//   - 大会の最終ランキング: 他の参加者の平均のレーティングを相手とみなし、順位から 1 (1位) 〜 0 (最下位) を結果として更新する
+//     同じスコアの参加者は同じ順位 (順位の平均) として扱う
+//
+// 対戦の結果を登録した大会は、最終ランキングでは更新しない (対戦で更新済み)
+// 順序は対戦の結果は登録した時刻、大会は終了した時刻で決める
+//
+// 新しい結果は関わる参加者のplayer_ratingだけを読んで更新する (applyRatingEvent)
+// 結果の削除や訂正は過去の結果の順序に割り込むので、全ての結果から計算し直す
+// 計算し直しはテナントの結果の数だけ時間がかかるので、ロックを放してからバックグラウンドで行う (scheduleRatingsRecompute)
+// 設定の変更と POST /api/organizer/ratings/recompute はその場で計算し直す
+
+// レーティングのテナントごとの設定、空ならデフォルト
+const (
+	ratingKFactorSettingName = "rating.k_factor"
+	ratingInitialSettingName = "rating.initial"
+)
+
+const (
+	defaultRatingKFactor = 32
+	defaultRatingInitial = 1500
+)
+
+type ratingConfig struct {
+	kFactor float64
+	initial float64
+}
+
+func tenantRatingConfig(ctx context.Context, tenantID int64) (ratingConfig, error) {
+	settings, err := getTenantSettings(ctx, tenantID)
+	if err != nil {
+		return ratingConfig{}, err
+	}
+	conf := ratingConfig{kFactor: defaultRatingKFactor, initial: defaultRatingInitial}
+	for name, dst := range map[string]*float64{ratingKFactorSettingName: &conf.kFactor, ratingInitialSettingName: &conf.initial} {
+		v := settings[name]
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return ratingConfig{}, fmt.Errorf("invalid tenant setting %s: %q, %w", name, v, err)
+		}
+		*dst = float64(n)
+	}
+	return conf, nil
+}
+
+type PlayerRatingRow struct {
+	TenantID  int64   `db:"tenant_id"`
+	PlayerID  string  `db:"player_id"`
+	Rating    float64 `db:"rating"`
+	Games     int64   `db:"games"`
+	UpdatedAt int64   `db:"updated_at"`
+}
+
+type PlayerRatingDetail struct {
+	Rating int64 `json:"rating"`
+	Games  int64 `json:"games"`
+}
+
+func newPlayerRatingDetail(r *PlayerRatingRow) PlayerRatingDetail {
+	return PlayerRatingDetail{
+		Rating: int64(math.Round(r.Rating)),
+		Games:  r.Games,
+	}
+}
+
+// 参加者のレーティング、まだ結果のない参加者はnil
+func retrievePlayerRating(ctx context.Context, tenantDB dbOrTx, tenantID int64, playerID string) (*PlayerRatingRow, error) {
+	var r PlayerRatingRow
+	if err := tenantDB.GetContext(ctx, &r, "SELECT * FROM player_rating WHERE tenant_id = ? AND player_id = ?", tenantID, playerID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error Select player_rating: tenantID=%d, playerID=%s, %w", tenantID, playerID, err)
+	}
+	return &r, nil
+}
+
+// レーティングを更新する結果
+// matchかrankingのどちらかを持つ
+type ratingEvent struct {
+	at      int64
+	id      string
+	match   *MatchResultRow
+	ranking []CompetitionRank
+}
+
+// Eloの期待値
+func eloExpected(r, opponent float64) float64 {
+	return 1 / (1 + math.Pow(10, (opponent-r)/400))
+}
+
+type ratingState struct {
+	conf    ratingConfig
+	ratings map[string]float64
+	games   map[string]int64
+}
+
+func (s *ratingState) rating(playerID string) float64 {
+	if r, ok := s.ratings[playerID]; ok {
+		return r
+	}
+	return s.conf.initial
+}
+
+func (s *ratingState) applyMatch(m *MatchResultRow) {
+	ra, rb := s.rating(m.PlayerAID), s.rating(m.PlayerBID)
+	sa := 0.5
+	if m.ScoreA > m.ScoreB {
+		sa = 1
+	} else if m.ScoreA < m.ScoreB {
+		sa = 0
+	}
+	s.ratings[m.PlayerAID] = ra + s.conf.kFactor*(sa-eloExpected(ra, rb))
+	s.ratings[m.PlayerBID] = rb + s.conf.kFactor*((1-sa)-eloExpected(rb, ra))
+	s.games[m.PlayerAID]++
+	s.games[m.PlayerBID]++
+}
+
+// ranksは順位順に並んでいること
+func (s *ratingState) applyRanking(ranks []CompetitionRank) {
+	n := len(ranks)
+	if n < 2 {
+		return
+	}
+	var sum float64
+	before := make([]float64, n)
+	for i, r := range ranks {
+		before[i] = s.rating(r.PlayerID)
+		sum += before[i]
+	}
+	for i := 0; i < n; {
+		// 同じスコアの参加者は順位の平均を使う
+		j := i
+		for j < n && ranks[j].Score == ranks[i].Score {
+			j++
+		}
+		pos := float64(i+j-1) / 2 // 0始まりの順位の平均
+		actual := 1 - pos/float64(n-1)
+		for k := i; k < j; k++ {
+			field := (sum - before[k]) / float64(n-1)
+			id := ranks[k].PlayerID
+			s.ratings[id] = before[k] + s.conf.kFactor*(actual-eloExpected(before[k], field))
+			s.games[id]++
+		}
+		i = j
+	}
+}
+
+// 全ての結果からテナントのレーティングを計算し直してplayer_ratingを置き換える
+// 呼び出し側でlockTenantの排他ロックを取っておくこと
+func recomputeRatings(ctx context.Context, tenantDB *tenantDBConn, tenantID int64) error {
+	conf, err := tenantRatingConfig(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	ms := []MatchResultRow{}
+	if err := tenantDB.SelectContext(ctx, &ms, "SELECT * FROM match_result WHERE tenant_id = ?", tenantID); err != nil {
+		return fmt.Errorf("error Select match_result: tenantID=%d, %w", tenantID, err)
+	}
+	results := []CompetitionResultRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&results,
+		"SELECT * FROM competition_result WHERE tenant_id = ? AND competition_id NOT IN (SELECT competition_id FROM match_result WHERE tenant_id = ?)",
+		tenantID, tenantID,
+	); err != nil {
+		return fmt.Errorf("error Select competition_result: tenantID=%d, %w", tenantID, err)
+	}
+
+	events := make([]ratingEvent, 0, len(ms)+len(results))
+	for i := range ms {
+		events = append(events, ratingEvent{at: ms[i].CreatedAt, id: ms[i].ID, match: &ms[i]})
+	}
+	for _, r := range results {
+		ranks := []CompetitionRank{}
+		if err := json.Unmarshal([]byte(r.Ranking), &ranks); err != nil {
+			return fmt.Errorf("error json.Unmarshal competition_result.ranking: tenantID=%d, competitionID=%s, %w", tenantID, r.CompetitionID, err)
+		}
+		events = append(events, ratingEvent{at: r.FinishedAt, id: r.CompetitionID, ranking: ranks})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].at != events[j].at {
+			return events[i].at < events[j].at
+		}
+		return events[i].id < events[j].id
+	})
+
+	state := &ratingState{conf: conf, ratings: map[string]float64{}, games: map[string]int64{}}
+	for i, ev := range events {
+		if i%ingestCancelCheckRows == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if ev.match != nil {
+			state.applyMatch(ev.match)
+		} else {
+			state.applyRanking(ev.ranking)
+		}
+	}
+
+	now := srv(ctx).clock.Now().Unix()
+	rows := make([]PlayerRatingRow, 0, len(state.ratings))
+	for id, r := range state.ratings {
+		rows = append(rows, PlayerRatingRow{TenantID: tenantID, PlayerID: id, Rating: r, Games: state.games[id], UpdatedAt: now})
+	}
+	return withRetry(ctx, func() error {
+		tx, err := tenantDB.BeginTxx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("error BeginTxx: tenantID=%d, %w", tenantID, err)
+		}
+		defer tx.Rollback()
+		if _, err := tx.ExecContext(ctx, "DELETE FROM player_rating WHERE tenant_id = ?", tenantID); err != nil {
+			return fmt.Errorf("error Delete player_rating: tenantID=%d, %w", tenantID, err)
+		}
+		// SQLiteの変数の上限を超えないよう分けて書く
+		for start := 0; start < len(rows); start += 1000 {
+			end := start + 1000
+			if end > len(rows) {
+				end = len(rows)
+			}
+			if _, err := tx.NamedExecContext(
+				ctx,
+				"INSERT INTO player_rating (tenant_id, player_id, rating, games, updated_at) VALUES (:tenant_id, :player_id, :rating, :games, :updated_at)",
+				rows[start:end],
+			); err != nil {
+				return fmt.Errorf("error Insert player_rating: tenantID=%d, %w", tenantID, err)
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// 新しい結果1つ分だけレーティングを更新する
+// 結果の変更は確定しているので、失敗してもエラーにはせず記録だけして計算し直しを予約する
+// 呼び出し側でlockTenantの排他ロックを取っておくこと
+func applyRatingEvent(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, ev ratingEvent) {
+	applied, err := updateRatings(ctx, tenantDB, tenantID, ev)
+	if err != nil {
+		logger.Warn("failed to update ratings", zap.Int64("tenant_id", tenantID), zap.Error(err))
+	}
+	if !applied {
+		scheduleRatingsRecompute(ctx, tenantID)
+	}
+}
+
+// 確定した大会の最終ランキングをレーティングに反映する
+// 対戦の結果を登録した大会は対戦で更新済みなので何もしない
+// 呼び出し側でlockTenantの排他ロックを取っておくこと
+func applyCompetitionRating(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, result *CompetitionResultRow) {
+	var matches int64
+	if err := tenantDB.GetContext(ctx, &matches, "SELECT COUNT(*) FROM match_result WHERE tenant_id = ? AND competition_id = ?", tenantID, result.CompetitionID); err != nil {
+		logger.Warn("failed to update ratings", zap.Int64("tenant_id", tenantID), zap.Error(err))
+		scheduleRatingsRecompute(ctx, tenantID)
+		return
+	}
+	if matches > 0 {
+		return
+	}
+	ranks := []CompetitionRank{}
+	if err := json.Unmarshal([]byte(result.Ranking), &ranks); err != nil {
+		logger.Warn("failed to update ratings", zap.Int64("tenant_id", tenantID), zap.Error(err))
+		return
+	}
+	applyRatingEvent(ctx, tenantDB, tenantID, ratingEvent{at: result.FinishedAt, id: result.CompetitionID, ranking: ranks})
+}
+
+// evに関わる参加者のplayer_ratingを読み、evを適用して書き戻す
+// evより後の結果が既にある場合は順序が変わるので何もせずfalseを返す
+func updateRatings(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, ev ratingEvent) (bool, error) {
+	conf, err := tenantRatingConfig(ctx, tenantID)
+	if err != nil {
+		return false, err
+	}
+	var playerIDs []string
+	if ev.match != nil {
+		playerIDs = []string{ev.match.PlayerAID, ev.match.PlayerBID}
+	} else {
+		if len(ev.ranking) < 2 {
+			return true, nil
+		}
+		for _, r := range ev.ranking {
+			playerIDs = append(playerIDs, r.PlayerID)
+		}
+	}
+
+	applied := false
+	err = withRetry(ctx, func() error {
+		tx, err := tenantDB.BeginTxx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("error BeginTxx: tenantID=%d, %w", tenantID, err)
+		}
+		defer tx.Rollback()
+
+		var later int64
+		if err := tx.GetContext(
+			ctx,
+			&later,
+			`SELECT (SELECT COUNT(*) FROM match_result WHERE tenant_id = ? AND (created_at > ? OR (created_at = ? AND id > ?)))
+			 + (SELECT COUNT(*) FROM competition_result WHERE tenant_id = ? AND (finished_at > ? OR (finished_at = ? AND competition_id > ?)))`,
+			tenantID, ev.at, ev.at, ev.id, tenantID, ev.at, ev.at, ev.id,
+		); err != nil {
+			return fmt.Errorf("error Select later results: tenantID=%d, %w", tenantID, err)
+		}
+		if later > 0 {
+			return nil
+		}
+
+		state := &ratingState{conf: conf, ratings: map[string]float64{}, games: map[string]int64{}}
+		// SQLiteの変数の上限を超えないよう分けて読む
+		for start := 0; start < len(playerIDs); start += 1000 {
+			end := start + 1000
+			if end > len(playerIDs) {
+				end = len(playerIDs)
+			}
+			query, args, err := sqlx.In("SELECT * FROM player_rating WHERE tenant_id = ? AND player_id IN (?)", tenantID, playerIDs[start:end])
+			if err != nil {
+				return fmt.Errorf("error sqlx.In: %w", err)
+			}
+			rows := []PlayerRatingRow{}
+			if err := tx.SelectContext(ctx, &rows, query, args...); err != nil {
+				return fmt.Errorf("error Select player_rating: tenantID=%d, %w", tenantID, err)
+			}
+			for _, r := range rows {
+				state.ratings[r.PlayerID] = r.Rating
+				state.games[r.PlayerID] = r.Games
+			}
+		}
+		if ev.match != nil {
+			state.applyMatch(ev.match)
+		} else {
+			state.applyRanking(ev.ranking)
+		}
+
+		now := srv(ctx).clock.Now().Unix()
+		for _, id := range playerIDs {
+			if _, err := tx.ExecContext(
+				ctx,
+				`INSERT INTO player_rating (tenant_id, player_id, rating, games, updated_at) VALUES (?, ?, ?, ?, ?)
+				 ON CONFLICT (tenant_id, player_id) DO UPDATE SET rating = excluded.rating, games = excluded.games, updated_at = excluded.updated_at`,
+				tenantID, id, state.ratings[id], state.games[id], now,
+			); err != nil {
+				return fmt.Errorf("error Upsert player_rating: tenantID=%d, playerID=%s, %w", tenantID, id, err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error Commit: tenantID=%d, %w", tenantID, err)
+		}
+		applied = true
+		return nil
+	})
+	return applied, err
+}
+
+// 計算し直しを待つ時間の上限
+var ratingRecomputeTimeout = getEnvDuration("ISUCON_RATING_RECOMPUTE_TIMEOUT", 5*time.Minute)
+
+// 結果の削除や訂正のあとに、バックグラウンドでテナントのレーティングを計算し直す
+// 失敗しても記録だけする (次の変更か POST /api/organizer/ratings/recompute で直る)
+// ロックを持ったまま呼んでよい、計算し直しは自分でロックを取る
+func scheduleRatingsRecompute(ctx context.Context, tenantID int64) {
+	s := srv(ctx)
+	s.ratingRecomputes.schedule(s, tenantID)
+}
+
+// テナントごとのバックグラウンドの計算し直し
+// 同じテナントは同時に1つだけ実行し、実行中に頼まれたら終わってからもう1回だけ実行する
+type ratingRecomputer struct {
+	mu sync.Mutex
+	// 実行中のテナントID、値は終わってからもう1回実行するかどうか
+	running map[int64]bool
+	wg      sync.WaitGroup
+}
+
+func newRatingRecomputer() *ratingRecomputer {
+	return &ratingRecomputer{running: map[int64]bool{}}
+}
+
+func (r *ratingRecomputer) schedule(s *Server, tenantID int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.running[tenantID]; ok {
+		r.running[tenantID] = true
+		return
+	}
+	r.running[tenantID] = false
+	r.wg.Add(1)
+	go r.run(s, tenantID)
+}
+
+func (r *ratingRecomputer) run(s *Server, tenantID int64) {
+	defer r.wg.Done()
+	for {
+		// リクエストのcontextを引き継ぐと、リクエストIDが同じためにロックの待ち合わせを誤検知するので新しく作る
+		ctx, cancel := context.WithTimeout(withServer(context.Background(), s), ratingRecomputeTimeout)
+		if err := recomputeTenantRatings(ctx, tenantID); err != nil {
+			logger.Warn("failed to recompute ratings", zap.Int64("tenant_id", tenantID), zap.Error(err))
+		}
+		cancel()
+
+		r.mu.Lock()
+		if !r.running[tenantID] {
+			delete(r.running, tenantID)
+			r.mu.Unlock()
+			return
+		}
+		r.running[tenantID] = false
+		r.mu.Unlock()
+	}
+}
+
+// 実行中の計算し直しが終わるのを待つ
+func (r *ratingRecomputer) wait() {
+	r.wg.Wait()
+}
+
+type RatingSettingsHandlerResult struct {
+	KFactor       int64 `json:"k_factor"`
+	InitialRating int64 `json:"initial_rating"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/rating
+// レーティングの設定を取得する
+func ratingSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	conf, err := tenantRatingConfig(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: RatingSettingsHandlerResult{
+		KFactor:       int64(conf.kFactor),
+		InitialRating: int64(conf.initial),
+	}})
+}
+
+type RatingSettingsRequest struct {
+	KFactor       int64 `form:"k_factor" validate:"min=0,max=1000"`
+	InitialRating int64 `form:"initial_rating" validate:"min=0,max=100000"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/rating
+// レーティングの設定を変更し、全ての結果から計算し直す
+// k_factor, initial_ratingは空ならデフォルト (32, 1500)
+func ratingSettingsUpdateHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	var req RatingSettingsRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+	for name, value := range map[string]int64{ratingKFactorSettingName: req.KFactor, ratingInitialSettingName: req.InitialRating} {
+		s := ""
+		if value != 0 {
+			s = strconv.FormatInt(value, 10)
+		}
+		if err := setTenantSetting(ctx, v.tenantID, name, s); err != nil {
+			return err
+		}
+	}
+
+	if err := recomputeTenantRatings(ctx, v.tenantID); err != nil {
+		return err
+	}
+	conf, err := tenantRatingConfig(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: RatingSettingsHandlerResult{
+		KFactor:       int64(conf.kFactor),
+		InitialRating: int64(conf.initial),
+	}})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/ratings/recompute
+// 全ての結果からレーティングを計算し直す
+func ratingsRecomputeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	if err := recomputeTenantRatings(ctx, v.tenantID); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
+
+func recomputeTenantRatings(ctx context.Context, tenantID int64) error {
+	tenantDB, err := connectToTenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	fl, err := lockTenant(ctx, tenantID, lockWrite)
+	if err != nil {
+		return fmt.Errorf("error lockTenant: %w", err)
+	}
+	defer fl.Close()
+	return recomputeRatings(ctx, tenantDB, tenantID)
+}
+
+type PlayerRatingRank struct {
+	Rank              int64  `json:"rank"`
+	PlayerID          string `json:"player_id"`
+	PlayerDisplayName string `json:"player_display_name"`
+	Rating            int64  `json:"rating"`
+	Games             int64  `json:"games"`
+}
+
+type RatingsHandlerResult struct {
+	Pagination Pagination         `json:"pagination"`
+	Ratings    []PlayerRatingRank `json:"ratings"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/ratings
+// レーティングの高い順に参加者を取得する
+func organizerRatingsHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	tenantDB, err := connectToTenantDB(c.Request().Context(), v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	return ratingsHandler(c, v, tenantDB)
+}
+
+// 参加者向けAPI
+// GET /api/player/ratings
+// レーティングの高い順に参加者を取得する
+func playerRatingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return err
+	}
+	// 読み取り専用のAPIトークンでも取得できる
+	if v.role != RolePlayer && v.role != RoleReader {
+		return echo.NewHTTPError(http.StatusForbidden, "role player required")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	if v.role == RolePlayer {
+		if err := authorizePlayer(ctx, tenantDB, v.tenantID, v.playerID); err != nil {
+			return err
+		}
+	}
+	return ratingsHandler(c, v, tenantDB)
+}
+
+func ratingsHandler(c echo.Context, v *Viewer, tenantDB dbOrTx) error {
+	ctx := c.Request().Context()
+
+	type row struct {
+		PlayerRatingRow
+		DisplayName string `db:"display_name"`
+	}
+	rows := []row{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&rows,
+		`SELECT player_rating.*, player.display_name AS display_name FROM player_rating
+		 JOIN player ON player.tenant_id = player_rating.tenant_id AND player.id = player_rating.player_id
+		 WHERE player_rating.tenant_id = ? ORDER BY player_rating.rating DESC, player_rating.player_id ASC`,
+		v.tenantID,
+	); err != nil {
+		return fmt.Errorf("error Select player_rating: tenantID=%d, %w", v.tenantID, err)
+	}
+	page, err := parsePageParams(c, 100, 1000)
+	if err != nil {
+		return err
+	}
+	start, end, pg, err := offsetPage(page, 0, len(rows))
+	if err != nil {
+		return err
+	}
+	pg.setLinks(c)
+
+	// RatingsHandlerResultの形でストリーミングで返す
+	fields := []streamField{{Key: "pagination", Value: pg}}
+	return streamSuccessList(c, fields, "ratings", func(emit func(v any) error) error {
+		for i := start; i < end; i++ {
+			d := newPlayerRatingDetail(&rows[i].PlayerRatingRow)
+			if err := emit(PlayerRatingRank{
+				Rank:              int64(i + 1),
+				PlayerID:          rows[i].PlayerID,
+				PlayerDisplayName: rows[i].DisplayName,
+				Rating:            d.Rating,
+				Games:             d.Games,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,61 @@
+package isuports
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// SIGHUPを受けたら再起動せずに設定と鍵を読み直す
+// 大会期間中の鍵のローテーションやチューニングのためのもの
+func handleReloadSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			logger.Info("reloaded runtime state", reloadRuntimeState()...)
+		}
+	}()
+}
+
+// 設定ファイル、JWTの公開鍵、一部のキャッシュを読み直し、変わった内容をログのフィールドにまとめて返す
+func reloadRuntimeState() []zap.Field {
+	var summary []zap.Field
+
+	// 設定ファイル
+	// 値は秘密情報を含みうるのでキー名だけを出す
+	changed, err := reloadConfigFile()
+	if err != nil {
+		summary = append(summary, zap.NamedError("config_error", err))
+	} else {
+		summary = append(summary, zap.Strings("config_changed_keys", changed))
+		// 起動時に読んだ値のうち、実行中に変えても問題ないものを反映する
+		if s := defaultServer; s != nil {
+			s.tenantDBs.setMaxOpen(getEnvInt("ISUCON_TENANT_DB_MAX_OPEN", 1000))
+			configureAdminDBPool(s.adminDB)
+			if s.adminReadDB != s.adminDB {
+				configureAdminDBPool(s.adminReadDB)
+			}
+		}
+	}
+
+	// JWTの公開鍵
+	// 読み込みに失敗した場合は今の鍵を使い続ける
+	if s := defaultServer; s != nil {
+		if err := s.jwtVerifier.reloadKey(); err != nil {
+			summary = append(summary, zap.NamedError("jwt_key_error", err))
+		} else {
+			summary = append(summary, zap.Bool("jwt_key_reloaded", true))
+		}
+	}
+
+	// DBの外から変更されうる内容のキャッシュ
+	if s := defaultServer; s != nil {
+		s.tenantRowCache.Reset()
+		s.billingReportCache.Reset()
+	}
+	summary = append(summary, zap.Strings("caches_reset", []string{"jwt_token", "tenant_row", "billing_report"}))
+	return summary
+}
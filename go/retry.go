@@ -0,0 +1,75 @@
+package isuports
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/mattn/go-sqlite3"
+)
+
+// 書き込みのリトライ設定
+var (
+	retryMaxAttempts = getEnvInt("ISUCON_RETRY_MAX_ATTEMPTS", 10)
+	retryBaseDelay   = getEnvDuration("ISUCON_RETRY_BASE_DELAY", 5*time.Millisecond)
+	retryMaxDelay    = getEnvDuration("ISUCON_RETRY_MAX_DELAY", 500*time.Millisecond)
+)
+
+// MySQLのデッドロック、ロック待ちタイムアウト
+const (
+	mysqlErrLockWaitTimeout = 1205
+	mysqlErrDeadlock        = 1213
+)
+
+// リトライすれば成功する可能性のあるDBエラーか
+func isRetryableDBError(err error) bool {
+	var merr *mysql.MySQLError
+	if errors.As(err, &merr) {
+		return merr.Number == mysqlErrDeadlock || merr.Number == mysqlErrLockWaitTimeout
+	}
+	var serr sqlite3.Error
+	if errors.As(err, &serr) {
+		return serr.Code == sqlite3.ErrBusy || serr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// fnがリトライ可能なエラーを返す間、ジッター付きの指数バックオフで再実行する
+// トランザクションを使う場合はBeginからCommitまでをfnに含めること
+func withRetry(ctx context.Context, fn func() error) error {
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= retryMaxAttempts || !isRetryableDBError(err) {
+			return err
+		}
+
+		// full jitter: [0, delay) の間でランダムに待つ
+		wait := time.Duration(rand.Int63n(int64(delay) + 1))
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		if delay *= 2; delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+// attempts回目に失敗した後、次に試すまでの時間
+// baseから倍々に伸ばし、maxで頭打ちにする
+func backoffDelay(base, max time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package isuports
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// ファイルディスクリプタ数のソフト上限をハード上限まで引き上げる
+// テナントDBを大量に開くとデフォルトのソフト上限(1024)にすぐ達するため
+func raiseFileDescriptorLimit() (uint64, error) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0, fmt.Errorf("error syscall.Getrlimit: %w", err)
+	}
+	if rlim.Cur < rlim.Max {
+		rlim.Cur = rlim.Max
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+			return 0, fmt.Errorf("error syscall.Setrlimit: %w", err)
+		}
+	}
+	return uint64(rlim.Cur), nil
+}
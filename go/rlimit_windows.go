@@ -0,0 +1,6 @@
+package isuports
+
+// Windowsではファイルディスクリプタ数の上限を変更しない
+func raiseFileDescriptorLimit() (uint64, error) {
+	return 0, nil
+}
@@ -0,0 +1,31 @@
+-- 管理用DBの初期スキーマ
+-- 既存の管理用DBに適用しても壊さないよう IF NOT EXISTS をつけている
+
+CREATE TABLE IF NOT EXISTS `tenant` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `name` VARCHAR(255) NOT NULL,
+  `display_name` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `name` (`name`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `id_generator` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `stub` CHAR(1) NOT NULL DEFAULT '',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `stub` (`stub`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
+INSERT IGNORE INTO `id_generator` (`id`, `stub`) VALUES (2678400000, 'a');
+
+CREATE TABLE IF NOT EXISTS `visit_history` (
+  `player_id` VARCHAR(255) NOT NULL,
+  `tenant_id` BIGINT UNSIGNED NOT NULL,
+  `competition_id` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  INDEX `player_id_idx` (`player_id`, `competition_id`, `tenant_id`),
+  INDEX `tenant_competition_idx` (`tenant_id`, `competition_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
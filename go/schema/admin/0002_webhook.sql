@@ -0,0 +1,32 @@
+-- Webhookの送信先と送信キュー (webhook.go を参照)
+
+CREATE TABLE IF NOT EXISTS `webhook_endpoint` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `tenant_id` BIGINT NOT NULL,
+  `url` VARCHAR(1024) NOT NULL,
+  `secret` VARCHAR(255) NOT NULL,
+  `events` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `tenant_idx` (`tenant_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
+-- statusは pending (送信待ち、リトライ待ち), delivered (送信済み), dead (リトライ回数を超えた) のいずれか
+CREATE TABLE IF NOT EXISTS `webhook_delivery` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `tenant_id` BIGINT NOT NULL,
+  `endpoint_id` BIGINT NOT NULL,
+  `event` VARCHAR(64) NOT NULL,
+  `payload` MEDIUMTEXT NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `attempts` INT NOT NULL DEFAULT 0,
+  `next_attempt_at` BIGINT NOT NULL,
+  `last_status_code` INT NOT NULL DEFAULT 0,
+  `last_error` VARCHAR(1024) NOT NULL DEFAULT '',
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `status_next_attempt_idx` (`status`, `next_attempt_at`),
+  INDEX `endpoint_idx` (`endpoint_id`, `id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
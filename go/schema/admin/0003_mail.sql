@@ -0,0 +1,36 @@
+-- テナントごとの設定、参加者のメールアドレス、メールの送信キュー (tenantsetting.go, mail.go を参照)
+
+CREATE TABLE IF NOT EXISTS `tenant_setting` (
+  `tenant_id` BIGINT NOT NULL,
+  `name` VARCHAR(64) NOT NULL,
+  `value` TEXT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`, `name`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `player_email` (
+  `tenant_id` BIGINT NOT NULL,
+  `player_id` VARCHAR(255) NOT NULL,
+  `email` VARCHAR(255) NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`, `player_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
+-- statusは pending (送信待ち、リトライ待ち), sent (送信済み), dead (リトライ回数を超えた) のいずれか
+CREATE TABLE IF NOT EXISTS `mail_outbox` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `tenant_id` BIGINT NOT NULL,
+  `kind` VARCHAR(64) NOT NULL,
+  `to_address` VARCHAR(255) NOT NULL,
+  `subject` VARCHAR(1024) NOT NULL,
+  `body` TEXT NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `attempts` INT NOT NULL DEFAULT 0,
+  `next_attempt_at` BIGINT NOT NULL,
+  `last_error` VARCHAR(1024) NOT NULL DEFAULT '',
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `status_next_attempt_idx` (`status`, `next_attempt_at`),
+  INDEX `tenant_idx` (`tenant_id`, `id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
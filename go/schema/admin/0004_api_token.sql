@@ -0,0 +1,15 @@
+-- 読み取り専用のAPIトークン (apitoken.go を参照)
+-- トークンそのものは保存せず、SHA-256のハッシュで照合する
+
+CREATE TABLE IF NOT EXISTS `api_token` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `tenant_id` BIGINT NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `token_hash` CHAR(64) NOT NULL,
+  `token_prefix` VARCHAR(16) NOT NULL,
+  `revoked_at` BIGINT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `token_hash_idx` (`token_hash`),
+  INDEX `tenant_idx` (`tenant_id`, `id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
@@ -0,0 +1,26 @@
+-- テナント管理者のSSO (sso.go を参照)
+
+-- SSOでログインできるIdPのユーザー
+-- subjectが空ならemailで照合する
+CREATE TABLE IF NOT EXISTS `sso_identity` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `tenant_id` BIGINT NOT NULL,
+  `subject` VARCHAR(255) NOT NULL DEFAULT '',
+  `email` VARCHAR(255) NOT NULL DEFAULT '',
+  `organizer_id` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `tenant_idx` (`tenant_id`, `id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
+-- ログイン中の認可リクエスト、IdPから戻ってきたときに一度だけ使う
+CREATE TABLE IF NOT EXISTS `sso_state` (
+  `state` VARCHAR(64) NOT NULL,
+  `tenant_id` BIGINT NOT NULL,
+  `nonce` VARCHAR(64) NOT NULL,
+  `code_verifier` VARCHAR(128) NOT NULL,
+  `redirect_to` VARCHAR(1024) NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  PRIMARY KEY (`state`),
+  INDEX `expires_at_idx` (`expires_at`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
@@ -0,0 +1,12 @@
+-- SCIMのユーザーと参加者の対応 (scim.go を参照)
+
+CREATE TABLE IF NOT EXISTS `scim_user` (
+  `tenant_id` BIGINT NOT NULL,
+  `player_id` VARCHAR(255) NOT NULL,
+  `user_name` VARCHAR(255) NOT NULL,
+  `external_id` VARCHAR(255) NOT NULL DEFAULT '',
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`, `player_id`),
+  UNIQUE KEY `user_name_idx` (`tenant_id`, `user_name`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
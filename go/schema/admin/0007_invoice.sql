@@ -0,0 +1,29 @@
+-- 月ごとの請求書 (invoice.go, stripe.go を参照)
+
+-- statusは draft, open, paid, payment_failed, void, uncollectible のいずれか
+CREATE TABLE IF NOT EXISTS `billing_invoice` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `tenant_id` BIGINT NOT NULL,
+  `period` CHAR(7) NOT NULL,
+  `amount_yen` BIGINT NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `stripe_invoice_id` VARCHAR(255) NOT NULL DEFAULT '',
+  `last_error` VARCHAR(1024) NOT NULL DEFAULT '',
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `tenant_period_idx` (`tenant_id`, `period`),
+  INDEX `period_idx` (`period`, `status`),
+  INDEX `stripe_invoice_idx` (`stripe_invoice_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `billing_invoice_line` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `invoice_id` BIGINT NOT NULL,
+  `tenant_id` BIGINT NOT NULL,
+  `competition_id` VARCHAR(255) NOT NULL,
+  `description` VARCHAR(1024) NOT NULL,
+  `amount_yen` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `invoice_idx` (`invoice_id`, `id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
@@ -0,0 +1,4 @@
+-- Webhookのペイロードの形式 (webhook.go を参照)
+-- formatは full (署名付きの完全な形式), simple (ZapierやIFTTT向けのフラットな形式) のいずれか
+
+ALTER TABLE `webhook_endpoint` ADD COLUMN `format` VARCHAR(16) NOT NULL DEFAULT 'full' AFTER `events`;
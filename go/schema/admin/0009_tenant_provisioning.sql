@@ -0,0 +1,4 @@
+-- 作成途中のテナント (admin.go の addTenant を参照)
+-- テナントDBの作成が終わるまでは1にしておき、その間はどのAPIからも存在しないテナントとして扱う
+
+ALTER TABLE `tenant` ADD COLUMN `provisioning` TINYINT(1) NOT NULL DEFAULT 0 AFTER `display_name`;
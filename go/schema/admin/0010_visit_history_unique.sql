@@ -0,0 +1,39 @@
+-- 訪問履歴を (テナント, 大会, 参加者) ごとに1行にする (visit.go を参照)
+-- created_at は最初の訪問、updated_at は最後の訪問
+-- 書き込みの再試行で同じ訪問が二重に入っても1行にまとまるよう一意キーをつける
+--
+-- visit_historyには主キーがなく重複した行をその場で消せないので、まとめた行を別のテーブルに作ってから入れ替える
+-- コピーしてから入れ替えるまでに書き込まれた訪問は、入れ替えた後に古いテーブルから取り込む
+--
+-- 途中で失敗しても、このファイルをそのまま再実行すれば揃う
+--   入れ替えた後に失敗していたら、最初に古いテーブルの残りを取り込んでから消す
+--   (初回は空の visit_history_old を作って消すだけになる)
+--   作りかけの visit_history_dedup は消して作り直す
+--
+-- 一意キーのない前のバージョンのサーバーが動いていると入れ替えた後の書き込みが失敗するので、
+-- 適用する間は前のバージョンのサーバー (訪問の書き込みと /initialize) を止めておくこと
+
+CREATE TABLE IF NOT EXISTS `visit_history_old` LIKE `visit_history`;
+INSERT INTO `visit_history` (player_id, tenant_id, competition_id, created_at, updated_at)
+  SELECT player_id, tenant_id, competition_id, MIN(created_at), MAX(updated_at) FROM `visit_history_old` GROUP BY tenant_id, competition_id, player_id
+  ON DUPLICATE KEY UPDATE created_at = LEAST(`visit_history`.created_at, VALUES(created_at)), updated_at = GREATEST(`visit_history`.updated_at, VALUES(updated_at));
+DROP TABLE `visit_history_old`;
+
+DROP TABLE IF EXISTS `visit_history_dedup`;
+CREATE TABLE `visit_history_dedup` (
+  `player_id` VARCHAR(255) NOT NULL,
+  `tenant_id` BIGINT UNSIGNED NOT NULL,
+  `competition_id` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  INDEX `player_id_idx` (`player_id`, `competition_id`, `tenant_id`),
+  INDEX `tenant_competition_idx` (`tenant_id`, `competition_id`),
+  UNIQUE KEY `tenant_competition_player_idx` (`tenant_id`, `competition_id`, `player_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+INSERT INTO `visit_history_dedup` (player_id, tenant_id, competition_id, created_at, updated_at)
+  SELECT player_id, tenant_id, competition_id, MIN(created_at), MAX(updated_at) FROM `visit_history` GROUP BY tenant_id, competition_id, player_id;
+RENAME TABLE `visit_history` TO `visit_history_old`, `visit_history_dedup` TO `visit_history`;
+INSERT INTO `visit_history` (player_id, tenant_id, competition_id, created_at, updated_at)
+  SELECT player_id, tenant_id, competition_id, MIN(created_at), MAX(updated_at) FROM `visit_history_old` GROUP BY tenant_id, competition_id, player_id
+  ON DUPLICATE KEY UPDATE created_at = LEAST(`visit_history`.created_at, VALUES(created_at)), updated_at = GREATEST(`visit_history`.updated_at, VALUES(updated_at));
+DROP TABLE `visit_history_old`;
@@ -0,0 +1,41 @@
+-- テナントDBの初期スキーマ
+-- 既存のテナントDB (initial_data) に適用しても壊さないよう IF NOT EXISTS をつけている
+
+CREATE TABLE IF NOT EXISTS competition (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  title TEXT NOT NULL,
+  finished_at BIGINT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS created_at_idx ON competition (created_at);
+
+CREATE TABLE IF NOT EXISTS player (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  display_name TEXT NOT NULL,
+  is_disqualified BOOLEAN NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS player_score (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  player_id VARCHAR(255) NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  score BIGINT NOT NULL,
+  row_num BIGINT NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS tenant_player_idx ON player_score (tenant_id, player_id);
+
+CREATE INDEX IF NOT EXISTS tenant_player_competition_row_idx ON player_score (tenant_id, player_id, competition_id, row_num DESC);
+
+CREATE INDEX IF NOT EXISTS tenant_competition_row_idx ON player_score (tenant_id, competition_id, row_num DESC);
+
+CREATE INDEX IF NOT EXISTS comp_idx ON player_score (competition_id ASC);
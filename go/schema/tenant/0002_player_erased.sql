@@ -0,0 +1,3 @@
+-- 個人データを消去した参加者 (playerdata.go を参照)
+-- 行は消さずに残し、ランキングや請求の集計が変わらないようにする
+ALTER TABLE player ADD COLUMN erased_at BIGINT NULL;
@@ -0,0 +1,14 @@
+-- テナント管理者の操作の監査ログ (audit.go を参照)
+-- 終了した大会のスコアの訂正など、通常は許可しない操作を行ったときに記録する
+
+CREATE TABLE IF NOT EXISTS audit_log (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  tenant_id BIGINT NOT NULL,
+  actor VARCHAR(255) NOT NULL,
+  action VARCHAR(64) NOT NULL,
+  target_id VARCHAR(255) NOT NULL,
+  detail TEXT NOT NULL,
+  created_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_tenant_created_at_idx ON audit_log (tenant_id, created_at);
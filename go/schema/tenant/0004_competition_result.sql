@@ -0,0 +1,19 @@
+-- 終了した大会の確定した結果 (competitionfinish.go を参照)
+-- 大会の終了と同じトランザクションで課金レポートと最終ランキングを書く
+
+CREATE TABLE IF NOT EXISTS competition_result (
+  competition_id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  finished_at BIGINT NOT NULL,
+  player_count BIGINT NOT NULL,
+  visitor_count BIGINT NOT NULL,
+  billing_player_yen BIGINT NOT NULL,
+  billing_visitor_yen BIGINT NOT NULL,
+  billing_yen BIGINT NOT NULL,
+  ranking TEXT NOT NULL,
+  event_published_at BIGINT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS competition_result_tenant_idx ON competition_result (tenant_id);
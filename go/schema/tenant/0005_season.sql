@@ -0,0 +1,19 @@
+-- シーズン (season.go を参照)
+-- 大会をまとめ、シーズンを通した順位を出す
+-- aggregation は sum (全大会のスコアの合計) か best (上位best_n大会のスコアの合計)
+
+CREATE TABLE IF NOT EXISTS season (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  title TEXT NOT NULL,
+  aggregation VARCHAR(16) NOT NULL,
+  best_n BIGINT NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS season_tenant_created_at_idx ON season (tenant_id, created_at);
+
+ALTER TABLE competition ADD COLUMN season_id VARCHAR(255) NULL;
+
+CREATE INDEX IF NOT EXISTS competition_season_idx ON competition (tenant_id, season_id);
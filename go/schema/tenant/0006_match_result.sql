@@ -0,0 +1,17 @@
+-- 対戦の結果 (matchresult.go を参照)
+-- 対戦形式の大会は、スコアのCSVの代わりに1試合ずつ結果を登録し、勝ち点をplayer_scoreに書く
+
+CREATE TABLE IF NOT EXISTS match_result (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  player_a_id VARCHAR(255) NOT NULL,
+  player_b_id VARCHAR(255) NOT NULL,
+  score_a BIGINT NOT NULL,
+  score_b BIGINT NOT NULL,
+  played_at BIGINT NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS match_result_competition_idx ON match_result (tenant_id, competition_id, played_at);
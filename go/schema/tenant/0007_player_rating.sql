@@ -0,0 +1,13 @@
+-- 参加者のレーティング (rating.go を参照)
+-- 終了した大会の最終ランキングと対戦の結果から計算し直せるので、計算した結果だけを置く
+
+CREATE TABLE IF NOT EXISTS player_rating (
+  tenant_id BIGINT NOT NULL,
+  player_id VARCHAR(255) NOT NULL,
+  rating REAL NOT NULL,
+  games BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL,
+  PRIMARY KEY (tenant_id, player_id)
+);
+
+CREATE INDEX IF NOT EXISTS player_rating_rating_idx ON player_rating (tenant_id, rating DESC);
@@ -0,0 +1,4 @@
+-- ライブモードの大会 (livescore.go を参照)
+-- 1ならスコアをメモリ上に持ち、定期的にplayer_scoreへ書き出す
+
+ALTER TABLE competition ADD COLUMN live INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,643 @@
+package isuports
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// SCIM 2.0 (RFC 7643, 7644) による参加者のプロビジョニング
+// 企業のテナントが社員名簿をIdPから参加者に自動で同期できるようにする
+// Usersの作成・名前の変更・無効化 (active=false) を、参加者の追加・表示名の変更・失格に対応させる
+// 失格は取り消せないので、無効化した参加者を有効に戻すことはできない
+// 認証はテナントごとに発行するBearerトークンで行う (テナント設定にハッシュだけを保存する)
+
+const (
+	scimTokenHashSettingName = "scim.token_hash"
+	scimTokenPrefix          = "isscim_"
+
+	scimSchemaUser         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimSchemaListResponse = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaError        = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSchemaPatchOp      = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimSchemaSPConfig     = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+
+	scimContentType = "application/scim+json"
+	// 一覧で一度に返す件数の上限
+	scimMaxResults = 1000
+)
+
+// SCIMのuserNameとexternalIdを参加者に対応づける
+// SCIM以外で追加した参加者は行がなく、参加者IDをuserNameとして扱う
+type SCIMUserRow struct {
+	TenantID   int64  `db:"tenant_id"`
+	PlayerID   string `db:"player_id"`
+	UserName   string `db:"user_name"`
+	ExternalID string `db:"external_id"`
+	CreatedAt  int64  `db:"created_at"`
+	UpdatedAt  int64  `db:"updated_at"`
+}
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Created      string `json:"created"`
+	LastModified string `json:"lastModified"`
+	Location     string `json:"location"`
+}
+
+type scimUser struct {
+	Schemas     []string  `json:"schemas"`
+	ID          string    `json:"id"`
+	ExternalID  string    `json:"externalId,omitempty"`
+	UserName    string    `json:"userName"`
+	DisplayName string    `json:"displayName"`
+	Active      bool      `json:"active"`
+	Meta        *scimMeta `json:"meta,omitempty"`
+}
+
+// リクエストのUser、省略した属性はnil
+type scimUserInput struct {
+	ExternalID  *string `json:"externalId"`
+	UserName    *string `json:"userName"`
+	DisplayName *string `json:"displayName"`
+	Name        *struct {
+		Formatted string `json:"formatted"`
+	} `json:"name"`
+	Active *bool `json:"active"`
+}
+
+// displayNameがなければname.formattedを表示名にする
+func (in *scimUserInput) displayName() *string {
+	if in.DisplayName != nil {
+		return in.DisplayName
+	}
+	if in.Name != nil && in.Name.Formatted != "" {
+		return &in.Name.Formatted
+	}
+	return nil
+}
+
+type scimError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+// SCIMのエラーを返す
+// 他のAPIとは形式が違うのでerrorResponseHandlerには渡さない
+func scimErrorResponse(c echo.Context, status int, scimType, detail string) error {
+	return scimJSON(c, status, scimError{
+		Schemas:  []string{scimSchemaError},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
+
+func scimJSON(c echo.Context, status int, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error json.Marshal: %w", err)
+	}
+	return c.Blob(status, scimContentType, b)
+}
+
+func scimBaseURL(c echo.Context) string {
+	return fmt.Sprintf("%s://%s/scim/v2", c.Scheme(), c.Request().Host)
+}
+
+// Bearerトークンを検証してテナントを返す
+// 認証に失敗した場合はエラーのレスポンスを書いてnilを返す
+func scimAuthenticate(c echo.Context) (*TenantRow, error) {
+	tenant, err := retrieveTenantRowFromHeader(c)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, scimErrorResponse(c, http.StatusNotFound, "", "tenant not found")
+		}
+		return nil, fmt.Errorf("error retrieveTenantRowFromHeader: %w", err)
+	}
+	if tenant.Name == "admin" {
+		return nil, scimErrorResponse(c, http.StatusNotFound, "", "admin has not this API")
+	}
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || !strings.HasPrefix(token, scimTokenPrefix) {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="scim"`)
+		return nil, scimErrorResponse(c, http.StatusUnauthorized, "", "bearer token is required")
+	}
+	hash, err := getTenantSetting(c.Request().Context(), tenant.ID, scimTokenHashSettingName)
+	if err != nil {
+		return nil, err
+	}
+	if hash == "" || subtle.ConstantTimeCompare([]byte(hash), []byte(hashAPIToken(token))) != 1 {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="scim"`)
+		return nil, scimErrorResponse(c, http.StatusUnauthorized, "", "invalid bearer token")
+	}
+	return tenant, nil
+}
+
+// SCIMのハンドラ
+// 認証してテナントDBを開いてから呼ぶ
+func scimHandler(h func(c echo.Context, tenantID int64, tenantDB *tenantDBConn) error) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		tenant, err := scimAuthenticate(c)
+		if tenant == nil {
+			return err
+		}
+		tenantDB, err := connectToTenantDB(c.Request().Context(), tenant.ID)
+		if err != nil {
+			return err
+		}
+		defer tenantDB.Close()
+		return h(c, tenant.ID, tenantDB)
+	}
+}
+
+func scimTime(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+func toSCIMUser(c echo.Context, p PlayerRow, u *SCIMUserRow) scimUser {
+	su := scimUser{
+		Schemas:     []string{scimSchemaUser},
+		ID:          p.ID,
+		UserName:    p.ID,
+		DisplayName: p.DisplayName,
+		Active:      !p.IsDisqualified,
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Created:      scimTime(p.CreatedAt),
+			LastModified: scimTime(p.UpdatedAt),
+			Location:     scimBaseURL(c) + "/Users/" + p.ID,
+		},
+	}
+	if u != nil {
+		su.UserName = u.UserName
+		su.ExternalID = u.ExternalID
+		if u.UpdatedAt > p.UpdatedAt {
+			su.Meta.LastModified = scimTime(u.UpdatedAt)
+		}
+	}
+	return su
+}
+
+func retrieveSCIMUser(ctx context.Context, tenantID int64, playerID string) (*SCIMUserRow, error) {
+	var u SCIMUserRow
+	if err := srv(ctx).adminDB.GetContext(ctx, &u, "SELECT * FROM scim_user WHERE tenant_id = ? AND player_id = ?", tenantID, playerID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error Select scim_user: tenantID=%d, playerID=%s, %w", tenantID, playerID, err)
+	}
+	return &u, nil
+}
+
+// 同じuserNameの参加者がいるか
+func scimUserNameTaken(ctx context.Context, tenantDB dbOrTx, tenantID int64, userName, exceptPlayerID string) (bool, error) {
+	var n int
+	if err := srv(ctx).adminDB.GetContext(
+		ctx,
+		&n,
+		"SELECT COUNT(*) FROM scim_user WHERE tenant_id = ? AND user_name = ? AND player_id != ?",
+		tenantID, userName, exceptPlayerID,
+	); err != nil {
+		return false, fmt.Errorf("error Select scim_user: tenantID=%d, %w", tenantID, err)
+	}
+	if n > 0 {
+		return true, nil
+	}
+	// SCIM以外で追加した参加者は参加者IDがuserName
+	if userName == exceptPlayerID {
+		return false, nil
+	}
+	if _, err := retrievePlayer(ctx, tenantDB, tenantID, userName); err == nil {
+		return true, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	return false, nil
+}
+
+// userName eq "..." か externalId eq "..." の形式のfilterだけに対応する
+var scimFilterRegexp = regexp.MustCompile(`^\s*(userName|externalId)\s+eq\s+"((?:[^"\\]|\\.)*)"\s*$`)
+
+// SCIM
+// GET /scim/v2/Users
+// 参加者の一覧を取得する
+func scimUsersHandler(c echo.Context, tenantID int64, tenantDB *tenantDBConn) error {
+	ctx := c.Request().Context()
+
+	var filterAttr, filterValue string
+	if f := c.QueryParam("filter"); f != "" {
+		m := scimFilterRegexp.FindStringSubmatch(f)
+		if m == nil {
+			return scimErrorResponse(c, http.StatusBadRequest, "invalidFilter", "only 'userName eq' and 'externalId eq' filters are supported")
+		}
+		if err := json.Unmarshal([]byte(`"`+m[2]+`"`), &filterValue); err != nil {
+			return scimErrorResponse(c, http.StatusBadRequest, "invalidFilter", "invalid filter value")
+		}
+		filterAttr = m[1]
+	}
+	startIndex, count := 1, scimMaxResults
+	if s := c.QueryParam("startIndex"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 1 {
+			startIndex = n
+		}
+	}
+	if s := c.QueryParam("count"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 && n < scimMaxResults {
+			count = n
+		}
+	}
+
+	pls := []PlayerRow{}
+	if err := tenantDB.SelectContext(ctx, &pls, "SELECT * FROM player WHERE tenant_id = ? ORDER BY created_at ASC, id ASC", tenantID); err != nil {
+		return fmt.Errorf("error Select player: tenantID=%d, %w", tenantID, err)
+	}
+	us := []SCIMUserRow{}
+	if err := srv(ctx).adminDB.SelectContext(ctx, &us, "SELECT * FROM scim_user WHERE tenant_id = ?", tenantID); err != nil {
+		return fmt.Errorf("error Select scim_user: tenantID=%d, %w", tenantID, err)
+	}
+	userByPlayer := make(map[string]*SCIMUserRow, len(us))
+	for i := range us {
+		userByPlayer[us[i].PlayerID] = &us[i]
+	}
+
+	matched := make([]scimUser, 0, len(pls))
+	for _, p := range pls {
+		su := toSCIMUser(c, p, userByPlayer[p.ID])
+		switch {
+		case filterAttr == "userName" && su.UserName != filterValue:
+			continue
+		case filterAttr == "externalId" && su.ExternalID != filterValue:
+			continue
+		}
+		matched = append(matched, su)
+	}
+	resources := []scimUser{}
+	if startIndex-1 < len(matched) {
+		resources = matched[startIndex-1:]
+	}
+	if len(resources) > count {
+		resources = resources[:count]
+	}
+	return scimJSON(c, http.StatusOK, map[string]any{
+		"schemas":      []string{scimSchemaListResponse},
+		"totalResults": len(matched),
+		"startIndex":   startIndex,
+		"itemsPerPage": len(resources),
+		"Resources":    resources,
+	})
+}
+
+// SCIM
+// GET /scim/v2/Users/:id
+// 参加者を取得する
+func scimUserHandler(c echo.Context, tenantID int64, tenantDB *tenantDBConn) error {
+	ctx := c.Request().Context()
+	p, err := retrievePlayer(ctx, tenantDB, tenantID, c.Param("id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return scimErrorResponse(c, http.StatusNotFound, "", "user not found")
+		}
+		return err
+	}
+	u, err := retrieveSCIMUser(ctx, tenantID, p.ID)
+	if err != nil {
+		return err
+	}
+	return scimJSON(c, http.StatusOK, toSCIMUser(c, *p, u))
+}
+
+// SCIM
+// POST /scim/v2/Users
+// 参加者を追加する
+func scimUserCreateHandler(c echo.Context, tenantID int64, tenantDB *tenantDBConn) error {
+	ctx := c.Request().Context()
+	var in scimUserInput
+	if err := json.NewDecoder(c.Request().Body).Decode(&in); err != nil {
+		return scimErrorResponse(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+	}
+	if in.UserName == nil || *in.UserName == "" || len(*in.UserName) > 255 {
+		return scimErrorResponse(c, http.StatusBadRequest, "invalidValue", "userName is required")
+	}
+	if taken, err := scimUserNameTaken(ctx, tenantDB, tenantID, *in.UserName, ""); err != nil {
+		return err
+	} else if taken {
+		return scimErrorResponse(c, http.StatusConflict, "uniqueness", "userName is already used")
+	}
+	if q, err := checkPlayersQuota(ctx, tenantDB, tenantID, 1); err != nil {
+		return err
+	} else if q != nil {
+		return scimErrorResponse(c, http.StatusForbidden, "", fmt.Sprintf("tenant quota exceeded: %s", q.Quota))
+	}
+
+	id, err := dispenseID(ctx)
+	if err != nil {
+		return fmt.Errorf("error dispenseID: %w", err)
+	}
+	now := srv(ctx).clock.Now().Unix()
+	displayName := *in.UserName
+	if dn := in.displayName(); dn != nil && *dn != "" {
+		displayName = *dn
+	}
+	p := PlayerRow{tenantID, id, displayName, in.Active != nil && !*in.Active, now, now, sql.NullInt64{}}
+	u := SCIMUserRow{TenantID: tenantID, PlayerID: id, UserName: *in.UserName, CreatedAt: now, UpdatedAt: now}
+	if in.ExternalID != nil {
+		u.ExternalID = *in.ExternalID
+	}
+	if _, err := srv(ctx).adminDB.ExecContext(
+		ctx,
+		"INSERT INTO scim_user (tenant_id, player_id, user_name, external_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+		u.TenantID, u.PlayerID, u.UserName, u.ExternalID, u.CreatedAt, u.UpdatedAt,
+	); err != nil {
+		// 確かめてから追加するまでの間に同じuserNameで作られた
+		if isUniqueViolation(err) {
+			return scimErrorResponse(c, http.StatusConflict, "uniqueness", "userName is already used")
+		}
+		return fmt.Errorf("error Insert scim_user: tenantID=%d, %w", tenantID, err)
+	}
+	if err := withRetry(ctx, func() error {
+		_, err := tenantDB.ExecContext(
+			ctx,
+			"INSERT INTO player (id, tenant_id, display_name, is_disqualified, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+			p.ID, p.TenantID, p.DisplayName, p.IsDisqualified, p.CreatedAt, p.UpdatedAt,
+		)
+		return err
+	}); err != nil {
+		return fmt.Errorf("error Insert player: id=%s, %w", p.ID, err)
+	}
+	srv(ctx).playerCache.Set(tenantKey{tenantID, id}, p)
+
+	c.Response().Header().Set(echo.HeaderLocation, scimBaseURL(c)+"/Users/"+id)
+	return scimJSON(c, http.StatusCreated, toSCIMUser(c, p, &u))
+}
+
+// Userの変更を参加者に反映する
+// activeをtrueにしても失格は取り消せない
+func applySCIMUser(c echo.Context, tenantID int64, tenantDB *tenantDBConn, playerID string, in scimUserInput) error {
+	ctx := c.Request().Context()
+	p, err := retrievePlayer(ctx, tenantDB, tenantID, playerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return scimErrorResponse(c, http.StatusNotFound, "", "user not found")
+		}
+		return err
+	}
+	u, err := retrieveSCIMUser(ctx, tenantID, p.ID)
+	if err != nil {
+		return err
+	}
+	if in.Active != nil && *in.Active && p.IsDisqualified {
+		return scimErrorResponse(c, http.StatusBadRequest, "mutability", "disqualified players cannot be reactivated")
+	}
+
+	now := srv(ctx).clock.Now().Unix()
+	if in.UserName != nil || in.ExternalID != nil {
+		if u == nil {
+			u = &SCIMUserRow{TenantID: tenantID, PlayerID: p.ID, UserName: p.ID, CreatedAt: now}
+		}
+		if in.UserName != nil {
+			if *in.UserName == "" || len(*in.UserName) > 255 {
+				return scimErrorResponse(c, http.StatusBadRequest, "invalidValue", "invalid userName")
+			}
+			if taken, err := scimUserNameTaken(ctx, tenantDB, tenantID, *in.UserName, p.ID); err != nil {
+				return err
+			} else if taken {
+				return scimErrorResponse(c, http.StatusConflict, "uniqueness", "userName is already used")
+			}
+			u.UserName = *in.UserName
+		}
+		if in.ExternalID != nil {
+			u.ExternalID = *in.ExternalID
+		}
+		u.UpdatedAt = now
+		if _, err := srv(ctx).adminDB.ExecContext(
+			ctx,
+			"INSERT INTO scim_user (tenant_id, player_id, user_name, external_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE user_name = VALUES(user_name), external_id = VALUES(external_id), updated_at = VALUES(updated_at)",
+			u.TenantID, u.PlayerID, u.UserName, u.ExternalID, u.CreatedAt, u.UpdatedAt,
+		); err != nil {
+			return fmt.Errorf("error Upsert scim_user: tenantID=%d, playerID=%s, %w", tenantID, p.ID, err)
+		}
+	}
+	if dn := in.displayName(); dn != nil && *dn != "" && *dn != p.DisplayName {
+		if err := withRetry(ctx, func() error {
+			_, err := tenantDB.ExecContext(
+				ctx,
+				"UPDATE player SET display_name = ?, updated_at = ? WHERE tenant_id = ? AND id = ?",
+				*dn, now, tenantID, p.ID,
+			)
+			return err
+		}); err != nil {
+			return fmt.Errorf("error Update player: id=%s, %w", p.ID, err)
+		}
+		srv(ctx).playerCache.Delete(tenantKey{tenantID, p.ID})
+	}
+	if in.Active != nil && !*in.Active && !p.IsDisqualified {
+		if _, err := disqualifyPlayer(ctx, tenantDB, tenantID, p.ID); err != nil {
+			return err
+		}
+	}
+
+	p, err = retrievePlayer(ctx, tenantDB, tenantID, p.ID)
+	if err != nil {
+		return err
+	}
+	return scimJSON(c, http.StatusOK, toSCIMUser(c, *p, u))
+}
+
+// SCIM
+// PUT /scim/v2/Users/:id
+// 参加者を置き換える
+func scimUserReplaceHandler(c echo.Context, tenantID int64, tenantDB *tenantDBConn) error {
+	var in scimUserInput
+	if err := json.NewDecoder(c.Request().Body).Decode(&in); err != nil {
+		return scimErrorResponse(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+	}
+	if in.UserName == nil {
+		return scimErrorResponse(c, http.StatusBadRequest, "invalidValue", "userName is required")
+	}
+	// PUTで省略したactiveはtrueとして扱う
+	if in.Active == nil {
+		active := true
+		in.Active = &active
+	}
+	return applySCIMUser(c, tenantID, tenantDB, c.Param("id"), in)
+}
+
+// SCIM
+// PATCH /scim/v2/Users/:id
+// 参加者の一部の属性を変更する
+// userName, externalId, displayName, name.formatted, active の replace と add に対応する
+func scimUserPatchHandler(c echo.Context, tenantID int64, tenantDB *tenantDBConn) error {
+	var req struct {
+		Schemas    []string `json:"schemas"`
+		Operations []struct {
+			Op    string          `json:"op"`
+			Path  string          `json:"path"`
+			Value json.RawMessage `json:"value"`
+		} `json:"Operations"`
+	}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return scimErrorResponse(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+	}
+
+	var in scimUserInput
+	for _, op := range req.Operations {
+		switch strings.ToLower(op.Op) {
+		case "replace", "add":
+		default:
+			return scimErrorResponse(c, http.StatusBadRequest, "invalidValue", fmt.Sprintf("unsupported op: %s", op.Op))
+		}
+		// pathを省略した場合はvalueが属性のオブジェクト
+		if op.Path == "" {
+			if err := json.Unmarshal(op.Value, &in); err != nil {
+				return scimErrorResponse(c, http.StatusBadRequest, "invalidValue", err.Error())
+			}
+			continue
+		}
+		var dest any
+		switch op.Path {
+		case "userName":
+			dest = &in.UserName
+		case "externalId":
+			dest = &in.ExternalID
+		case "displayName", "name.formatted":
+			dest = &in.DisplayName
+		case "active":
+			dest = &in.Active
+		default:
+			return scimErrorResponse(c, http.StatusBadRequest, "invalidPath", fmt.Sprintf("unsupported path: %s", op.Path))
+		}
+		if err := json.Unmarshal(op.Value, dest); err != nil {
+			// activeを文字列の"False"で送ってくるIdPがある
+			if op.Path == "active" {
+				var s string
+				if json.Unmarshal(op.Value, &s) == nil {
+					if b, err := strconv.ParseBool(strings.ToLower(s)); err == nil {
+						in.Active = &b
+						continue
+					}
+				}
+			}
+			return scimErrorResponse(c, http.StatusBadRequest, "invalidValue", err.Error())
+		}
+	}
+	return applySCIMUser(c, tenantID, tenantDB, c.Param("id"), in)
+}
+
+// SCIM
+// DELETE /scim/v2/Users/:id
+// 参加者を失格にする (スコアを残すため削除はしない)
+func scimUserDeleteHandler(c echo.Context, tenantID int64, tenantDB *tenantDBConn) error {
+	ctx := c.Request().Context()
+	p, err := retrievePlayer(ctx, tenantDB, tenantID, c.Param("id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return scimErrorResponse(c, http.StatusNotFound, "", "user not found")
+		}
+		return err
+	}
+	if !p.IsDisqualified {
+		if _, err := disqualifyPlayer(ctx, tenantDB, tenantID, p.ID); err != nil {
+			return err
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// SCIM
+// GET /scim/v2/ServiceProviderConfig
+// 対応している機能を返す
+func scimServiceProviderConfigHandler(c echo.Context) error {
+	if tenant, err := scimAuthenticate(c); tenant == nil {
+		return err
+	}
+	supported := func(b bool) map[string]bool { return map[string]bool{"supported": b} }
+	return scimJSON(c, http.StatusOK, map[string]any{
+		"schemas":        []string{scimSchemaSPConfig},
+		"patch":          supported(true),
+		"bulk":           map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]any{"supported": true, "maxResults": scimMaxResults},
+		"changePassword": supported(false),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]any{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer Token",
+			"description": "テナント管理者が発行したトークン",
+		}},
+	})
+}
+
+type SCIMSettingsHandlerResult struct {
+	BaseURL string `json:"base_url"`
+	Enabled bool   `json:"enabled"`
+	Token   string `json:"token,omitempty"` // 発行したときだけ返す
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/scim
+// SCIMのエンドポイントとトークンを発行済みかを取得する
+func scimSettingsHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	hash, err := getTenantSetting(c.Request().Context(), v.tenantID, scimTokenHashSettingName)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: SCIMSettingsHandlerResult{
+		BaseURL: scimBaseURL(c),
+		Enabled: hash != "",
+	}})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/scim/token
+// SCIMのトークンを発行する、発行済みのトークンは使えなくなる
+// disable=1を指定するとトークンを削除してSCIMを使えなくする
+// トークンはこのレスポンスでだけ返す
+func scimTokenHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	res := SCIMSettingsHandlerResult{BaseURL: scimBaseURL(c)}
+	var hash string
+	if c.FormValue("disable") != "1" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Errorf("error rand.Read: %w", err)
+		}
+		res.Token = scimTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+		res.Enabled = true
+		hash = hashAPIToken(res.Token)
+	}
+	if err := setTenantSetting(c.Request().Context(), v.tenantID, scimTokenHashSettingName, hash); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
@@ -0,0 +1,207 @@
+package isuports
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 埋め込み用のスコアボード
+// 会場のディスプレイやテナントのサイトにiframeやJSで埋め込むための、軽いランキングを返す
+// 読み取り専用のAPIトークン (apitoken.go を参照) が必要で、iframeからはヘッダを送れないのでクエリのtokenでも受け付ける
+// ブラウザから別ドメインで呼ぶ場合は、テナントごとに許可したOriginにだけCORSのヘッダを返す
+
+const embedAllowedOriginsSettingName = "embed_allowed_origins"
+
+// 埋め込みの設定
+var (
+	// ディスプレイが数秒おきに取得しても負荷にならないようにキャッシュさせる
+	embedMaxAge               = getEnvDuration("ISUCON_EMBED_MAX_AGE", 5*time.Second)
+	embedStaleWhileRevalidate = getEnvDuration("ISUCON_EMBED_STALE_WHILE_REVALIDATE", 30*time.Second)
+)
+
+// 埋め込みのリクエストのViewerを返す
+// Authorizationヘッダがなければクエリのtokenを使う
+func parseEmbedViewer(c echo.Context) (*Viewer, error) {
+	token, ok := apiTokenFromHeader(c)
+	if !ok {
+		token = c.QueryParam("token")
+		if !strings.HasPrefix(token, apiTokenPrefix) {
+			return nil, echo.NewHTTPError(http.StatusUnauthorized, "api token is required")
+		}
+	}
+	return parseAPITokenViewer(c, token)
+}
+
+type EmbedRank struct {
+	Rank              int64  `json:"rank"`
+	Score             int64  `json:"score"`
+	PlayerDisplayName string `json:"player_display_name"`
+}
+
+type EmbedRankingHandlerResult struct {
+	Competition CompetitionDetail `json:"competition"`
+	Ranks       []EmbedRank       `json:"ranks"`
+	GeneratedAt int64             `json:"generated_at"`
+}
+
+// 埋め込み用API
+// GET /embed/competition/:competition_id/ranking
+// 大会のランキングの上位を取得する
+// limitで件数を指定する (デフォルト20、最大100)
+func embedRankingHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	tenant, err := retrieveTenantRowFromHeader(c)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "tenant not found")
+		}
+		return fmt.Errorf("error retrieveTenantRowFromHeader: %w", err)
+	}
+	origins, err := allowedOrigins(c, tenant.ID, embedAllowedOriginsSettingName)
+	if err != nil {
+		return err
+	}
+	// エラーのレスポンスもブラウザから読めるように先に設定する
+	setAllowOrigin(c, origins)
+
+	v, err := parseEmbedViewer(c)
+	if err != nil {
+		return err
+	}
+
+	limit := 20
+	if s := c.QueryParam("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid limit: %s", s))
+		}
+		if limit > 100 {
+			limit = 100
+		}
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	competitionID := c.Param("competition_id")
+	competition, err := retrieveCompetition(ctx, tenantDB, v.tenantID, competitionID)
+	if err != nil {
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+
+	ranks, err := competitionRanks(ctx, tenantDB, v.tenantID, competitionID)
+	if err != nil {
+		return err
+	}
+	if len(ranks) > limit {
+		ranks = ranks[:limit]
+	}
+	loc, err := tenantLocation(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	rs := make([]EmbedRank, 0, len(ranks))
+	for i, r := range ranks {
+		rs = append(rs, EmbedRank{
+			Rank:              int64(i + 1),
+			Score:             r.Score,
+			PlayerDisplayName: r.PlayerDisplayName,
+		})
+	}
+
+	res := EmbedRankingHandlerResult{
+		Competition: newCompetitionDetail(competition, loc),
+		Ranks:       rs,
+	}
+	// ETagは生成時刻を除いた内容から作り、順位が変わっていなければ304を返す
+	etag, err := contentETag(res)
+	if err != nil {
+		return err
+	}
+
+	h := c.Response().Header()
+	h.Set(echo.HeaderCacheControl, fmt.Sprintf(
+		"private, max-age=%d, stale-while-revalidate=%d",
+		int(embedMaxAge.Seconds()), int(embedStaleWhileRevalidate.Seconds()),
+	))
+	if notModified(c, etag, 0) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	res.GeneratedAt = srv(ctx).clock.Now().Unix()
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// 埋め込み用API
+// OPTIONS /embed/competition/:competition_id/ranking
+// CORSのプリフライトリクエストに応答する
+func embedPreflightHandler(c echo.Context) error {
+	tenant, err := retrieveTenantRowFromHeader(c)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "tenant not found")
+		}
+		return fmt.Errorf("error retrieveTenantRowFromHeader: %w", err)
+	}
+	origins, err := allowedOrigins(c, tenant.ID, embedAllowedOriginsSettingName)
+	if err != nil {
+		return err
+	}
+	if setAllowOrigin(c, origins) {
+		h := c.Response().Header()
+		h.Set(echo.HeaderAccessControlAllowMethods, http.MethodGet)
+		h.Set(echo.HeaderAccessControlAllowHeaders, echo.HeaderAuthorization)
+		h.Set(echo.HeaderAccessControlMaxAge, "600")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+type EmbedSettingsHandlerResult struct {
+	AllowedOrigins []string `json:"allowed_origins"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/embed
+// 埋め込み用のスコアボードを呼べるOriginを取得する
+func embedSettingsHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	s, err := getTenantSetting(c.Request().Context(), v.tenantID, embedAllowedOriginsSettingName)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: EmbedSettingsHandlerResult{AllowedOrigins: splitOrigins(s)}})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/embed
+// 埋め込み用のスコアボードを呼べるOriginを設定する
+// allowed_originsはカンマ区切りで、*なら全てのOriginを許可し、空ならCORSのヘッダを返さない
+func embedSettingsUpdateHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	if err := setAllowedOrigins(c, v.tenantID, embedAllowedOriginsSettingName, true); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
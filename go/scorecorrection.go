@@ -0,0 +1,72 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 終了した大会へのスコアのアップロード
+// 終了した大会のスコアは課金レポートの元になるので、どの経路 (CSV、URLからの取り込み、署名付きURL、他サービスの形式) でも
+// 400とコード competition_finished で拒否する
+// 結果の誤りを訂正する場合だけ、テナント管理者が POST /api/organizer/competition/:competition_id/score に
+// override=1 と理由 (reason) を指定して置き換えられる、その操作は監査ログ (audit.go) に残す
+
+// 終了した大会へのアップロードを拒否したときの FailureResult.Code
+const errorCodeCompetitionFinished = "competition_finished"
+
+// 終了した大会へのアップロード
+// errorResponseHandler が400とコードを返す
+type competitionFinishedError struct {
+	competitionID string
+}
+
+func (e *competitionFinishedError) Error() string {
+	return "competition is finished"
+}
+
+// アップロードするハンドラが、拒否したアップロードとして他の400と同じくテナント管理者に通知する (notify.go を参照)
+func (e *competitionFinishedError) Unwrap() error {
+	return echo.NewHTTPError(http.StatusBadRequest, e.Error())
+}
+
+func competitionFinishedResponse(c echo.Context, e *competitionFinishedError) error {
+	return c.JSON(http.StatusBadRequest, FailureResult{
+		Status:  false,
+		Message: e.Error(),
+		Code:    errorCodeCompetitionFinished,
+	})
+}
+
+// 大会が終了しているかを、キャッシュを通さずにテナントDBから読む
+// アップロードの確認をしてからロックを取るまでの間に終了した場合も拒否するため、ロックを取ってから呼ぶ
+func competitionFinishedAt(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string) (sql.NullInt64, error) {
+	var finishedAt sql.NullInt64
+	if err := tenantDB.GetContext(ctx, &finishedAt, "SELECT finished_at FROM competition WHERE tenant_id = ? AND id = ?", tenantID, competitionID); err != nil {
+		return finishedAt, fmt.Errorf("error Select competition: tenantID=%d, id=%s, %w", tenantID, competitionID, err)
+	}
+	return finishedAt, nil
+}
+
+// 終了した大会のスコアを置き換える操作者と理由
+type scoreCorrection struct {
+	actor  string // テナント管理者 (JWTのsub)
+	reason string
+}
+
+func (sc *scoreCorrection) auditEntry(ctx context.Context, competitionID string, rows, finishedAt int64) *auditEntry {
+	return &auditEntry{
+		actor:    sc.actor,
+		action:   auditActionScoreCorrection,
+		targetID: competitionID,
+		detail: map[string]any{
+			"reason":      sc.reason,
+			"rows":        rows,
+			"finished_at": finishedAt,
+			"request_id":  requestIDFromContext(ctx),
+		},
+	}
+}
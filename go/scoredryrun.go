@@ -0,0 +1,78 @@
+package isuports
+
+import (
+	"context"
+	"sort"
+)
+
+// スコアのアップロードのドライラン
+// POST /api/organizer/competition/:competition_id/score に dry_run=1 を指定すると、検証までは通常のアップロードと同じに行い、
+// 置き換えた場合にランキングがどう変わるかだけを返す
+// player_score、ライブモードのランキング、課金レポートのキャッシュ、Webhook、監査ログには何も書かない
+
+// ドライランで返す上位の件数
+const scoreDryRunTopRanks = 10
+
+type ScoreDryRunSummary struct {
+	PlayersRanked  int64             `json:"players_ranked"`  // 置き換え後のランキングの参加者数
+	PlayersAdded   int64             `json:"players_added"`   // 新たにランキングに載る参加者数
+	PlayersRemoved int64             `json:"players_removed"` // ランキングから消える参加者数
+	PlayersChanged int64             `json:"players_changed"` // スコアか順位が変わる参加者数 (追加と削除を除く)
+	TopRanks       []CompetitionRank `json:"top_ranks"`       // 置き換え後の上位
+}
+
+// 今のランキングとrowsで置き換えた後のランキングを比べる
+// 呼び出し側でlockTenantのロックを取っておくこと
+func summarizeScoreDryRun(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, competitionID string, rows []PlayerScoreRow) (*ScoreDryRunSummary, error) {
+	current, ok, err := srv(ctx).liveScores.ranks(ctx, tenantDB, tenantID, competitionID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if current, err = loadCompetitionRanks(ctx, tenantDB, tenantID, competitionID); err != nil {
+			return nil, err
+		}
+	}
+
+	// rowsはファイルに登場した順なので、row_numの降順に並べ替えてからランキングを作る (liveScoreStore.put と同じ)
+	sorted := make([]PlayerScoreRow, len(rows))
+	copy(sorted, rows)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].RowNum > sorted[j].RowNum })
+	next, err := buildCompetitionRanks(ctx, tenantDB, sorted)
+	if err != nil {
+		return nil, err
+	}
+
+	type position struct {
+		rank  int
+		score int64
+	}
+	before := make(map[string]position, len(current))
+	for i, r := range current {
+		before[r.PlayerID] = position{rank: i + 1, score: r.Score}
+	}
+	s := &ScoreDryRunSummary{PlayersRanked: int64(len(next))}
+	for i, r := range next {
+		p, ok := before[r.PlayerID]
+		if !ok {
+			s.PlayersAdded++
+			continue
+		}
+		if p.rank != i+1 || p.score != r.Score {
+			s.PlayersChanged++
+		}
+		delete(before, r.PlayerID)
+	}
+	s.PlayersRemoved = int64(len(before))
+
+	top := next
+	if len(top) > scoreDryRunTopRanks {
+		top = top[:scoreDryRunTopRanks]
+	}
+	s.TopRanks = make([]CompetitionRank, len(top))
+	for i, r := range top {
+		r.Rank = int64(i + 1)
+		s.TopRanks[i] = r
+	}
+	return s, nil
+}
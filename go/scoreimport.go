@@ -0,0 +1,195 @@
+package isuports
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// URLからのスコアの取り込み
+// 共有しているGoogleスプレッドシートや外部に置いたCSVを取得して、アップロードと同じ処理でスコアを置き換える
+// サーバーから任意のURLにリクエストすることになるので、httpsのみ、プライベートなアドレスへの接続は拒否する (outbound.go を参照)
+
+var (
+	scoreImportTimeout = getEnvDuration("ISUCON_SCORE_IMPORT_TIMEOUT", 30*time.Second)
+	// アップロードのボディの上限 (ISUCON_SCORE_BODY_LIMIT) と揃える
+	scoreImportMaxSize = int64(getEnvInt("ISUCON_SCORE_IMPORT_MAX_SIZE", 32<<20))
+	// 開発環境などでプライベートなアドレスからの取り込みを許す
+	scoreImportAllowPrivate = getEnv("ISUCON_SCORE_IMPORT_ALLOW_PRIVATE", "0") == "1"
+)
+
+var scoreImportClient = &http.Client{
+	Timeout: scoreImportTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: scoreImportDialGuard.control,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: scoreImportTimeout,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to non-https url: %s", req.URL.Redacted())
+		}
+		return nil
+	},
+}
+
+// 接続先のアドレスを検査する (outbound.go を参照)
+// ISUCON_SCORE_IMPORT_ALLOW_PRIVATE はスコアの取り込みだけに効く
+var scoreImportDialGuard = outboundGuard{allowPrivate: scoreImportAllowPrivate}
+
+// GoogleスプレッドシートのURLならCSVでエクスポートするURLに変える
+// https://docs.google.com/spreadsheets/d/{id}/edit#gid={gid} -> https://docs.google.com/spreadsheets/d/{id}/export?format=csv&gid={gid}
+func scoreImportURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil || len(rawURL) > 1024 {
+		return nil, errors.New("invalid url")
+	}
+	if strings.ToLower(u.Hostname()) != "docs.google.com" {
+		return u, nil
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 3 || parts[0] != "spreadsheets" || parts[1] != "d" || parts[2] == "e" {
+		// 「ウェブに公開」したURL (/spreadsheets/d/e/...) は output=csv を付けて指定してもらう
+		return u, nil
+	}
+	gid := u.Query().Get("gid")
+	if frag, err := url.ParseQuery(u.Fragment); err == nil && frag.Get("gid") != "" {
+		gid = frag.Get("gid")
+	}
+	q := url.Values{}
+	q.Set("format", "csv")
+	if gid != "" {
+		q.Set("gid", gid)
+	}
+	return &url.URL{
+		Scheme:   "https",
+		Host:     u.Host,
+		Path:     "/spreadsheets/d/" + parts[2] + "/export",
+		RawQuery: q.Encode(),
+	}, nil
+}
+
+// CSVかJSONのファイルを取得して、内容と形式を返す
+// 利用者に返すエラーはechoのHTTPErrorにする
+func fetchScoreCSV(ctx context.Context, u *url.URL) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", echo.NewHTTPError(http.StatusBadRequest, "invalid url")
+	}
+	req.Header.Set("Accept", "text/csv, text/plain;q=0.9, */*;q=0.1")
+	res, err := scoreImportClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+		return nil, "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("failed to fetch csv: %s", err))
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("failed to fetch csv: status=%d", res.StatusCode))
+	}
+	// 共有されていないスプレッドシートはログインページのHTMLが返る
+	if mt, _, err := mime.ParseMediaType(res.Header.Get(echo.HeaderContentType)); err == nil &&
+		(mt == echo.MIMETextHTML || strings.HasPrefix(mt, "image/") || strings.HasPrefix(mt, "video/")) {
+		return nil, "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("url is not a csv: content-type=%s", mt))
+	}
+	if res.ContentLength > scoreImportMaxSize {
+		return nil, "", echo.NewHTTPError(http.StatusBadRequest, "csv is too large")
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, scoreImportMaxSize+1))
+	if err != nil {
+		return nil, "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("failed to fetch csv: %s", err))
+	}
+	if int64(len(b)) > scoreImportMaxSize {
+		return nil, "", echo.NewHTTPError(http.StatusBadRequest, "csv is too large")
+	}
+	if !utf8.Valid(b) {
+		return nil, "", echo.NewHTTPError(http.StatusBadRequest, "csv must be encoded in UTF-8")
+	}
+	// Excelやスプレッドシートが付けるBOMを取り除く
+	return bytes.TrimPrefix(b, []byte("\xef\xbb\xbf")), ingestFormatOf(res.Header.Get(echo.HeaderContentType), u.Path), nil
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/competition/:competition_id/score/import_url
+// URLから取得したCSVで大会のスコアを置き換える
+func competitionScoreImportURLHandler(c echo.Context) (err error) {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "competition_id required")
+	}
+	comp, err := retrieveCompetition(ctx, tenantDB, v.tenantID, competitionID)
+	if err != nil {
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	// 取得やバリデーションで失敗した取り込みもアップロードと同じく通知する
+	defer func() {
+		var he *echo.HTTPError
+		if errors.As(err, &he) && he.Code == http.StatusBadRequest {
+			notifyScoreRejected(c, comp, fmt.Sprint(he.Message))
+		}
+	}()
+	if comp.FinishedAt.Valid {
+		return &competitionFinishedError{competitionID: comp.ID}
+	}
+
+	u, err := scoreImportURL(c.FormValue("url"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	b, format, err := fetchScoreCSV(ctx, u)
+	if err != nil {
+		return err
+	}
+
+	playerCheck, err := parsePlayerCheck(c)
+	if err != nil {
+		return err
+	}
+	res, q, err := importScores(ctx, tenantDB, v.tenantID, competitionID, scoreImportOptions{playerCheck: playerCheck}, bytes.NewReader(b), format)
+	if err != nil {
+		return err
+	}
+	if q != nil {
+		return quotaExceeded(c, http.StatusForbidden, *q)
+	}
+	archiveScoreCSV(v.tenantID, competitionID, path.Base(u.Path), b)
+
+	return c.JSON(http.StatusOK, SuccessResult{
+		Status: true,
+		Data:   res,
+	})
+}
@@ -0,0 +1,131 @@
+package isuports
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 署名付きURLによるスコアのアップロード
+// 数百MBのCSVはアプリケーションサーバーへのアップロードがタイムアウトするので、
+// テナント管理者がオブジェクトストレージに直接PUTし、その後でサーバーがオブジェクトから取り込む
+//  1. POST /api/organizer/competition/:competition_id/score?presign=1 でアップロード先のURLを発行する
+//  2. 発行したURLにCSVをPUTする
+//  3. POST /api/organizer/competition/:competition_id/score/ingest にupload_idを渡して取り込む
+// アップロードしたオブジェクトはそのままCSVの原本として残る
+
+// 署名付きURLの有効期間
+var scoreUploadURLExpires = getEnvDuration("ISUCON_SCORE_UPLOAD_URL_EXPIRES", 15*time.Minute)
+
+var scoreUploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// アップロード先のオブジェクトキー
+// upload_idだけをクライアントから受け取り、他のテナントや大会のオブジェクトを指定できないようにする
+func scoreUploadKey(tenantID int64, competitionID, uploadID string) string {
+	return objectStorage.key("scores", fmt.Sprintf("tenant-%d", tenantID), competitionID, "uploads", uploadID+".csv")
+}
+
+type ScoreUploadURLHandlerResult struct {
+	UploadID  string `json:"upload_id"`
+	URL       string `json:"url"`
+	Method    string `json:"method"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// 署名付きURLを発行する (competitionScoreHandler から呼ぶ)
+func scoreUploadURL(c echo.Context, tenantID int64, competitionID string) error {
+	if objectStorage == nil {
+		return echo.NewHTTPError(http.StatusNotImplemented, "object storage is not configured")
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("error rand.Read: %w", err)
+	}
+	uploadID := hex.EncodeToString(b)
+	now := time.Now()
+	return c.JSON(http.StatusOK, SuccessResult{
+		Status: true,
+		Data: ScoreUploadURLHandlerResult{
+			UploadID:  uploadID,
+			URL:       objectStorage.presign(http.MethodPut, scoreUploadKey(tenantID, competitionID, uploadID), scoreUploadURLExpires, now),
+			Method:    http.MethodPut,
+			ExpiresAt: now.Add(scoreUploadURLExpires).Unix(),
+		},
+	})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/competition/:competition_id/score/ingest
+// 署名付きURLにアップロードしたCSVで大会のスコアを置き換える
+func competitionScoreIngestHandler(c echo.Context) (err error) {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+	if objectStorage == nil {
+		return echo.NewHTTPError(http.StatusNotImplemented, "object storage is not configured")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "competition_id required")
+	}
+	comp, err := retrieveCompetition(ctx, tenantDB, v.tenantID, competitionID)
+	if err != nil {
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	defer func() {
+		var he *echo.HTTPError
+		if errors.As(err, &he) && he.Code == http.StatusBadRequest {
+			notifyScoreRejected(c, comp, fmt.Sprint(he.Message))
+		}
+	}()
+	if comp.FinishedAt.Valid {
+		return &competitionFinishedError{competitionID: comp.ID}
+	}
+
+	uploadID := c.FormValue("upload_id")
+	if !scoreUploadIDPattern.MatchString(uploadID) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid upload_id")
+	}
+	body, err := objectStorage.get(ctx, scoreUploadKey(v.tenantID, competitionID, uploadID))
+	if err != nil {
+		if errors.Is(err, errObjectNotFound) {
+			return echo.NewHTTPError(http.StatusBadRequest, "upload not found")
+		}
+		return err
+	}
+	defer body.Close()
+
+	playerCheck, err := parsePlayerCheck(c)
+	if err != nil {
+		return err
+	}
+	res, q, err := importScores(ctx, tenantDB, v.tenantID, competitionID, scoreImportOptions{playerCheck: playerCheck}, body, ingestFormatCSV)
+	if err != nil {
+		return err
+	}
+	if q != nil {
+		return quotaExceeded(c, http.StatusForbidden, *q)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{
+		Status: true,
+		Data:   res,
+	})
+}
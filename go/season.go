@@ -0,0 +1,530 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+)
+
+// シーズン
+// 1年を通したシリーズなど、複数の大会をまとめて通算の順位を出す
+// 大会は1つのシーズンにだけ属する (competition.season_id)
+// 通算の順位は参加者ごとに大会のスコア (ランキングと同じく最後の行) を集計して出す
+//   - sum:  全大会のスコアの合計
+//   - best: スコアの高い順に best_n 大会分の合計
+
+const (
+	seasonAggregationSum  = "sum"
+	seasonAggregationBest = "best"
+)
+
+type SeasonRow struct {
+	TenantID    int64  `db:"tenant_id"`
+	ID          string `db:"id"`
+	Title       string `db:"title"`
+	Aggregation string `db:"aggregation"`
+	BestN       int64  `db:"best_n"`
+	CreatedAt   int64  `db:"created_at"`
+	UpdatedAt   int64  `db:"updated_at"`
+}
+
+type SeasonDetail struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Aggregation string `json:"aggregation"`
+	BestN       int64  `json:"best_n,omitempty"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+func newSeasonDetail(s *SeasonRow) SeasonDetail {
+	return SeasonDetail{
+		ID:          s.ID,
+		Title:       s.Title,
+		Aggregation: s.Aggregation,
+		BestN:       s.BestN,
+		CreatedAt:   s.CreatedAt,
+	}
+}
+
+// シーズンを取得する
+func retrieveSeason(ctx context.Context, tenantDB dbOrTx, tenantID int64, id string) (*SeasonRow, error) {
+	var s SeasonRow
+	if err := tenantDB.GetContext(ctx, &s, "SELECT * FROM season WHERE tenant_id = ? AND id = ?", tenantID, id); err != nil {
+		err = fmt.Errorf("error Select season: tenantID=%d, id=%s, %w", tenantID, id, err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &notFoundError{resource: "season", err: err}
+		}
+		return nil, err
+	}
+	return &s, nil
+}
+
+type SeasonRequest struct {
+	Title       string `form:"title" validate:"required,max=255"`
+	Aggregation string `form:"aggregation" validate:"pattern=season_aggregation"`
+	BestN       int64  `form:"best_n" validate:"min=0"`
+}
+
+// aggregationの省略時はsum、bestならbest_nが必須
+func (r *SeasonRequest) normalize() error {
+	if r.Aggregation == "" {
+		r.Aggregation = seasonAggregationSum
+	}
+	if r.Aggregation == seasonAggregationSum {
+		r.BestN = 0
+		return nil
+	}
+	if r.BestN < 1 {
+		return &requestError{fields: []FieldError{{Field: "best_n", Code: fieldErrMin, Message: "best_n must be at least 1 when aggregation is best"}}}
+	}
+	return nil
+}
+
+type SeasonsHandlerResult struct {
+	Seasons []SeasonDetail `json:"seasons"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/seasons
+// シーズンの一覧を取得する
+func organizerSeasonsHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	tenantDB, err := connectToTenantDB(c.Request().Context(), v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	return seasonsHandler(c, v, tenantDB)
+}
+
+// 参加者向けAPI
+// GET /api/player/seasons
+// シーズンの一覧を取得する
+func playerSeasonsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return err
+	}
+	// 読み取り専用のAPIトークンでも取得できる
+	if v.role != RolePlayer && v.role != RoleReader {
+		return echo.NewHTTPError(http.StatusForbidden, "role player required")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	if v.role == RolePlayer {
+		if err := authorizePlayer(ctx, tenantDB, v.tenantID, v.playerID); err != nil {
+			return err
+		}
+	}
+	return seasonsHandler(c, v, tenantDB)
+}
+
+func seasonsHandler(c echo.Context, v *Viewer, tenantDB dbOrTx) error {
+	ctx := c.Request().Context()
+
+	ss := []SeasonRow{}
+	if err := tenantDB.SelectContext(ctx, &ss, "SELECT * FROM season WHERE tenant_id = ? ORDER BY created_at DESC", v.tenantID); err != nil {
+		return fmt.Errorf("error Select season: tenantID=%d, %w", v.tenantID, err)
+	}
+	res := SeasonsHandlerResult{Seasons: make([]SeasonDetail, 0, len(ss))}
+	for i := range ss {
+		res.Seasons = append(res.Seasons, newSeasonDetail(&ss[i]))
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+type SeasonHandlerResult struct {
+	Season SeasonDetail `json:"season"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/seasons/add
+// シーズンを追加する
+func seasonsAddHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	var req SeasonRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+	if err := req.normalize(); err != nil {
+		return err
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	id, err := dispenseID(ctx)
+	if err != nil {
+		return fmt.Errorf("error dispenseID: %w", err)
+	}
+	now := srv(ctx).clock.Now().Unix()
+	s := SeasonRow{
+		TenantID:    v.tenantID,
+		ID:          id,
+		Title:       req.Title,
+		Aggregation: req.Aggregation,
+		BestN:       req.BestN,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := withRetry(ctx, func() error {
+		_, err := tenantDB.NamedExecContext(
+			ctx,
+			"INSERT INTO season (id, tenant_id, title, aggregation, best_n, created_at, updated_at) VALUES (:id, :tenant_id, :title, :aggregation, :best_n, :created_at, :updated_at)",
+			s,
+		)
+		return err
+	}); err != nil {
+		return fmt.Errorf("error Insert season: tenantID=%d, id=%s, %w", v.tenantID, id, err)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: SeasonHandlerResult{Season: newSeasonDetail(&s)}})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/season/:season_id
+// シーズンの名前と集計方法を変更する
+func seasonUpdateHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	seasonID := c.Param("season_id")
+	var req SeasonRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+	if err := req.normalize(); err != nil {
+		return err
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	s, err := retrieveSeason(ctx, tenantDB, v.tenantID, seasonID)
+	if err != nil {
+		return err
+	}
+	s.Title, s.Aggregation, s.BestN = req.Title, req.Aggregation, req.BestN
+	s.UpdatedAt = srv(ctx).clock.Now().Unix()
+	if err := withRetry(ctx, func() error {
+		_, err := tenantDB.ExecContext(
+			ctx,
+			"UPDATE season SET title = ?, aggregation = ?, best_n = ?, updated_at = ? WHERE tenant_id = ? AND id = ?",
+			s.Title, s.Aggregation, s.BestN, s.UpdatedAt, v.tenantID, seasonID,
+		)
+		return err
+	}); err != nil {
+		return fmt.Errorf("error Update season: tenantID=%d, id=%s, %w", v.tenantID, seasonID, err)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: SeasonHandlerResult{Season: newSeasonDetail(s)}})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/season/:season_id/delete
+// シーズンを削除する
+// 属していた大会は消さず、どのシーズンにも属さない大会にする
+func seasonDeleteHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	seasonID := c.Param("season_id")
+	if _, err := retrieveSeason(ctx, tenantDB, v.tenantID, seasonID); err != nil {
+		return err
+	}
+
+	now := srv(ctx).clock.Now().Unix()
+	var compIDs []string
+	if err := withRetry(ctx, func() error {
+		tx, err := tenantDB.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		compIDs = []string{}
+		if err := tx.SelectContext(ctx, &compIDs, "SELECT id FROM competition WHERE tenant_id = ? AND season_id = ?", v.tenantID, seasonID); err != nil {
+			return fmt.Errorf("error Select competition: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE competition SET season_id = NULL, updated_at = ? WHERE tenant_id = ? AND season_id = ?", now, v.tenantID, seasonID); err != nil {
+			return fmt.Errorf("error Update competition: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM season WHERE tenant_id = ? AND id = ?", v.tenantID, seasonID); err != nil {
+			return fmt.Errorf("error Delete season: %w", err)
+		}
+		return tx.Commit()
+	}); err != nil {
+		return fmt.Errorf("error deleting season: tenantID=%d, id=%s, %w", v.tenantID, seasonID, err)
+	}
+	for _, id := range compIDs {
+		srv(ctx).competitionCache.Delete(tenantKey{v.tenantID, id})
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/competition/:competition_id/season
+// 大会の属するシーズンを変更する、season_idが空ならどのシーズンにも属さない大会にする
+func competitionSeasonHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	competitionID := c.Param("competition_id")
+	comp, err := retrieveCompetition(ctx, tenantDB, v.tenantID, competitionID)
+	if err != nil {
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	seasonID, err := competitionSeasonID(ctx, tenantDB, v.tenantID, c.FormValue("season_id"))
+	if err != nil {
+		return err
+	}
+
+	now := srv(ctx).clock.Now().Unix()
+	if err := withRetry(ctx, func() error {
+		_, err := tenantDB.ExecContext(
+			ctx,
+			"UPDATE competition SET season_id = ?, updated_at = ? WHERE tenant_id = ? AND id = ?",
+			seasonID, now, v.tenantID, competitionID,
+		)
+		return err
+	}); err != nil {
+		return fmt.Errorf("error Update competition: tenantID=%d, id=%s, %w", v.tenantID, competitionID, err)
+	}
+	srv(ctx).competitionCache.Delete(tenantKey{v.tenantID, competitionID})
+
+	comp.SeasonID, comp.UpdatedAt = seasonID, now
+	loc, err := tenantLocation(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: CompetitionsAddHandlerResult{Competition: newCompetitionDetail(comp, loc)}})
+}
+
+// 大会に設定するシーズンID、存在しないシーズンなら404を返す
+// 空ならNULLにする
+func competitionSeasonID(ctx context.Context, tenantDB dbOrTx, tenantID int64, id string) (sql.NullString, error) {
+	if id == "" {
+		return sql.NullString{}, nil
+	}
+	if _, err := retrieveSeason(ctx, tenantDB, tenantID, id); err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: id, Valid: true}, nil
+}
+
+type SeasonStanding struct {
+	Rank              int64  `json:"rank"`
+	Score             int64  `json:"score"`
+	PlayerID          string `json:"player_id"`
+	PlayerDisplayName string `json:"player_display_name"`
+	// スコアのある大会の数 (bestの場合は集計に使わなかった大会も含む)
+	Competitions int64 `json:"competitions"`
+}
+
+type SeasonStandingsHandlerResult struct {
+	Season     SeasonDetail     `json:"season"`
+	Pagination Pagination       `json:"pagination"`
+	Standings  []SeasonStanding `json:"standings"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/season/:season_id/standings
+// シーズンの通算の順位を取得する
+func organizerSeasonStandingsHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	tenantDB, err := connectToTenantDB(c.Request().Context(), v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	return seasonStandingsHandler(c, v, tenantDB)
+}
+
+// 参加者向けAPI
+// GET /api/player/season/:season_id/standings
+// シーズンの通算の順位を取得する
+func playerSeasonStandingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return err
+	}
+	// 読み取り専用のAPIトークンでも取得できる
+	if v.role != RolePlayer && v.role != RoleReader {
+		return echo.NewHTTPError(http.StatusForbidden, "role player required")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	if v.role == RolePlayer {
+		if err := authorizePlayer(ctx, tenantDB, v.tenantID, v.playerID); err != nil {
+			return err
+		}
+	}
+	return seasonStandingsHandler(c, v, tenantDB)
+}
+
+func seasonStandingsHandler(c echo.Context, v *Viewer, tenantDB *tenantDBConn) error {
+	ctx := c.Request().Context()
+
+	season, err := retrieveSeason(ctx, tenantDB, v.tenantID, c.Param("season_id"))
+	if err != nil {
+		return err
+	}
+	page, err := parsePageParams(c, 100, 1000)
+	if err != nil {
+		return err
+	}
+	standings, err := loadSeasonStandings(ctx, tenantDB, season)
+	if err != nil {
+		return err
+	}
+	start, end, pg, err := offsetPage(page, 0, len(standings))
+	if err != nil {
+		return err
+	}
+	pg.setLinks(c)
+
+	// SeasonStandingsHandlerResultの形でストリーミングで返す
+	fields := []streamField{
+		{Key: "season", Value: newSeasonDetail(season)},
+		{Key: "pagination", Value: pg},
+	}
+	return streamSuccessList(c, fields, "standings", func(emit func(v any) error) error {
+		for i := start; i < end; i++ {
+			if err := emit(standings[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// シーズンに属する大会のランキングから通算の順位を作る
+func loadSeasonStandings(ctx context.Context, tenantDB *tenantDBConn, season *SeasonRow) ([]SeasonStanding, error) {
+	compIDs := []string{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&compIDs,
+		"SELECT id FROM competition WHERE tenant_id = ? AND season_id = ? ORDER BY created_at ASC",
+		season.TenantID, season.ID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select competition: tenantID=%d, seasonID=%s, %w", season.TenantID, season.ID, err)
+	}
+
+	scores := map[string][]int64{}
+	names := map[string]string{}
+	for _, compID := range compIDs {
+		// 大会のランキングAPIと同じスコアを使う
+		ranks, err := competitionRanks(ctx, tenantDB, season.TenantID, compID)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range ranks {
+			scores[r.PlayerID] = append(scores[r.PlayerID], r.Score)
+			names[r.PlayerID] = r.PlayerDisplayName
+		}
+	}
+
+	standings := make([]SeasonStanding, 0, len(scores))
+	for playerID, ss := range scores {
+		counted := ss
+		if season.Aggregation == seasonAggregationBest && int64(len(ss)) > season.BestN {
+			sort.Slice(ss, func(i, j int) bool { return ss[i] > ss[j] })
+			counted = ss[:season.BestN]
+		}
+		var total int64
+		for _, s := range counted {
+			total += s
+		}
+		standings = append(standings, SeasonStanding{
+			Score:             total,
+			PlayerID:          playerID,
+			PlayerDisplayName: names[playerID],
+			Competitions:      int64(len(ss)),
+		})
+	}
+	// スコアの降順、同じならplayer_idの昇順
+	sort.Slice(standings, func(i, j int) bool {
+		if standings[i].Score != standings[j].Score {
+			return standings[i].Score > standings[j].Score
+		}
+		return standings[i].PlayerID < standings[j].PlayerID
+	})
+	for i := range standings {
+		standings[i].Rank = int64(i + 1)
+	}
+	return standings, nil
+}
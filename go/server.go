@@ -0,0 +1,201 @@
+package isuports
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/logica0419/helpisu"
+)
+
+// サーバーの依存
+// 管理用DB、テナントDBのプール、SQLiteのドライバ名、時計、テナントのデータのキャッシュと、
+// テナントDBを扱う処理が持つ状態 (マイグレーション済みのテナント、ロック、ライブモードのスコアなど) をまとめて持つ
+// リクエストのcontextに入れておき (Server.middleware)、ハンドラとその先の関数は srv(ctx) で取り出す
+// テストではテナントDBのディレクトリを分けたServerを複数作り、同時に動かせる
+// (ISUCON_TENANT_DB_DIR などの設定値、メトリクスの集計、JWTの署名鍵とIdPの設定のキャッシュはプロセスで共有する)
+//
+// リクエストのcontextを持たない処理 (定期的に実行する処理など) は withServer でServerを入れたcontextを渡す
+// Run とサブコマンドが作ったServerを defaultServer にし、メトリクスの公開とシグナルでの再読み込みはそれを使う
+type Server struct {
+	adminDB *sqlx.DB
+	// 参照系クエリの接続先
+	// レプリカが設定されていなければadminDBと同じものを指す
+	adminReadDB      *sqlx.DB
+	tenantDBs        *tenantDBPool
+	sqliteDriverName string
+	clock            Clock
+	// 設定されていればIDを連番で払い出す (idgen.go を参照)
+	sequentialIDs *sequentialIDGenerator
+
+	// テナントのデータのキャッシュ
+	// 別のServerとは別のDBを見ているかもしれないので共有しない
+	tenantRowCache      *ttlCache[string, TenantRow]
+	apiTokenCache       *ttlCache[string, APITokenRow]
+	allowedOriginsCache *ttlCache[tenantKey, []string]
+	playerCache         *helpisu.Cache[tenantKey, PlayerRow]
+	competitionCache    *helpisu.Cache[tenantKey, CompetitionRow]
+	billingReportCache  *helpisu.Cache[string, BillingReport]
+	tenantLocationCache *helpisu.Cache[int64, *time.Location]
+	tenantCache         *helpisu.Cache[int64, struct{}]
+
+	// 書き出し待ちの訪問履歴 (visit.go を参照)
+	visits *visitQueue
+
+	// マイグレーション済みのテナントID (migrate.go を参照)
+	migratedTenants *migratedTenantSet
+	// 払い出したIDの最大値 (dispenseID を参照)
+	dispensed *dispensedID
+	// ライブモードの大会のスコア (livescore.go を参照)
+	liveScores *liveScoreStore
+	// このServerが持っているテナントのロック (tenantlock.go を参照)
+	tenantLocks *tenantLockStats
+	// 同時アクセスをまとめる集計
+	billingFlight *flightGroup[[]BillingReport]
+	rankingFlight *flightGroup[[]CompetitionRank]
+	// バックグラウンドのレーティングの計算し直し (rating.go を参照)
+	ratingRecomputes *ratingRecomputer
+	// 送信中の通知 (notify.go を参照)
+	notifications sync.WaitGroup
+	// 定期的に実行する処理は最初の初期化で1回だけ開始する (initializeHandler を参照)
+	initializeTickersOnce sync.Once
+	// 管理DBとの接続が切れたら知らせる (Run で設定する)
+	disconnectDetector *helpisu.DBDisconnectDetector
+
+	// 起動時に設定から作るもの
+	shards         *shardRouter
+	jwtVerifier    *jwtVerifier
+	quotas         tenantQuotaConfig
+	requestLimiter *tenantRateLimiter
+}
+
+type ServerOption func(*Server)
+
+// 時計を差し替える (clock.go を参照)
+func WithClock(c Clock) ServerOption {
+	return func(s *Server) {
+		s.clock = c
+	}
+}
+
+// テナントDBを開くドライバを差し替える
+func WithSQLiteDriver(name string) ServerOption {
+	return func(s *Server) {
+		s.sqliteDriverName = name
+	}
+}
+
+// 管理用DBの読み取り用レプリカを使う
+func WithAdminReadDB(db *sqlx.DB) ServerOption {
+	return func(s *Server) {
+		s.adminReadDB = db
+	}
+}
+
+// 同時に開いておくテナントDBの上限
+func WithTenantDBMaxOpen(n int) ServerOption {
+	return func(s *Server) {
+		s.tenantDBs = newTenantDBPool(n)
+	}
+}
+
+// JWTの公開鍵の読み込み方を差し替える
+func WithJWTKeyLoader(loadKey func() (any, error)) ServerOption {
+	return func(s *Server) {
+		s.jwtVerifier = newJWTVerifier(loadKey)
+	}
+}
+
+// IDを seed の次から連番で払い出す
+func WithSequentialIDs(seed int64) ServerOption {
+	return func(s *Server) {
+		s.sequentialIDs = newSequentialIDGenerator(seed)
+	}
+}
+
+func NewServer(adminDB *sqlx.DB, opts ...ServerOption) *Server {
+	tenantCacheTTL := getEnvDuration("ISUCON_TENANT_CACHE_TTL", time.Minute)
+	s := &Server{
+		adminDB:          adminDB,
+		adminReadDB:      adminDB,
+		tenantDBs:        newTenantDBPool(getEnvInt("ISUCON_TENANT_DB_MAX_OPEN", 1000)),
+		sqliteDriverName: "sqlite3",
+		clock:            newClock(getEnv("ISUCON_FROZEN_TIME", "")),
+
+		tenantRowCache:      newTTLCache[string, TenantRow](tenantCacheTTL),
+		apiTokenCache:       newTTLCache[string, APITokenRow](getEnvDuration("ISUCON_API_TOKEN_CACHE_TTL", time.Minute)),
+		allowedOriginsCache: newTTLCache[tenantKey, []string](tenantCacheTTL),
+		playerCache:         helpisu.NewCache[tenantKey, PlayerRow](),
+		competitionCache:    helpisu.NewCache[tenantKey, CompetitionRow](),
+		billingReportCache:  helpisu.NewCache[string, BillingReport](),
+		tenantLocationCache: helpisu.NewCache[int64, *time.Location](),
+		tenantCache:         helpisu.NewCache[int64, struct{}](),
+		visits:              newVisitQueue(),
+
+		migratedTenants: newMigratedTenantSet(),
+		dispensed:       &dispensedID{cur: -1},
+		liveScores:      newLiveScoreStore(),
+		tenantLocks:     newTenantLockStats(),
+		billingFlight:   &flightGroup[[]BillingReport]{},
+		rankingFlight:   &flightGroup[[]CompetitionRank]{},
+
+		ratingRecomputes: newRatingRecomputer(),
+
+		shards:      defaultShards,
+		jwtVerifier: newJWTVerifier(loadJWTKey),
+	}
+	s.quotas = tenantQuotaConfigFromEnv()
+	s.requestLimiter = newTenantRateLimiter(s.quotas)
+	if seed := getEnv("ISUCON_SEQUENTIAL_ID_SEED", ""); seed != "" {
+		s.sequentialIDs = newSequentialIDGenerator(parseSequentialIDSeed(seed))
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// テナントに紐づくキャッシュを全て消す
+func (s *Server) resetCaches() {
+	s.tenantRowCache.Reset()
+	s.apiTokenCache.Reset()
+	s.allowedOriginsCache.Reset()
+	s.playerCache.Reset()
+	s.competitionCache.Reset()
+	s.billingReportCache.Reset()
+	s.tenantLocationCache.Reset()
+	s.tenantCache.Reset()
+}
+
+var defaultServer *Server
+
+type serverContextKey struct{}
+
+// ctxにsを入れる
+// リクエストの処理から始めたバックグラウンドの処理にも、元のリクエストのServerを引き継ぐときに使う
+func withServer(ctx context.Context, s *Server) context.Context {
+	return context.WithValue(ctx, serverContextKey{}, s)
+}
+
+// ctxのServerを返す
+// 入っていないのは呼び出し側の誤りなので、別のServerの状態を使ってしまわないようpanicする
+func srv(ctx context.Context) *Server {
+	s, ok := ctx.Value(serverContextKey{}).(*Server)
+	if !ok {
+		panic("isuports: no Server in context")
+	}
+	return s
+}
+
+// リクエストのcontextにServerを入れる
+func (s *Server) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			c.SetRequest(req.WithContext(withServer(req.Context(), s)))
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package isuports
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// テストで使うテナントID
+const testTenantID = 1
+
+// テストの時計の初期値
+var testNow = time.Date(2022, 7, 23, 10, 0, 0, 0, time.UTC)
+
+// 一時ディレクトリのテナントDBを使うServerを作る
+// テナントDBは埋め込んだマイグレーション (schema/tenant) から作り、管理用DBは偽物 (admindb_test.go を参照) にする
+// 返すcontextにはServerが入っている
+func newTestServer(t *testing.T, opts ...ServerOption) (context.Context, *Server) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("ISUCON_TENANT_DB_DIR", dir)
+
+	adminDB := openFakeAdminDB(t, dir)
+
+	opts = append([]ServerOption{WithClock(newFrozenClock(testNow)), WithSequentialIDs(0)}, opts...)
+	s := NewServer(adminDB, opts...)
+	if err := s.createTenantDB(testTenantID); err != nil {
+		t.Fatalf("failed to create tenant DB: %s", err)
+	}
+	t.Cleanup(func() {
+		// バックグラウンドのレーティングの計算し直しと通知がテナントDBを閉じた後に動かないよう待つ
+		s.ratingRecomputes.wait()
+		s.notifications.Wait()
+		s.tenantDBs.closeAll()
+		adminDB.Close()
+	})
+	return withServer(context.Background(), s), s
+}
+
+// テナントDBに参加者を追加する
+func insertTestPlayers(t *testing.T, ctx context.Context, ids ...string) {
+	t.Helper()
+	tenantDB, err := connectToTenantDB(ctx, testTenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tenantDB.Close()
+	now := srv(ctx).clock.Now().Unix()
+	for _, id := range ids {
+		if _, err := tenantDB.ExecContext(
+			ctx,
+			"INSERT INTO player (id, tenant_id, display_name, is_disqualified, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+			id, testTenantID, "name-"+id, false, now, now,
+		); err != nil {
+			t.Fatalf("failed to insert player: %s", err)
+		}
+	}
+}
+
+// テナントDBに大会を追加する、finishedAtが0なら開催中
+func insertTestCompetition(t *testing.T, ctx context.Context, id string, finishedAt int64) {
+	t.Helper()
+	tenantDB, err := connectToTenantDB(ctx, testTenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tenantDB.Close()
+	now := srv(ctx).clock.Now().Unix()
+	var fa any
+	if finishedAt != 0 {
+		fa = finishedAt
+	}
+	if _, err := tenantDB.ExecContext(
+		ctx,
+		"INSERT INTO competition (id, tenant_id, title, finished_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+		id, testTenantID, "title-"+id, fa, now, now,
+	); err != nil {
+		t.Fatalf("failed to insert competition: %s", err)
+	}
+}
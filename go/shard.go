@@ -0,0 +1,154 @@
+package isuports
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// テナントのシャーディング
+// テナントIDの範囲ごとに担当するアプリケーションサーバーを決め、テナントDB(SQLiteのファイル)はそのサーバーだけが持つ
+// 担当でないサーバーに来たリクエストは、担当のサーバーにプロキシするか307でリダイレクトする
+//
+//	ISUCON_SHARDS      "1-100=http://10.0.0.1:3000,101-=http://10.0.0.2:3000" の形式 (上限を省略すると無制限)
+//	ISUCON_SHARD_SELF  自分のサーバーのURL (ISUCON_SHARDSの値のどれかと一致させる)
+//	ISUCON_SHARD_MODE  proxy か redirect (デフォルトは proxy)
+//
+// redirectの場合はURLの {tenant} をテナント名に置き換えてLocationにする
+// SaaS管理者向けAPIと /initialize は振り分けの対象にしない
+// 未設定の場合は1台ですべてのテナントを持つ
+type shardRange struct {
+	min, max int64 // maxが0なら上限なし
+	target   string
+	proxy    *httputil.ReverseProxy
+}
+
+type shardRouter struct {
+	ranges   []shardRange
+	self     string
+	redirect bool
+}
+
+// 起動時の設定から作った振り分け、NewServerで使う
+// 設定が不正な場合は振り分けをせず、Runでエラーにする
+var defaultShards, shardConfigErr = newShardRouterFromConfig()
+
+func newShardRouterFromConfig() (*shardRouter, error) {
+	r := &shardRouter{
+		self:     strings.TrimSuffix(getEnv("ISUCON_SHARD_SELF", ""), "/"),
+		redirect: getEnv("ISUCON_SHARD_MODE", "proxy") == "redirect",
+	}
+	for _, kv := range strings.Split(getEnv("ISUCON_SHARDS", ""), ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return &shardRouter{}, fmt.Errorf("invalid ISUCON_SHARDS: %s", kv)
+		}
+		lo, hi, ok := strings.Cut(kv[:i], "-")
+		if !ok {
+			return &shardRouter{}, fmt.Errorf("invalid ISUCON_SHARDS range: %s", kv)
+		}
+		var (
+			sr  = shardRange{target: strings.TrimSuffix(kv[i+1:], "/")}
+			err error
+		)
+		if sr.min, err = strconv.ParseInt(lo, 10, 64); err != nil {
+			return &shardRouter{}, fmt.Errorf("invalid ISUCON_SHARDS range: %s, %w", kv, err)
+		}
+		if hi != "" {
+			if sr.max, err = strconv.ParseInt(hi, 10, 64); err != nil {
+				return &shardRouter{}, fmt.Errorf("invalid ISUCON_SHARDS range: %s, %w", kv, err)
+			}
+		}
+		if !r.redirect {
+			u, err := url.Parse(sr.target)
+			if err != nil {
+				return &shardRouter{}, fmt.Errorf("invalid ISUCON_SHARDS target: %s, %w", kv, err)
+			}
+			// Hostヘッダはテナントの判定に使うので書き換えずにそのまま渡す
+			sr.proxy = httputil.NewSingleHostReverseProxy(u)
+		}
+		r.ranges = append(r.ranges, sr)
+	}
+	if len(r.ranges) > 0 && r.self == "" {
+		return &shardRouter{}, fmt.Errorf("ISUCON_SHARD_SELF is required when ISUCON_SHARDS is set")
+	}
+	return r, nil
+}
+
+func (r *shardRouter) enabled() bool {
+	return len(r.ranges) > 0
+}
+
+// テナントを担当する範囲を返す、どの範囲にも入らなければnil
+func (r *shardRouter) lookup(tenantID int64) *shardRange {
+	for i := range r.ranges {
+		sr := &r.ranges[i]
+		if tenantID >= sr.min && (sr.max == 0 || tenantID <= sr.max) {
+			return sr
+		}
+	}
+	return nil
+}
+
+// このサーバーがテナントDBを持つテナントか
+// シャーディングしていない場合は常にtrue
+func (r *shardRouter) owns(tenantID int64) bool {
+	if !r.enabled() {
+		return true
+	}
+	sr := r.lookup(tenantID)
+	return sr != nil && sr.target == r.self
+}
+
+// 他のサーバーから転送されてきたリクエストにつけるヘッダ
+// 設定の食い違いで転送がループしないようにする
+const shardForwardedHeader = "X-Isuports-Shard-Forwarded"
+
+// 担当でないテナントへのリクエストを担当のサーバーに振り分けるmiddleware
+// ルーティング後のパスを使うので e.Use で登録すること
+// 振り分けはリクエストのServerのものを使う
+func shardMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := srv(c.Request().Context()).shards
+			if !r.enabled() {
+				return next(c)
+			}
+			path := c.Path()
+			if path == "/initialize" || strings.HasPrefix(path, "/api/admin/") {
+				return next(c)
+			}
+			tenant, err := retrieveTenantRowFromHeader(c)
+			if err != nil || tenant.Name == "admin" {
+				// テナントが見つからない場合のエラーはハンドラに任せる
+				return next(c)
+			}
+			if r.owns(tenant.ID) {
+				return next(c)
+			}
+			sr := r.lookup(tenant.ID)
+			if sr == nil {
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "no shard for tenant")
+			}
+			if c.Request().Header.Get(shardForwardedHeader) != "" {
+				return fmt.Errorf("shard forwarding loop: tenantID=%d, target=%s", tenant.ID, sr.target)
+			}
+			if r.redirect {
+				location := strings.ReplaceAll(sr.target, "{tenant}", tenant.Name) + c.Request().RequestURI
+				return c.Redirect(http.StatusTemporaryRedirect, location)
+			}
+			c.Request().Header.Set(shardForwardedHeader, r.self)
+			sr.proxy.ServeHTTP(c.Response(), c.Request())
+			return nil
+		}
+	}
+}
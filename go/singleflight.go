@@ -0,0 +1,102 @@
+package isuports
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 同じキーに対する重い読み取りを1回にまとめる
+// 実行中に同じキーで呼ばれた場合は、新たに実行せず先に始まった呼び出しの結果を共有する
+// 結果は複数のリクエストで共有されるので、呼び出し側で書き換えないこと
+//
+// fnは最初の呼び出し元のcontextから切り離したcontext (detachedContext) で実行する
+// 最初のリクエストが切断されても、待っている側は context.Canceled ではなく結果を受け取れる
+// 待っている呼び出し元 (最初の呼び出し元を含む) が全員いなくなったら、切り離したcontextもキャンセルする
+// 切り離したcontextには ISUCON_FLIGHT_TIMEOUT のタイムアウトもつける
+type flightGroup[V any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[V]
+}
+
+type flightCall[V any] struct {
+	done chan struct{}
+	val  V
+	err  error
+
+	// まだ結果を待っている呼び出し元の数、flightGroup.muで守る
+	waiters int
+	cancel  context.CancelFunc
+}
+
+var flightTimeout = getEnvDuration("ISUCON_FLIGHT_TIMEOUT", 30*time.Second)
+
+// 待っている側は自分のctxが終わればその時点で諦める
+// 最初の呼び出し元はfnが終わるまで待つので、fnで使うテナントDBの接続などは呼び出し元で閉じてよい
+func (g *flightGroup[V]) Do(ctx context.Context, key string, fn func(ctx context.Context) (V, error)) (V, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall[V]{}
+	}
+	if call, ok := g.calls[key]; ok {
+		call.waiters++
+		g.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.val, call.err
+		case <-ctx.Done():
+			g.leave(key, call)
+			var zero V
+			return zero, ctx.Err()
+		}
+	}
+	fctx, cancel := context.WithTimeout(detachedContext{ctx}, flightTimeout)
+	defer cancel()
+	call := &flightCall[V]{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		if g.calls[key] == call {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	// 最初の呼び出し元もfnの実行中に切断されたら待つのをやめたものとして数える
+	go func() {
+		select {
+		case <-ctx.Done():
+			g.leave(key, call)
+		case <-call.done:
+		}
+	}()
+	call.val, call.err = fn(fctx)
+	return call.val, call.err
+}
+
+// 呼び出し元が待つのをやめる
+// 誰も待っていなくなったらfnをキャンセルし、後から来た呼び出しはキャンセルされたものを共有せずに新しく実行する
+func (g *flightGroup[V]) leave(key string, call *flightCall[V]) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if call.waiters--; call.waiters > 0 {
+		return
+	}
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+	call.cancel()
+}
+
+// 親のcontextの値 (Server、リクエストIDなど) だけを引き継ぎ、キャンセルと期限は引き継がないcontext
+// go1.21 の context.WithoutCancel と同じ
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (c detachedContext) Done() <-chan struct{}       { return nil }
+func (c detachedContext) Err() error                  { return nil }
+func (c detachedContext) Value(key any) any           { return c.parent.Value(key) }
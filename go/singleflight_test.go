@@ -0,0 +1,112 @@
+package isuports
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// keyの呼び出しをn個の呼び出し元が待ち始めるまで待つ
+func waitFlightWaiters[V any](g *flightGroup[V], key string, n int) {
+	for {
+		g.mu.Lock()
+		waiters := g.calls[key].waiters
+		g.mu.Unlock()
+		if waiters == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlightGroupCancel(t *testing.T) {
+	t.Run("cancel fn when every caller has left", func(t *testing.T) {
+		g := &flightGroup[int]{}
+		started := make(chan struct{})
+		fnErr := make(chan error, 1)
+		leaderCtx, cancelLeader := context.WithCancel(context.Background())
+		leaderDone := make(chan struct{})
+		go func() {
+			defer close(leaderDone)
+			g.Do(leaderCtx, "k", func(ctx context.Context) (int, error) {
+				close(started)
+				<-ctx.Done()
+				fnErr <- ctx.Err()
+				return 0, ctx.Err()
+			})
+		}()
+		<-started
+
+		followerCtx, cancelFollower := context.WithCancel(context.Background())
+		followerDone := make(chan error, 1)
+		go func() {
+			_, err := g.Do(followerCtx, "k", func(ctx context.Context) (int, error) {
+				t.Error("follower must share the running call")
+				return 0, nil
+			})
+			followerDone <- err
+		}()
+		waitFlightWaiters(g, "k", 2)
+
+		cancelLeader()
+		select {
+		case err := <-fnErr:
+			t.Fatalf("fn was cancelled while a caller was still waiting: %s", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		cancelFollower()
+		if err := <-followerDone; !errors.Is(err, context.Canceled) {
+			t.Errorf("follower err = %v, want context.Canceled", err)
+		}
+		select {
+		case err := <-fnErr:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("fn ctx err = %v, want context.Canceled", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("fn was not cancelled after every caller left")
+		}
+		<-leaderDone
+
+		// キャンセルされた呼び出しは共有せず、新しく実行する
+		v, err := g.Do(context.Background(), "k", func(ctx context.Context) (int, error) { return 1, nil })
+		if err != nil || v != 1 {
+			t.Errorf("Do after cancel = %d, %v, want 1, nil", v, err)
+		}
+	})
+
+	t.Run("follower gets the result after the leader disconnects", func(t *testing.T) {
+		g := &flightGroup[int]{}
+		started := make(chan struct{})
+		release := make(chan struct{})
+		leaderCtx, cancelLeader := context.WithCancel(context.Background())
+		go g.Do(leaderCtx, "k", func(ctx context.Context) (int, error) {
+			close(started)
+			select {
+			case <-release:
+				return 42, nil
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		})
+		<-started
+
+		res := make(chan int, 1)
+		go func() {
+			v, err := g.Do(context.Background(), "k", func(ctx context.Context) (int, error) { return 0, nil })
+			if err != nil {
+				t.Error(err)
+			}
+			res <- v
+		}()
+		// followerが待ち始めてから最初の呼び出し元を切断する
+		waitFlightWaiters(g, "k", 2)
+		cancelLeader()
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+		if v := <-res; v != 42 {
+			t.Errorf("follower got %d, want 42", v)
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	proxy "github.com/shogo82148/go-sql-proxy"
+	"go.uber.org/zap"
+)
+
+// 遅いリクエストとクエリのログ
+// どのテナントのどの大会のデータで遅くなっているかを追えるよう、ルート・テナント名・大会IDを一緒に出す
+var (
+	// これより時間がかかったリクエストを記録する (0なら記録しない)
+	slowRequestThreshold = getEnvDuration("ISUCON_SLOW_REQUEST_THRESHOLD", 0)
+	// これより時間がかかったクエリを記録する (0なら記録しない)
+	slowQueryThreshold = getEnvDuration("ISUCON_SLOW_QUERY_THRESHOLD", 0)
+)
+
+// クエリのログに出すためのリクエストの情報
+type requestTags struct {
+	requestID     string
+	route         string
+	tenant        string
+	competitionID string
+}
+
+type requestTagsKey struct{}
+
+func requestTagsFromContext(ctx context.Context) *requestTags {
+	tags, _ := ctx.Value(requestTagsKey{}).(*requestTags)
+	return tags
+}
+
+func (t *requestTags) fields() []zap.Field {
+	if t == nil {
+		return nil
+	}
+	fs := []zap.Field{
+		zap.String("request_id", t.requestID),
+		zap.String("route", t.route),
+		zap.String("tenant", t.tenant),
+	}
+	if t.competitionID != "" {
+		fs = append(fs, zap.String("competition_id", t.competitionID))
+	}
+	return fs
+}
+
+// 遅いリクエストを記録するmiddleware
+// クエリのログでも使えるよう、リクエストの情報をrequest.Context()に入れる
+// ルーティング後のパラメータを使うので e.Use で登録すること
+func slowRequestMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if slowRequestThreshold <= 0 && slowQueryThreshold <= 0 {
+			return next
+		}
+		return func(c echo.Context) error {
+			req := c.Request()
+			tags := &requestTags{
+				requestID:     requestIDFromContext(req.Context()),
+				route:         c.Path(),
+				tenant:        strings.TrimSuffix(req.Host, getEnv("ISUCON_BASE_HOSTNAME", ".t.isucon.dev")),
+				competitionID: c.Param("competition_id"),
+			}
+			c.SetRequest(req.WithContext(context.WithValue(req.Context(), requestTagsKey{}, tags)))
+
+			start := time.Now()
+			err := next(c)
+			elapsed := time.Since(start)
+			if slowRequestThreshold > 0 && elapsed >= slowRequestThreshold {
+				logger.Warn("slow request", append(tags.fields(),
+					zap.String("method", req.Method),
+					zap.String("uri", req.RequestURI),
+					zap.Float64("latency_ms", float64(elapsed.Microseconds())/1000),
+				)...)
+			}
+			return err
+		}
+	}
+}
+
+// 遅いクエリを記録するドライバを登録し、そのドライバ名を返す
+// 記録しない設定の場合は元のドライバ名をそのまま返す
+func wrapSlowQueryDriver(name string, d driver.Driver) string {
+	if slowQueryThreshold <= 0 {
+		return name
+	}
+	wrapped := name + "-with-slowlog"
+	sql.Register(wrapped, proxy.NewProxyContext(d, &proxy.HooksContext{
+		PreExec: func(_ context.Context, _ *proxy.Stmt, _ []driver.NamedValue) (interface{}, error) {
+			return time.Now(), nil
+		},
+		PostExec: func(c context.Context, ctx interface{}, stmt *proxy.Stmt, args []driver.NamedValue, _ driver.Result, _ error) error {
+			logSlowQuery(c, name, ctx.(time.Time), stmt, args)
+			return nil
+		},
+		PreQuery: func(_ context.Context, _ *proxy.Stmt, _ []driver.NamedValue) (interface{}, error) {
+			return time.Now(), nil
+		},
+		PostQuery: func(c context.Context, ctx interface{}, stmt *proxy.Stmt, args []driver.NamedValue, _ driver.Rows, _ error) error {
+			logSlowQuery(c, name, ctx.(time.Time), stmt, args)
+			return nil
+		},
+	}))
+	return wrapped
+}
+
+func logSlowQuery(ctx context.Context, driverName string, start time.Time, stmt *proxy.Stmt, args []driver.NamedValue) {
+	elapsed := time.Since(start)
+	if elapsed < slowQueryThreshold {
+		return
+	}
+	argsValues := make([]any, 0, len(args))
+	for _, arg := range args {
+		argsValues = append(argsValues, arg.Value)
+	}
+	logger.Warn("slow query", append(requestTagsFromContext(ctx).fields(),
+		zap.String("driver", driverName),
+		zap.String("statement", stmt.QueryString),
+		zap.Any("args", argsValues),
+		zap.Float64("latency_ms", float64(elapsed.Microseconds())/1000),
+	)...)
+}
@@ -19,7 +19,7 @@ var traceLogEncoder *json.Encoder
 func initializeSQLLogger() (string, io.Closer, error) {
 	traceFilePath := getEnv("ISUCON_SQLITE_TRACE_FILE", "")
 	if traceFilePath == "" {
-		return "sqlite3", io.NopCloser(nil), nil
+		return wrapSlowQueryDriver("sqlite3", &sqlite3.SQLiteDriver{}), io.NopCloser(nil), nil
 	}
 
 	traceLogFile, err := os.OpenFile(traceFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
@@ -30,8 +30,9 @@ func initializeSQLLogger() (string, io.Closer, error) {
 	traceLogEncoder = json.NewEncoder(traceLogFile)
 	traceLogEncoder.SetEscapeHTML(false)
 	driverName := "sqlite3-with-trace"
-	sql.Register(driverName, proxy.NewProxyContext(&sqlite3.SQLiteDriver{}, &proxy.HooksContext{}))
-	return driverName, traceLogFile, nil
+	traceDriver := proxy.NewProxyContext(&sqlite3.SQLiteDriver{}, &proxy.HooksContext{})
+	sql.Register(driverName, traceDriver)
+	return wrapSlowQueryDriver(driverName, traceDriver), traceLogFile, nil
 }
 
 func traceLogPre(_ context.Context, _ *proxy.Stmt, _ []driver.NamedValue) (interface{}, error) {
@@ -0,0 +1,626 @@
+package isuports
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/logica0419/helpisu"
+)
+
+// テナント管理者のSSO (OpenID Connect)
+// テナントごとにIdPを設定し、認可コードフロー (PKCE) でログインしたIdPのユーザーをテナント管理者として扱う
+// IdPのユーザーはsubかメールアドレスでsso_identityに登録したものだけを受け付け、登録したorganizer_idをsubにしたJWTをCookieに設定する
+// JWTに署名するため ISUCON_JWT_PRIVATE_KEY_FILE (public.pemと対になる秘密鍵) を設定したときだけ使える
+// SAMLには対応していない
+
+// テナントの設定 (tenantsetting.go を参照)
+const (
+	ssoIssuerSettingName       = "sso.issuer"
+	ssoClientIDSettingName     = "sso.client_id"
+	ssoClientSecretSettingName = "sso.client_secret"
+)
+
+// SSOの設定
+var (
+	ssoSessionTTL = getEnvDuration("ISUCON_SSO_SESSION_TTL", 12*time.Hour)
+	// ログインを開始してからIdPから戻ってくるまでの時間の上限
+	ssoStateTTL = getEnvDuration("ISUCON_SSO_STATE_TTL", 10*time.Minute)
+	ssoTimeout  = getEnvDuration("ISUCON_SSO_TIMEOUT", 10*time.Second)
+)
+
+// issuerはテナントが設定するので、プライベートなアドレスへの接続を拒否する (outbound.go を参照)
+// ディスカバリ、トークンの取得、JWKSの取得のすべてでこのクライアントを使う
+var ssoClient = &http.Client{
+	Timeout: ssoTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: outboundDialGuard.control,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: ssoTimeout,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to non-https url: %s", req.URL.Redacted())
+		}
+		return nil
+	},
+}
+
+// IdPのエンドポイントとして使えるURLか
+func validSSOEndpoint(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Scheme == "https" && u.Host != "" && u.User == nil
+}
+
+type SSOIdentityRow struct {
+	ID          int64  `db:"id"`
+	TenantID    int64  `db:"tenant_id"`
+	Subject     string `db:"subject"` // IdPのsub、空ならemailで照合する
+	Email       string `db:"email"`
+	OrganizerID string `db:"organizer_id"` // 発行するJWTのsub
+	CreatedAt   int64  `db:"created_at"`
+}
+
+type SSOStateRow struct {
+	State        string `db:"state"`
+	TenantID     int64  `db:"tenant_id"`
+	Nonce        string `db:"nonce"`
+	CodeVerifier string `db:"code_verifier"`
+	RedirectTo   string `db:"redirect_to"`
+	ExpiresAt    int64  `db:"expires_at"`
+}
+
+// テナントのIdPの設定
+type ssoConfig struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+}
+
+func retrieveSSOConfig(ctx context.Context, tenantID int64) (*ssoConfig, error) {
+	settings, err := getTenantSettings(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	conf := &ssoConfig{
+		issuer:       settings[ssoIssuerSettingName],
+		clientID:     settings[ssoClientIDSettingName],
+		clientSecret: settings[ssoClientSecretSettingName],
+	}
+	if conf.issuer == "" || conf.clientID == "" {
+		return nil, nil
+	}
+	return conf, nil
+}
+
+// IdPのエンドポイントと署名の検証に使う鍵
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	keys                  jwk.Set
+}
+
+var oidcProviderCache = newTTLCache[string, *oidcProvider](getEnvDuration("ISUCON_SSO_PROVIDER_CACHE_TTL", time.Hour))
+
+// IdPの設定をディスカバリで取得する
+func discoverOIDCProvider(ctx context.Context, issuer string) (*oidcProvider, error) {
+	if p, ok := oidcProviderCache.Get(issuer); ok {
+		return p, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error http.NewRequest: %w", err)
+	}
+	res, err := ssoClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error get openid-configuration: issuer=%s, %w", issuer, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error get openid-configuration: issuer=%s, status=%d", issuer, res.StatusCode)
+	}
+	var p oidcProvider
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&p); err != nil {
+		return nil, fmt.Errorf("error decode openid-configuration: issuer=%s, %w", issuer, err)
+	}
+	if !validSSOEndpoint(p.AuthorizationEndpoint) || !validSSOEndpoint(p.TokenEndpoint) || !validSSOEndpoint(p.JWKSURI) {
+		return nil, fmt.Errorf("invalid openid-configuration: issuer=%s", issuer)
+	}
+	if p.keys, err = jwk.Fetch(ctx, p.JWKSURI, jwk.WithHTTPClient(ssoClient)); err != nil {
+		return nil, fmt.Errorf("error jwk.Fetch: jwksURI=%s, %w", p.JWKSURI, err)
+	}
+	oidcProviderCache.Set(issuer, &p)
+	return &p, nil
+}
+
+// JWTの署名に使う秘密鍵
+var jwtSigningKeyCache = helpisu.NewCache[bool, any]()
+
+func loadJWTSigningKey() (any, error) {
+	if key, ok := jwtSigningKeyCache.Get(true); ok {
+		return key, nil
+	}
+	keyFilename := getEnv("ISUCON_JWT_PRIVATE_KEY_FILE", "")
+	if keyFilename == "" {
+		return nil, nil
+	}
+	keysrc, err := os.ReadFile(keyFilename)
+	if err != nil {
+		return nil, fmt.Errorf("error os.ReadFile: keyFilename=%s: %w", keyFilename, err)
+	}
+	key, _, err := jwk.DecodePEM(keysrc)
+	if err != nil {
+		return nil, fmt.Errorf("error jwk.DecodePEM: %w", err)
+	}
+	jwtSigningKeyCache.Set(true, key)
+	return key, nil
+}
+
+func randomURLString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error rand.Read: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// テナントのSSOの設定と、セッションを発行するための秘密鍵を取得する
+// どちらかがなければ404にする
+func ssoTenant(c echo.Context) (*TenantRow, *ssoConfig, any, error) {
+	tenant, err := retrieveTenantRowFromHeader(c)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, nil, echo.NewHTTPError(http.StatusNotFound, "tenant not found")
+		}
+		return nil, nil, nil, fmt.Errorf("error retrieveTenantRowFromHeader: %w", err)
+	}
+	if tenant.Name == "admin" {
+		return nil, nil, nil, echo.NewHTTPError(http.StatusNotFound, "sso is not configured")
+	}
+	key, err := loadJWTSigningKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	conf, err := retrieveSSOConfig(c.Request().Context(), tenant.ID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if key == nil || conf == nil {
+		return nil, nil, nil, echo.NewHTTPError(http.StatusNotFound, "sso is not configured")
+	}
+	return tenant, conf, key, nil
+}
+
+func ssoRedirectURI(c echo.Context) string {
+	return fmt.Sprintf("%s://%s/auth/sso/callback", c.Scheme(), c.Request().Host)
+}
+
+// SSO
+// GET /auth/sso/login
+// IdPの認可エンドポイントにリダイレクトする
+// redirectでログイン後に戻るパスを指定できる (デフォルトは /organizer/)
+func ssoLoginHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	tenant, conf, _, err := ssoTenant(c)
+	if err != nil {
+		return err
+	}
+	provider, err := discoverOIDCProvider(ctx, conf.issuer)
+	if err != nil {
+		return err
+	}
+
+	redirectTo := c.QueryParam("redirect")
+	// 別のサイトに飛ばされないよう、同じホストのパスだけを受け付ける
+	if !strings.HasPrefix(redirectTo, "/") || strings.HasPrefix(redirectTo, "//") || strings.HasPrefix(redirectTo, "/\\") {
+		redirectTo = "/organizer/"
+	}
+	st := SSOStateRow{TenantID: tenant.ID, RedirectTo: redirectTo, ExpiresAt: time.Now().Add(ssoStateTTL).Unix()}
+	if st.State, err = randomURLString(32); err != nil {
+		return err
+	}
+	if st.Nonce, err = randomURLString(32); err != nil {
+		return err
+	}
+	if st.CodeVerifier, err = randomURLString(32); err != nil {
+		return err
+	}
+	// 期限切れの状態はここで消す
+	if _, err := srv(ctx).adminDB.ExecContext(ctx, "DELETE FROM sso_state WHERE expires_at < ?", time.Now().Unix()); err != nil {
+		return fmt.Errorf("error Delete sso_state: %w", err)
+	}
+	if _, err := srv(ctx).adminDB.ExecContext(
+		ctx,
+		"INSERT INTO sso_state (state, tenant_id, nonce, code_verifier, redirect_to, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		st.State, st.TenantID, st.Nonce, st.CodeVerifier, st.RedirectTo, st.ExpiresAt,
+	); err != nil {
+		return fmt.Errorf("error Insert sso_state: tenantID=%d, %w", tenant.ID, err)
+	}
+
+	challenge := sha256.Sum256([]byte(st.CodeVerifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", conf.clientID)
+	q.Set("redirect_uri", ssoRedirectURI(c))
+	q.Set("scope", "openid email")
+	q.Set("state", st.State)
+	q.Set("nonce", st.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return c.Redirect(http.StatusFound, provider.AuthorizationEndpoint+sep+q.Encode())
+}
+
+// 認可コードをIDトークンに交換する
+func exchangeSSOCode(ctx context.Context, c echo.Context, conf *ssoConfig, provider *oidcProvider, code, codeVerifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", ssoRedirectURI(c))
+	form.Set("client_id", conf.clientID)
+	form.Set("code_verifier", codeVerifier)
+	if conf.clientSecret != "" {
+		form.Set("client_secret", conf.clientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("error http.NewRequest: %w", err)
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	res, err := ssoClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error post token endpoint: %w", err)
+	}
+	defer res.Body.Close()
+	var body struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("error decode token response: status=%d, %w", res.StatusCode, err)
+	}
+	if res.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("error token endpoint: status=%d, error=%s", res.StatusCode, body.Error)
+	}
+	return body.IDToken, nil
+}
+
+// IDトークンのユーザーに対応するsso_identityを探す
+// メールアドレスはIdPが確認済みのものだけを使う
+func retrieveSSOIdentity(ctx context.Context, tenantID int64, token jwt.Token) (*SSOIdentityRow, error) {
+	var email string
+	if v, ok := token.Get("email"); ok {
+		if verified, _ := token.Get("email_verified"); verified == true {
+			email, _ = v.(string)
+		}
+	}
+	var ident SSOIdentityRow
+	if err := srv(ctx).adminDB.GetContext(
+		ctx,
+		&ident,
+		"SELECT * FROM sso_identity WHERE tenant_id = ? AND ((subject != '' AND subject = ?) OR (subject = '' AND email != '' AND email = ?)) ORDER BY id LIMIT 1",
+		tenantID, token.Subject(), email,
+	); err != nil {
+		return nil, fmt.Errorf("error Select sso_identity: tenantID=%d, %w", tenantID, err)
+	}
+	return &ident, nil
+}
+
+// SSO
+// GET /auth/sso/callback
+// IdPから戻ってきたリクエストを検証し、テナント管理者のJWTをCookieに設定する
+func ssoCallbackHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	tenant, conf, key, err := ssoTenant(c)
+	if err != nil {
+		return err
+	}
+	if e := c.QueryParam("error"); e != "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, fmt.Sprintf("sso login failed: %s", e))
+	}
+
+	// stateは一度だけ使える
+	var st SSOStateRow
+	if err := srv(ctx).adminDB.GetContext(ctx, &st, "SELECT * FROM sso_state WHERE state = ?", c.QueryParam("state")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid state")
+		}
+		return fmt.Errorf("error Select sso_state: %w", err)
+	}
+	res, err := srv(ctx).adminDB.ExecContext(ctx, "DELETE FROM sso_state WHERE state = ?", st.State)
+	if err != nil {
+		return fmt.Errorf("error Delete sso_state: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid state")
+	}
+	if st.TenantID != tenant.ID || st.ExpiresAt < time.Now().Unix() {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid state")
+	}
+
+	provider, err := discoverOIDCProvider(ctx, conf.issuer)
+	if err != nil {
+		return err
+	}
+	idToken, err := exchangeSSOCode(ctx, c, conf, provider, c.QueryParam("code"), st.CodeVerifier)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	token, err := jwt.Parse(
+		[]byte(idToken),
+		jwt.WithKeySet(provider.keys),
+		jwt.WithValidate(true),
+		jwt.WithIssuer(conf.issuer),
+		jwt.WithAudience(conf.clientID),
+	)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, fmt.Sprintf("invalid id_token: %s", err))
+	}
+	if nonce, _ := token.Get("nonce"); nonce != st.Nonce {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid id_token: nonce is not match")
+	}
+
+	ident, err := retrieveSSOIdentity(ctx, tenant.ID, token)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusForbidden, "this account is not allowed to sign in")
+		}
+		return err
+	}
+
+	// テナント管理者のJWTを発行する
+	now := time.Now()
+	session := jwt.New()
+	for k, v := range map[string]any{
+		"iss":  "isuports",
+		"sub":  ident.OrganizerID,
+		"aud":  []string{tenant.Name},
+		"role": RoleOrganizer,
+		"iat":  now,
+		"exp":  now.Add(ssoSessionTTL),
+	} {
+		if err := session.Set(k, v); err != nil {
+			return fmt.Errorf("error jwt.Set: %s, %w", k, err)
+		}
+	}
+	signed, err := jwt.Sign(session, jwt.WithKey(jwa.RS256, key))
+	if err != nil {
+		return fmt.Errorf("error jwt.Sign: %w", err)
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     cookieName,
+		Value:    string(signed),
+		Path:     "/",
+		Expires:  now.Add(ssoSessionTTL),
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return c.Redirect(http.StatusFound, st.RedirectTo)
+}
+
+type SSOIdentityDetail struct {
+	ID          string `json:"id"`
+	Subject     string `json:"subject,omitempty"`
+	Email       string `json:"email,omitempty"`
+	OrganizerID string `json:"organizer_id"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+type SSOSettingsHandlerResult struct {
+	Issuer          string              `json:"issuer"`
+	ClientID        string              `json:"client_id"`
+	HasClientSecret bool                `json:"has_client_secret"`
+	RedirectURI     string              `json:"redirect_uri"` // IdPに登録するURL
+	Enabled         bool                `json:"enabled"`      // 秘密鍵が設定されていなければログインできない
+	Identities      []SSOIdentityDetail `json:"identities"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/sso
+// SSOの設定とログインできるIdPのユーザーを取得する
+func ssoSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	settings, err := getTenantSettings(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	key, err := loadJWTSigningKey()
+	if err != nil {
+		return err
+	}
+	is := []SSOIdentityRow{}
+	if err := srv(ctx).adminDB.SelectContext(ctx, &is, "SELECT * FROM sso_identity WHERE tenant_id = ? ORDER BY id", v.tenantID); err != nil {
+		return fmt.Errorf("error Select sso_identity: tenantID=%d, %w", v.tenantID, err)
+	}
+	res := SSOSettingsHandlerResult{
+		Issuer:          settings[ssoIssuerSettingName],
+		ClientID:        settings[ssoClientIDSettingName],
+		HasClientSecret: settings[ssoClientSecretSettingName] != "",
+		RedirectURI:     ssoRedirectURI(c),
+		Enabled:         key != nil && settings[ssoIssuerSettingName] != "" && settings[ssoClientIDSettingName] != "",
+		Identities:      make([]SSOIdentityDetail, 0, len(is)),
+	}
+	for _, i := range is {
+		res.Identities = append(res.Identities, SSOIdentityDetail{
+			ID:          strconv.FormatInt(i.ID, 10),
+			Subject:     i.Subject,
+			Email:       i.Email,
+			OrganizerID: i.OrganizerID,
+			CreatedAt:   i.CreatedAt,
+		})
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/sso
+// SSOのIdPを設定する、issuerを空にするとSSOを使わない
+// client_secretを省略した場合は設定済みの値を使う (公開クライアントならPKCEだけで認証する)
+func ssoSettingsUpdateHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	issuer := c.FormValue("issuer")
+	clientID := c.FormValue("client_id")
+	if issuer != "" {
+		u, err := url.Parse(issuer)
+		if err != nil || u.Scheme != "https" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid issuer")
+		}
+		if clientID == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "client_id is required")
+		}
+		// 設定する前にディスカバリできることを確認する
+		oidcProviderCache.Delete(issuer)
+		if _, err := discoverOIDCProvider(ctx, issuer); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("failed to discover issuer: %s", err))
+		}
+	}
+	values := map[string]string{
+		ssoIssuerSettingName:   issuer,
+		ssoClientIDSettingName: clientID,
+	}
+	if issuer == "" {
+		values[ssoClientSecretSettingName] = ""
+	} else if secret := c.FormValue("client_secret"); secret != "" {
+		values[ssoClientSecretSettingName] = secret
+	}
+	for name, value := range values {
+		if err := setTenantSetting(ctx, v.tenantID, name, value); err != nil {
+			return err
+		}
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
+
+type SSOIdentityAddHandlerResult struct {
+	Identity SSOIdentityDetail `json:"identity"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/sso/identities/add
+// SSOでログインできるIdPのユーザーを登録する
+// subjectかemailのどちらかを指定し、organizer_idを省略した場合はそのどちらかをJWTのsubにする
+func ssoIdentityAddHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	ident := SSOIdentityRow{
+		TenantID:    v.tenantID,
+		Subject:     c.FormValue("subject"),
+		Email:       c.FormValue("email"),
+		OrganizerID: c.FormValue("organizer_id"),
+		CreatedAt:   srv(ctx).clock.Now().Unix(),
+	}
+	if (ident.Subject == "") == (ident.Email == "") {
+		return echo.NewHTTPError(http.StatusBadRequest, "either subject or email is required")
+	}
+	if ident.Email != "" && !validEmail(ident.Email) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid email")
+	}
+	if ident.OrganizerID == "" {
+		ident.OrganizerID = ident.Subject + ident.Email
+	}
+	if len(ident.Subject) > 255 || len(ident.OrganizerID) > 255 {
+		return echo.NewHTTPError(http.StatusBadRequest, "subject or organizer_id is too long")
+	}
+	res, err := srv(ctx).adminDB.ExecContext(
+		ctx,
+		"INSERT INTO sso_identity (tenant_id, subject, email, organizer_id, created_at) VALUES (?, ?, ?, ?, ?)",
+		ident.TenantID, ident.Subject, ident.Email, ident.OrganizerID, ident.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("error Insert sso_identity: tenantID=%d, %w", v.tenantID, err)
+	}
+	if ident.ID, err = res.LastInsertId(); err != nil {
+		return fmt.Errorf("error get LastInsertId: %w", err)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: SSOIdentityAddHandlerResult{
+		Identity: SSOIdentityDetail{
+			ID:          strconv.FormatInt(ident.ID, 10),
+			Subject:     ident.Subject,
+			Email:       ident.Email,
+			OrganizerID: ident.OrganizerID,
+			CreatedAt:   ident.CreatedAt,
+		},
+	}})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/sso/identity/:identity_id/delete
+// SSOでログインできるIdPのユーザーを削除する
+// 発行済みのJWTは期限まで使える
+func ssoIdentityDeleteHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	res, err := srv(ctx).adminDB.ExecContext(
+		ctx,
+		"DELETE FROM sso_identity WHERE tenant_id = ? AND id = ?",
+		v.tenantID, c.Param("identity_id"),
+	)
+	if err != nil {
+		return fmt.Errorf("error Delete sso_identity: tenantID=%d, %w", v.tenantID, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("error get RowsAffected: %w", err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "identity not found")
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
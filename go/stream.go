@@ -0,0 +1,138 @@
+package isuports
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ストリーミング中に何件ごとにクライアントへ送り出すか
+const streamFlushInterval = 1000
+
+// ストリーミングで返すレスポンスのdata内のフィールド
+type streamField struct {
+	Key   string
+	Value any
+}
+
+// リストを含む成功レスポンスをストリーミングで返す
+// {"status":true,"data":{<fields>,"<listKey>":[...]}} の形で、リストの要素を1つずつエンコードして送るので
+// レスポンス全体をメモリ上でJSONにすることがない
+// eachには要素を1つずつemitに渡す関数を指定する
+func streamSuccessList(c echo.Context, fields []streamField, listKey string, each func(emit func(v any) error) error) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	res.WriteHeader(http.StatusOK)
+
+	w := bufio.NewWriterSize(res, 32*1024)
+	enc := json.NewEncoder(w)
+	w.WriteString(`{"status":true,"data":{`)
+	for _, f := range fields {
+		fmt.Fprintf(w, "%q:", f.Key)
+		if err := enc.Encode(f.Value); err != nil {
+			return fmt.Errorf("error encode field: key=%s, %w", f.Key, err)
+		}
+		w.WriteByte(',')
+	}
+	fmt.Fprintf(w, "%q:[", listKey)
+
+	n := 0
+	if err := each(func(v any) error {
+		if n > 0 {
+			w.WriteByte(',')
+		}
+		n++
+		if err := enc.Encode(v); err != nil {
+			return fmt.Errorf("error encode list element: key=%s, %w", listKey, err)
+		}
+		if n%streamFlushInterval == 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			res.Flush()
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	w.WriteString("]}}\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	res.Flush()
+	return nil
+}
+
+// CSVで返す場合の列
+type csvColumns struct {
+	header []string
+	record func(v any) []string // emitに渡された要素を1行にする
+}
+
+// CSVを要求されているか
+// ?format=csv か、AcceptヘッダでJSONよりtext/csvを先に指定した場合にCSVで返す
+func wantsCSV(c echo.Context) bool {
+	if f := c.QueryParam("format"); f != "" {
+		return f == "csv"
+	}
+	accept := c.Request().Header.Get(echo.HeaderAccept)
+	i := strings.Index(accept, "text/csv")
+	if i < 0 {
+		return false
+	}
+	j := strings.Index(accept, echo.MIMEApplicationJSON)
+	return j < 0 || i < j
+}
+
+// 要求に応じてリストをJSONかCSVでストリーミングで返す
+// CSVの場合はfieldsは含めず、リストの要素だけを1行ずつ返す
+func streamSuccessListOrCSV(c echo.Context, fields []streamField, listKey string, cols csvColumns, each func(emit func(v any) error) error) error {
+	if !wantsCSV(c) {
+		return streamSuccessList(c, fields, listKey, each)
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=UTF-8")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", listKey+".csv"))
+	res.WriteHeader(http.StatusOK)
+
+	w := bufio.NewWriterSize(res, 32*1024)
+	// Excelで開いたときに文字化けしないようBOMをつける
+	w.WriteString("\uFEFF")
+	cw := csv.NewWriter(w)
+	if err := cw.Write(cols.header); err != nil {
+		return err
+	}
+	n := 0
+	if err := each(func(v any) error {
+		if err := cw.Write(cols.record(v)); err != nil {
+			return fmt.Errorf("error write csv: key=%s, %w", listKey, err)
+		}
+		n++
+		if n%streamFlushInterval == 0 {
+			cw.Flush()
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			res.Flush()
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	res.Flush()
+	return nil
+}
@@ -0,0 +1,315 @@
+package isuports
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// Stripeによる請求
+// 請求書 (invoice.go を参照) をテナントごとのStripeの顧客に請求書として送り、支払いの結果をWebhookで受け取る
+// ISUCON_STRIPE_SECRET_KEY を設定したときだけ使える
+// 同じ請求書を二重に送らないよう、Stripeへのリクエストには請求書と明細のIDから作ったIdempotency-Keyをつける
+
+const stripeCustomerSettingName = "stripe.customer_id"
+
+// Stripeの設定
+var (
+	stripeSecretKey     = getEnv("ISUCON_STRIPE_SECRET_KEY", "")
+	stripeWebhookSecret = getEnv("ISUCON_STRIPE_WEBHOOK_SECRET", "")
+	stripeAPIBase       = getEnv("ISUCON_STRIPE_API_BASE", "https://api.stripe.com")
+	stripeDaysUntilDue  = getEnvInt("ISUCON_STRIPE_DAYS_UNTIL_DUE", 30)
+	// Webhookの署名の時刻のずれの許容範囲
+	stripeWebhookTolerance = getEnvDuration("ISUCON_STRIPE_WEBHOOK_TOLERANCE", 5*time.Minute)
+)
+
+var stripeClient = &http.Client{Timeout: getEnvDuration("ISUCON_STRIPE_TIMEOUT", 30*time.Second)}
+
+type stripeError struct {
+	status  int
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+func (e *stripeError) Error() string {
+	return fmt.Sprintf("stripe: status=%d, type=%s, %s", e.status, e.Type, e.Message)
+}
+
+// StripeのAPIにフォームでPOSTしてレスポンスのidを返す
+func stripePost(ctx context.Context, path string, form url.Values, idempotencyKey string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, stripeAPIBase+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("error http.NewRequest: %w", err)
+	}
+	req.SetBasicAuth(stripeSecretKey, "")
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	res, err := stripeClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error post %s: %w", path, err)
+	}
+	defer res.Body.Close()
+	var body struct {
+		ID    string       `json:"id"`
+		Error *stripeError `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("error decode %s: status=%d, %w", path, res.StatusCode, err)
+	}
+	if res.StatusCode != http.StatusOK || body.Error != nil {
+		if body.Error == nil {
+			body.Error = &stripeError{}
+		}
+		body.Error.status = res.StatusCode
+		return "", body.Error
+	}
+	return body.ID, nil
+}
+
+// テナントのStripeの顧客IDを返す、なければ作る
+func stripeCustomerID(ctx context.Context, tenant TenantRow) (string, error) {
+	id, err := getTenantSetting(ctx, tenant.ID, stripeCustomerSettingName)
+	if err != nil || id != "" {
+		return id, err
+	}
+	form := url.Values{}
+	form.Set("name", tenant.DisplayName)
+	form.Set("metadata[tenant_id]", strconv.FormatInt(tenant.ID, 10))
+	form.Set("metadata[tenant_name]", tenant.Name)
+	id, err = stripePost(ctx, "/v1/customers", form, fmt.Sprintf("isuports-customer-%d-%d", tenant.ID, tenant.CreatedAt))
+	if err != nil {
+		return "", err
+	}
+	if err := setTenantSetting(ctx, tenant.ID, stripeCustomerSettingName, id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// draftの請求書をStripeに送ってopenにする
+func pushInvoiceToStripe(ctx context.Context, inv InvoiceRow) error {
+	var tenant TenantRow
+	if err := srv(ctx).adminDB.GetContext(ctx, &tenant, "SELECT * FROM tenant WHERE id = ?", inv.TenantID); err != nil {
+		return fmt.Errorf("error Select tenant: id=%d, %w", inv.TenantID, err)
+	}
+	customerID, err := stripeCustomerID(ctx, tenant)
+	if err != nil {
+		return err
+	}
+	lines := []InvoiceLineRow{}
+	if err := srv(ctx).adminDB.SelectContext(ctx, &lines, "SELECT * FROM billing_invoice_line WHERE invoice_id = ? ORDER BY id", inv.ID); err != nil {
+		return fmt.Errorf("error Select billing_invoice_line: invoiceID=%d, %w", inv.ID, err)
+	}
+
+	// 明細を作ってから、顧客の未請求の明細をまとめた請求書を作る
+	// 明細は作り直すとIDが変わるので、リトライしても同じ明細を二重に作らないようupdated_atもキーに含める
+	for _, l := range lines {
+		form := url.Values{}
+		form.Set("customer", customerID)
+		form.Set("currency", "jpy") // 円は小数点以下のない通貨なので金額をそのまま送る
+		form.Set("amount", strconv.FormatInt(l.AmountYen, 10))
+		form.Set("description", l.Description)
+		form.Set("metadata[invoice_id]", strconv.FormatInt(inv.ID, 10))
+		form.Set("metadata[competition_id]", l.CompetitionID)
+		if _, err := stripePost(ctx, "/v1/invoiceitems", form, fmt.Sprintf("isuports-invoiceitem-%d-%d-%d", inv.ID, inv.UpdatedAt, l.ID)); err != nil {
+			return err
+		}
+	}
+	form := url.Values{}
+	form.Set("customer", customerID)
+	form.Set("collection_method", "send_invoice")
+	form.Set("days_until_due", strconv.Itoa(stripeDaysUntilDue))
+	form.Set("pending_invoice_items_behavior", "include")
+	form.Set("description", fmt.Sprintf("ISUPORTS ご利用料金 %s", inv.Period))
+	form.Set("metadata[invoice_id]", strconv.FormatInt(inv.ID, 10))
+	form.Set("metadata[period]", inv.Period)
+	stripeInvoiceID, err := stripePost(ctx, "/v1/invoices", form, fmt.Sprintf("isuports-invoice-%d-%d", inv.ID, inv.UpdatedAt))
+	if err != nil {
+		return err
+	}
+	if _, err := stripePost(ctx, "/v1/invoices/"+url.PathEscape(stripeInvoiceID)+"/finalize", url.Values{}, ""); err != nil {
+		return err
+	}
+
+	if _, err := srv(ctx).adminDB.ExecContext(
+		ctx,
+		"UPDATE billing_invoice SET status = ?, stripe_invoice_id = ?, last_error = '', updated_at = ? WHERE id = ? AND status = ?",
+		invoiceStatusOpen, stripeInvoiceID, srv(ctx).clock.Now().Unix(), inv.ID, invoiceStatusDraft,
+	); err != nil {
+		return fmt.Errorf("error Update billing_invoice: id=%d, %w", inv.ID, err)
+	}
+	return nil
+}
+
+// SaaS管理者用API
+// draftの請求書をStripeに送る
+// POST /api/admin/invoices/sync
+// periodにYYYY-MMを指定する、送信に失敗した請求書はdraftのままlast_errorを記録する
+func invoicesSyncHandler(c echo.Context) error {
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.tenantName != "admin" {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("%s has not this API", v.tenantName),
+		)
+	}
+	if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+	if stripeSecretKey == "" {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "stripe is not configured")
+	}
+
+	ctx := c.Request().Context()
+	period := c.FormValue("period")
+	if _, _, err := parseBillingPeriod(period, billingLocation); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	invs := []InvoiceRow{}
+	if err := srv(ctx).adminDB.SelectContext(
+		ctx,
+		&invs,
+		"SELECT * FROM billing_invoice WHERE period = ? AND status = ? AND amount_yen > 0 ORDER BY tenant_id",
+		period, invoiceStatusDraft,
+	); err != nil {
+		return fmt.Errorf("error Select billing_invoice: period=%s, %w", period, err)
+	}
+	// Stripeのレート制限があるので順番に送る
+	for _, inv := range invs {
+		if err := pushInvoiceToStripe(ctx, inv); err != nil {
+			var se *stripeError
+			if !errors.As(err, &se) && ctx.Err() != nil {
+				return err
+			}
+			logger.Warn("failed to push invoice to stripe", zap.Int64("invoice_id", inv.ID), zap.Error(err))
+			lastError := err.Error()
+			if len(lastError) > 1024 {
+				lastError = lastError[:1024]
+			}
+			// updated_atはIdempotency-Keyに使っているので変えない
+			if _, err := srv(ctx).adminDB.ExecContext(
+				ctx,
+				"UPDATE billing_invoice SET last_error = ? WHERE id = ?",
+				lastError, inv.ID,
+			); err != nil {
+				return fmt.Errorf("error Update billing_invoice: id=%d, %w", inv.ID, err)
+			}
+		}
+	}
+
+	if err := srv(ctx).adminDB.SelectContext(ctx, &invs, "SELECT * FROM billing_invoice WHERE period = ? ORDER BY tenant_id", period); err != nil {
+		return fmt.Errorf("error Select billing_invoice: period=%s, %w", period, err)
+	}
+	ds, err := invoiceDetails(ctx, invs)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: InvoicesHandlerResult{Invoices: ds}})
+}
+
+// Stripe-Signatureヘッダを検証する
+// t=タイムスタンプ,v1=署名 の形式で、署名は "タイムスタンプ.ボディ" のHMAC-SHA256
+func verifyStripeSignature(header string, body []byte, now time.Time) bool {
+	var (
+		timestamp string
+		sigs      []string
+	)
+	for _, kv := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "t":
+			timestamp = v
+		case "v1":
+			sigs = append(sigs, v)
+		}
+	}
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if d := now.Sub(time.Unix(t, 0)); d > stripeWebhookTolerance || d < -stripeWebhookTolerance {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(stripeWebhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+	for _, s := range sigs {
+		if sig, err := hex.DecodeString(s); err == nil && hmac.Equal(sig, expected) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stripeのイベントと請求書の状態の対応
+var stripeInvoiceEventStatus = map[string]string{
+	"invoice.paid":                 invoiceStatusPaid,
+	"invoice.payment_failed":       invoiceStatusPaymentFailed,
+	"invoice.voided":               invoiceStatusVoid,
+	"invoice.marked_uncollectible": invoiceStatusUncollectible,
+}
+
+// Stripe向けAPI
+// POST /stripe/webhook
+// 請求書の支払いの結果を受け取る
+func stripeWebhookHandler(c echo.Context) error {
+	if stripeWebhookSecret == "" {
+		return echo.NewHTTPError(http.StatusNotFound, "stripe webhook is not configured")
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("error io.ReadAll: %w", err)
+	}
+	if !verifyStripeSignature(c.Request().Header.Get("Stripe-Signature"), body, srv(c.Request().Context()).clock.Now()) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid signature")
+	}
+	var event struct {
+		ID      string `json:"id"`
+		Type    string `json:"type"`
+		Created int64  `json:"created"`
+		Data    struct {
+			Object struct {
+				ID string `json:"id"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid event")
+	}
+	status, ok := stripeInvoiceEventStatus[event.Type]
+	if !ok {
+		// 購読していないイベントは無視する
+		return c.NoContent(http.StatusOK)
+	}
+	// イベントは順番どおりに届くとは限らないので、支払い済みと取り消しは他の状態で上書きしない
+	if _, err := srv(c.Request().Context()).adminDB.ExecContext(
+		c.Request().Context(),
+		"UPDATE billing_invoice SET status = ?, updated_at = ? WHERE stripe_invoice_id = ? AND status NOT IN (?, ?)",
+		status, srv(c.Request().Context()).clock.Now().Unix(), event.Data.Object.ID, invoiceStatusPaid, invoiceStatusVoid,
+	); err != nil {
+		return fmt.Errorf("error Update billing_invoice: stripeInvoiceID=%s, %w", event.Data.Object.ID, err)
+	}
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,46 @@
+package isuports
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStripeWebhookSignatureTolerance(t *testing.T) {
+	secret := stripeWebhookSecret
+	stripeWebhookSecret = "whsec_test"
+	t.Cleanup(func() { stripeWebhookSecret = secret })
+
+	clock := newFrozenClock(testNow)
+	app := newTestApp(t, WithClock(clock))
+	body := `{"id":"evt_1","type":"customer.created","data":{"object":{"id":"cus_1"}}}`
+	post := func(signedAt time.Time) int {
+		t.Helper()
+		timestamp := fmt.Sprint(signedAt.Unix())
+		mac := hmac.New(sha256.New, []byte(stripeWebhookSecret))
+		mac.Write([]byte(timestamp + "." + body))
+		req := httptest.NewRequest(http.MethodPost, "/stripe/webhook", strings.NewReader(body))
+		req.Header.Set("Stripe-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+		rec := httptest.NewRecorder()
+		app.e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// 署名の時刻はサーバーの時計と比べる
+	if code := post(testNow); code != http.StatusOK {
+		t.Errorf("signed at the server clock: status = %d, want 200", code)
+	}
+	if code := post(time.Now()); code != http.StatusBadRequest {
+		t.Errorf("signed at the wall clock: status = %d, want 400", code)
+	}
+	clock.Advance(stripeWebhookTolerance + time.Second)
+	if code := post(testNow); code != http.StatusBadRequest {
+		t.Errorf("signed before the tolerance: status = %d, want 400", code)
+	}
+}
@@ -3,23 +3,46 @@ package isuports
 import (
 	"context"
 	"database/sql"
-	"encoding/csv"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"reflect"
 	"strconv"
 	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
-	"github.com/logica0419/helpisu"
 )
 
 type CompetitionDetail struct {
-	ID         string `json:"id"`
-	Title      string `json:"title"`
-	IsFinished bool   `json:"is_finished"`
+	ID                string `json:"id"`
+	Title             string `json:"title"`
+	IsFinished        bool   `json:"is_finished"`
+	CreatedAt         int64  `json:"created_at"`
+	CreatedAtRFC3339  string `json:"created_at_rfc3339"`
+	FinishedAt        *int64 `json:"finished_at,omitempty"`
+	FinishedAtRFC3339 string `json:"finished_at_rfc3339,omitempty"`
+	SeasonID          string `json:"season_id,omitempty"`
+	Live              bool   `json:"live,omitempty"`
+}
+
+// 日時はテナントのタイムゾーンでも返す (timezone.go を参照)
+func newCompetitionDetail(comp *CompetitionRow, loc *time.Location) CompetitionDetail {
+	d := CompetitionDetail{
+		ID:               comp.ID,
+		Title:            comp.Title,
+		IsFinished:       comp.FinishedAt.Valid,
+		CreatedAt:        comp.CreatedAt,
+		CreatedAtRFC3339: formatTenantTime(comp.CreatedAt, loc),
+		SeasonID:         comp.SeasonID.String,
+		Live:             comp.Live,
+	}
+	if comp.FinishedAt.Valid {
+		finishedAt := comp.FinishedAt.Int64
+		d.FinishedAt = &finishedAt
+		d.FinishedAtRFC3339 = formatTenantTime(finishedAt, loc)
+	}
+	return d
 }
 
 type CompetitionsAddHandlerResult struct {
@@ -30,7 +53,7 @@ type CompetitionsAddHandlerResult struct {
 // POST /api/organizer/competitions/add
 // 大会を追加する
 func competitionsAddHandler(c echo.Context) error {
-	ctx := context.Background()
+	ctx := c.Request().Context()
 	v, err := parseViewer(c)
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
@@ -38,46 +61,65 @@ func competitionsAddHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
+	defer tenantDB.Close()
 
 	title := c.FormValue("title")
+	// シーズンを指定して追加できる (season.go を参照)
+	seasonID, err := competitionSeasonID(ctx, tenantDB, v.tenantID, c.FormValue("season_id"))
+	if err != nil {
+		return err
+	}
+
+	// ライブモードにするとスコアをメモリ上に持つ (livescore.go を参照)
+	live := c.FormValue("live") == "true"
 
-	now := time.Now().Unix()
+	if q, err := checkCompetitionsQuota(ctx, tenantDB, v.tenantID); err != nil {
+		return err
+	} else if q != nil {
+		return quotaExceeded(c, http.StatusForbidden, *q)
+	}
+
+	now := srv(ctx).clock.Now().Unix()
 	id, err := dispenseID(ctx)
 	if err != nil {
 		return fmt.Errorf("error dispenseID: %w", err)
 	}
-	if _, err := tenantDB.ExecContext(
-		ctx,
-		"INSERT INTO competition (id, tenant_id, title, finished_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
-		id, v.tenantID, title, sql.NullInt64{}, now, now,
-	); err != nil {
+	if err := withRetry(ctx, func() error {
+		_, err := tenantDB.ExecContext(
+			ctx,
+			"INSERT INTO competition (id, tenant_id, title, finished_at, created_at, updated_at, season_id, live) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			id, v.tenantID, title, sql.NullInt64{}, now, now, seasonID, live,
+		)
+		return err
+	}); err != nil {
 		return fmt.Errorf(
 			"error Insert competition: id=%s, tenant_id=%d, title=%s, finishedAt=null, createdAt=%d, updatedAt=%d, %w",
 			id, v.tenantID, title, now, now, err,
 		)
 	}
 
+	srv(ctx).competitionCache.Delete(tenantKey{v.tenantID, id})
+
+	loc, err := tenantLocation(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
 	res := CompetitionsAddHandlerResult{
-		Competition: CompetitionDetail{
-			ID:         id,
-			Title:      title,
-			IsFinished: false,
-		},
+		Competition: newCompetitionDetail(&CompetitionRow{TenantID: v.tenantID, ID: id, Title: title, CreatedAt: now, UpdatedAt: now, SeasonID: seasonID, Live: live}, loc),
 	}
 	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
 }
 
-var compFinishCache = helpisu.NewCache[int, []string]()
-
 /// テナント管理者向けAPI
 // POST /api/organizer/competition/:competition_id/finish
 // 大会を終了する
+// 既に終了した大会には409を返す (conflict.go を参照)
 func competitionFinishHandler(c echo.Context) error {
-	ctx := context.Background()
+	ctx := c.Request().Context()
 	v, err := parseViewer(c)
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
@@ -85,62 +127,52 @@ func competitionFinishHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
+	defer tenantDB.Close()
 
 	id := c.Param("competition_id")
 	if id == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "competition_id required")
 	}
-	_, err = retrieveCompetition(ctx, tenantDB, id)
+	comp, err := retrieveCompetition(ctx, tenantDB, v.tenantID, id)
 	if err != nil {
-		// 存在しない大会
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "competition not found")
-		}
 		return fmt.Errorf("error retrieveCompetition: %w", err)
 	}
 
-	now := time.Now().Unix()
-	if _, err := tenantDB.ExecContext(
-		ctx,
-		"UPDATE competition SET finished_at = ?, updated_at = ? WHERE id = ?",
-		now, now, id,
-	); err != nil {
-		return fmt.Errorf(
-			"error Update competition: finishedAt=%d, updatedAt=%d, id=%s, %w",
-			now, now, id, err,
-		)
-	}
-
-	finish, ok := compFinishCache.Get(0)
-	if !ok {
-		finish = []string{}
+	// 終了と課金レポート・最終ランキングの確定は1つのトランザクションで行う (competitionfinish.go を参照)
+	if _, err := finishCompetition(ctx, tenantDB, v.tenantID, id); err != nil {
+		return fmt.Errorf("error finishCompetition: %w", err)
 	}
-	compFinishCache.Set(0, append(finish, strconv.Itoa(int(v.tenantID))+id))
-
-	competitionCache.Delete(id)
+	notifyCompetitionFinished(c, comp)
 	return c.JSON(http.StatusOK, SuccessResult{Status: true})
 }
 
-func updateCompetitionFinish() {
-	finish, _ := compFinishCache.GetAndDelete(0)
-	for j := range finish {
-		billingReportCache.Delete(finish[j])
-	}
-}
-
 type ScoreHandlerResult struct {
 	Rows int64 `json:"rows"`
+	// player_check=lenient で飛ばした行数と、存在しない参加者
+	Skipped        int64           `json:"skipped"`
+	UnknownPlayers []UnknownPlayer `json:"unknown_players,omitempty"`
+	// dry_run=1 の場合だけ返す、Rowsは置き換えるはずだった行数 (scoredryrun.go を参照)
+	DryRun *ScoreDryRunSummary `json:"dry_run,omitempty"`
+}
+
+type CompetitionScoreRequest struct {
+	CompetitionID string `param:"competition_id" validate:"required"`
+	Presign       bool   `query:"presign"`
+	DryRun        bool   `query:"dry_run"`
+	// 終了した大会のスコアを訂正する場合に指定する (scorecorrection.go を参照)
+	Override bool   `form:"override"`
+	Reason   string `form:"reason" validate:"max=1000"`
 }
 
 // テナント管理者向けAPI
 // POST /api/organizer/competition/:competition_id/score
 // 大会のスコアをCSVでアップロードする
-func competitionScoreHandler(c echo.Context) error {
-	ctx := context.Background()
+func competitionScoreHandler(c echo.Context) (err error) {
+	ctx := c.Request().Context()
 	v, err := parseViewer(c)
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
@@ -149,33 +181,56 @@ func competitionScoreHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
+	defer tenantDB.Close()
 
-	competitionID := c.Param("competition_id")
-	if competitionID == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "competition_id required")
+	var req CompetitionScoreRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
-	comp, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	competitionID := req.CompetitionID
+	comp, err := retrieveCompetition(ctx, tenantDB, v.tenantID, competitionID)
 	if err != nil {
-		// 存在しない大会
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "competition not found")
-		}
 		return fmt.Errorf("error retrieveCompetition: %w", err)
 	}
-	if comp.FinishedAt.Valid {
-		res := FailureResult{
-			Status:  false,
-			Message: "competition is finished",
+	// バリデーションで失敗したアップロードはテナント管理者に通知する (notify.go を参照)
+	// ドライランは確認のためのものなので通知しない
+	defer func() {
+		var he *echo.HTTPError
+		if errors.As(err, &he) && he.Code == http.StatusBadRequest && !req.DryRun {
+			notifyScoreRejected(c, comp, fmt.Sprint(he.Message))
+		}
+	}()
+	if req.DryRun && req.Presign {
+		return &requestError{fields: []FieldError{{Field: "dry_run", Code: fieldErrInvalid, Message: "dry_run cannot be used with presign"}}}
+	}
+	if req.Override {
+		var fields []FieldError
+		if req.Reason == "" {
+			fields = append(fields, FieldError{Field: "reason", Code: fieldErrRequired, Message: "reason is required with override"})
+		}
+		if req.Presign {
+			fields = append(fields, FieldError{Field: "presign", Code: fieldErrInvalid, Message: "presign cannot be used with override"})
 		}
-		return c.JSON(http.StatusBadRequest, res)
+		if len(fields) > 0 {
+			return &requestError{fields: fields}
+		}
+	}
+	if comp.FinishedAt.Valid && !req.Override {
+		return &competitionFinishedError{competitionID: comp.ID}
+	}
+	// 大きなファイルはオブジェクトストレージに直接アップロードしてもらう (scoreupload.go を参照)
+	if req.Presign {
+		return scoreUploadURL(c, v.tenantID, competitionID)
 	}
 
 	fh, err := c.FormFile("scores")
-	if err != nil {
+	if errors.Is(err, http.ErrMissingFile) {
+		return &requestError{fields: []FieldError{{Field: "scores", Code: fieldErrRequired, Message: "scores is required"}}}
+	} else if err != nil {
 		return fmt.Errorf("error c.FormFile(scores): %w", err)
 	}
 	f, err := fh.Open()
@@ -184,98 +239,228 @@ func competitionScoreHandler(c echo.Context) error {
 	}
 	defer f.Close()
 
-	r := csv.NewReader(f)
-	headers, err := r.Read()
+	playerCheck, err := parsePlayerCheck(c)
 	if err != nil {
-		return fmt.Errorf("error r.Read at header: %w", err)
+		return err
+	}
+	opts := scoreImportOptions{allowFinished: req.Override, playerCheck: playerCheck, dryRun: req.DryRun}
+	// 終了した大会の訂正は監査ログに残す
+	// 終了していない大会にoverrideを指定しただけなら通常のアップロードと同じ
+	if req.Override {
+		opts.correction = &scoreCorrection{actor: v.playerID, reason: req.Reason}
+	}
+	res, q, err := importScores(ctx, tenantDB, v.tenantID, competitionID, opts, f, ingestFormatOf(fh.Header.Get(echo.HeaderContentType), fh.Filename))
+	if err != nil {
+		return err
 	}
-	if !reflect.DeepEqual(headers, []string{"player_id", "score"}) {
-		return echo.NewHTTPError(http.StatusBadRequest, "invalid CSV headers")
+	if q != nil {
+		return quotaExceeded(c, http.StatusForbidden, *q)
+	}
+	// オブジェクトストレージが設定されていればCSVの原本を保存しておく
+	if !req.DryRun {
+		archiveScoreUpload(v.tenantID, competitionID, fh)
 	}
 
-	// / DELETEしたタイミングで参照が来ると空っぽのランキングになるのでロックする
-	fl, err := flockByTenantID(v.tenantID)
+	return c.JSON(http.StatusOK, SuccessResult{
+		Status: true,
+		Data:   res,
+	})
+}
+
+// スコアの取り込みの指定
+type scoreImportOptions struct {
+	allowFinished bool   // 終了した大会の訂正 (scorecorrection.go を参照)
+	playerCheck   string // 存在しない参加者の行の扱い、空ならstrict (ingest.go を参照)
+	dryRun        bool   // 検証だけして書き込まない (scoredryrun.go を参照)
+
+	// 終了した大会を置き換えたときに監査ログに残す内容 (scorecorrection.go を参照)
+	correction *scoreCorrection
+}
+
+// スコアのファイルを検証して大会のスコアを全て置き換え、置き換えた行数を返す
+// formatはingestFormatCSVかingestFormatJSONで、検証に失敗した場合は *ingestError を返す (ingest.go を参照)
+// 行数の上限を超えた場合はその内容を返す
+// 大会が終了していれば、opts.allowFinished でない限り *competitionFinishedError を返す
+func importScores(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, competitionID string, opts scoreImportOptions, f io.Reader, format string) (ScoreHandlerResult, *QuotaDetail, error) {
+	var res ScoreHandlerResult
+	pc, err := newPlayerIDCheck(ctx, tenantDB, tenantID, opts.playerCheck)
 	if err != nil {
-		return fmt.Errorf("error flockByTenantID: %w", err)
+		return res, nil, err
 	}
-	defer fl.Close()
-	var rowNum int64
+	schema, err := scoreIngestSchema(ctx, tenantID, pc)
+	if err != nil {
+		return res, nil, err
+	}
+
+	// ファイルの読み込みと検証はロックの外で行う
+	// オブジェクトストレージからの大きなファイルの読み込み中に、ランキングや課金の参照を待たせないため
+	var q *QuotaDetail
 	playerScoreRows := []PlayerScoreRow{}
-	for {
-		rowNum++
-		row, err := r.Read()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return fmt.Errorf("error r.Read at rows: %w", err)
-		}
-		if len(row) != 2 {
-			return fmt.Errorf("row must have two columns: %#v", row)
+	if _, err := schema.run(ctx, f, format, func(row ingestRow) error {
+		if q = checkScoreRowsQuota(ctx, row.num); q != nil {
+			return errIngestStop
 		}
-		playerID, scoreStr := row[0], row[1]
-		if _, err := retrievePlayer(ctx, tenantDB, playerID); err != nil {
-			// 存在しない参加者が含まれている
-			if errors.Is(err, sql.ErrNoRows) {
-				return echo.NewHTTPError(
-					http.StatusBadRequest,
-					fmt.Sprintf("player not found: %s", playerID),
-				)
+		// ドライランでは書き込まないのでIDを払い出さない
+		var id string
+		if !opts.dryRun {
+			var err error
+			if id, err = dispenseID(ctx); err != nil {
+				return fmt.Errorf("error dispenseID: %w", err)
 			}
-			return fmt.Errorf("error retrievePlayer: %w", err)
-		}
-		var score int64
-		if score, err = strconv.ParseInt(scoreStr, 10, 64); err != nil {
-			return echo.NewHTTPError(
-				http.StatusBadRequest,
-				fmt.Sprintf("error strconv.ParseUint: scoreStr=%s, %s", scoreStr, err),
-			)
 		}
-		id, err := dispenseID(ctx)
-		if err != nil {
-			return fmt.Errorf("error dispenseID: %w", err)
-		}
-		now := time.Now().Unix()
+		now := srv(ctx).clock.Now().Unix()
 		playerScoreRows = append(playerScoreRows, PlayerScoreRow{
 			ID:            id,
-			TenantID:      v.tenantID,
-			PlayerID:      playerID,
+			TenantID:      tenantID,
+			PlayerID:      row.str("player_id"),
 			CompetitionID: competitionID,
-			Score:         score,
-			RowNum:        rowNum,
+			Score:         row.integer("score"),
+			RowNum:        row.num,
 			CreatedAt:     now,
 			UpdatedAt:     now,
 		})
+		return nil
+	}); err != nil {
+		if q != nil {
+			return res, q, nil
+		}
+		var ie *ingestError
+		if errors.As(err, &ie) {
+			ie.report.UnknownPlayers = pc.unknown
+		}
+		return res, nil, err
 	}
 
-	if _, err := tenantDB.ExecContext(
-		ctx,
-		"DELETE FROM player_score WHERE tenant_id = ? AND competition_id = ?",
-		v.tenantID,
-		competitionID,
-	); err != nil {
-		return fmt.Errorf("error Delete player_score: tenantID=%d, competitionID=%s, %w", v.tenantID, competitionID, err)
+	res.Rows = int64(len(playerScoreRows))
+	res.UnknownPlayers = pc.unknown
+	if pc.mode == playerCheckLenient {
+		for _, up := range pc.unknown {
+			res.Skipped += int64(len(up.Rows))
+		}
 	}
 
-	_, err = tenantDB.NamedExecContext(
-		ctx,
-		"INSERT INTO player_score (id, tenant_id, player_id, competition_id, score, row_num, created_at, updated_at) VALUES (:id, :tenant_id, :player_id, :competition_id, :score, :row_num, :created_at, :updated_at)",
-		playerScoreRows,
-	)
+	// / DELETEしたタイミングで参照が来ると空っぽのランキングになるのでロックする
+	// ドライランは今のランキングを読むだけなので共有ロックでよい
+	intent := lockWrite
+	if opts.dryRun {
+		intent = lockRead
+	}
+	fl, err := lockTenant(ctx, tenantID, intent)
 	if err != nil {
-		return fmt.Errorf(
-			"error Insert player_score: %w",
-			err,
-		)
+		return res, nil, fmt.Errorf("error lockTenant: %w", err)
+	}
+	defer fl.Close()
+	// 呼び出し側で確かめてからロックを取るまでの間に終了していないか、ロックを取ってから確かめる
+	finishedAt, err := competitionFinishedAt(ctx, tenantDB, tenantID, competitionID)
+	if err != nil {
+		return res, nil, err
+	}
+	if finishedAt.Valid && !opts.allowFinished {
+		return res, nil, &competitionFinishedError{competitionID: competitionID}
+	}
+	if opts.dryRun {
+		if res.DryRun, err = summarizeScoreDryRun(ctx, tenantDB, tenantID, competitionID, playerScoreRows); err != nil {
+			return res, nil, err
+		}
+		return res, nil, nil
+	}
 
+	// 終了した大会はライブモードの対象外なので、訂正はplayer_scoreに直接書く
+	live, err := competitionLiveMode(ctx, tenantDB, tenantID, competitionID)
+	if err != nil {
+		return res, nil, err
+	}
+	if live && !finishedAt.Valid {
+		// ライブモードではメモリ上のランキングを更新し、player_scoreへは定期的に書き出す
+		if err := srv(ctx).liveScores.put(ctx, tenantDB, tenantID, competitionID, playerScoreRows); err != nil {
+			return res, nil, fmt.Errorf("error liveScores.put: %w", err)
+		}
+	} else {
+		// 訂正の監査ログはスコアの置き換えと同じトランザクションで書き、監査ログのない訂正が残らないようにする
+		var audit *auditEntry
+		if finishedAt.Valid && opts.correction != nil {
+			audit = opts.correction.auditEntry(ctx, competitionID, res.Rows, finishedAt.Int64)
+		}
+		if err := replacePlayerScores(ctx, tenantDB, tenantID, competitionID, playerScoreRows, audit); err != nil {
+			return res, nil, err
+		}
+	}
+	if finishedAt.Valid {
+		// 確定していた課金レポートと最終ランキングを計算し直す (competitionfinish.go を参照)
+		// 課金レポートのキャッシュはロックを持っている間に消す (beginBillingSnapshot を参照)
+		if _, err := resaveCompetitionResult(ctx, tenantDB, tenantID, competitionID); err != nil {
+			return res, nil, fmt.Errorf("error resaveCompetitionResult: %w", err)
+		}
+		srv(ctx).billingReportCache.Delete(strconv.Itoa(int(tenantID)) + competitionID)
+		scheduleRatingsRecompute(ctx, tenantID)
 	}
+	publishWebhookEvent(ctx, tenantID, webhookEventScoreUploaded, map[string]any{
+		"competition_id": competitionID,
+		"rows":           len(playerScoreRows),
+	})
 
-	return c.JSON(http.StatusOK, SuccessResult{
-		Status: true,
-		Data:   ScoreHandlerResult{Rows: int64(len(playerScoreRows))},
+	return res, nil, nil
+}
+
+// 大会のスコアを全て置き換える
+// 失敗したときに中途半端に置き換わったり、読み取り中のランキングが空になったりしないよう
+// DELETEとINSERTを1つのトランザクションで行う
+// auditがnilでなければ同じトランザクションで監査ログを書く
+// 呼び出し側でlockTenantの排他ロックを取っておくこと
+func replacePlayerScores(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, competitionID string, rows []PlayerScoreRow, audit *auditEntry) error {
+	return withRetry(ctx, func() error {
+		return replacePlayerScoresTx(ctx, tenantDB, tenantID, competitionID, rows, audit)
 	})
 }
 
+func replacePlayerScoresTx(ctx context.Context, tenantDB *tenantDBConn, tenantID int64, competitionID string, rows []PlayerScoreRow, audit *auditEntry) error {
+	tx, err := tenantDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error BeginTxx: tenantID=%d, %w", tenantID, err)
+	}
+	defer tx.Rollback()
+
+	if err := writePlayerScoresTx(ctx, tx, tenantID, competitionID, rows); err != nil {
+		return err
+	}
+	if audit != nil {
+		if err := insertAudit(ctx, tx, tenantID, audit.actor, audit.action, audit.targetID, audit.detail); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error Commit: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	return nil
+}
+
+// トランザクションの中で大会のスコアを全て置き換える
+func writePlayerScoresTx(ctx context.Context, tx *sqlx.Tx, tenantID int64, competitionID string, rows []PlayerScoreRow) error {
+	if _, err := tx.ExecContext(
+		ctx,
+		"DELETE FROM player_score WHERE tenant_id = ? AND competition_id = ?",
+		tenantID,
+		competitionID,
+	); err != nil {
+		return fmt.Errorf("error Delete player_score: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+
+	if len(rows) > 0 {
+		if _, err := tx.NamedExecContext(
+			ctx,
+			"INSERT INTO player_score (id, tenant_id, player_id, competition_id, score, row_num, created_at, updated_at) VALUES (:id, :tenant_id, :player_id, :competition_id, :score, :row_num, :created_at, :updated_at)",
+			rows,
+		); err != nil {
+			return fmt.Errorf(
+				"error Insert player_score: %w",
+				err,
+			)
+		}
+	}
+	return nil
+}
+
 type BillingHandlerResult struct {
 	Reports []BillingReport `json:"reports"`
 }
@@ -284,7 +469,7 @@ type BillingHandlerResult struct {
 // GET /api/organizer/billing
 // テナント内の課金レポートを取得する
 func billingHandler(c echo.Context) error {
-	ctx := context.Background()
+	ctx := c.Request().Context()
 	v, err := parseViewer(c)
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
@@ -293,34 +478,61 @@ func billingHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
+	defer tenantDB.Close()
 
-	cs := []CompetitionRow{}
-	if err := tenantDB.SelectContext(
-		ctx,
-		&cs,
-		"SELECT * FROM competition WHERE tenant_id=? ORDER BY created_at DESC",
-		v.tenantID,
-	); err != nil {
-		return fmt.Errorf("error Select competition: %w", err)
+	// 同じテナントの課金レポートへの同時アクセスは集計を1回にまとめる
+	tbrs, err := srv(ctx).billingFlight.Do(ctx, strconv.FormatInt(v.tenantID, 10), func(ctx context.Context) ([]BillingReport, error) {
+		return tenantBillingReports(ctx, tenantDB, v.tenantID)
+	})
+	if err != nil {
+		return err
+	}
+	loc, err := tenantLocation(ctx, v.tenantID)
+	if err != nil {
+		return err
 	}
-	tbrs := make([]BillingReport, 0, len(cs))
-	for _, comp := range cs {
-		report, err := billingReportByCompetition(ctx, tenantDB, v.tenantID, comp.ID)
-		if err != nil {
-			return fmt.Errorf("error billingReportByCompetition: %w", err)
+	// 同時にアクセスした他のリクエストと共有しているのでコピーしてから埋める
+	reports := make([]BillingReport, len(tbrs))
+	for i, r := range tbrs {
+		if r.FinishedAt > 0 {
+			r.FinishedAtRFC3339 = formatTenantTime(r.FinishedAt, loc)
 		}
-		tbrs = append(tbrs, *report)
+		reports[i] = r
 	}
 
 	res := SuccessResult{
 		Status: true,
 		Data: BillingHandlerResult{
-			Reports: tbrs,
+			Reports: reports,
 		},
 	}
 	return c.JSON(http.StatusOK, res)
 }
+
+// テナントの全大会の課金レポートを作成日時の降順で返す
+func tenantBillingReports(ctx context.Context, tenantDB *tenantDBConn, tenantID int64) ([]BillingReport, error) {
+	tx, err := beginBillingSnapshot(ctx, tenantDB, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("error beginBillingSnapshot: %w", err)
+	}
+	defer tx.Close()
+
+	cs := []CompetitionRow{}
+	if err := tx.SelectContext(
+		ctx,
+		&cs,
+		"SELECT * FROM competition WHERE tenant_id=? ORDER BY created_at DESC",
+		tenantID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select competition: %w", err)
+	}
+	tbrs, err := billingReportsByTenant(ctx, tx, tenantID, cs)
+	if err != nil {
+		return nil, fmt.Errorf("error billingReportsByTenant: %w", err)
+	}
+	return tbrs, nil
+}
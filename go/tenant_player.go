@@ -5,27 +5,53 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"mime/multipart"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
 )
 
 type PlayerDetail struct {
-	ID             string `json:"id"`
-	DisplayName    string `json:"display_name"`
-	IsDisqualified bool   `json:"is_disqualified"`
+	ID               string `json:"id"`
+	DisplayName      string `json:"display_name"`
+	IsDisqualified   bool   `json:"is_disqualified"`
+	CreatedAt        int64  `json:"created_at"`
+	CreatedAtRFC3339 string `json:"created_at_rfc3339"`
+}
+
+// 日時はテナントのタイムゾーンでも返す (timezone.go を参照)
+func newPlayerDetail(p *PlayerRow, loc *time.Location) PlayerDetail {
+	return PlayerDetail{
+		ID:               p.ID,
+		DisplayName:      p.DisplayName,
+		IsDisqualified:   p.IsDisqualified,
+		CreatedAt:        p.CreatedAt,
+		CreatedAtRFC3339: formatTenantTime(p.CreatedAt, loc),
+	}
 }
 
 type PlayersListHandlerResult struct {
-	Players []PlayerDetail `json:"players"`
+	Pagination Pagination     `json:"pagination"`
+	Players    []PlayerDetail `json:"players"`
+}
+
+// 参加者一覧をCSVで返す場合の列
+var playerCSVColumns = csvColumns{
+	header: []string{"id", "display_name", "is_disqualified"},
+	record: func(v any) []string {
+		p := v.(PlayerDetail)
+		return []string{p.ID, p.DisplayName, strconv.FormatBool(p.IsDisqualified)}
+	},
 }
 
 // テナント管理者向けAPI
 // GET /api/organizer/players
 // 参加者一覧を返す
 func playersListHandler(c echo.Context) error {
-	ctx := context.Background()
+	ctx := c.Request().Context()
 	v, err := parseViewer(c)
 	if err != nil {
 		return err
@@ -33,10 +59,11 @@ func playersListHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return fmt.Errorf("error connectToTenantDB: %w", err)
 	}
+	defer tenantDB.Close()
 
 	var pls []PlayerRow
 	if err := tenantDB.SelectContext(
@@ -47,30 +74,59 @@ func playersListHandler(c echo.Context) error {
 	); err != nil {
 		return fmt.Errorf("error Select player: %w", err)
 	}
-	var pds []PlayerDetail
-	for _, p := range pls {
-		pds = append(pds, PlayerDetail{
-			ID:             p.ID,
-			DisplayName:    p.DisplayName,
-			IsDisqualified: p.IsDisqualified,
-		})
+	// limitを省略した場合は全件返す
+	page, err := parsePageParams(c, 0, 1000)
+	if err != nil {
+		return err
 	}
-
-	res := PlayersListHandlerResult{
-		Players: pds,
+	start, end, pg, err := offsetPage(page, 0, len(pls))
+	if err != nil {
+		return err
 	}
-	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+	pg.setLinks(c)
+	loc, err := tenantLocation(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	// 参加者数が多いテナントもあるので、PlayersListHandlerResultの形でストリーミングで返す
+	fields := []streamField{{Key: "pagination", Value: pg}}
+	return streamSuccessListOrCSV(c, fields, "players", playerCSVColumns, func(emit func(v any) error) error {
+		for i := range pls[start:end] {
+			if err := emit(newPlayerDetail(&pls[start+i], loc)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 type PlayersAddHandlerResult struct {
 	Players []PlayerDetail `json:"players"`
 }
 
+// 参加者のファイルから表示名を読む
+// 検証に失敗した場合は *ingestError を返す
+func readPlayersFile(ctx context.Context, fh *multipart.FileHeader) ([]string, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, fmt.Errorf("error fh.Open FormFile(players): %w", err)
+	}
+	defer f.Close()
+	var names []string
+	if _, err := playerIngestSchema.run(ctx, f, ingestFormatOf(fh.Header.Get(echo.HeaderContentType), fh.Filename), func(row ingestRow) error {
+		names = append(names, row.str("display_name"))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
 // テナント管理者向けAPI
 // GET /api/organizer/players/add
 // テナントに参加者を追加する
 func playersAddHandler(c echo.Context) error {
-	ctx := context.Background()
+	ctx := c.Request().Context()
 	v, err := parseViewer(c)
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
@@ -78,17 +134,40 @@ func playersAddHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
+	defer tenantDB.Close()
 
 	params, err := c.FormParams()
 	if err != nil {
 		return fmt.Errorf("error c.FormParams: %w", err)
 	}
 	displayNames := params["display_name[]"]
+	// CSVかJSONのファイルでもまとめて追加できる (ingest.go を参照)
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		if fh, err := c.FormFile("players"); err == nil {
+			names, err := readPlayersFile(ctx, fh)
+			if err != nil {
+				return err
+			}
+			displayNames = append(displayNames, names...)
+		} else if !errors.Is(err, http.ErrMissingFile) {
+			return fmt.Errorf("error c.FormFile(players): %w", err)
+		}
+	}
+
+	if q, err := checkPlayersQuota(ctx, tenantDB, v.tenantID, len(displayNames)); err != nil {
+		return err
+	} else if q != nil {
+		return quotaExceeded(c, http.StatusForbidden, *q)
+	}
 
+	loc, err := tenantLocation(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
 	pds := make([]PlayerDetail, 0, len(displayNames))
 
 	players := make([]PlayerRow, 0, len(displayNames))
@@ -98,25 +177,26 @@ func playersAddHandler(c echo.Context) error {
 			return fmt.Errorf("error dispenseID: %w", err)
 		}
 
-		now := time.Now().Unix()
-		player := PlayerRow{v.tenantID, id, displayName, false, now, now}
+		now := srv(ctx).clock.Now().Unix()
+		player := PlayerRow{v.tenantID, id, displayName, false, now, now, sql.NullInt64{}}
 		players = append(players, player)
 
-		pds = append(pds, PlayerDetail{
-			ID:             player.ID,
-			DisplayName:    player.DisplayName,
-			IsDisqualified: player.IsDisqualified,
-		})
-
-		playerCache.Set(id, player)
+		pds = append(pds, newPlayerDetail(&player, loc))
 	}
 
-	_, err = tenantDB.NamedExec("INSERT INTO player (id, tenant_id, display_name, is_disqualified, created_at, updated_at) values (:id, :tenant_id, :display_name, :is_disqualified, :created_at, :updated_at)", players)
+	err = withRetry(ctx, func() error {
+		_, err := tenantDB.NamedExecContext(ctx, "INSERT INTO player (id, tenant_id, display_name, is_disqualified, created_at, updated_at) values (:id, :tenant_id, :display_name, :is_disqualified, :created_at, :updated_at)", players)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf(
+		return asConflict(fmt.Errorf(
 			"error Insert player at tenantDB: %w",
 			err,
-		)
+		), errorCodeDuplicatePlayer, "duplicate player")
+	}
+	// INSERTに失敗した参加者がキャッシュに残らないよう、書き込めてからキャッシュする
+	for _, player := range players {
+		srv(ctx).playerCache.Set(tenantKey{v.tenantID, player.ID}, player)
 	}
 
 	res := PlayersAddHandlerResult{
@@ -133,7 +213,7 @@ type PlayerDisqualifiedHandlerResult struct {
 // POST /api/organizer/player/:player_id/disqualified
 // 参加者を失格にする
 func playerDisqualifiedHandler(c echo.Context) error {
-	ctx := context.Background()
+	ctx := c.Request().Context()
 	v, err := parseViewer(c)
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
@@ -141,40 +221,53 @@ func playerDisqualifiedHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
+	defer tenantDB.Close()
 
-	playerID := c.Param("player_id")
+	p, err := disqualifyPlayer(ctx, tenantDB, v.tenantID, c.Param("player_id"))
+	if err != nil {
+		return err
+	}
 
-	now := time.Now().Unix()
-	if _, err := tenantDB.ExecContext(
-		ctx,
-		"UPDATE player SET is_disqualified = ?, updated_at = ? WHERE id = ?",
-		true, now, playerID,
-	); err != nil {
-		return fmt.Errorf(
+	loc, err := tenantLocation(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	res := PlayerDisqualifiedHandlerResult{
+		Player: newPlayerDetail(p, loc),
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// 参加者を失格にしてWebhookで通知する
+// 参加者が存在しなければ *notFoundError を返す
+func disqualifyPlayer(ctx context.Context, tenantDB dbOrTx, tenantID int64, playerID string) (*PlayerRow, error) {
+	now := srv(ctx).clock.Now().Unix()
+	if err := withRetry(ctx, func() error {
+		_, err := tenantDB.ExecContext(
+			ctx,
+			"UPDATE player SET is_disqualified = ?, updated_at = ? WHERE id = ?",
+			true, now, playerID,
+		)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf(
 			"error Update player: isDisqualified=%t, updatedAt=%d, id=%s, %w",
 			true, now, playerID, err,
 		)
 	}
-	playerCache.Delete(playerID)
-	p, err := retrievePlayer(ctx, tenantDB, playerID)
+	srv(ctx).playerCache.Delete(tenantKey{tenantID, playerID})
+	p, err := retrievePlayer(ctx, tenantDB, tenantID, playerID)
 	if err != nil {
-		// 存在しないプレイヤー
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "player not found")
-		}
-		return fmt.Errorf("error retrievePlayer: %w", err)
+		return nil, fmt.Errorf("error retrievePlayer: %w", err)
 	}
 
-	res := PlayerDisqualifiedHandlerResult{
-		Player: PlayerDetail{
-			ID:             p.ID,
-			DisplayName:    p.DisplayName,
-			IsDisqualified: p.IsDisqualified,
-		},
-	}
-	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+	publishWebhookEvent(ctx, tenantID, webhookEventPlayerDisqualified, map[string]any{
+		"player_id":    p.ID,
+		"display_name": p.DisplayName,
+	})
+	return p, nil
 }
@@ -0,0 +1,404 @@
+package isuports
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// テナントDBのハンドルを保持するプール
+// 開いているハンドル数が上限を超えたら、最後に使われてから最も時間が経ったものから閉じる
+// リクエスト処理中のハンドルは、返却されるまで閉じずに待つ
+type tenantDBPool struct {
+	mu      sync.Mutex
+	maxOpen int
+	lru     *list.List // 先頭ほど最近使われたもの
+	entries map[int64]*list.Element
+
+	hits      int64 // 開いているハンドルを再利用できた回数
+	misses    int64 // 新しく開いた回数
+	evictions int64 // 上限超過などで追い出した回数
+}
+
+// テナントDBのプールの状態
+type tenantDBPoolStats struct {
+	MaxOpen   int   `json:"max_open"`
+	Open      int   `json:"open"`
+	InUse     int   `json:"in_use"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+type tenantDBEntry struct {
+	id       int64
+	db       *sqlx.DB
+	refs     int
+	lastUsed time.Time
+	evicted  bool
+}
+
+// リクエスト中に使うテナントDBのハンドル
+// Closeしてもコネクションは閉じず、プールに返却するだけ
+type tenantDBConn struct {
+	*sqlx.DB
+	pool  *tenantDBPool
+	entry *tenantDBEntry
+	once  sync.Once
+}
+
+// テナントDBへのクエリごとのタイムアウト
+// 0ならリクエストのcontextがキャンセルされるまで待つ
+var dbQueryTimeout = getEnvDuration("ISUCON_DB_QUERY_TIMEOUT", 0)
+
+// クエリごとのタイムアウトを設定したcontextを返す
+func queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if dbQueryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, dbQueryTimeout)
+}
+
+func (c *tenantDBConn) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	return c.DB.GetContext(ctx, dest, query, args...)
+}
+
+func (c *tenantDBConn) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	return c.DB.SelectContext(ctx, dest, query, args...)
+}
+
+func (c *tenantDBConn) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	return c.DB.ExecContext(ctx, query, args...)
+}
+
+func (c *tenantDBConn) NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	return c.DB.NamedExecContext(ctx, query, arg)
+}
+
+// ハンドルをプールに返却する
+func (c *tenantDBConn) Close() error {
+	c.once.Do(func() {
+		c.pool.release(c.entry)
+	})
+	return nil
+}
+
+// maxOpenが0以下なら上限なし
+func newTenantDBPool(maxOpen int) *tenantDBPool {
+	return &tenantDBPool{
+		maxOpen: maxOpen,
+		lru:     list.New(),
+		entries: map[int64]*list.Element{},
+	}
+}
+
+// テナントDBのハンドルを借りる
+// 使い終わったら必ずCloseすること
+func (p *tenantDBPool) acquire(id int64, open func(id int64) (*sqlx.DB, error)) (*tenantDBConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if el, ok := p.entries[id]; ok {
+		e := el.Value.(*tenantDBEntry)
+		p.hits++
+		e.refs++
+		e.lastUsed = time.Now()
+		p.lru.MoveToFront(el)
+		return &tenantDBConn{DB: e.db, pool: p, entry: e}, nil
+	}
+
+	// sqlx.Openは実際にはファイルを開かないのでロック中に呼んでも問題ない
+	db, err := open(id)
+	if err != nil {
+		return nil, err
+	}
+	p.misses++
+	e := &tenantDBEntry{
+		id:       id,
+		db:       db,
+		refs:     1,
+		lastUsed: time.Now(),
+	}
+	p.entries[id] = p.lru.PushFront(e)
+	p.evictLocked()
+	return &tenantDBConn{DB: e.db, pool: p, entry: e}, nil
+}
+
+func (p *tenantDBPool) release(e *tenantDBEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e.refs--
+	if e.evicted && e.refs == 0 {
+		e.db.Close()
+	}
+}
+
+// 上限を超えた分を古いものから追い出す
+// 使用中のものはプールから外すだけにして、最後の返却時に閉じる
+func (p *tenantDBPool) evictLocked() {
+	if p.maxOpen <= 0 {
+		return
+	}
+	for p.lru.Len() > p.maxOpen {
+		p.removeLocked(p.lru.Back())
+		p.evictions++
+	}
+}
+
+func (p *tenantDBPool) removeLocked(el *list.Element) {
+	e := el.Value.(*tenantDBEntry)
+	p.lru.Remove(el)
+	delete(p.entries, e.id)
+	e.evicted = true
+	if e.refs == 0 {
+		e.db.Close()
+	}
+}
+
+// プールにハンドルがあるか
+func (p *tenantDBPool) has(id int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.entries[id]
+	return ok
+}
+
+// テナントDBがリクエストに使われていない状態になってからの経過時間を返す
+// 使用中ならfalse、プールにない(開いていない)場合は最大値を返す
+func (p *tenantDBPool) idleFor(id int64) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	el, ok := p.entries[id]
+	if !ok {
+		return time.Duration(math.MaxInt64), true
+	}
+	e := el.Value.(*tenantDBEntry)
+	if e.refs > 0 {
+		return 0, false
+	}
+	return time.Since(e.lastUsed), true
+}
+
+// プールの状態を返す
+func (p *tenantDBPool) stats() tenantDBPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := tenantDBPoolStats{
+		MaxOpen:   p.maxOpen,
+		Open:      p.lru.Len(),
+		Hits:      p.hits,
+		Misses:    p.misses,
+		Evictions: p.evictions,
+	}
+	for el := p.lru.Front(); el != nil; el = el.Next() {
+		if el.Value.(*tenantDBEntry).refs > 0 {
+			s.InUse++
+		}
+	}
+	return s
+}
+
+// 指定したテナントのハンドルをプールから外す
+// 使用中の場合は最後の返却時に閉じる
+func (p *tenantDBPool) remove(id int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if el, ok := p.entries[id]; ok {
+		p.removeLocked(el)
+	}
+}
+
+// 開いているハンドルの情報
+type tenantDBHandleInfo struct {
+	TenantID        int64     `json:"tenant_id"`
+	Refs            int       `json:"refs"`
+	LastUsed        time.Time `json:"last_used"`
+	IdleSeconds     float64   `json:"idle_seconds"`
+	OpenConnections int       `json:"open_connections"`
+	FileSize        int64     `json:"file_size"` // WALを含む、取得できなければ-1
+}
+
+// 開いているハンドルの一覧を最近使われた順に返す
+// fdのリークの調査や、上限と追い出しの設定を決めるためのもの
+func (p *tenantDBPool) handles() []tenantDBHandleInfo {
+	p.mu.Lock()
+	infos := make([]tenantDBHandleInfo, 0, p.lru.Len())
+	for el := p.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*tenantDBEntry)
+		infos = append(infos, tenantDBHandleInfo{
+			TenantID:        e.id,
+			Refs:            e.refs,
+			LastUsed:        e.lastUsed,
+			IdleSeconds:     time.Since(e.lastUsed).Seconds(),
+			OpenConnections: e.db.Stats().OpenConnections,
+		})
+	}
+	p.mu.Unlock()
+
+	// ファイルの情報はロックの外で取る
+	for i := range infos {
+		infos[i].FileSize = -1
+		path := tenantDBPath(infos[i].TenantID)
+		st, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		infos[i].FileSize = st.Size()
+		if wal, err := os.Stat(path + "-wal"); err == nil {
+			infos[i].FileSize += wal.Size()
+		}
+	}
+	return infos
+}
+
+// 上限を変更する
+func (p *tenantDBPool) setMaxOpen(maxOpen int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxOpen = maxOpen
+	p.evictLocked()
+}
+
+// 全てのハンドルを閉じる
+func (p *tenantDBPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.lru.Len() > 0 {
+		p.removeLocked(p.lru.Back())
+	}
+}
+
+// テナントDBを開く
+func (s *Server) openTenantDB(id int64) (*sqlx.DB, error) {
+	p := tenantDBPath(id)
+	// mode=rwでは無いファイルを開いても最初のクエリまで失敗しないので、先に確かめる
+	if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+		return nil, &tenantDBMissingError{TenantID: id, Path: p}
+	}
+	db, err := sqlx.Open(s.sqliteDriverName, fmt.Sprintf("file:%s?mode=rw", p))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tenant DB: %w", err)
+	}
+	return db, nil
+}
+
+// FailureResult.Code
+const errorCodeTenantDBUnavailable = "tenant_db_unavailable"
+
+// テナントDBのファイルがない
+// 作成中に再起動した、ファイルを消してしまった、別のシャードのテナントにアクセスしたなど
+// どのハンドラから返っても503とコードにする
+type tenantDBMissingError struct {
+	TenantID int64
+	Path     string
+}
+
+func (e *tenantDBMissingError) Error() string {
+	return fmt.Sprintf("tenant DB is missing: tenantID=%d, path=%s", e.TenantID, e.Path)
+}
+
+func tenantDBMissingResponse(c echo.Context, e *tenantDBMissingError) error {
+	return c.JSON(http.StatusServiceUnavailable, FailureResult{
+		Status:  false,
+		Message: "tenant database is unavailable",
+		Code:    errorCodeTenantDBUnavailable,
+	})
+}
+
+// ファイルのないテナントDBを作り直すか
+// 作り直すと空のDBになるので、データを失ったのに気づかないことがないよう標準では作り直さない
+var tenantDBCreateMissing = getEnv("ISUCON_TENANT_DB_CREATE_MISSING", "false") == "true"
+
+var createMissingTenantDBMu sync.Mutex
+
+// ファイルのないテナントDBを埋め込んだスキーマから作り直す
+// 作成が終わった、このシャードのテナントだけを作り直し、それ以外は元のエラーを返す
+func (s *Server) createMissingTenantDB(ctx context.Context, me *tenantDBMissingError) error {
+	id := me.TenantID
+	if !tenantDBCreateMissing || !s.shards.owns(id) {
+		return me
+	}
+	var provisioning bool
+	if err := s.adminDB.GetContext(ctx, &provisioning, "SELECT provisioning FROM tenant WHERE id = ?", id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return me
+		}
+		return fmt.Errorf("error Select tenant: id=%d, %w", id, err)
+	}
+	// 作成中のテナントは addTenant がファイルを作る
+	if provisioning {
+		return me
+	}
+
+	createMissingTenantDBMu.Lock()
+	defer createMissingTenantDBMu.Unlock()
+	// 待っている間に他のリクエストが作っていれば何もしない
+	if _, err := os.Stat(me.Path); err == nil {
+		return nil
+	}
+	logger.Warn("creating missing tenant DB", zap.Int64("tenant_id", id), zap.String("path", me.Path))
+	if err := s.createTenantDB(id); err != nil {
+		return fmt.Errorf("error createTenantDB: id=%d, %w", id, err)
+	}
+	return nil
+}
+
+// テナントDBの作成に失敗したときのエラー
+type TenantDBCreateError struct {
+	TenantID int64
+	Path     string
+	Op       string // 失敗した操作 (open, schema)
+	Err      error
+}
+
+func (e *TenantDBCreateError) Error() string {
+	return fmt.Sprintf("failed to create tenant DB: tenantID=%d, path=%s, op=%s: %s", e.TenantID, e.Path, e.Op, e.Err)
+}
+
+func (e *TenantDBCreateError) Unwrap() error {
+	return e.Err
+}
+
+// テナントDBを新規に作成する
+// sqlite3コマンドに依存せず、埋め込んだマイグレーションをdatabase/sql経由で流す
+func (s *Server) createTenantDB(id int64) error {
+	if s.tenantDBs.has(id) {
+		return nil
+	}
+
+	p := tenantDBPath(id)
+	db, err := sqlx.Open(s.sqliteDriverName, fmt.Sprintf("file:%s?mode=rwc", p))
+	if err != nil {
+		return &TenantDBCreateError{TenantID: id, Path: p, Op: "open", Err: err}
+	}
+	defer db.Close()
+
+	if _, err := migrateTenantDB(withServer(context.Background(), s), id, db); err != nil {
+		// 作りかけのファイルが残ると次回以降のmode=rwでの接続が成功してしまうので消しておく
+		db.Close()
+		os.Remove(p)
+		return &TenantDBCreateError{TenantID: id, Path: p, Op: "schema", Err: err}
+	}
+	s.migratedTenants.add(id)
+	return nil
+}
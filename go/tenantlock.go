@@ -0,0 +1,281 @@
+package isuports
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// テナントのロック
+// テナントDBを更新する処理 (スコアの置き換え、大会の終了など) と読むだけの処理 (ランキングなど) は
+// テナントごとのファイルロックで整合性を取る
+//
+//	lockWrite 排他ロック、更新する処理で使う
+//	lockRead  共有ロック、player_scoreなどを読むだけの処理で使い、読み取り同士は同時に進められる
+//
+// 待つのは ISUCON_TENANT_LOCK_TIMEOUT まで (0なら無制限) で、超えたら503を返す
+// 詰まったアップロードが1つあっても、そのテナントのランキングがいつまでも待たされることはない
+// 待ち時間はintentごとのヒストグラムにして /debug/vars の tenant_lock に出す
+//
+// 読み取りが途切れないと排他ロックがいつまでも取れないので、このプロセスで排他ロックを待っているものがあれば
+// 新しい共有ロックはそれが取れるまで待つ
+//
+// このプロセスで持っているロックは持ち主のリクエストIDと一緒に記録しておき、
+//   - 同じリクエストが排他ロックを持ったまま同じテナントのロックを取ろうとしたら、待たずにエラーにする (自分自身を待ち続けることになるため)
+//   - タイムアウトしたときは、その時点で持っているリクエストをログに出す
+
+type lockIntent int
+
+const (
+	lockRead lockIntent = iota
+	lockWrite
+)
+
+func (i lockIntent) String() string {
+	if i == lockWrite {
+		return "write"
+	}
+	return "read"
+}
+
+var (
+	tenantLockTimeout = getEnvDuration("ISUCON_TENANT_LOCK_TIMEOUT", 10*time.Second)
+	// ロックが空くのを確かめる間隔
+	tenantLockRetryDelay = 2 * time.Millisecond
+)
+
+// 同じリクエストの中で自分の持っているロックを待とうとした
+var errTenantLockDeadlock = errors.New("tenant lock deadlock")
+
+// 排他ロックのためのファイル名を生成する
+func lockFilePath(id int64) string {
+	tenantDBDir := getEnv("ISUCON_TENANT_DB_DIR", "../tenant_db")
+	return filepath.Join(tenantDBDir, fmt.Sprintf("%d.lock", id))
+}
+
+// Serverが持っているロック
+type tenantLockHolder struct {
+	id        int64
+	tenantID  int64
+	intent    lockIntent
+	requestID string
+	since     time.Time
+}
+
+type tenantLockStats struct {
+	mu      sync.Mutex
+	nextID  int64
+	holders map[int64]*tenantLockHolder
+
+	// テナントごとの排他ロックを待っている数
+	writersWaiting map[int64]int
+
+	waits    [2]*latencyHistogram // lockIntentごと
+	timeouts [2]int64
+}
+
+func newTenantLockStats() *tenantLockStats {
+	return &tenantLockStats{
+		holders:        map[int64]*tenantLockHolder{},
+		writersWaiting: map[int64]int{},
+		waits:          [2]*latencyHistogram{newLatencyHistogram(), newLatencyHistogram()},
+	}
+}
+
+// 同じリクエストが同じテナントで持っているロックを返す
+// リクエストIDのない処理 (バックグラウンドの処理) は区別できないので調べない
+func (s *tenantLockStats) heldBy(tenantID int64, requestID string) *tenantLockHolder {
+	if requestID == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range s.holders {
+		if h.tenantID == tenantID && h.requestID == requestID {
+			h := *h
+			return &h
+		}
+	}
+	return nil
+}
+
+// 排他ロックを待ち始める、返り値の関数で待ち終わる
+func (s *tenantLockStats) waitWriter(tenantID int64) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writersWaiting[tenantID]++
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.writersWaiting[tenantID]--; s.writersWaiting[tenantID] <= 0 {
+			delete(s.writersWaiting, tenantID)
+		}
+	}
+}
+
+// 排他ロックを待っているものがなくなるまで待つ
+func (s *tenantLockStats) waitForWriters(ctx context.Context, tenantID int64) error {
+	for {
+		s.mu.Lock()
+		n := s.writersWaiting[tenantID]
+		s.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(tenantLockRetryDelay):
+		}
+	}
+}
+
+func (s *tenantLockStats) add(h *tenantLockHolder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	h.id = s.nextID
+	s.holders[h.id] = h
+}
+
+func (s *tenantLockStats) remove(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.holders, id)
+}
+
+// テナントのロックを持っているものを古い順に返す
+func (s *tenantLockStats) holdersOf(tenantID int64) []TenantLockHolderDetail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ds := []TenantLockHolderDetail{}
+	for _, h := range s.holders {
+		if tenantID == 0 || h.tenantID == tenantID {
+			ds = append(ds, h.detail())
+		}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].HeldMs > ds[j].HeldMs })
+	return ds
+}
+
+type TenantLockHolderDetail struct {
+	TenantID  int64   `json:"tenant_id"`
+	Intent    string  `json:"intent"`
+	RequestID string  `json:"request_id,omitempty"`
+	HeldMs    float64 `json:"held_ms"`
+}
+
+func (h *tenantLockHolder) detail() TenantLockHolderDetail {
+	return TenantLockHolderDetail{
+		TenantID:  h.tenantID,
+		Intent:    h.intent.String(),
+		RequestID: h.requestID,
+		HeldMs:    float64(time.Since(h.since).Microseconds()) / 1000,
+	}
+}
+
+type TenantLockIntentDetail struct {
+	Wait     LatencyHistogramDetail `json:"wait"`
+	Timeouts int64                  `json:"timeouts"`
+}
+
+type TenantLockStatsDetail struct {
+	Read    TenantLockIntentDetail   `json:"read"`
+	Write   TenantLockIntentDetail   `json:"write"`
+	Holders []TenantLockHolderDetail `json:"holders"`
+}
+
+func (s *tenantLockStats) detail() TenantLockStatsDetail {
+	return TenantLockStatsDetail{
+		Read: TenantLockIntentDetail{
+			Wait:     s.waits[lockRead].detail(),
+			Timeouts: atomic.LoadInt64(&s.timeouts[lockRead]),
+		},
+		Write: TenantLockIntentDetail{
+			Wait:     s.waits[lockWrite].detail(),
+			Timeouts: atomic.LoadInt64(&s.timeouts[lockWrite]),
+		},
+		Holders: s.holdersOf(0),
+	}
+}
+
+// 取得したテナントのロック
+// Closeで解放する
+type tenantLock struct {
+	fl    *flock.Flock
+	id    int64
+	stats *tenantLockStats
+}
+
+func (l *tenantLock) Close() error {
+	l.stats.remove(l.id)
+	return l.fl.Close()
+}
+
+// テナントのロックを取る
+// ISUCON_TENANT_LOCK_TIMEOUT かctxの期限までに取れなければ503を返す
+func lockTenant(ctx context.Context, tenantID int64, intent lockIntent) (io.Closer, error) {
+	requestID := requestIDFromContext(ctx)
+	tenantLocks := srv(ctx).tenantLocks
+	held := tenantLocks.heldBy(tenantID, requestID)
+	if held != nil && (held.intent == lockWrite || intent == lockWrite) {
+		return nil, fmt.Errorf("%w: tenantID=%d, requestID=%s, held=%s, want=%s", errTenantLockDeadlock, tenantID, requestID, held.intent, intent)
+	}
+
+	if tenantLockTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tenantLockTimeout)
+		defer cancel()
+	}
+
+	p := lockFilePath(tenantID)
+	fl := flock.New(p)
+	start := time.Now()
+	var ok bool
+	var err error
+	if intent == lockWrite {
+		done := tenantLocks.waitWriter(tenantID)
+		ok, err = fl.TryLockContext(ctx, tenantLockRetryDelay)
+		done()
+	} else {
+		// 共有ロックを既に持っているリクエストが待つと、排他ロックを待っているものと互いに待ち続けるので待たない
+		if held == nil {
+			err = tenantLocks.waitForWriters(ctx, tenantID)
+		}
+		if err == nil {
+			ok, err = fl.TryRLockContext(ctx, tenantLockRetryDelay)
+		}
+	}
+	wait := time.Since(start)
+	tenantLocks.waits[intent].observe(wait)
+	if !ok {
+		fl.Close()
+		if err == nil || errors.Is(err, context.DeadlineExceeded) {
+			atomic.AddInt64(&tenantLocks.timeouts[intent], 1)
+			logger.Warn("tenant lock timeout",
+				zap.String("request_id", requestID),
+				zap.Int64("tenant_id", tenantID),
+				zap.String("intent", intent.String()),
+				zap.Int64("wait_ms", wait.Milliseconds()),
+				zap.Any("holders", tenantLocks.holdersOf(tenantID)),
+			)
+			return nil, fmt.Errorf("tenant lock timeout: tenantID=%d, intent=%s, %w", tenantID, intent, echo.NewHTTPError(http.StatusServiceUnavailable, "tenant is busy"))
+		}
+		return nil, fmt.Errorf("error flock: path=%s, intent=%s, %w", p, intent, err)
+	}
+
+	h := &tenantLockHolder{tenantID: tenantID, intent: intent, requestID: requestID, since: time.Now()}
+	tenantLocks.add(h)
+	return &tenantLock{fl: fl, id: h.id, stats: tenantLocks}, nil
+}
@@ -0,0 +1,67 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// テナントごとの設定
+// 管理用DBのtenant_settingにテナントIDと名前をキーにして文字列で保存する
+// 値が空の設定は保存せず、未設定として扱う
+
+type TenantSettingRow struct {
+	TenantID  int64  `db:"tenant_id"`
+	Name      string `db:"name"`
+	Value     string `db:"value"`
+	UpdatedAt int64  `db:"updated_at"`
+}
+
+// テナントの設定を取得する、未設定なら空文字列を返す
+func getTenantSetting(ctx context.Context, tenantID int64, name string) (string, error) {
+	var value string
+	if err := srv(ctx).adminDB.GetContext(
+		ctx,
+		&value,
+		"SELECT value FROM tenant_setting WHERE tenant_id = ? AND name = ?",
+		tenantID, name,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", fmt.Errorf("error Select tenant_setting: tenantID=%d, name=%s, %w", tenantID, name, err)
+	}
+	return value, nil
+}
+
+// テナントの設定をまとめて取得する
+func getTenantSettings(ctx context.Context, tenantID int64) (map[string]string, error) {
+	rows := []TenantSettingRow{}
+	if err := srv(ctx).adminDB.SelectContext(ctx, &rows, "SELECT * FROM tenant_setting WHERE tenant_id = ?", tenantID); err != nil {
+		return nil, fmt.Errorf("error Select tenant_setting: tenantID=%d, %w", tenantID, err)
+	}
+	settings := make(map[string]string, len(rows))
+	for _, r := range rows {
+		settings[r.Name] = r.Value
+	}
+	return settings, nil
+}
+
+// テナントの設定を保存する、valueが空なら削除する
+func setTenantSetting(ctx context.Context, tenantID int64, name, value string) error {
+	if value == "" {
+		if _, err := srv(ctx).adminDB.ExecContext(ctx, "DELETE FROM tenant_setting WHERE tenant_id = ? AND name = ?", tenantID, name); err != nil {
+			return fmt.Errorf("error Delete tenant_setting: tenantID=%d, name=%s, %w", tenantID, name, err)
+		}
+		return nil
+	}
+	if _, err := srv(ctx).adminDB.ExecContext(
+		ctx,
+		"INSERT INTO tenant_setting (tenant_id, name, value, updated_at) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value), updated_at = VALUES(updated_at)",
+		tenantID, name, value, srv(ctx).clock.Now().Unix(),
+	); err != nil {
+		return fmt.Errorf("error Upsert tenant_setting: tenantID=%d, name=%s, %w", tenantID, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+	// サーバーにタイムゾーンのデータベースがなくても設定できるよう埋め込む
+	_ "time/tzdata"
+
+	"github.com/labstack/echo/v4"
+)
+
+// テナントのタイムゾーン
+// 大会・参加者・課金のレスポンスでは、unix秒の *_at と並べてテナントの現地時刻のRFC3339 (*_at_rfc3339) を返す
+// 月ごとの請求の締め (invoice.go) もテナントのタイムゾーンの月初で区切る
+// 未設定のテナントは日本時間 (billingLocation) として扱う
+
+const timezoneSettingName = "timezone"
+
+// テナントのタイムゾーンを返す
+func tenantLocation(ctx context.Context, tenantID int64) (*time.Location, error) {
+	if loc, ok := srv(ctx).tenantLocationCache.Get(tenantID); ok {
+		return loc, nil
+	}
+	name, err := getTenantSetting(ctx, tenantID, timezoneSettingName)
+	if err != nil {
+		return nil, err
+	}
+	loc := billingLocation
+	if name != "" {
+		if loc, err = time.LoadLocation(name); err != nil {
+			// 保存するときに検証しているので、読めなければ設定がないものとして扱う
+			loc = billingLocation
+		}
+	}
+	srv(ctx).tenantLocationCache.Set(tenantID, loc)
+	return loc, nil
+}
+
+// unix秒をタイムゾーンのRFC3339にする
+func formatTenantTime(sec int64, loc *time.Location) string {
+	return time.Unix(sec, 0).In(loc).Format(time.RFC3339)
+}
+
+type TimezoneHandlerResult struct {
+	Timezone string `json:"timezone"`
+	Now      string `json:"now"` // 現在時刻をそのタイムゾーンで表したもの
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/timezone
+// テナントのタイムゾーンを取得する
+func timezoneHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	loc, err := tenantLocation(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: TimezoneHandlerResult{
+		Timezone: loc.String(),
+		Now:      formatTenantTime(srv(ctx).clock.Now().Unix(), loc),
+	}})
+}
+
+type TimezoneUpdateRequest struct {
+	Timezone string `form:"timezone"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/timezone
+// テナントのタイムゾーンをIANAの名前 (Asia/Tokyo など) で設定する、空にすると日本時間に戻す
+func timezoneUpdateHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	var req TimezoneUpdateRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+	loc := billingLocation
+	if req.Timezone != "" {
+		// time.LoadLocation は "Local" や空文字列も受け付けるので、サーバーによって変わる名前は拒否する
+		if req.Timezone == "Local" {
+			return &requestError{fields: []FieldError{{Field: "timezone", Code: fieldErrInvalid, Message: "invalid timezone: Local"}}}
+		}
+		if loc, err = time.LoadLocation(req.Timezone); err != nil {
+			return &requestError{fields: []FieldError{{Field: "timezone", Code: fieldErrInvalid, Message: fmt.Sprintf("invalid timezone: %s", req.Timezone)}}}
+		}
+	}
+	if err := setTenantSetting(ctx, v.tenantID, timezoneSettingName, req.Timezone); err != nil {
+		return err
+	}
+	srv(ctx).tenantLocationCache.Delete(v.tenantID)
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: TimezoneHandlerResult{
+		Timezone: loc.String(),
+		Now:      formatTenantTime(srv(ctx).clock.Now().Unix(), loc),
+	}})
+}
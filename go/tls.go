@@ -0,0 +1,91 @@
+package isuports
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// HTTPSで待ち受ける設定
+// 前段にリバースプロキシを置かない構成のためのもの
+//
+//	ISUCON_TLS_CERT_FILE, ISUCON_TLS_KEY_FILE  証明書と秘密鍵のファイル (ワイルドカード証明書を想定)
+//	ISUCON_TLS_AUTOCERT=1                      Let's Encryptから自動で証明書を取得する
+//	ISUCON_TLS_AUTOCERT_DIR                    取得した証明書を保存するディレクトリ
+//	ISUCON_TLS_AUTOCERT_EMAIL                  ACMEアカウントの連絡先
+//
+// autocertはTLS-ALPN-01で検証するので、ワイルドカード証明書は取得できない
+// テナントのホスト名ごとに、初めてアクセスがあったときに証明書を取得する
+// 存在しないテナント名で大量に証明書を発行されないよう、登録済みのテナントだけを許可する
+func newTLSConfig() (*tls.Config, error) {
+	certFile := getEnv("ISUCON_TLS_CERT_FILE", "")
+	keyFile := getEnv("ISUCON_TLS_KEY_FILE", "")
+	autoCert := getEnv("ISUCON_TLS_AUTOCERT", "0") == "1"
+
+	switch {
+	case certFile != "" || keyFile != "":
+		if autoCert {
+			return nil, fmt.Errorf("ISUCON_TLS_CERT_FILE and ISUCON_TLS_AUTOCERT cannot be used together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error tls.LoadX509KeyPair: cert=%s, key=%s, %w", certFile, keyFile, err)
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+			NextProtos:   []string{"h2", "http/1.1"},
+		}, nil
+	case autoCert:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(getEnv("ISUCON_TLS_AUTOCERT_DIR", "../autocert")),
+			HostPolicy: tenantHostPolicy,
+			Email:      getEnv("ISUCON_TLS_AUTOCERT_EMAIL", ""),
+		}
+		c := m.TLSConfig()
+		c.MinVersion = tls.VersionTLS12
+		return c, nil
+	}
+	return nil, nil
+}
+
+// 証明書を発行してよいホスト名か
+// 管理者用のホストと、登録済みのテナントのホストだけを許可する
+func tenantHostPolicy(ctx context.Context, host string) error {
+	if host == getEnv("ISUCON_ADMIN_HOSTNAME", "admin.t.isucon.dev") {
+		return nil
+	}
+	baseHost := getEnv("ISUCON_BASE_HOSTNAME", ".t.isucon.dev")
+	if !strings.HasSuffix(host, baseHost) {
+		return fmt.Errorf("host not allowed: %s", host)
+	}
+	name := strings.TrimSuffix(host, baseHost)
+	if err := validateTenantName(name); err != nil {
+		return err
+	}
+	if _, ok := srv(ctx).tenantRowCache.Get(name); ok {
+		return nil
+	}
+	var id int64
+	if err := srv(ctx).adminReadDB.GetContext(ctx, &id, "SELECT id FROM tenant WHERE name = ?", name); err != nil {
+		return fmt.Errorf("tenant not found: %s, %w", name, err)
+	}
+	return nil
+}
+
+// TLSを使う設定ならリスナーをTLSでラップする
+func wrapTLSListener(ln net.Listener) (net.Listener, bool, error) {
+	c, err := newTLSConfig()
+	if err != nil {
+		return nil, false, err
+	}
+	if c == nil {
+		return ln, false, nil
+	}
+	return tls.NewListener(ln, c), true, nil
+}
@@ -0,0 +1,92 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 起動時の設定の検証
+// 最初のリクエストで500を返してから気づくのではなく、起動時にまとめて報告して終了する
+
+// 検証で見つかった問題の一覧
+type startupErrors []string
+
+func (e startupErrors) Error() string {
+	return fmt.Sprintf("%d problem(s) found:\n  - %s", len(e), strings.Join(e, "\n  - "))
+}
+
+// 起動に必要な設定とリソースを確認する
+// 問題がなければnilを返し、あればすべての問題をまとめたエラーを返す
+func validateStartup(ctx context.Context) error {
+	var errs startupErrors
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	// 管理用DB
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := srv(ctx).adminDB.PingContext(pingCtx); err != nil {
+		add("admin db is not reachable: %s", err)
+	}
+	if srv(ctx).adminReadDB != srv(ctx).adminDB {
+		if err := srv(ctx).adminReadDB.PingContext(pingCtx); err != nil {
+			add("admin read db is not reachable: %s", err)
+		}
+	}
+
+	// テナントDBのディレクトリ
+	tenantDBDir := getEnv("ISUCON_TENANT_DB_DIR", "../tenant_db")
+	if err := checkWritableDir(tenantDBDir); err != nil {
+		add("ISUCON_TENANT_DB_DIR: %s", err)
+	}
+	// /initialize でコピーする初期データ
+	initialDataDir := getEnv("ISUCON_INITIAL_DATA_DIR", "../../initial_data")
+	if st, err := os.Stat(initialDataDir); err != nil {
+		add("ISUCON_INITIAL_DATA_DIR: %s", err)
+	} else if !st.IsDir() {
+		add("ISUCON_INITIAL_DATA_DIR: not a directory: %s", initialDataDir)
+	}
+
+	// JWTの公開鍵
+	if _, err := loadJWTKey(); err != nil {
+		add("ISUCON_JWT_KEY_FILE: %s", err)
+	}
+
+	// 埋め込んだスキーマ
+	for _, dir := range []string{"schema/admin", "schema/tenant"} {
+		ms, err := loadMigrations(dir)
+		if err != nil {
+			add("%s: %s", dir, err)
+		} else if len(ms) == 0 {
+			add("%s: no migration files", dir)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ディレクトリが存在し、ファイルを作れるか確認する
+func checkWritableDir(dir string) error {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("not a directory: %s", dir)
+	}
+	f, err := os.CreateTemp(dir, ".isuports-write-check-*")
+	if err != nil {
+		return fmt.Errorf("not writable: %s, %w", dir, err)
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(filepath.Clean(name))
+}
@@ -0,0 +1,131 @@
+package isuports
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// 参加者の訪問履歴 (visit_history) の書き込み
+// ランキングAPIの訪問はメモリに溜め、delayedInsertVisitHistory でまとめて管理用DBに書き出す
+// 課金は (テナント, 大会, 参加者) ごとに最初の訪問だけを見るので、キューもテーブルもこの組で1行にする
+// 書き出しに失敗した訪問はキューに残り次の書き出しで再試行される
+// 再試行で同じ行を二度書いても一意キーで1行にまとまるので、二重に課金されることはない
+
+type visitKey struct {
+	tenantID      int64
+	competitionID string
+	playerID      string
+}
+
+type visitQueue struct {
+	mu      sync.Mutex
+	pending map[visitKey]VisitHistoryRow
+	// 書き出しは同時に1つだけ
+	flushMu sync.Mutex
+}
+
+func newVisitQueue() *visitQueue {
+	return &visitQueue{pending: map[visitKey]VisitHistoryRow{}}
+}
+
+func (q *visitQueue) record(vh VisitHistoryRow) {
+	k := visitKey{vh.TenantID, vh.CompetitionID, vh.PlayerID}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if cur, ok := q.pending[k]; ok {
+		// 最初の訪問時刻は残し、最後の訪問時刻だけ進める
+		if vh.CreatedAt > cur.CreatedAt {
+			vh.CreatedAt = cur.CreatedAt
+		}
+		if vh.UpdatedAt < cur.UpdatedAt {
+			vh.UpdatedAt = cur.UpdatedAt
+		}
+	}
+	q.pending[k] = vh
+}
+
+// 大会の書き出し待ちの訪問
+func (q *visitQueue) competition(tenantID int64, competitionID string) []VisitHistoryRow {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	vhs := []VisitHistoryRow{}
+	for k, vh := range q.pending {
+		if k.tenantID == tenantID && k.competitionID == competitionID {
+			vhs = append(vhs, vh)
+		}
+	}
+	return vhs
+}
+
+// 書き出し待ちの訪問を捨てる
+// 捨てた件数を返す
+func (q *visitQueue) discard(tenantID int64, competitionID, playerID string) int64 {
+	k := visitKey{tenantID, competitionID, playerID}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.pending[k]; !ok {
+		return 0
+	}
+	delete(q.pending, k)
+	return 1
+}
+
+func (q *visitQueue) reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = map[visitKey]VisitHistoryRow{}
+}
+
+func (q *visitQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// 書き出し待ちの訪問を管理用DBに書き出す
+func (q *visitQueue) flush(ctx context.Context, s *Server) error {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	q.mu.Lock()
+	vhs := make([]VisitHistoryRow, 0, len(q.pending))
+	for _, vh := range q.pending {
+		vhs = append(vhs, vh)
+	}
+	q.mu.Unlock()
+	if len(vhs) == 0 {
+		return nil
+	}
+
+	err := withRetry(ctx, func() error {
+		_, err := s.adminDB.NamedExecContext(
+			ctx,
+			`INSERT INTO visit_history (player_id, tenant_id, competition_id, created_at, updated_at) VALUES (:player_id, :tenant_id, :competition_id, :created_at, :updated_at)
+			 ON DUPLICATE KEY UPDATE created_at = LEAST(created_at, VALUES(created_at)), updated_at = GREATEST(updated_at, VALUES(updated_at))`,
+			vhs,
+		)
+		return err
+	})
+	if err != nil {
+		// キューに残したまま次の書き出しで再試行する
+		logger.Warn("failed to insert visit_history", zap.Int("pending", len(vhs)), zap.Error(err))
+		return err
+	}
+
+	// 書き出している間に届いた訪問は残す
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, vh := range vhs {
+		k := visitKey{vh.TenantID, vh.CompetitionID, vh.PlayerID}
+		if cur, ok := q.pending[k]; ok && cur == vh {
+			delete(q.pending, k)
+		}
+	}
+	return nil
+}
+
+func delayedInsertVisitHistory(s *Server) {
+	_ = s.visits.flush(withServer(context.Background(), s), s)
+}
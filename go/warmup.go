@@ -0,0 +1,107 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// /initialize 後のウォームアップ
+// ベンチマークの最初の数秒がキャッシュのミスとテナントDBのオープンで遅くならないよう、
+// 最近アクセスのあったテナントのDBを開き、キャッシュを埋めておく
+// ISUCON_WARMUP_TENANTS に開くテナントの数を指定する (0なら何もしない)
+var warmUpTenants = getEnvInt("ISUCON_WARMUP_TENANTS", 0)
+
+// ウォームアップの結果
+type warmUpResult struct {
+	Tenants      int
+	Competitions int
+	Elapsed      time.Duration
+}
+
+// ウォームアップを行う
+// initializeの応答を遅らせないよう、呼び出し側でgoroutineで実行すること
+func warmUp(ctx context.Context) (*warmUpResult, error) {
+	start := time.Now()
+	res := &warmUpResult{}
+
+	if _, err := srv(ctx).jwtVerifier.key(); err != nil {
+		return nil, err
+	}
+
+	if warmUpTenants <= 0 {
+		res.Elapsed = time.Since(start)
+		return res, nil
+	}
+
+	// 訪問履歴が最近記録されたテナントから順に開く
+	var tenants []TenantRow
+	if err := srv(ctx).adminReadDB.SelectContext(
+		ctx,
+		&tenants,
+		`SELECT t.* FROM tenant t
+		 JOIN (SELECT tenant_id, MAX(created_at) AS last_visited FROM visit_history GROUP BY tenant_id) v ON v.tenant_id = t.id
+		 ORDER BY v.last_visited DESC LIMIT ?`,
+		warmUpTenants,
+	); err != nil {
+		return nil, fmt.Errorf("error Select active tenants: %w", err)
+	}
+
+	for _, t := range tenants {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		if !srv(ctx).shards.owns(t.ID) {
+			continue
+		}
+		srv(ctx).tenantRowCache.Set(t.Name, t)
+		srv(ctx).tenantCache.Set(t.ID, struct{}{})
+
+		n, err := warmUpTenant(ctx, t.ID)
+		if err != nil {
+			return res, err
+		}
+		res.Tenants++
+		res.Competitions += n
+	}
+	res.Elapsed = time.Since(start)
+	return res, nil
+}
+
+// テナントDBを開いて大会のキャッシュを埋め、キャッシュした大会の数を返す
+func warmUpTenant(ctx context.Context, tenantID int64) (int, error) {
+	tenantDB, err := connectToTenantDB(ctx, tenantID)
+	if err != nil {
+		return 0, fmt.Errorf("error connectToTenantDB: tenantID=%d, %w", tenantID, err)
+	}
+	defer tenantDB.Close()
+
+	var comps []CompetitionRow
+	if err := tenantDB.SelectContext(ctx, &comps, "SELECT * FROM competition WHERE tenant_id = ?", tenantID); err != nil {
+		return 0, fmt.Errorf("error Select competition: tenantID=%d, %w", tenantID, err)
+	}
+	for _, comp := range comps {
+		srv(ctx).competitionCache.Set(tenantKey{tenantID, comp.ID}, comp)
+	}
+	return len(comps), nil
+}
+
+// initializeから呼ぶ
+func startWarmUp(s *Server) {
+	go func() {
+		ctx, cancel := context.WithTimeout(withServer(context.Background(), s), getEnvDuration("ISUCON_WARMUP_TIMEOUT", 30*time.Second))
+		defer cancel()
+		res, err := warmUp(ctx)
+		if err != nil {
+			logger.Warn("warm-up failed", zap.Error(err))
+			return
+		}
+		logger.Info("warm-up finished",
+			zap.Int("tenants", res.Tenants),
+			zap.Int("competitions", res.Competitions),
+			zap.Int64("elapsed_ms", res.Elapsed.Milliseconds()),
+		)
+	}()
+}
@@ -0,0 +1,194 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// レイテンシの悪化やgoroutineの増加を検知して、自動でプロファイルを取る
+// ベンチ後の分析のために、誰かがちょうど良いタイミングで :6060 を叩かなくても済むようにする
+//
+//	ISUCON_WATCHDOG_P99         直近のリクエストのp99がこれを超えたら取る (0なら見ない)
+//	ISUCON_WATCHDOG_GOROUTINES  goroutineの数がこれを超えたら取る (0なら見ない)
+//	ISUCON_WATCHDOG_INTERVAL    確認する間隔
+//	ISUCON_WATCHDOG_COOLDOWN    一度取ってから次に取るまでの最短の間隔
+//	ISUCON_PROFILE_DIR          保存先
+//	ISUCON_PROFILE_CPU_DURATION CPUプロファイルを取る時間
+type watchdog struct {
+	p99Threshold       time.Duration
+	goroutineThreshold int
+	interval           time.Duration
+	cooldown           time.Duration
+	dir                string
+	cpuDuration        time.Duration
+
+	latencies *latencyWindow
+	lastTaken time.Time
+}
+
+func newWatchdogFromConfig() *watchdog {
+	return &watchdog{
+		p99Threshold:       getEnvDuration("ISUCON_WATCHDOG_P99", 0),
+		goroutineThreshold: getEnvInt("ISUCON_WATCHDOG_GOROUTINES", 0),
+		interval:           getEnvDuration("ISUCON_WATCHDOG_INTERVAL", 5*time.Second),
+		cooldown:           getEnvDuration("ISUCON_WATCHDOG_COOLDOWN", 5*time.Minute),
+		dir:                getEnv("ISUCON_PROFILE_DIR", "../profiles"),
+		cpuDuration:        getEnvDuration("ISUCON_PROFILE_CPU_DURATION", 10*time.Second),
+		latencies:          newLatencyWindow(4096),
+	}
+}
+
+func (w *watchdog) enabled() bool {
+	return w.p99Threshold > 0 || w.goroutineThreshold > 0
+}
+
+// 直近のリクエストのレイテンシを記録するmiddleware
+func (w *watchdog) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if w.p99Threshold <= 0 {
+			return next
+		}
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			w.latencies.add(time.Since(start))
+			return err
+		}
+	}
+}
+
+// ctxがキャンセルされるまで定期的に確認する
+func (w *watchdog) run(ctx context.Context) {
+	if !w.enabled() {
+		return
+	}
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		reason := w.check()
+		if reason == "" || time.Since(w.lastTaken) < w.cooldown {
+			continue
+		}
+		w.lastTaken = time.Now()
+		files, err := w.capture(ctx, reason)
+		if err != nil {
+			logger.Error("failed to capture profile", zap.String("reason", reason), zap.Error(err))
+			continue
+		}
+		logger.Warn("captured profile", zap.String("reason", reason), zap.Strings("files", files))
+	}
+}
+
+// しきい値を超えていればその理由を返す
+func (w *watchdog) check() string {
+	if w.goroutineThreshold > 0 {
+		if n := runtime.NumGoroutine(); n > w.goroutineThreshold {
+			return fmt.Sprintf("goroutines=%d", n)
+		}
+	}
+	if w.p99Threshold > 0 {
+		if p99, ok := w.latencies.percentile(0.99); ok && p99 > w.p99Threshold {
+			return fmt.Sprintf("p99=%s", p99)
+		}
+	}
+	return ""
+}
+
+// goroutineのダンプとCPUプロファイルを保存し、保存したファイルを返す
+// ファイル名には取得した時刻を入れる
+func (w *watchdog) capture(ctx context.Context, reason string) ([]string, error) {
+	if err := os.MkdirAll(w.dir, 0755); err != nil {
+		return nil, fmt.Errorf("error os.MkdirAll: dir=%s, %w", w.dir, err)
+	}
+	ts := time.Now().Format("20060102T150405")
+	var files []string
+
+	// 詰まっている箇所がわかるよう、goroutineは先にスタックトレースつきで保存する
+	gpath := filepath.Join(w.dir, fmt.Sprintf("goroutine-%s.txt", ts))
+	gf, err := os.Create(gpath)
+	if err != nil {
+		return nil, fmt.Errorf("error os.Create: path=%s, %w", gpath, err)
+	}
+	fmt.Fprintf(gf, "# reason: %s\n", reason)
+	err = pprof.Lookup("goroutine").WriteTo(gf, 2)
+	gf.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error write goroutine dump: %w", err)
+	}
+	files = append(files, gpath)
+
+	cpath := filepath.Join(w.dir, fmt.Sprintf("cpu-%s.pprof", ts))
+	cf, err := os.Create(cpath)
+	if err != nil {
+		return files, fmt.Errorf("error os.Create: path=%s, %w", cpath, err)
+	}
+	defer cf.Close()
+	// :6060 で手動でプロファイルを取っている最中はエラーになる
+	if err := pprof.StartCPUProfile(cf); err != nil {
+		os.Remove(cpath)
+		return files, fmt.Errorf("error pprof.StartCPUProfile: %w", err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(w.cpuDuration):
+	}
+	pprof.StopCPUProfile()
+	return append(files, cpath), nil
+}
+
+// 直近n件のレイテンシを保持するリングバッファ
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+func newLatencyWindow(n int) *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, n)}
+}
+
+func (l *latencyWindow) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.samples[l.next] = d
+	l.next++
+	if l.next == len(l.samples) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+// パーセンタイルを返す、サンプルが少なすぎる場合はfalse
+func (l *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	l.mu.Lock()
+	n := l.next
+	if l.full {
+		n = len(l.samples)
+	}
+	if n < 100 {
+		l.mu.Unlock()
+		return 0, false
+	}
+	s := make([]time.Duration, n)
+	copy(s, l.samples[:n])
+	l.mu.Unlock()
+
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s[int(float64(n-1)*p)], true
+}
@@ -0,0 +1,654 @@
+package isuports
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// Webhookの送信
+// イベントは管理用DBのwebhook_deliveryに積み、ワーカーが非同期に送信する
+// 送信に失敗した場合は指数バックオフでリトライし、上限を超えたらdeadにして送信をやめる
+// 複数のサーバーで動かしても同じ配信を二重に送らないよう、next_attempt_atを条件にしたUPDATEで取得する
+
+// Webhookで通知するイベント
+const (
+	webhookEventScoreUploaded       = "score_uploaded"
+	webhookEventCompetitionFinished = "competition_finished"
+	webhookEventPlayerDisqualified  = "player_disqualified"
+)
+
+var webhookEvents = []string{
+	webhookEventScoreUploaded,
+	webhookEventCompetitionFinished,
+	webhookEventPlayerDisqualified,
+}
+
+// イベントのdataに対応するprotobufのメッセージ (proto/isuports/v1/events.proto を参照)
+var webhookEventSchemas = map[string]string{
+	webhookEventScoreUploaded:       "isuports.v1.ScoreUploaded",
+	webhookEventCompetitionFinished: "isuports.v1.CompetitionFinished",
+	webhookEventPlayerDisqualified:  "isuports.v1.PlayerDisqualified",
+}
+
+// webhook_endpoint.format
+// simpleはZapierやIFTTTなどの自動化ツールで扱いやすいよう、dataの中身をトップレベルに展開したフラットなJSONにする
+const (
+	webhookFormatFull   = "full"
+	webhookFormatSimple = "simple"
+)
+
+// webhook_delivery.status
+const (
+	webhookStatusPending   = "pending"
+	webhookStatusDelivered = "delivered"
+	webhookStatusDead      = "dead"
+)
+
+// Webhookの送信設定
+var (
+	webhookWorkers        = getEnvInt("ISUCON_WEBHOOK_WORKERS", 4)
+	webhookPollInterval   = getEnvDuration("ISUCON_WEBHOOK_POLL_INTERVAL", time.Second)
+	webhookTimeout        = getEnvDuration("ISUCON_WEBHOOK_TIMEOUT", 10*time.Second)
+	webhookMaxAttempts    = getEnvInt("ISUCON_WEBHOOK_MAX_ATTEMPTS", 8)
+	webhookRetryBaseDelay = getEnvDuration("ISUCON_WEBHOOK_RETRY_BASE_DELAY", 10*time.Second)
+	webhookRetryMaxDelay  = getEnvDuration("ISUCON_WEBHOOK_RETRY_MAX_DELAY", time.Hour)
+)
+
+// テナントが登録したURLに送るので、プライベートなアドレスへの接続を拒否する (outbound.go を参照)
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: outboundDialGuard.control,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: webhookTimeout,
+	},
+	// リダイレクト先にも署名つきのペイロードを送ることになるので、リダイレクトには従わない
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Webhookの送信先のURLを検証する
+// ペイロードには参加者の情報が入るので平文では送らない
+func validWebhookURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Scheme == "https" && u.Host != "" && u.User == nil && len(rawURL) <= 1024
+}
+
+type WebhookEndpointRow struct {
+	ID        int64  `db:"id"`
+	TenantID  int64  `db:"tenant_id"`
+	URL       string `db:"url"`
+	Secret    string `db:"secret"`
+	Events    string `db:"events"` // カンマ区切り、空なら全てのイベント
+	Format    string `db:"format"`
+	CreatedAt int64  `db:"created_at"`
+	UpdatedAt int64  `db:"updated_at"`
+}
+
+// 送信先がイベントを受け取るか
+func (e WebhookEndpointRow) subscribes(event string) bool {
+	if e.Events == "" {
+		return true
+	}
+	for _, ev := range strings.Split(e.Events, ",") {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookDeliveryRow struct {
+	ID             int64  `db:"id"`
+	TenantID       int64  `db:"tenant_id"`
+	EndpointID     int64  `db:"endpoint_id"`
+	Event          string `db:"event"`
+	Payload        string `db:"payload"`
+	Status         string `db:"status"`
+	Attempts       int    `db:"attempts"`
+	NextAttemptAt  int64  `db:"next_attempt_at"`
+	LastStatusCode int    `db:"last_status_code"`
+	LastError      string `db:"last_error"`
+	CreatedAt      int64  `db:"created_at"`
+	UpdatedAt      int64  `db:"updated_at"`
+}
+
+// 送信するリクエストボディ
+type webhookPayload struct {
+	Event     string         `json:"event"`
+	TenantID  string         `json:"tenant_id"`
+	CreatedAt int64          `json:"created_at"`
+	Data      map[string]any `json:"data"`
+}
+
+// 形式ごとのリクエストボディを作る
+// simpleではイベントとテナントのキーをdataのキーより優先する
+func marshalWebhookPayload(format string, p webhookPayload) ([]byte, error) {
+	if format != webhookFormatSimple {
+		return json.Marshal(p)
+	}
+	flat := make(map[string]any, len(p.Data)+3)
+	for k, v := range p.Data {
+		flat[k] = v
+	}
+	flat["event"] = p.Event
+	flat["tenant_id"] = p.TenantID
+	flat["created_at"] = p.CreatedAt
+	return json.Marshal(flat)
+}
+
+// イベントを購読している送信先ごとに送信キューへ積む
+// 呼び出し元の処理は完了しているので、失敗してもログに残すだけにする
+func publishWebhookEvent(ctx context.Context, tenantID int64, event string, data map[string]any) {
+	if err := enqueueWebhookEvent(ctx, tenantID, event, data); err != nil {
+		logger.Error("failed to publish webhook event",
+			zap.Int64("tenant_id", tenantID),
+			zap.String("event", event),
+			zap.Error(err),
+		)
+	}
+}
+
+func enqueueWebhookEvent(ctx context.Context, tenantID int64, event string, data map[string]any) error {
+	es := []WebhookEndpointRow{}
+	if err := srv(ctx).adminDB.SelectContext(ctx, &es, "SELECT * FROM webhook_endpoint WHERE tenant_id = ?", tenantID); err != nil {
+		return fmt.Errorf("error Select webhook_endpoint: tenantID=%d, %w", tenantID, err)
+	}
+	now := time.Now().Unix()
+	p := webhookPayload{
+		Event:     event,
+		TenantID:  strconv.FormatInt(tenantID, 10),
+		CreatedAt: now,
+		Data:      data,
+	}
+	// 形式ごとに一度だけ作る
+	payloads := map[string][]byte{}
+	for _, e := range es {
+		if !e.subscribes(event) {
+			continue
+		}
+		payload, ok := payloads[e.Format]
+		if !ok {
+			var err error
+			if payload, err = marshalWebhookPayload(e.Format, p); err != nil {
+				return fmt.Errorf("error json.Marshal: %w", err)
+			}
+			payloads[e.Format] = payload
+		}
+		if _, err := srv(ctx).adminDB.ExecContext(
+			ctx,
+			"INSERT INTO webhook_delivery (tenant_id, endpoint_id, event, payload, status, next_attempt_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			tenantID, e.ID, event, string(payload), webhookStatusPending, now, now, now,
+		); err != nil {
+			return fmt.Errorf("error Insert webhook_delivery: endpointID=%d, %w", e.ID, err)
+		}
+	}
+	return nil
+}
+
+// 送信待ちの配信と送信先
+type webhookJob struct {
+	WebhookDeliveryRow
+	URL    string `db:"url"`
+	Secret string `db:"secret"`
+}
+
+// 送信キューを監視して送信する
+// ctxがキャンセルされたら送信中のものを待ってから戻る
+func runWebhookDelivery(ctx context.Context) {
+	if webhookWorkers <= 0 {
+		return
+	}
+	jobs := make(chan webhookJob)
+	var wg sync.WaitGroup
+	for i := 0; i < webhookWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				deliverWebhook(srv(ctx), j)
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
+
+	t := time.NewTicker(webhookPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		claimed, err := claimWebhookJobs(ctx, webhookWorkers*10)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Warn("failed to claim webhook deliveries", zap.Error(err))
+			}
+			continue
+		}
+		for _, j := range claimed {
+			select {
+			case <-ctx.Done():
+				// 取得したものは期限が切れたら再度送信される
+				return
+			case jobs <- j:
+			}
+		}
+	}
+}
+
+// 送信時刻を過ぎた配信を最大limit件取得する
+// 他のサーバーに取られないよう、next_attempt_atを送信のタイムアウトより先に延ばしてから返す
+func claimWebhookJobs(ctx context.Context, limit int) ([]webhookJob, error) {
+	now := time.Now().Unix()
+	js := []webhookJob{}
+	if err := srv(ctx).adminDB.SelectContext(
+		ctx,
+		&js,
+		"SELECT d.*, e.url, e.secret FROM webhook_delivery d JOIN webhook_endpoint e ON e.id = d.endpoint_id"+
+			" WHERE d.status = ? AND d.next_attempt_at <= ? ORDER BY d.next_attempt_at LIMIT ?",
+		webhookStatusPending, now, limit,
+	); err != nil {
+		return nil, fmt.Errorf("error Select webhook_delivery: %w", err)
+	}
+	lease := now + int64((webhookTimeout+time.Minute)/time.Second)
+	claimed := js[:0]
+	for _, j := range js {
+		res, err := srv(ctx).adminDB.ExecContext(
+			ctx,
+			"UPDATE webhook_delivery SET next_attempt_at = ? WHERE id = ? AND status = ? AND next_attempt_at = ?",
+			lease, j.ID, webhookStatusPending, j.NextAttemptAt,
+		)
+		if err != nil {
+			return claimed, fmt.Errorf("error Update webhook_delivery: id=%d, %w", j.ID, err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 1 {
+			claimed = append(claimed, j)
+		}
+	}
+	return claimed, nil
+}
+
+// リクエストボディの署名
+// 受信側は X-Isuports-Signature をsecretで検証する
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// 1件送信して結果を記録する
+// サーバーの終了中でも送信中のものは結果を記録できるよう、ctxは使わない
+func deliverWebhook(s *Server, j webhookJob) {
+	statusCode, sendErr := sendWebhook(j)
+
+	now := time.Now()
+	attempts := j.Attempts + 1
+	status, next, lastError := webhookStatusDelivered, j.NextAttemptAt, ""
+	if sendErr != nil {
+		lastError = sendErr.Error()
+		if len(lastError) > 1024 {
+			lastError = lastError[:1024]
+		}
+		if attempts >= webhookMaxAttempts {
+			status = webhookStatusDead
+		} else {
+			status, next = webhookStatusPending, now.Add(backoffDelay(webhookRetryBaseDelay, webhookRetryMaxDelay, attempts)).Unix()
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := withRetry(ctx, func() error {
+		_, err := s.adminDB.ExecContext(
+			ctx,
+			"UPDATE webhook_delivery SET status = ?, attempts = ?, next_attempt_at = ?, last_status_code = ?, last_error = ?, updated_at = ? WHERE id = ?",
+			status, attempts, next, statusCode, lastError, now.Unix(), j.ID,
+		)
+		return err
+	}); err != nil {
+		logger.Error("failed to record webhook delivery", zap.Int64("delivery_id", j.ID), zap.Error(err))
+	}
+	if status == webhookStatusDead {
+		logger.Warn("webhook delivery gave up",
+			zap.Int64("tenant_id", j.TenantID),
+			zap.Int64("delivery_id", j.ID),
+			zap.String("event", j.Event),
+			zap.Int("attempts", attempts),
+			zap.String("error", lastError),
+		)
+	}
+}
+
+// 送信してステータスコードを返す、2xx以外はエラーにする
+func sendWebhook(j webhookJob) (int, error) {
+	// httpsが必須になる前に登録された送信先には送らない
+	if !validWebhookURL(j.URL) {
+		return 0, errors.New("invalid url: https is required")
+	}
+	body := []byte(j.Payload)
+	req, err := http.NewRequest(http.MethodPost, j.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("error http.NewRequest: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "isuports-webhook")
+	req.Header.Set("X-Isuports-Event", j.Event)
+	req.Header.Set("X-Isuports-Event-Schema", webhookEventSchemas[j.Event])
+	req.Header.Set("X-Isuports-Delivery", strconv.FormatInt(j.ID, 10))
+	req.Header.Set("X-Isuports-Signature", webhookSignature(j.Secret, body))
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+type WebhookDetail struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Format    string   `json:"format"`
+	Secret    string   `json:"secret,omitempty"` // 登録したときだけ返す
+	CreatedAt int64    `json:"created_at"`
+}
+
+func webhookDetail(e WebhookEndpointRow) WebhookDetail {
+	events := webhookEvents
+	if e.Events != "" {
+		events = strings.Split(e.Events, ",")
+	}
+	return WebhookDetail{
+		ID:        strconv.FormatInt(e.ID, 10),
+		URL:       e.URL,
+		Events:    events,
+		Format:    e.Format,
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+type WebhooksHandlerResult struct {
+	Webhooks []WebhookDetail `json:"webhooks"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/webhooks
+// Webhookの送信先の一覧を取得する
+func webhooksHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	es := []WebhookEndpointRow{}
+	if err := srv(ctx).adminDB.SelectContext(ctx, &es, "SELECT * FROM webhook_endpoint WHERE tenant_id = ? ORDER BY id", v.tenantID); err != nil {
+		return fmt.Errorf("error Select webhook_endpoint: tenantID=%d, %w", v.tenantID, err)
+	}
+	ws := make([]WebhookDetail, 0, len(es))
+	for _, e := range es {
+		ws = append(ws, webhookDetail(e))
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: WebhooksHandlerResult{Webhooks: ws}})
+}
+
+type WebhookAddHandlerResult struct {
+	Webhook WebhookDetail `json:"webhook"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/webhooks/add
+// Webhookの送信先を登録する
+// eventsはカンマ区切りで、省略した場合は全てのイベントを送る
+// formatはfullかsimpleで、省略した場合はfull
+// 署名の検証に使うsecretは登録したときのレスポンスでだけ返す
+func webhookAddHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	rawURL := c.FormValue("url")
+	if !validWebhookURL(rawURL) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid url: https is required")
+	}
+	var events []string
+	if s := c.FormValue("events"); s != "" {
+		for _, ev := range strings.Split(s, ",") {
+			ev = strings.TrimSpace(ev)
+			known := false
+			for _, e := range webhookEvents {
+				known = known || e == ev
+			}
+			if !known {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown event: %s", ev))
+			}
+			events = append(events, ev)
+		}
+	}
+
+	format := c.FormValue("format")
+	switch format {
+	case "":
+		format = webhookFormatFull
+	case webhookFormatFull, webhookFormatSimple:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown format: %s", format))
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("error rand.Read: %w", err)
+	}
+	now := srv(ctx).clock.Now().Unix()
+	e := WebhookEndpointRow{
+		TenantID:  v.tenantID,
+		URL:       rawURL,
+		Secret:    hex.EncodeToString(b),
+		Events:    strings.Join(events, ","),
+		Format:    format,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	res, err := srv(ctx).adminDB.ExecContext(
+		ctx,
+		"INSERT INTO webhook_endpoint (tenant_id, url, secret, events, format, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		e.TenantID, e.URL, e.Secret, e.Events, e.Format, e.CreatedAt, e.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("error Insert webhook_endpoint: tenantID=%d, %w", v.tenantID, err)
+	}
+	if e.ID, err = res.LastInsertId(); err != nil {
+		return fmt.Errorf("error get LastInsertId: %w", err)
+	}
+
+	d := webhookDetail(e)
+	d.Secret = e.Secret
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: WebhookAddHandlerResult{Webhook: d}})
+}
+
+// テナントのWebhookの送信先を取得する
+func retrieveWebhookEndpoint(ctx context.Context, tenantID int64, id string) (*WebhookEndpointRow, error) {
+	var e WebhookEndpointRow
+	if err := srv(ctx).adminDB.GetContext(ctx, &e, "SELECT * FROM webhook_endpoint WHERE tenant_id = ? AND id = ?", tenantID, id); err != nil {
+		return nil, fmt.Errorf("error Select webhook_endpoint: tenantID=%d, id=%s, %w", tenantID, id, err)
+	}
+	return &e, nil
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/webhook/:webhook_id/delete
+// Webhookの送信先と、その送信履歴を削除する
+func webhookDeleteHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	e, err := retrieveWebhookEndpoint(ctx, v.tenantID, c.Param("webhook_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "webhook not found")
+		}
+		return err
+	}
+	if _, err := srv(ctx).adminDB.ExecContext(ctx, "DELETE FROM webhook_endpoint WHERE id = ?", e.ID); err != nil {
+		return fmt.Errorf("error Delete webhook_endpoint: id=%d, %w", e.ID, err)
+	}
+	if _, err := srv(ctx).adminDB.ExecContext(ctx, "DELETE FROM webhook_delivery WHERE endpoint_id = ?", e.ID); err != nil {
+		return fmt.Errorf("error Delete webhook_delivery: endpointID=%d, %w", e.ID, err)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
+
+type WebhookDeliveryDetail struct {
+	ID             string `json:"id"`
+	Event          string `json:"event"`
+	Status         string `json:"status"`
+	Attempts       int    `json:"attempts"`
+	NextAttemptAt  int64  `json:"next_attempt_at"`
+	LastStatusCode int    `json:"last_status_code"`
+	LastError      string `json:"last_error"`
+	CreatedAt      int64  `json:"created_at"`
+	UpdatedAt      int64  `json:"updated_at"`
+}
+
+type WebhookDeliveriesHandlerResult struct {
+	Deliveries []WebhookDeliveryDetail `json:"deliveries"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/webhook/:webhook_id/deliveries
+// Webhookの送信履歴を新しい順に最大100件取得する
+// URL引数beforeを指定した場合、指定した値よりもidが小さいものを取得する
+func webhookDeliveriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	e, err := retrieveWebhookEndpoint(ctx, v.tenantID, c.Param("webhook_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "webhook not found")
+		}
+		return err
+	}
+	var beforeID int64
+	if before := c.QueryParam("before"); before != "" {
+		if beforeID, err = strconv.ParseInt(before, 10, 64); err != nil {
+			return echo.NewHTTPError(
+				http.StatusBadRequest,
+				fmt.Sprintf("failed to parse query parameter 'before': %s", err.Error()),
+			)
+		}
+	}
+
+	ds := []WebhookDeliveryRow{}
+	if beforeID != 0 {
+		err = srv(ctx).adminDB.SelectContext(ctx, &ds, "SELECT * FROM webhook_delivery WHERE endpoint_id = ? AND id < ? ORDER BY id DESC LIMIT 100", e.ID, beforeID)
+	} else {
+		err = srv(ctx).adminDB.SelectContext(ctx, &ds, "SELECT * FROM webhook_delivery WHERE endpoint_id = ? ORDER BY id DESC LIMIT 100", e.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("error Select webhook_delivery: endpointID=%d, %w", e.ID, err)
+	}
+	res := make([]WebhookDeliveryDetail, 0, len(ds))
+	for _, d := range ds {
+		res = append(res, WebhookDeliveryDetail{
+			ID:             strconv.FormatInt(d.ID, 10),
+			Event:          d.Event,
+			Status:         d.Status,
+			Attempts:       d.Attempts,
+			NextAttemptAt:  d.NextAttemptAt,
+			LastStatusCode: d.LastStatusCode,
+			LastError:      d.LastError,
+			CreatedAt:      d.CreatedAt,
+			UpdatedAt:      d.UpdatedAt,
+		})
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: WebhookDeliveriesHandlerResult{Deliveries: res}})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/webhook/:webhook_id/delivery/:delivery_id/retry
+// deadになった送信をもう一度送信待ちに戻す
+func webhookRetryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	e, err := retrieveWebhookEndpoint(ctx, v.tenantID, c.Param("webhook_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "webhook not found")
+		}
+		return err
+	}
+	now := time.Now().Unix()
+	res, err := srv(ctx).adminDB.ExecContext(
+		ctx,
+		"UPDATE webhook_delivery SET status = ?, attempts = 0, next_attempt_at = ?, updated_at = ? WHERE id = ? AND endpoint_id = ? AND status = ?",
+		webhookStatusPending, now, now, c.Param("delivery_id"), e.ID, webhookStatusDead,
+	)
+	if err != nil {
+		return fmt.Errorf("error Update webhook_delivery: endpointID=%d, %w", e.ID, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("error get RowsAffected: %w", err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "dead delivery not found")
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
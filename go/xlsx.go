@@ -0,0 +1,369 @@
+package isuports
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 課金レポートをExcel (xlsx) で出力する
+// CSVは文字コードや区切り文字の地域設定の違いで経理部門で開けないことがあるので、
+// ライブラリを使わずにSpreadsheetMLをzipで固めて返す
+
+const mimeXLSX = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// xlsxのセル
+// formulaを指定した場合、valueは計算済みの値としてそのまま書き出す (開いたときに再計算される)
+type xlsxCell struct {
+	value   any // string か int64
+	formula string
+}
+
+// xlsxのシート
+type xlsxSheet struct {
+	name string
+	rows [][]xlsxCell
+}
+
+func xlsxString(s string) xlsxCell { return xlsxCell{value: s} }
+func xlsxInt(n int64) xlsxCell     { return xlsxCell{value: n} }
+func xlsxFormula(f string, cached int64) xlsxCell {
+	return xlsxCell{value: cached, formula: f}
+}
+
+// 0始まりの列番号をA, B, ..., Z, AA, ... の形にする
+func xlsxColumn(i int) string {
+	name := ""
+	for i >= 0 {
+		name = string(rune('A'+i%26)) + name
+		i = i/26 - 1
+	}
+	return name
+}
+
+// セル参照 (例: B3) を返す、列と行は0始まり
+func xlsxRef(col, row int) string {
+	return xlsxColumn(col) + strconv.Itoa(row+1)
+}
+
+// シート名を使える文字と長さ(31文字)にして、重複しないようにする
+func xlsxSheetName(name string, used map[string]bool) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\'`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" {
+		name = "sheet"
+	}
+	truncate := func(s string, n int) string {
+		for utf8.RuneCountInString(s) > n {
+			_, size := utf8.DecodeLastRuneInString(s)
+			s = s[:len(s)-size]
+		}
+		return s
+	}
+	base := truncate(name, 31)
+	name = base
+	for i := 2; used[strings.ToLower(name)]; i++ {
+		suffix := fmt.Sprintf(" (%d)", i)
+		name = truncate(base, 31-len(suffix)) + suffix
+	}
+	used[strings.ToLower(name)] = true
+	return name
+}
+
+// 別シートのセルを参照する数式で使うシート名
+func xlsxSheetRef(name string) string {
+	return "'" + name + "'"
+}
+
+// xlsxファイルを書き出す
+func writeXLSX(w io.Writer, sheets []xlsxSheet) error {
+	zw := zip.NewWriter(w)
+	put := func(name, body string) error {
+		f, err := zw.Create(name)
+		if err != nil {
+			return fmt.Errorf("error zip.Create: name=%s, %w", name, err)
+		}
+		if _, err := io.WriteString(f, xml.Header+body); err != nil {
+			return fmt.Errorf("error write xlsx: name=%s, %w", name, err)
+		}
+		return nil
+	}
+
+	var contentTypes, workbookSheets, workbookRels strings.Builder
+	for i, s := range sheets {
+		n := i + 1
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&workbookSheets, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(s.name), n, n)
+		fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, n, n)
+	}
+
+	if err := put("[Content_Types].xml",
+		`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">`+
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>`+
+			`<Default Extension="xml" ContentType="application/xml"/>`+
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>`+
+			contentTypes.String()+
+			`</Types>`); err != nil {
+		return err
+	}
+	if err := put("_rels/.rels",
+		`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`+
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>`+
+			`</Relationships>`); err != nil {
+		return err
+	}
+	// 開いたときに数式を再計算させる
+	if err := put("xl/workbook.xml",
+		`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">`+
+			`<sheets>`+workbookSheets.String()+`</sheets>`+
+			`<calcPr fullCalcOnLoad="1"/>`+
+			`</workbook>`); err != nil {
+		return err
+	}
+	if err := put("xl/_rels/workbook.xml.rels",
+		`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`+
+			workbookRels.String()+
+			`</Relationships>`); err != nil {
+		return err
+	}
+
+	for i, s := range sheets {
+		var b strings.Builder
+		b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+		for r, row := range s.rows {
+			fmt.Fprintf(&b, `<row r="%d">`, r+1)
+			for col, cell := range row {
+				ref := xlsxRef(col, r)
+				switch v := cell.value.(type) {
+				case nil:
+					if cell.formula != "" {
+						fmt.Fprintf(&b, `<c r="%s"><f>%s</f></c>`, ref, xmlEscape(cell.formula))
+					}
+				case string:
+					fmt.Fprintf(&b, `<c r="%s" t="inlineStr"><is><t>%s</t></is></c>`, ref, xmlEscape(v))
+				case int64:
+					if cell.formula != "" {
+						fmt.Fprintf(&b, `<c r="%s"><f>%s</f><v>%d</v></c>`, ref, xmlEscape(cell.formula), v)
+					} else {
+						fmt.Fprintf(&b, `<c r="%s"><v>%d</v></c>`, ref, v)
+					}
+				default:
+					return fmt.Errorf("unsupported xlsx cell value: %T", v)
+				}
+			}
+			b.WriteString(`</row>`)
+		}
+		b.WriteString(`</sheetData></worksheet>`)
+		if err := put(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1), b.String()); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("error zip.Close: %w", err)
+	}
+	return nil
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// xlsxをダウンロードさせる
+func xlsxResponse(c echo.Context, filename string, sheets []xlsxSheet) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, mimeXLSX)
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	res.WriteHeader(http.StatusOK)
+	return writeXLSX(res, sheets)
+}
+
+// 大会ごとの課金レポートのシート
+// 合計金額のセルの位置を返す
+func competitionBillingSheet(name string, r BillingReport) (xlsxSheet, string) {
+	s := xlsxSheet{
+		name: name,
+		rows: [][]xlsxCell{
+			{xlsxString("大会ID"), xlsxString(r.CompetitionID)},
+			{xlsxString("大会名"), xlsxString(r.CompetitionTitle)},
+			{},
+			{xlsxString("項目"), xlsxString("人数"), xlsxString("単価"), xlsxString("金額")},
+			{xlsxString("スコアを登録した参加者"), xlsxInt(r.PlayerCount), xlsxInt(billingPlayerUnitYen), xlsxFormula("B5*C5", r.BillingPlayerYen)},
+			{xlsxString("ランキングを閲覧した参加者"), xlsxInt(r.VisitorCount), xlsxInt(billingVisitorUnitYen), xlsxFormula("B6*C6", r.BillingVisitorYen)},
+			{xlsxString("合計"), {}, {}, xlsxFormula("SUM(D5:D6)", r.BillingYen)},
+		},
+	}
+	return s, "D7"
+}
+
+// テナントの課金レポートのシート
+// 大会ごとに1行で、最後の行に合計を置く
+// 合計金額のセルの位置を返す
+func tenantBillingSheet(name string, reports []BillingReport) (xlsxSheet, string) {
+	s := xlsxSheet{name: name}
+	s.rows = append(s.rows, []xlsxCell{
+		xlsxString("大会ID"), xlsxString("大会名"), xlsxString("参加者数"), xlsxString("閲覧者数"),
+		xlsxString("参加者分"), xlsxString("閲覧者分"), xlsxString("合計"),
+	})
+	var total int64
+	for _, r := range reports {
+		row := len(s.rows)
+		s.rows = append(s.rows, []xlsxCell{
+			xlsxString(r.CompetitionID),
+			xlsxString(r.CompetitionTitle),
+			xlsxInt(r.PlayerCount),
+			xlsxInt(r.VisitorCount),
+			xlsxFormula(fmt.Sprintf("%s*%d", xlsxRef(2, row), billingPlayerUnitYen), r.BillingPlayerYen),
+			xlsxFormula(fmt.Sprintf("%s*%d", xlsxRef(3, row), billingVisitorUnitYen), r.BillingVisitorYen),
+			xlsxFormula(fmt.Sprintf("%s+%s", xlsxRef(4, row), xlsxRef(5, row)), r.BillingYen),
+		})
+		total += r.BillingYen
+	}
+	last := len(s.rows)
+	s.rows = append(s.rows, []xlsxCell{xlsxString("合計"), {}, {}, {}, {}, {}, xlsxSum(6, last, total)})
+	return s, xlsxRef(6, last)
+}
+
+// 見出しの次の行からrows行目までのcol列の合計のセル
+func xlsxSum(col, rows int, total int64) xlsxCell {
+	if rows <= 1 {
+		return xlsxInt(0)
+	}
+	return xlsxFormula(fmt.Sprintf("SUM(%s:%s)", xlsxRef(col, 1), xlsxRef(col, rows-1)), total)
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/billing.xlsx
+// テナント内の課金レポートを大会ごとのシートに分けたxlsxで返す
+// 先頭のシートに各大会のシートの合計を参照する集計を置く
+func billingXLSXHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.role != RoleOrganizer {
+		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+	}
+
+	tenantDB, err := connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	tbrs, err := srv(ctx).billingFlight.Do(ctx, strconv.FormatInt(v.tenantID, 10), func(ctx context.Context) ([]BillingReport, error) {
+		return tenantBillingReports(ctx, tenantDB, v.tenantID)
+	})
+	if err != nil {
+		return err
+	}
+
+	used := map[string]bool{}
+	summary := xlsxSheet{name: xlsxSheetName("合計", used)}
+	summary.rows = append(summary.rows, []xlsxCell{xlsxString("大会ID"), xlsxString("大会名"), xlsxString("金額")})
+	sheets := []xlsxSheet{{}}
+	var total int64
+	for _, r := range tbrs {
+		s, totalRef := competitionBillingSheet(xlsxSheetName(r.CompetitionTitle, used), r)
+		sheets = append(sheets, s)
+		summary.rows = append(summary.rows, []xlsxCell{
+			xlsxString(r.CompetitionID),
+			xlsxString(r.CompetitionTitle),
+			xlsxFormula(xlsxSheetRef(s.name)+"!"+totalRef, r.BillingYen),
+		})
+		total += r.BillingYen
+	}
+	summary.rows = append(summary.rows, []xlsxCell{
+		xlsxString("合計"), {}, xlsxSum(2, len(summary.rows), total),
+	})
+	sheets[0] = summary
+
+	return xlsxResponse(c, fmt.Sprintf("billing-%s.xlsx", v.tenantName), sheets)
+}
+
+// SaaS管理者用API
+// GET /api/admin/tenants/billing.xlsx
+// 全テナントの課金レポートをテナントごとのシートに分けたxlsxで返す
+// 先頭のシートに各テナントのシートの合計を参照する集計を置く
+func tenantsBillingXLSXHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	v, err := parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+	if v.tenantName != "admin" {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("%s has not this API", v.tenantName),
+		)
+	}
+	if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+
+	ts := []TenantRow{}
+	if err := srv(ctx).adminReadDB.SelectContext(ctx, &ts, "SELECT * FROM tenant WHERE provisioning = 0 ORDER BY id"); err != nil {
+		return fmt.Errorf("error Select tenant: %w", err)
+	}
+	indexes := make([]int, len(ts))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	reports := make([][]BillingReport, len(ts))
+	if err := forEachParallel(ctx, billingWorkers, indexes, func(ctx context.Context, i int) error {
+		tenantDB, err := connectToTenantDB(ctx, ts[i].ID)
+		if err != nil {
+			return fmt.Errorf("failed to connectToTenantDB: %w", err)
+		}
+		defer tenantDB.Close()
+		rs, err := tenantBillingReports(ctx, tenantDB, ts[i].ID)
+		if err != nil {
+			return fmt.Errorf("failed to tenantBillingReports: tenantID=%d, %w", ts[i].ID, err)
+		}
+		reports[i] = rs
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	used := map[string]bool{}
+	summary := xlsxSheet{name: xlsxSheetName("合計", used)}
+	summary.rows = append(summary.rows, []xlsxCell{xlsxString("テナントID"), xlsxString("テナント名"), xlsxString("表示名"), xlsxString("金額")})
+	sheets := []xlsxSheet{{}}
+	var total int64
+	for i, t := range ts {
+		s, totalRef := tenantBillingSheet(xlsxSheetName(t.Name, used), reports[i])
+		sheets = append(sheets, s)
+		var yen int64
+		for _, r := range reports[i] {
+			yen += r.BillingYen
+		}
+		summary.rows = append(summary.rows, []xlsxCell{
+			xlsxString(strconv.FormatInt(t.ID, 10)),
+			xlsxString(t.Name),
+			xlsxString(t.DisplayName),
+			xlsxFormula(xlsxSheetRef(s.name)+"!"+totalRef, yen),
+		})
+		total += yen
+	}
+	summary.rows = append(summary.rows, []xlsxCell{
+		xlsxString("合計"), {}, {}, xlsxSum(3, len(summary.rows), total),
+	})
+	sheets[0] = summary
+
+	return xlsxResponse(c, "billing.xlsx", sheets)
+}
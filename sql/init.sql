@@ -1,4 +1,15 @@
 DELETE FROM tenant WHERE id > 100;
 DELETE FROM visit_history WHERE created_at >= '1654041600';
+DELETE FROM webhook_endpoint WHERE tenant_id > 100;
+DELETE FROM webhook_delivery WHERE tenant_id > 100;
+DELETE FROM tenant_setting WHERE tenant_id > 100;
+DELETE FROM player_email WHERE tenant_id > 100;
+DELETE FROM mail_outbox WHERE tenant_id > 100;
+DELETE FROM api_token WHERE tenant_id > 100;
+DELETE FROM sso_identity WHERE tenant_id > 100;
+DELETE FROM sso_state WHERE tenant_id > 100;
+DELETE FROM scim_user WHERE tenant_id > 100;
+DELETE FROM billing_invoice WHERE tenant_id > 100;
+DELETE FROM billing_invoice_line WHERE tenant_id > 100;
 UPDATE id_generator SET id=2678400000 WHERE stub='a';
 ALTER TABLE id_generator AUTO_INCREMENT=2678400000;